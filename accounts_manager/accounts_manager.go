@@ -3,6 +3,7 @@ package accountsmanager
 import (
 	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/alonsovidales/pit/log"
 	"github.com/alonsovidales/pit/models/users"
@@ -40,6 +41,18 @@ const (
 	cConfirmEmailTTL = 24 * 3600
 )
 
+// ErrMissingCredentials The user ID or the key were not provided
+var ErrMissingCredentials = errors.New("The uid and key are required")
+
+// ErrAccountExists There is another account registered with the same e-mail
+var ErrAccountExists = errors.New("The email address you have entered is already registered")
+
+// ErrVerificationEmail The verification e-mail can't be sent
+var ErrVerificationEmail = errors.New("Problem trying to send the verification e-mail")
+
+// ErrRecoveryEmail The password recovery e-mail can't be sent
+var ErrRecoveryEmail = errors.New("Problem trying to send the password recovery e-mail")
+
 // Manager Strcuture that will be used to manage all the accounts in the system
 type Manager struct {
 	usersModel     users.ModelInt
@@ -93,21 +106,36 @@ func (mg *Manager) BillingInfo(w http.ResponseWriter, r *http.Request) {
 func (mg *Manager) Register(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
+	err := mg.sendVerification(r.FormValue("uid"), r.FormValue("key"))
+	switch err {
+	case nil:
+		w.WriteHeader(200)
+		w.Write([]byte("Verification e-mail sent, please check your e-mail!"))
+	case ErrMissingCredentials:
+		w.WriteHeader(400)
+		w.Write([]byte("The uid and key parameters are required"))
+	case ErrAccountExists:
+		w.WriteHeader(422)
+		w.Write([]byte(err.Error()))
+	default:
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// sendVerification Sends to the given e-mail address the link that has to be
+// used in order to verify the new account
+func (mg *Manager) sendVerification(uid, key string) (err error) {
 	// Sanitize e-mail addr removin all the + Chars in order to avoid fake
 	// duplicated accounts
-	uid := strings.Replace(r.FormValue("uid"), "+", "", -1)
-	key := r.FormValue("key")
+	uid = strings.Replace(uid, "+", "", -1)
 
 	if uid == "" || key == "" {
-		w.WriteHeader(400)
-		w.Write([]byte("The uid and key parameters are required"))
-		return
+		return ErrMissingCredentials
 	}
 
 	if mg.usersModel.AdminGetUserInfoByID(uid) != nil {
-		w.WriteHeader(422)
-		w.Write([]byte("The email address you have entered is already registered"))
-		return
+		return ErrAccountExists
 	}
 
 	ttl := time.Now().Unix() + cConfirmEmailTTL
@@ -133,14 +161,10 @@ func (mg *Manager) Register(w http.ResponseWriter, r *http.Request) {
 		"Account verification from Pitia")
 
 	if !emailSent {
-		w.WriteHeader(500)
-		w.Write([]byte("Problem trying to send the verification e-mail"))
-
-		return
+		return ErrVerificationEmail
 	}
 
-	w.WriteHeader(200)
-	w.Write([]byte("Verification e-mail sent, please check your e-mail!"))
+	return
 }
 
 // Verify This method will be called in order to verify the identity of an
@@ -263,41 +287,47 @@ func (mg *Manager) ChangePass(w http.ResponseWriter, r *http.Request) {
 func (mg *Manager) RecoverPass(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	uid := r.FormValue("u")
+	if err := mg.sendRecovery(r.FormValue("u"), r.RemoteAddr); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("KO"))
+		return
+	}
 
-	if userInfo := mg.usersModel.AdminGetUserInfoByID(uid); userInfo != nil {
-		ttl := time.Now().Unix() + cConfirmEmailTTL
+	w.WriteHeader(200)
+	w.Write([]byte("OK"))
+}
 
-		v := url.Values{}
-		v.Set("u", uid)
-		v.Set("t", fmt.Sprintf("%d", ttl))
-		v.Set("s", mg.getSignature(uid, "recovery", ttl))
+// sendRecovery Sends the password recovery link to the e-mail of the account,
+// in case of the account doesn't exists no error is returned in order to
+// don't give any clue about if the user is or is not registered
+func (mg *Manager) sendRecovery(uid, ip string) (err error) {
+	userInfo := mg.usersModel.AdminGetUserInfoByID(uid)
+	if userInfo == nil {
+		return
+	}
 
-		verifURL := fmt.Sprintf(
-			"%s/%s?%s",
-			mg.baseURL,
-			CResetPass,
-			v.Encode())
+	ttl := time.Now().Unix() + cConfirmEmailTTL
 
-		body := fmt.Sprintf(
-			"Hi!,\n\tYou have requested password recovery, please click the following link to reset your password: %s\n\nBest,",
-			verifURL)
+	v := url.Values{}
+	v.Set("u", uid)
+	v.Set("t", fmt.Sprintf("%d", ttl))
+	v.Set("s", mg.getSignature(uid, "recovery", ttl))
 
-		if mg.SendEmail(uid, body, "Pitia: Password Recovery") {
-			userInfo.AddActivityLog(users.CActivityAccountType, "Password recovery sent", r.RemoteAddr)
-			w.WriteHeader(200)
-			w.Write([]byte("OK"))
-			return
-		}
+	verifURL := fmt.Sprintf(
+		"%s/%s?%s",
+		mg.baseURL,
+		CResetPass,
+		v.Encode())
 
-		w.WriteHeader(500)
-		w.Write([]byte("KO"))
-		return
+	body := fmt.Sprintf(
+		"Hi!,\n\tYou have requested password recovery, please click the following link to reset your password: %s\n\nBest,",
+		verifURL)
+
+	if !mg.SendEmail(uid, body, "Pitia: Password Recovery") {
+		return ErrRecoveryEmail
 	}
+	userInfo.AddActivityLog(users.CActivityAccountType, "Password recovery sent", ip)
 
-	// Don't return any clue about if the user is or is not registered
-	w.WriteHeader(200)
-	w.Write([]byte("OK"))
 	return
 }
 
@@ -0,0 +1,174 @@
+package accountsmanager
+
+import (
+	"github.com/alonsovidales/pit/models/users"
+	"github.com/alonsovidales/pit/rest"
+	"net/http"
+)
+
+const (
+	// CV2AccountsPath Endpoint used to register new accounts on the version
+	// 2 of the API:
+	//   POST /v2/accounts  Sends the verification e-mail for a new account
+	CV2AccountsPath = rest.CV2Prefix + "accounts"
+	// CV2AccountPath Root of the resources of the account identified by the
+	// basic auth credentials on the version 2 of the API:
+	//   DELETE /v2/account           Disables the account
+	//   GET    /v2/account/logs      Activity logs of the account
+	//   GET    /v2/account/billing   Billing information of the account
+	//   PUT    /v2/account/password  Changes the password of the account
+	//   POST   /v2/account/recover   Sends the password recovery e-mail
+	CV2AccountPath = rest.CV2Prefix + "account"
+)
+
+// CredentialsReq Body of the request to register a new account
+type CredentialsReq struct {
+	// UID E-mail address of the account
+	UID string `json:"uid"`
+	// Key Password of the account
+	Key string `json:"key"`
+}
+
+// ChangePassReq Body of the request to modify the password of an account
+type ChangePassReq struct {
+	// Key New password for the account
+	Key string `json:"key"`
+}
+
+// RecoverPassReq Body of the request to recover the password of an account
+type RecoverPassReq struct {
+	// UID E-mail address of the account
+	UID string `json:"uid"`
+}
+
+// StatusResponse Response returned by the actions that doesn't return any
+// resource
+type StatusResponse struct {
+	// Success Indicates if the action was performed
+	Success bool `json:"success"`
+	// Message Human readable description of the result
+	Message string `json:"message,omitempty"`
+}
+
+// AccountsV2APIHandler Handler for the CV2AccountsPath endpoint
+func (mg *Manager) AccountsV2APIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if len(rest.PathParts(r.URL.Path, CV2AccountsPath)) != 0 {
+		rest.WriteError(w, 404, rest.CodeNotFound, "Resource not found")
+		return
+	}
+	if !rest.AllowMethods(w, r, "POST") {
+		return
+	}
+
+	req := &CredentialsReq{}
+	if err := rest.ReadJSON(r, req); err != nil {
+		rest.WriteError(w, 400, rest.CodeBadRequest, err.Error())
+		return
+	}
+
+	err := mg.sendVerification(req.UID, req.Key)
+	switch err {
+	case nil:
+		rest.WriteJSON(w, 202, &StatusResponse{
+			Success: true,
+			Message: "Verification e-mail sent, please check your e-mail!",
+		})
+	case ErrMissingCredentials:
+		rest.WriteError(w, 400, rest.CodeBadRequest, err.Error())
+	case ErrAccountExists:
+		rest.WriteError(w, 409, rest.CodeConflict, err.Error())
+	default:
+		rest.WriteError(w, 500, rest.CodeInternal, err.Error())
+	}
+}
+
+// AccountV2APIHandler Dispatches all the requests under CV2AccountPath to the
+// corresponding handler depending on the path and the HTTP method
+func (mg *Manager) AccountV2APIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	parts := rest.PathParts(r.URL.Path, CV2AccountPath)
+	if len(parts) == 1 && parts[0] == "recover" {
+		// The password recovery is the only action that doesn't require
+		// authentication
+		if rest.AllowMethods(w, r, "POST") {
+			mg.v2RecoverPass(w, r)
+		}
+		return
+	}
+
+	if len(parts) > 1 || (len(parts) == 1 && parts[0] != "logs" && parts[0] != "billing" && parts[0] != "password") {
+		rest.WriteError(w, 404, rest.CodeNotFound, "Resource not found")
+		return
+	}
+
+	uid, key, ok := r.BasicAuth()
+	userInfo := mg.usersModel.GetUserInfo(uid, key)
+	if !ok || userInfo == nil {
+		rest.WriteError(w, 401, rest.CodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	if len(parts) == 0 {
+		if rest.AllowMethods(w, r, "DELETE") {
+			userInfo.DisableUser()
+			userInfo.AddActivityLog(users.CActivityAccountType, "Account disabled", r.RemoteAddr)
+			w.WriteHeader(204)
+		}
+		return
+	}
+
+	switch parts[0] {
+	case "logs":
+		if rest.AllowMethods(w, r, "GET") {
+			rest.WriteJSON(w, 200, userInfo.GetAllActivity())
+		}
+	case "billing":
+		if rest.AllowMethods(w, r, "GET") {
+			rest.WriteJSON(w, 200, userInfo.GetBillingInfo())
+		}
+	case "password":
+		if rest.AllowMethods(w, r, "PUT") {
+			mg.v2ChangePass(w, r, userInfo)
+		}
+	}
+}
+
+// v2ChangePass Modifies the password of the authenticated account
+func (mg *Manager) v2ChangePass(w http.ResponseWriter, r *http.Request, userInfo *users.User) {
+	req := &ChangePassReq{}
+	if err := rest.ReadJSON(r, req); err != nil {
+		rest.WriteError(w, 400, rest.CodeBadRequest, err.Error())
+		return
+	}
+	if req.Key == "" {
+		rest.WriteError(w, 422, rest.CodeUnprocessable, "The new key can't be empty")
+		return
+	}
+
+	if !userInfo.UpdateUser(req.Key) {
+		rest.WriteError(w, 500, rest.CodeInternal, "The password can't be updated")
+		return
+	}
+	userInfo.AddActivityLog(users.CActivityAccountType, "Password changed", r.RemoteAddr)
+
+	w.WriteHeader(204)
+}
+
+// v2RecoverPass Sends the password recovery e-mail to the account
+func (mg *Manager) v2RecoverPass(w http.ResponseWriter, r *http.Request) {
+	req := &RecoverPassReq{}
+	if err := rest.ReadJSON(r, req); err != nil {
+		rest.WriteError(w, 400, rest.CodeBadRequest, err.Error())
+		return
+	}
+
+	if err := mg.sendRecovery(req.UID, r.RemoteAddr); err != nil {
+		rest.WriteError(w, 500, rest.CodeInternal, err.Error())
+		return
+	}
+
+	rest.WriteJSON(w, 202, &StatusResponse{Success: true})
+}
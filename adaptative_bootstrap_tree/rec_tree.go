@@ -3,10 +3,15 @@ package rectree
 import (
 	"github.com/alonsovidales/pit/log"
 	"sort"
+	"unsafe"
 )
 
 const (
 	maxSecondaryElements = 20
+
+	// mapEntryOverhead Estimation of the bytes used by a map to store each
+	// entry in addition to the key and the value
+	mapEntryOverhead = 16
 )
 
 // BoostrapRecTree All the structs that implements this interface has to be
@@ -30,6 +35,11 @@ type Tree struct {
 
 	numOfTrees int
 
+	// totals Sums of the scores of each item on all the records, and the
+	// position of each item on them, used to update the tree, see Update
+	totals    []elemTotals
+	totalsPos map[uint64]int
+
 	// Flag used to return all the records even the yet classified, used
 	// for test proposals only
 	testMode bool
@@ -38,6 +48,12 @@ type Tree struct {
 type tNode struct {
 	value uint64
 
+	// records Number of records used to calculate the node
+	records int
+	// added Number of records routed to the node since it was calculated,
+	// see Update
+	added int
+
 	bestRecL []*scoresClassifications
 	bestRecU []*scoresClassifications
 	bestRecD []*scoresClassifications
@@ -74,6 +90,13 @@ type scoresClassifications struct {
 	score  float64
 	avg    float64
 	elemID uint64
+
+	// sum, sum2 and n Sum of the scores of the item, of their squares and
+	// number of scores on the records of the branch, used to update the
+	// score and the average, see Update
+	sum  uint64
+	sum2 uint64
+	n    uint64
 }
 
 type byClassif []*scoresClassifications
@@ -86,44 +109,22 @@ func (a byClassif) Less(i, j int) bool { return a[i].score > a[j].score }
 // max deep of maxDeep. Specify on maxScore the max possible score for the
 // elements
 func ProcessNewTrees(records []map[uint64]uint8, maxDeep int, maxScore uint8, numberOfTrees int) (tr *Tree, avgScores map[uint64]float64) {
-	avgScores = make(map[uint64]float64)
 	elementsTotals := []elemTotals{}
 	elemsPos := make(map[uint64]int)
 
-	i := 0
 	log.Debug("Records:", len(records))
 	for _, record := range records {
-		for k, v := range record {
-			vUint64 := uint64(v)
-			v2Uint64 := vUint64 * vUint64
-			if p, ok := elemsPos[k]; ok {
-				elementsTotals[p].sum += vUint64
-				elementsTotals[p].sum2 += v2Uint64
-				elementsTotals[p].err += uint64((maxScore - v) * (maxScore - v))
-				elementsTotals[p].n++
-			} else {
-				elementsTotals = append(elementsTotals, elemTotals{
-					elemID: k,
-					sum:    vUint64,
-					sum2:   v2Uint64,
-					err:    uint64((maxScore - v) * (maxScore - v)),
-					n:      1,
-				})
-				elemsPos[k] = i
-				i++
-			}
-		}
-	}
-
-	for _, v := range elementsTotals {
-		avgScores[v.elemID] = float64(v.sum) / float64(v.n)
+		elementsTotals = addTotals(elementsTotals, elemsPos, record, maxScore)
 	}
+	avgScores = averages(elementsTotals)
 
 	tr = &Tree{
 		maxDeep:   maxDeep,
 		maxScore:  maxScore,
 		totalRecs: len(records),
 		tree:      make(map[uint64]*tNode),
+		totals:    elementsTotals,
+		totalsPos: elemsPos,
 		testMode:  false,
 	}
 
@@ -133,7 +134,7 @@ func ProcessNewTrees(records []map[uint64]uint8, maxDeep int, maxScore uint8, nu
 		tr.numOfTrees = numberOfTrees
 	}
 
-	i = 0
+	i := 0
 	studiedIds := make(map[uint64]bool)
 	for {
 		if i >= tr.numOfTrees {
@@ -163,6 +164,42 @@ func ProcessNewTrees(records []map[uint64]uint8, maxDeep int, maxScore uint8, nu
 	return
 }
 
+// addTotals Adds the scores of the record to the totals of the items, the new
+// items are appended to the totals and their positions stored on totalsPos
+func addTotals(totals []elemTotals, totalsPos map[uint64]int, record map[uint64]uint8, maxScore uint8) []elemTotals {
+	for k, v := range record {
+		vUint64 := uint64(v)
+		v2Uint64 := vUint64 * vUint64
+		if p, ok := totalsPos[k]; ok {
+			totals[p].sum += vUint64
+			totals[p].sum2 += v2Uint64
+			totals[p].err += uint64((maxScore - v) * (maxScore - v))
+			totals[p].n++
+		} else {
+			totals = append(totals, elemTotals{
+				elemID: k,
+				sum:    vUint64,
+				sum2:   v2Uint64,
+				err:    uint64((maxScore - v) * (maxScore - v)),
+				n:      1,
+			})
+			totalsPos[k] = len(totals) - 1
+		}
+	}
+
+	return totals
+}
+
+// averages Returns the average score of each item
+func averages(totals []elemTotals) (avgScores map[uint64]float64) {
+	avgScores = make(map[uint64]float64, len(totals))
+	for _, v := range totals {
+		avgScores[v.elemID] = float64(v.sum) / float64(v.n)
+	}
+
+	return
+}
+
 // GetBestRecommendation Using the classification of the elements from the
 // first values, this method process and returns a list of up to maxRecs items
 // IDs
@@ -244,13 +281,42 @@ secondaryElemsLoop:
 	return
 }
 
+// MemoryUsage Returns an estimation of the bytes used by the nodes of the
+// trees
+func (tr *Tree) MemoryUsage() (bytes uint64) {
+	queue := make([]*tNode, 0, len(tr.tree))
+	for _, node := range tr.tree {
+		queue = append(queue, node)
+	}
+	bytes = uint64(len(tr.tree)) * uint64(unsafe.Sizeof(uint64(0))+unsafe.Sizeof(&tNode{})+mapEntryOverhead)
+
+	classifSize := uint64(unsafe.Sizeof(&scoresClassifications{}) + unsafe.Sizeof(scoresClassifications{}))
+	for len(queue) > 0 {
+		node := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+
+		bytes += uint64(unsafe.Sizeof(*node))
+		// The slices of recommendations are truncated, but the
+		// underlying arrays are still referenced
+		bytes += uint64(cap(node.bestRecL)+cap(node.bestRecU)+cap(node.bestRecD)) * classifSize
+		for _, child := range []*tNode{node.like, node.unknown, node.dislike} {
+			if child != nil {
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	return
+}
+
 func (tr *Tree) setTestMode() {
 	tr.testMode = true
 }
 
 func (tr *Tree) getTreeNode(fromElem uint64, elemsPos map[uint64]int, elementsTotals []elemTotals, records []map[uint64]uint8, deep int) (tn *tNode) {
 	tn = &tNode{
-		value: fromElem,
+		value:   fromElem,
+		records: len(records),
 	}
 
 	if len(elemsPos) == 0 {
@@ -323,6 +389,9 @@ func (tr *Tree) getTreeNode(fromElem uint64, elemsPos map[uint64]int, elementsTo
 					score:  scoreL,
 					elemID: elementsTotals[pos].elemID,
 					avg:    float64(totals[pos].sumL) / float64(totals[pos].nL),
+					sum:    totals[pos].sumL,
+					sum2:   totals[pos].sum2L,
+					n:      totals[pos].nL,
 				})
 			}
 		} else {
@@ -335,6 +404,9 @@ func (tr *Tree) getTreeNode(fromElem uint64, elemsPos map[uint64]int, elementsTo
 					score:  scoreH,
 					elemID: elementsTotals[pos].elemID,
 					avg:    float64(totals[pos].sumH) / float64(totals[pos].nH),
+					sum:    totals[pos].sumH,
+					sum2:   totals[pos].sum2H,
+					n:      totals[pos].nH,
 				})
 			}
 		} else {
@@ -347,6 +419,9 @@ func (tr *Tree) getTreeNode(fromElem uint64, elemsPos map[uint64]int, elementsTo
 					score:  scoreU,
 					elemID: elementsTotals[pos].elemID,
 					avg:    float64(totals[pos].sumU) / float64(totals[pos].nU),
+					sum:    totals[pos].sumU,
+					sum2:   totals[pos].sum2U,
+					n:      totals[pos].nU,
 				})
 			}
 		} else {
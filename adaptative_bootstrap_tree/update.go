@@ -0,0 +1,239 @@
+package rectree
+
+import (
+	"sort"
+)
+
+const (
+	// staleRatio Ratio between the records routed to a node since it was
+	// calculated and the records used to calculate it from which the split
+	// choices of the node could have changed, so its subtree is calculated
+	// again
+	staleRatio = 0.2
+	// minStaleRecords Min number of records routed to a node since it was
+	// calculated to calculate it again, avoids recalculate the small
+	// subtrees after each update
+	minStaleRecords = 10
+)
+
+// staleNode Node that has to be calculated again, the node is replaced on the
+// tree by set
+type staleNode struct {
+	node *tNode
+	// path Items of the ancestors of the node, including its own item
+	path []uint64
+	set  func(*tNode)
+}
+
+// Update Returns a copy of the tree updated with the given records. The records
+// are added to the statistics of the nodes where they are routed, including the
+// scores and averages of the recommended items of the nodes, so the
+// recommendations change with each update, see updateBest. The items
+// recommended by a node are only replaced by other items once the node is
+// calculated again: only the subtrees that received enough records since they
+// were calculated to change their split choices, staleRatio of the records used
+// to calculate them and at least minStaleRecords, are calculated again using
+// the records returned by getRecords, that is called only if any subtree is
+// calculated. The root items of the trees are not changed, neither the removed
+// records are considered, so the tree has to be recalculated from time to time
+// using ProcessNewTrees.
+// Returns also the average scores of the items and the number of subtrees
+// calculated again. The tree is not modified so it can be used meanwhile
+func (tr *Tree) Update(added []map[uint64]uint8, getRecords func() []map[uint64]uint8) (updated *Tree, avgScores map[uint64]float64, rebuilt int) {
+	updated = &Tree{
+		maxDeep:    tr.maxDeep,
+		maxScore:   tr.maxScore,
+		totalRecs:  tr.totalRecs + len(added),
+		numOfTrees: tr.numOfTrees,
+		tree:       make(map[uint64]*tNode, len(tr.tree)),
+		totals:     append([]elemTotals{}, tr.totals...),
+		totalsPos:  make(map[uint64]int, len(tr.totalsPos)),
+		testMode:   tr.testMode,
+	}
+	for elem, node := range tr.tree {
+		updated.tree[elem] = node
+	}
+	for elem, pos := range tr.totalsPos {
+		updated.totalsPos[elem] = pos
+	}
+
+	// The nodes are copied before be modified, only once by update
+	copied := make(map[*tNode]bool)
+	for _, record := range added {
+		updated.totals = addTotals(updated.totals, updated.totalsPos, record, updated.maxScore)
+		for elem := range updated.tree {
+			updated.route(elem, record, copied)
+		}
+	}
+
+	stale := updated.staleNodes(copied)
+	if len(stale) > 0 {
+		updated.rebuild(stale, getRecords())
+	}
+
+	return updated, averages(updated.totals), len(stale)
+}
+
+// route Adds the record to the statistics of all the nodes on its path from
+// the root of the tree of the given item
+func (tr *Tree) route(elem uint64, record map[uint64]uint8, copied map[*tNode]bool) {
+	node := copyNode(tr.tree[elem], copied)
+	tr.tree[elem] = node
+	for node != nil {
+		node.added++
+		tr.updateBest(node, record)
+		child := tr.child(node, record)
+		if *child != nil {
+			*child = copyNode(*child, copied)
+		}
+		node = *child
+	}
+}
+
+// child Returns the child of the node followed by the record
+func (tr *Tree) child(node *tNode, record map[uint64]uint8) **tNode {
+	v, ok := record[node.value]
+	switch {
+	case !ok:
+		return &node.unknown
+	case v >= tr.maxScore/2:
+		return &node.like
+	default:
+		return &node.dislike
+	}
+}
+
+// updateBest Adds the scores of the record to the recommended items of the node
+// for the branch followed by the record, the items whose average is not over
+// the half of the max score anymore are not recommended, and the rest are
+// sorted again by their new scores
+func (tr *Tree) updateBest(node *tNode, record map[uint64]uint8) {
+	best := &node.bestRecU
+	if v, ok := record[node.value]; ok {
+		if v >= tr.maxScore/2 {
+			best = &node.bestRecL
+		} else {
+			best = &node.bestRecD
+		}
+	}
+
+	updated := false
+	for _, classif := range *best {
+		if v, ok := record[classif.elemID]; ok {
+			classif.add(v)
+			updated = true
+		}
+	}
+	if !updated {
+		return
+	}
+
+	recommended := (*best)[:0]
+	for _, classif := range *best {
+		if uint8(classif.sum/classif.n) > tr.maxScore/2 {
+			recommended = append(recommended, classif)
+		}
+	}
+	sort.Sort(byClassif(recommended))
+	*best = recommended
+}
+
+// add Adds a score of the item to its statistics, see getTreeNode
+func (sc *scoresClassifications) add(score uint8) {
+	v := uint64(score)
+	sc.sum += v
+	sc.sum2 += v * v
+	sc.n++
+	sc.score = float64(sc.sum*sc.sum-sc.sum2) / float64(sc.n)
+	sc.avg = float64(sc.sum) / float64(sc.n)
+}
+
+// copyNode Returns a copy of the node, or the node itself if it was already
+// copied, the recommended items are copied too since they are updated by
+// updateBest
+func copyNode(node *tNode, copied map[*tNode]bool) *tNode {
+	if copied[node] {
+		return node
+	}
+	nodeCopy := *node
+	nodeCopy.bestRecL = copyClassifs(node.bestRecL)
+	nodeCopy.bestRecU = copyClassifs(node.bestRecU)
+	nodeCopy.bestRecD = copyClassifs(node.bestRecD)
+	copied[&nodeCopy] = true
+
+	return &nodeCopy
+}
+
+// copyClassifs Returns a copy of the recommended items
+func copyClassifs(classifs []*scoresClassifications) []*scoresClassifications {
+	if classifs == nil {
+		return nil
+	}
+	classifsCopy := make([]*scoresClassifications, len(classifs))
+	for i, classif := range classifs {
+		classifCopy := *classif
+		classifsCopy[i] = &classifCopy
+	}
+
+	return classifsCopy
+}
+
+// staleNodes Returns the nodes closest to the roots whose split choices could
+// have changed since they were calculated, only the copied nodes received new
+// records
+func (tr *Tree) staleNodes(copied map[*tNode]bool) (stale []*staleNode) {
+	var find func(node *tNode, path []uint64, set func(*tNode))
+	find = func(node *tNode, path []uint64, set func(*tNode)) {
+		if node == nil || !copied[node] {
+			return
+		}
+		path = append(path[:len(path):len(path)], node.value)
+		if node.added >= minStaleRecords && float64(node.added) > float64(node.records)*staleRatio {
+			stale = append(stale, &staleNode{node: node, path: path, set: set})
+			return
+		}
+
+		find(node.like, path, func(child *tNode) { node.like = child })
+		find(node.dislike, path, func(child *tNode) { node.dislike = child })
+		find(node.unknown, path, func(child *tNode) { node.unknown = child })
+	}
+
+	for elem, node := range tr.tree {
+		elem := elem
+		find(node, nil, func(root *tNode) { tr.tree[elem] = root })
+	}
+
+	return
+}
+
+// rebuild Calculates again the stale nodes using the records routed to each
+// one of them
+func (tr *Tree) rebuild(stale []*staleNode, records []map[uint64]uint8) {
+	staleRecords := make(map[*tNode][]map[uint64]uint8, len(stale))
+	for _, st := range stale {
+		staleRecords[st.node] = []map[uint64]uint8{}
+	}
+	for _, record := range records {
+		for _, root := range tr.tree {
+			for node := root; node != nil; node = *tr.child(node, record) {
+				if nodeRecords, ok := staleRecords[node]; ok {
+					staleRecords[node] = append(nodeRecords, record)
+					break
+				}
+			}
+		}
+	}
+
+	for _, st := range stale {
+		// The items of the ancestors can't be used to split the subtree
+		elemsPos := make(map[uint64]int, len(tr.totalsPos))
+		for elem, pos := range tr.totalsPos {
+			elemsPos[elem] = pos
+		}
+		for _, elem := range st.path {
+			delete(elemsPos, elem)
+		}
+
+		st.set(tr.getTreeNode(st.node.value, elemsPos, tr.totals, staleRecords[st.node], len(st.path)))
+	}
+}
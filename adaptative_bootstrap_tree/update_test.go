@@ -0,0 +1,157 @@
+package rectree
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// randomRecords Returns records with scores from minScore to MAXSCORE for some
+// of the first items, the items with a lower ID are scored more often
+func randomRecords(rnd *rand.Rand, n int, minScore int) (records []map[uint64]uint8) {
+	for i := 0; i < n; i++ {
+		record := make(map[uint64]uint8)
+		for len(record) < 10 {
+			record[uint64(rnd.ExpFloat64()*10)%50] = uint8(minScore + rnd.Intn(MAXSCORE-minScore+1))
+		}
+		records = append(records, record)
+	}
+
+	return
+}
+
+func TestUpdate(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	records := randomRecords(rnd, 1000, 0)
+	tr, _ := ProcessNewTrees(records, 10, MAXSCORE, 3)
+	avgBefore := averages(tr.totals)
+
+	// A few records only update the statistics of the nodes
+	added := randomRecords(rnd, 5, 0)
+	records = append(records, added...)
+	updated, avgScores, rebuilt := tr.Update(added, func() []map[uint64]uint8 {
+		t.Error("The records were requested without stale nodes")
+		return records
+	})
+	if rebuilt != 0 || updated.totalRecs != 1005 {
+		t.Error("Unexpected update, subtrees rebuilt:", rebuilt, "records:", updated.totalRecs)
+	}
+	if _, expected := ProcessNewTrees(records, 10, MAXSCORE, 3); !reflect.DeepEqual(avgScores, expected) {
+		t.Error("Unexpected average scores after the update:", avgScores, "expected:", expected)
+	}
+	for elem, root := range updated.tree {
+		if root.added != 5 || tr.tree[elem].added != 0 {
+			t.Error("The records were not added only to the updated tree, added:", root.added, tr.tree[elem].added)
+		}
+	}
+
+	// The subtrees that received too many records are calculated again
+	added = randomRecords(rnd, 300, 0)
+	records = append(records, added...)
+	requested := false
+	updated, avgScores, rebuilt = updated.Update(added, func() []map[uint64]uint8 {
+		requested = true
+		return records
+	})
+	if rebuilt == 0 || !requested {
+		t.Fatal("No subtree was calculated again after add:", len(added), "records")
+	}
+	if _, expected := ProcessNewTrees(records, 10, MAXSCORE, 3); !reflect.DeepEqual(avgScores, expected) {
+		t.Error("Unexpected average scores after the rebuild:", avgScores, "expected:", expected)
+	}
+	for _, root := range updated.tree {
+		if root.added != 0 || root.records != len(records) {
+			t.Error("The root of the tree was not calculated again, records:", root.records, "added:", root.added)
+		}
+	}
+	if newRecs := updated.GetBestRecommendation(records[0], 10); len(newRecs) == 0 {
+		t.Error("No recommendations returned by the updated tree")
+	}
+
+	// The original tree is not modified
+	if tr.totalRecs != 1000 || !reflect.DeepEqual(averages(tr.totals), avgBefore) {
+		t.Error("The original tree was modified, records:", tr.totalRecs)
+	}
+}
+
+// leafBest Returns the recommended items of the last node on the path of the
+// record from the root of the tree of the given item, for the branch followed
+// by the record
+func leafBest(tr *Tree, elem uint64, record map[uint64]uint8) (best []*scoresClassifications) {
+	for node := tr.tree[elem]; node != nil; node = *tr.child(node, record) {
+		switch v, ok := record[node.value]; {
+		case !ok:
+			best = node.bestRecU
+		case v >= tr.maxScore/2:
+			best = node.bestRecL
+		default:
+			best = node.bestRecD
+		}
+	}
+
+	return
+}
+
+func TestUpdateBestRecs(t *testing.T) {
+	// The items have to be liked in order to split the records and
+	// recommend items on the last nodes
+	rnd := rand.New(rand.NewSource(1))
+	records := randomRecords(rnd, 1000, 2)
+	tr, _ := ProcessNewTrees(records, 10, MAXSCORE, 3)
+
+	// Look for a record routed to a node with recommended items that the
+	// record scored under the max score
+	var root uint64
+	var record map[uint64]uint8
+	var before *scoresClassifications
+search:
+	for _, candidate := range records {
+		for elem := range tr.tree {
+			for _, classif := range leafBest(tr, elem, candidate) {
+				if v, ok := candidate[classif.elemID]; ok && v < MAXSCORE {
+					root, record, before = elem, candidate, classif
+					break search
+				}
+			}
+		}
+	}
+	if record == nil {
+		t.Fatal("No record routed to a node with recommended items")
+	}
+	expected := *before
+	expected.add(MAXSCORE)
+
+	// The record scores the item with the max score, the path of the
+	// record doesn't change since the recommended items are not used to
+	// split the records on the path
+	added := map[uint64]uint8{}
+	for k, v := range record {
+		added[k] = v
+	}
+	added[before.elemID] = MAXSCORE
+	updated, _, rebuilt := tr.Update([]map[uint64]uint8{added}, func() []map[uint64]uint8 {
+		t.Error("The records were requested without stale nodes")
+		return nil
+	})
+	if rebuilt != 0 {
+		t.Error("Unexpected subtrees rebuilt:", rebuilt)
+	}
+
+	var after *scoresClassifications
+	best := leafBest(updated, root, added)
+	for _, classif := range best {
+		if classif.elemID == before.elemID {
+			after = classif
+		}
+	}
+	if after == nil || *after != expected {
+		t.Error("The score of the recommended item was not updated, obtained:", after, "expected:", expected)
+	}
+	if !sort.IsSorted(byClassif(best)) {
+		t.Error("The recommended items are not sorted by score after the update")
+	}
+	if *before == expected || before.n+1 != expected.n {
+		t.Error("The recommended items of the original tree were modified:", before)
+	}
+}
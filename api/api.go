@@ -1,11 +1,16 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"github.com/alonsovidales/pit/accounts_manager"
 	"github.com/alonsovidales/pit/cfg"
+	"github.com/alonsovidales/pit/grpc_api"
 	"github.com/alonsovidales/pit/log"
+	"github.com/alonsovidales/pit/rest"
 	"github.com/alonsovidales/pit/shards_manager"
+	"google.golang.org/grpc"
+	"net"
 	"net/http"
 )
 
@@ -21,35 +26,139 @@ type API struct {
 	staticPath      string
 
 	muxHTTPServer *http.ServeMux
+	grpcServer    *grpc.Server
+	doc           *apiDoc
+
+	// httpServer Server that attends the API, nil if the API is not
+	// served by Init
+	httpServer *http.Server
+	// clusterServer Server that attends the internal calls between the
+	// instances of the cluster
+	clusterServer *http.Server
 }
 
 // Init Initializes the API and starts listening on the specified ports serving
-// both the HTTP API and the static content
-func Init(shardsManager *shardsmanager.Manager, accountsManager *accountsmanager.Manager, staticPath string, httpPort, httpsPort int, cert, key string) (api *API, sslAPI *API) {
-	api = &API{
-		shardsManager:   shardsManager,
-		accountsManager: accountsManager,
-		muxHTTPServer:   http.NewServeMux(),
-		staticPath:      staticPath,
-	}
-	api.registerAPIs(false)
+// the HTTP API, the static content, the gRPC service and the internal calls
+// between the instances of the cluster
+func Init(shardsManager *shardsmanager.Manager, accountsManager *accountsmanager.Manager, staticPath string, httpPort, httpsPort, grpcPort, clusterPort int, cert, key string) (api *API, sslAPI *API) {
+	api = New(shardsManager, accountsManager, staticPath, false)
 	log.Info("Starting API server on port:", httpPort)
-	go http.ListenAndServe(fmt.Sprintf(":%d", httpPort), api.muxHTTPServer)
+	api.httpServer = &http.Server{Addr: fmt.Sprintf(":%d", httpPort), Handler: api.muxHTTPServer}
+	go serveHTTP(api.httpServer, "", "")
+
+	// The internal calls between instances are attended on a dedicated
+	// port that doesn't have to be exposed outside the cluster
+	log.Info("Starting cluster server on port:", clusterPort)
+	api.clusterServer = &http.Server{Addr: fmt.Sprintf(":%d", clusterPort), Handler: shardsManager.ClusterServer()}
+	go serveHTTP(api.clusterServer, "", "")
+
+	api.grpcServer = grpcapi.NewServer(shardsManager.GRPCServer())
+	log.Info("Starting gRPC server on port:", grpcPort)
+	go api.serveGRPC(grpcPort)
 
 	// SSL Server, will not serve the /rec method by performance issues
-	sslAPI = &API{
+	sslAPI = New(shardsManager, accountsManager, staticPath, true)
+	log.Info("Starting SSL API server on port:", httpsPort)
+	sslAPI.httpServer = &http.Server{Addr: fmt.Sprintf(":%d", httpsPort), Handler: sslAPI.muxHTTPServer}
+	go serveHTTP(sslAPI.httpServer, cert, key)
+
+	return
+}
+
+// Shutdown Stops gracefully the API and gRPC servers started by Init, the new
+// connections are refused and the method waits until the requests in progress
+// are attended or until the context expires. The cluster server keeps running
+// until ShutdownCluster is called
+func (api *API) Shutdown(ctx context.Context) (err error) {
+	if err = shutdownHTTP(ctx, api.httpServer); err != nil {
+		log.Error("Problem stopping the API server, Error:", err)
+	}
+
+	if api.grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			api.grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			// Close the pending connections
+			api.grpcServer.Stop()
+			err = ctx.Err()
+		}
+	}
+
+	return
+}
+
+// ShutdownCluster Stops gracefully the server that attends the internal calls
+// between instances, it should be called after drain the instance since the
+// records of the shards handed off are migrated using these calls
+func (api *API) ShutdownCluster(ctx context.Context) (err error) {
+	if err = shutdownHTTP(ctx, api.clusterServer); err != nil {
+		log.Error("Problem stopping the cluster server, Error:", err)
+	}
+
+	return
+}
+
+// shutdownHTTP Stops gracefully the server if it was started
+func shutdownHTTP(ctx context.Context, srv *http.Server) error {
+	if srv == nil {
+		return nil
+	}
+
+	return srv.Shutdown(ctx)
+}
+
+// serveHTTP Listens on the address of the server, using TLS if a certificate
+// is specified, until the server is stopped
+func serveHTTP(srv *http.Server, cert, key string) {
+	var err error
+	if cert != "" {
+		err = srv.ListenAndServeTLS(cert, key)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Error("Problem serving HTTP on:", srv.Addr, "Error:", err)
+	}
+}
+
+// New Returns an API with all the endpoints registered, the API can be served
+// by any HTTP server since it implements the http.Handler interface. The SSL
+// API doesn't attend the recommendations requests of the first version
+func New(shardsManager *shardsmanager.Manager, accountsManager *accountsmanager.Manager, staticPath string, ssl bool) (api *API) {
+	api = &API{
 		shardsManager:   shardsManager,
 		accountsManager: accountsManager,
 		muxHTTPServer:   http.NewServeMux(),
 		staticPath:      staticPath,
 	}
-	sslAPI.registerAPIs(true)
-	log.Info("Starting SSL API server on port:", httpsPort)
-	go http.ListenAndServeTLS(fmt.Sprintf(":%d", httpsPort), cert, key, sslAPI.muxHTTPServer)
+	api.registerAPIs(ssl)
 
 	return
 }
 
+// ServeHTTP Dispatches the request to the handler of the endpoint
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.muxHTTPServer.ServeHTTP(w, r)
+}
+
+// serveGRPC Listens on the specified port serving the gRPC service
+func (api *API) serveGRPC(port int) {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Error("Problem trying to listen for gRPC connections on port:", port, "Error:", err)
+		return
+	}
+
+	if err = api.grpcServer.Serve(lis); err != nil {
+		log.Error("gRPC server stopped, Error:", err)
+	}
+}
+
 func (api *API) contact(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
@@ -69,56 +178,60 @@ func (api *API) contact(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-// registerAPIs Recister all the handles into the corresponding endpoints
-func (api *API) registerAPIs(ssl bool) {
-	if !ssl {
-		api.muxHTTPServer.HandleFunc(shardsmanager.CRecPath, api.shardsManager.ScoresAPIHandler)
-		api.muxHTTPServer.HandleFunc(shardsmanager.CScoresPath, api.shardsManager.ScoresAPIHandler)
+// healthCheck Returns OK while the instance is running, and an error while the
+// instance is draining in order to stop receiving requests from the load
+// balancer
+func (api *API) healthCheck(w http.ResponseWriter, r *http.Request) {
+	if api.shardsManager != nil && api.shardsManager.IsDraining() {
+		w.WriteHeader(503)
+		w.Write([]byte("DRAINING"))
+		return
 	}
 
-	api.muxHTTPServer.HandleFunc(shardsmanager.CGroupInfoPath, api.shardsManager.GroupInfoAPIHandler)
-
-	api.muxHTTPServer.HandleFunc(cHealtyPath, func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-		w.Write([]byte("OK"))
-	})
-
-	api.muxHTTPServer.HandleFunc(shardsmanager.CRegenerateGroupKey, api.shardsManager.RegenerateGroupKey)
-	api.muxHTTPServer.HandleFunc(shardsmanager.CDelGroup, api.shardsManager.DelGroup)
-	api.muxHTTPServer.HandleFunc(shardsmanager.CGetGroupsByUser, api.shardsManager.GetGroupsByUser)
-	api.muxHTTPServer.HandleFunc(shardsmanager.CAddUpdateGroup, api.shardsManager.AddUpdateGroup)
-	api.muxHTTPServer.HandleFunc(shardsmanager.CSetShardsGroup, api.shardsManager.SetShards)
-	api.muxHTTPServer.HandleFunc(shardsmanager.CRemoveShardsContent, api.shardsManager.RemoveShardsContent)
-
-	api.muxHTTPServer.HandleFunc(accountsmanager.CBillingInfo, api.accountsManager.BillingInfo)
-	api.muxHTTPServer.HandleFunc(accountsmanager.CRegisterPath, api.accountsManager.Register)
-	api.muxHTTPServer.HandleFunc(accountsmanager.CVerifyPath, api.accountsManager.Verify)
-	api.muxHTTPServer.HandleFunc(accountsmanager.CLogsPath, api.accountsManager.Logs)
-	api.muxHTTPServer.HandleFunc(accountsmanager.CRecoverPassPath, api.accountsManager.RecoverPass)
-	api.muxHTTPServer.HandleFunc(accountsmanager.CChangePass, api.accountsManager.ChangePass)
-	api.muxHTTPServer.HandleFunc(accountsmanager.CDisablePath, api.accountsManager.Disable)
-
-	api.muxHTTPServer.HandleFunc(cContact, api.contact)
-
-	api.muxHTTPServer.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		filePath := r.URL.Path[1:]
-		path := api.staticPath + filePath
-		lastPosSlash := -1
-		lastPosDot := -1
-
-		for i := 0; i < len(path); i++ {
-			switch path[i] {
-			case '/':
-				lastPosSlash = i
-			case '.':
-				lastPosDot = i
-			}
-		}
+	w.WriteHeader(200)
+	w.Write([]byte("OK"))
+}
+
+// apiDocHandler Returns the OpenAPI document that describes all the endpoints
+// registered on this server
+func (api *API) apiDocHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-		if filePath != "" && lastPosDot < lastPosSlash {
-			path += ".html"
+	rest.WriteJSON(w, 200, api.doc)
+}
+
+// staticHandler Serves the static content of the web site, the paths without
+// extension are served as HTML files
+func (api *API) staticHandler(w http.ResponseWriter, r *http.Request) {
+	filePath := r.URL.Path[1:]
+	path := api.staticPath + filePath
+	lastPosSlash := -1
+	lastPosDot := -1
+
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '/':
+			lastPosSlash = i
+		case '.':
+			lastPosDot = i
 		}
+	}
 
-		http.ServeFile(w, r, path)
-	})
+	if filePath != "" && lastPosDot < lastPosSlash {
+		path += ".html"
+	}
+
+	http.ServeFile(w, r, path)
+}
+
+// registerAPIs Recister all the handles into the corresponding endpoints and
+// generates the OpenAPI document that describes them
+func (api *API) registerAPIs(ssl bool) {
+	api.doc = newAPIDoc()
+	for _, rt := range api.routes(ssl) {
+		api.muxHTTPServer.HandleFunc(rt.path, rt.handler)
+		for path, item := range rt.doc {
+			api.doc.Paths[path] = item
+		}
+	}
 }
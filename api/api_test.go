@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var pathParamsRegExp = regexp.MustCompile(`\{[^}]+\}`)
+
+func TestAllRoutesDocumented(t *testing.T) {
+	for _, ssl := range []bool{false, true} {
+		api := &API{muxHTTPServer: http.NewServeMux()}
+		api.registerAPIs(ssl)
+
+		documented := make(map[string]bool)
+		for _, rt := range api.routes(ssl) {
+			if len(rt.doc) == 0 {
+				t.Error("The route:", rt.path, "is not documented")
+			}
+
+			for path, item := range rt.doc {
+				if len(item) == 0 {
+					t.Error("No operations documented for path:", path)
+				}
+				if api.doc.Paths[path] == nil {
+					t.Error("The path:", path, "is not present on the OpenAPI document")
+				}
+
+				// The documented path has to be attended by the
+				// handler of the route
+				r := httptest.NewRequest("GET", pathParamsRegExp.ReplaceAllString(path, "param"), nil)
+				if _, pattern := api.muxHTTPServer.Handler(r); pattern != rt.path {
+					t.Error("The documented path:", path, "is attended by:", pattern, "instead of:", rt.path)
+				}
+
+				for _, param := range pathParamsRegExp.FindAllString(path, -1) {
+					for _, op := range item {
+						found := false
+						for _, docParam := range op.Parameters {
+							found = found || (docParam.In == "path" && "{"+docParam.Name+"}" == param)
+						}
+						if !found {
+							t.Error("The path param:", param, "is not described on path:", path)
+						}
+					}
+				}
+				documented[path] = true
+			}
+		}
+
+		if len(documented) != len(api.doc.Paths) {
+			t.Error("Expected", len(documented), "documented paths, found:", len(api.doc.Paths))
+		}
+	}
+}
+
+func TestAPIDocHandler(t *testing.T) {
+	api := &API{muxHTTPServer: http.NewServeMux()}
+	api.registerAPIs(false)
+
+	w := httptest.NewRecorder()
+	api.muxHTTPServer.ServeHTTP(w, httptest.NewRequest("GET", CAPIDocPath, nil))
+	if w.Code != 200 {
+		t.Fatal("Expected status code 200, obtained:", w.Code)
+	}
+
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal("The OpenAPI document can't be decoded, Error:", err)
+	}
+	if doc["openapi"] != cOpenAPIVersion {
+		t.Error("Unexpected OpenAPI version:", doc["openapi"])
+	}
+
+	paths := doc["paths"].(map[string]interface{})
+	for _, path := range []string{"/rec", "/v2/groups/{gid}/recs", CAPIDocPath} {
+		if _, ok := paths[path]; !ok {
+			t.Error("The path:", path, "is not present on the document")
+		}
+	}
+
+	recs := paths["/v2/groups/{gid}/recs"].(map[string]interface{})["post"].(map[string]interface{})
+	schema, _ := json.Marshal(recs["responses"])
+	if !strings.Contains(string(schema), "stored_elements") {
+		t.Error("The response schema of the recommendations is not generated from the response type:", string(schema))
+	}
+}
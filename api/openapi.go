@@ -0,0 +1,364 @@
+package api
+
+import (
+	"github.com/alonsovidales/pit/shards_manager"
+	"reflect"
+	"strings"
+)
+
+// CAPIDocPath Endpoint that returns the OpenAPI specification of the HTTP API
+const CAPIDocPath = "/openapi.json"
+
+// cOpenAPIVersion Version of the OpenAPI specification used to describe the
+// API
+const cOpenAPIVersion = "3.0.3"
+
+// apiDoc OpenAPI document that describes all the registered endpoints
+type apiDoc struct {
+	OpenAPI    string                 `json:"openapi"`
+	Info       *docInfo               `json:"info"`
+	Paths      map[string]docPathItem `json:"paths"`
+	Components *docComponents         `json:"components"`
+}
+
+// docInfo General information of the API
+type docInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Version     string `json:"version"`
+}
+
+// docComponents Security schemes used by the operations
+type docComponents struct {
+	SecuritySchemes map[string]*docSecurityScheme `json:"securitySchemes"`
+}
+
+// docSecurityScheme Description of an authentication method
+type docSecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	In          string `json:"in,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// docPathItem Operations available on a path by lowercase HTTP method
+type docPathItem map[string]*docOperation
+
+// docOperation Description of an operation
+type docOperation struct {
+	Summary     string                  `json:"summary"`
+	Description string                  `json:"description,omitempty"`
+	Tags        []string                `json:"tags,omitempty"`
+	Parameters  []*docParameter         `json:"parameters,omitempty"`
+	RequestBody *docRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*docResponse `json:"responses"`
+	Security    []map[string][]string   `json:"security,omitempty"`
+}
+
+// docParameter Parameter sent on the path, query or headers
+type docParameter struct {
+	Name        string     `json:"name"`
+	In          string     `json:"in"`
+	Description string     `json:"description,omitempty"`
+	Required    bool       `json:"required"`
+	Schema      *docSchema `json:"schema"`
+}
+
+// docRequestBody Body of a request by content type
+type docRequestBody struct {
+	Required bool                     `json:"required"`
+	Content  map[string]*docMediaType `json:"content"`
+}
+
+// docResponse Response of an operation by content type
+type docResponse struct {
+	Description string                   `json:"description"`
+	Content     map[string]*docMediaType `json:"content,omitempty"`
+}
+
+// docMediaType Schema of a body
+type docMediaType struct {
+	Schema *docSchema `json:"schema"`
+}
+
+// docSchema JSON schema of a value
+type docSchema struct {
+	Type                 string                `json:"type,omitempty"`
+	Format               string                `json:"format,omitempty"`
+	Description          string                `json:"description,omitempty"`
+	Properties           map[string]*docSchema `json:"properties,omitempty"`
+	Required             []string              `json:"required,omitempty"`
+	Items                *docSchema            `json:"items,omitempty"`
+	AdditionalProperties *docSchema            `json:"additionalProperties,omitempty"`
+}
+
+// formParam Parameter of the first version of the API sent as form value
+type formParam struct {
+	name     string
+	desc     string
+	typ      string
+	required bool
+}
+
+// schemaOf Returns the JSON schema of the values of the given type following
+// the encoding/json rules
+func schemaOf(v interface{}) *docSchema {
+	return typeSchema(reflect.TypeOf(v), map[reflect.Type]bool{})
+}
+
+// typeSchema Returns the JSON schema of the given type, the types already
+// being described are returned as generic objects to avoid infinite recursion
+func typeSchema(t reflect.Type, visiting map[reflect.Type]bool) *docSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &docSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &docSchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &docSchema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &docSchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &docSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &docSchema{Type: "array", Items: typeSchema(t.Elem(), visiting)}
+	case reflect.Map:
+		return &docSchema{Type: "object", AdditionalProperties: typeSchema(t.Elem(), visiting)}
+	case reflect.Struct:
+		if visiting[t] {
+			return &docSchema{Type: "object"}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+
+		schema := &docSchema{
+			Type:       "object",
+			Properties: make(map[string]*docSchema),
+		}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				// Unexported fields are not encoded
+				continue
+			}
+			name := field.Name
+			if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			schema.Properties[name] = typeSchema(field.Type, visiting)
+		}
+
+		return schema
+	}
+
+	return &docSchema{}
+}
+
+// formOperation Returns the description of an operation of the first version
+// of the API, where all the parameters are sent as form values
+func formOperation(tag, summary string, params []*formParam, resp *docSchema) *docOperation {
+	body := &docSchema{
+		Type:       "object",
+		Properties: make(map[string]*docSchema),
+	}
+	for _, param := range params {
+		body.Properties[param.name] = &docSchema{
+			Type:        param.typ,
+			Description: param.desc,
+		}
+		if param.required {
+			body.Required = append(body.Required, param.name)
+		}
+	}
+
+	op := &docOperation{
+		Summary:   summary,
+		Tags:      []string{tag},
+		Responses: v1Responses(resp),
+	}
+	if len(params) > 0 {
+		op.Description = "The parameters can be sent as form values on the body or as query string parameters"
+		op.RequestBody = &docRequestBody{
+			Required: true,
+			Content: map[string]*docMediaType{
+				"application/x-www-form-urlencoded": &docMediaType{Schema: body},
+			},
+		}
+	}
+
+	return op
+}
+
+// queryOperation Returns the description of an operation of the first version
+// of the API accessed as a link, where all the parameters are sent on the
+// query string
+func queryOperation(tag, summary string, params []*formParam, resp *docSchema) *docOperation {
+	op := &docOperation{
+		Summary:   summary,
+		Tags:      []string{tag},
+		Responses: v1Responses(resp),
+	}
+	for _, param := range params {
+		op.Parameters = append(op.Parameters, &docParameter{
+			Name:        param.name,
+			In:          "query",
+			Description: param.desc,
+			Required:    param.required,
+			Schema:      &docSchema{Type: param.typ},
+		})
+	}
+
+	return op
+}
+
+// v1Responses Returns the responses of an operation of the first version of
+// the API, the errors are returned as plain text
+func v1Responses(resp *docSchema) map[string]*docResponse {
+	ok := &docResponse{
+		Description: "Success",
+		Content: map[string]*docMediaType{
+			"text/plain": &docMediaType{Schema: &docSchema{Type: "string"}},
+		},
+	}
+	if resp != nil {
+		ok.Content = map[string]*docMediaType{
+			"application/json": &docMediaType{Schema: resp},
+		}
+	}
+
+	return map[string]*docResponse{
+		"200":     ok,
+		"default": &docResponse{Description: "Error description as plain text"},
+	}
+}
+
+// jsonOperation Returns the description of an operation of the version 2 of
+// the API, where the bodies are JSON documents and the errors are returned as
+// error objects
+func jsonOperation(tag, summary string, security []string, params []*docParameter, req interface{}, status string, resp interface{}) *docOperation {
+	op := &docOperation{
+		Summary:    summary,
+		Tags:       []string{tag},
+		Parameters: params,
+		Responses: map[string]*docResponse{
+			"default": &docResponse{
+				Description: "Error object with the code and description of the error",
+				Content: map[string]*docMediaType{
+					"application/json": &docMediaType{Schema: errorSchema},
+				},
+			},
+		},
+	}
+
+	if len(security) > 0 {
+		requirement := make(map[string][]string)
+		for _, scheme := range security {
+			requirement[scheme] = []string{}
+		}
+		op.Security = []map[string][]string{requirement}
+	}
+
+	if req != nil {
+		op.RequestBody = &docRequestBody{
+			Required: true,
+			Content: map[string]*docMediaType{
+				"application/json": &docMediaType{Schema: schemaOf(req)},
+			},
+		}
+	}
+
+	op.Responses[status] = &docResponse{Description: "Success"}
+	if resp != nil {
+		schema, ok := resp.(*docSchema)
+		if !ok {
+			schema = schemaOf(resp)
+		}
+		op.Responses[status].Content = map[string]*docMediaType{
+			"application/json": &docMediaType{Schema: schema},
+		}
+	}
+
+	return op
+}
+
+// pathParam Returns a required string parameter sent on the path
+func pathParam(name, desc string) *docParameter {
+	return &docParameter{
+		Name:        name,
+		In:          "path",
+		Description: desc,
+		Required:    true,
+		Schema:      &docSchema{Type: "string"},
+	}
+}
+
+// errorSchema Schema of the error objects returned by the version 2 of the API
+var errorSchema = &docSchema{
+	Type: "object",
+	Properties: map[string]*docSchema{
+		"error": &docSchema{
+			Type: "object",
+			Properties: map[string]*docSchema{
+				"code":    &docSchema{Type: "string"},
+				"message": &docSchema{Type: "string"},
+			},
+		},
+	},
+}
+
+// shardStatsSchema Schema of the statistics returned for each one of the
+// shards of a group
+var shardStatsSchema = &docSchema{
+	Type:        "object",
+	Description: "Statistics by host name of the instance that owns the shard",
+	AdditionalProperties: &docSchema{
+		Type: "object",
+		Properties: map[string]*docSchema{
+			"stored_elements": &docSchema{Type: "integer", Format: "int64"},
+			"rec_tree_status": &docSchema{Type: "string"},
+			"queries_by_sec":  &docSchema{Type: "array", Items: &docSchema{Type: "integer", Format: "int64"}},
+			"queries_by_min":  &docSchema{Type: "array", Items: &docSchema{Type: "integer", Format: "int64"}},
+		},
+	},
+}
+
+// newAPIDoc Returns an empty OpenAPI document with the general information of
+// the API
+func newAPIDoc() *apiDoc {
+	return &apiDoc{
+		OpenAPI: cOpenAPIVersion,
+		Info: &docInfo{
+			Title:       "Pit",
+			Description: "Recommender system API",
+			Version:     "2",
+		},
+		Paths: make(map[string]docPathItem),
+		Components: &docComponents{
+			SecuritySchemes: map[string]*docSecurityScheme{
+				"userAuth": &docSecurityScheme{
+					Type:        "http",
+					Scheme:      "basic",
+					Description: "User ID and user key",
+				},
+				"groupAuth": &docSecurityScheme{
+					Type:        "http",
+					Scheme:      "basic",
+					Description: "User ID and group key",
+				},
+				"groupKey": &docSecurityScheme{
+					Type:        "apiKey",
+					In:          "header",
+					Name:        shardsmanager.CGroupKeyHeader,
+					Description: "Group key used on the management operations",
+				},
+			},
+		},
+	}
+}
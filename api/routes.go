@@ -0,0 +1,279 @@
+package api
+
+import (
+	"github.com/alonsovidales/pit/accounts_manager"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/models/users"
+	"github.com/alonsovidales/pit/shards_manager"
+	"net/http"
+)
+
+// route Endpoint registered on the HTTP server with the description of all
+// the paths and methods attended by the handler, in case of the path ends with
+// "/" the handler attends all the paths under it
+type route struct {
+	path    string
+	handler http.HandlerFunc
+	doc     map[string]docPathItem
+}
+
+// Form parameters shared by the endpoints of the first version of the API
+var (
+	pUID       = &formParam{"uid", "User ID", "string", true}
+	pGroupKey  = &formParam{"key", "Group key", "string", true}
+	pGroup     = &formParam{"group", "Group ID", "string", true}
+	pU         = &formParam{"u", "User ID", "string", true}
+	pUK        = &formParam{"uk", "User key", "string", true}
+	pG         = &formParam{"g", "Group ID", "string", true}
+	pK         = &formParam{"k", "Group key", "string", true}
+	pUserKey   = &formParam{"k", "User key", "string", true}
+	pRecID     = &formParam{"id", "Record ID", "integer", true}
+	pRecScores = &formParam{"scores", `JSON object with the scores by item ID, like: {"1": 5, "2": 3}`, "string", true}
+)
+
+// routes Returns all the endpoints to be registered on the server, the SSL
+// server doesn't attend the recommendations and scores requests of the first
+// version of the API by performance issues
+func (api *API) routes(ssl bool) (routes []*route) {
+	if !ssl {
+		routes = append(routes, []*route{
+			&route{shardsmanager.CRecPath, api.shardsManager.ScoresAPIHandler, map[string]docPathItem{
+				shardsmanager.CRecPath: docPathItem{"post": formOperation(
+					"recommendations",
+					"Stores the scores of the record and returns the recommendations for it, or only stores them if the insert param is specified",
+					[]*formParam{
+						pUID, pGroupKey, pGroup, pRecID, pRecScores,
+						&formParam{"max_recs", "Max number of recommendations to be returned", "integer", false},
+						&formParam{"insert", "If specified, the scores are stored without calculate recommendations", "string", false},
+						&formParam{"fanout", "If specified, the recommendations of all the shards of the group are merged", "string", false},
+					},
+					schemaOf(shardsmanager.RecsResponse{}))},
+			}},
+			&route{shardsmanager.CScoresPath, api.shardsManager.ScoresAPIHandler, map[string]docPathItem{
+				shardsmanager.CScoresPath: docPathItem{"post": formOperation(
+					"recommendations",
+					"Returns the average scores of the requested items",
+					[]*formParam{
+						pUID, pGroupKey, pGroup,
+						&formParam{"items", "JSON array with the items IDs", "string", true},
+					},
+					schemaOf(shardsmanager.ScoresResponse{}))},
+			}},
+			&route{shardsmanager.CRecBatchPath, api.shardsManager.RecBatchAPIHandler, map[string]docPathItem{
+				shardsmanager.CRecBatchPath: docPathItem{"post": formOperation(
+					"recommendations",
+					"Returns the recommendations for a batch of records, each record counts as a query",
+					[]*formParam{
+						pUID, pGroupKey, pGroup,
+						&formParam{"recs", `JSON array of requests like: [{"id": 1, "scores": {"1": 5}, "max_recs": 10}]`, "string", true},
+					},
+					schemaOf(shardsmanager.RecBatchResponse{}))},
+			}},
+		}...)
+	}
+
+	return append(routes, []*route{
+		&route{shardsmanager.CGroupInfoPath, api.shardsManager.GroupInfoAPIHandler, map[string]docPathItem{
+			shardsmanager.CGroupInfoPath: docPathItem{"post": formOperation(
+				"groups",
+				"Returns the statistics of all the shards of the group",
+				[]*formParam{pUID, pGroupKey, pGroup},
+				shardStatsSchema)},
+		}},
+		&route{cHealtyPath, api.healthCheck, map[string]docPathItem{
+			cHealtyPath: docPathItem{"get": formOperation("system", "Health check of the instance", nil, nil)},
+		}},
+		&route{shardsmanager.CRegenerateGroupKey, api.shardsManager.RegenerateGroupKey, map[string]docPathItem{
+			shardsmanager.CRegenerateGroupKey: docPathItem{"post": formOperation(
+				"groups", "Generates a new key for the group and returns it",
+				[]*formParam{pU, pUK, pG, pK}, nil)},
+		}},
+		&route{shardsmanager.CDelGroup, api.shardsManager.DelGroup, map[string]docPathItem{
+			shardsmanager.CDelGroup: docPathItem{"post": formOperation(
+				"groups", "Removes the group and all the content of the shards",
+				[]*formParam{pU, pUK, pG, pK}, nil)},
+		}},
+		&route{shardsmanager.CGetGroupsByUser, api.shardsManager.GetGroupsByUser, map[string]docPathItem{
+			shardsmanager.CGetGroupsByUser: docPathItem{"post": formOperation(
+				"groups", "Returns all the groups of the user by group ID",
+				[]*formParam{pU, pUK},
+				schemaOf(map[string]*shardinfo.GroupInfo{}))},
+		}},
+		&route{shardsmanager.CAddUpdateGroup, api.shardsManager.AddUpdateGroup, map[string]docPathItem{
+			shardsmanager.CAddUpdateGroup: docPathItem{"post": formOperation(
+				"groups", "Creates a new group and returns the key to access to it",
+				[]*formParam{
+					pU, pUK,
+					&formParam{"guid", "Name of the group", "string", true},
+					&formParam{"gt", "Type of group", "string", true},
+					&formParam{"shards", "Number of shards", "integer", true},
+					&formParam{"maxscore", "Max score that can be assigned to an item", "integer", true},
+					&formParam{"routing", "Routing mode of the requests, \"hash\" to consistently hash the records onto the shards", "string", false},
+				},
+				&docSchema{Type: "object", Properties: map[string]*docSchema{
+					"success": &docSchema{Type: "boolean"},
+					"key":     &docSchema{Type: "string"},
+				}})},
+		}},
+		&route{shardsmanager.CSetShardsGroup, api.shardsManager.SetShards, map[string]docPathItem{
+			shardsmanager.CSetShardsGroup: docPathItem{"post": formOperation(
+				"groups", "Sets the number of shards of the group",
+				[]*formParam{pU, pUK, pG, pK, &formParam{"s", "Number of shards", "integer", true}}, nil)},
+		}},
+		&route{shardsmanager.CRemoveShardsContent, api.shardsManager.RemoveShardsContent, map[string]docPathItem{
+			shardsmanager.CRemoveShardsContent: docPathItem{"post": formOperation(
+				"groups", "Removes all the records stored on the shards of the group",
+				[]*formParam{pU, pUK, pG, pK}, nil)},
+		}},
+
+		&route{accountsmanager.CBillingInfo, api.accountsManager.BillingInfo, map[string]docPathItem{
+			accountsmanager.CBillingInfo: docPathItem{"post": formOperation(
+				"accounts", "Returns the billing information of the account",
+				[]*formParam{pU, pUserKey}, schemaOf(users.BillingInfo{}))},
+		}},
+		&route{accountsmanager.CRegisterPath, api.accountsManager.Register, map[string]docPathItem{
+			accountsmanager.CRegisterPath: docPathItem{"post": formOperation(
+				"accounts", "Sends the verification e-mail to register a new account",
+				[]*formParam{
+					&formParam{"uid", "E-mail address", "string", true},
+					&formParam{"key", "Password", "string", true},
+				}, nil)},
+		}},
+		&route{accountsmanager.CVerifyPath, api.accountsManager.Verify, map[string]docPathItem{
+			accountsmanager.CVerifyPath: docPathItem{"get": queryOperation(
+				"accounts", "Verifies a new account from the link of the verification e-mail",
+				[]*formParam{
+					pU,
+					&formParam{"k", "Hash of the password", "string", true},
+					&formParam{"t", "Expiration timestamp", "integer", true},
+					&formParam{"s", "Signature", "string", true},
+				}, nil)},
+		}},
+		&route{accountsmanager.CLogsPath, api.accountsManager.Logs, map[string]docPathItem{
+			accountsmanager.CLogsPath: docPathItem{"post": formOperation(
+				"accounts", "Returns the activity logs of the account by log type",
+				[]*formParam{pU, pUserKey}, schemaOf(map[string][]*users.LogLine{}))},
+		}},
+		&route{accountsmanager.CRecoverPassPath, api.accountsManager.RecoverPass, map[string]docPathItem{
+			accountsmanager.CRecoverPassPath: docPathItem{"post": formOperation(
+				"accounts", "Sends the password recovery e-mail",
+				[]*formParam{pU}, nil)},
+		}},
+		&route{accountsmanager.CChangePass, api.accountsManager.ChangePass, map[string]docPathItem{
+			accountsmanager.CChangePass: docPathItem{"post": formOperation(
+				"accounts", "Changes the password of the account using the current password or a recovery signature",
+				[]*formParam{
+					pU,
+					&formParam{"k", "Current password", "string", false},
+					&formParam{"nk", "New password", "string", true},
+					&formParam{"t", "Expiration timestamp of the recovery link", "integer", false},
+					&formParam{"s", "Signature of the recovery link", "string", false},
+				}, nil)},
+		}},
+		&route{accountsmanager.CDisablePath, api.accountsManager.Disable, map[string]docPathItem{
+			accountsmanager.CDisablePath: docPathItem{"post": formOperation(
+				"accounts", "Disables the account",
+				[]*formParam{pU, pUserKey}, nil)},
+		}},
+		&route{cContact, api.contact, map[string]docPathItem{
+			cContact: docPathItem{"post": formOperation(
+				"system", "Sends a message from the contact form",
+				[]*formParam{
+					&formParam{"mail", "E-mail address of the sender", "string", true},
+					&formParam{"content", "Message", "string", true},
+				}, nil)},
+		}},
+		&route{CAPIDocPath, api.apiDocHandler, map[string]docPathItem{
+			CAPIDocPath: docPathItem{"get": jsonOperation(
+				"system", "Returns this OpenAPI document", nil, nil, nil, "200", &docSchema{Type: "object"})},
+		}},
+
+		// Version 2 of the API, all the resources under the same root
+		// are dispatched by the corresponding handler
+		&route{shardsmanager.CV2GroupsPath, api.shardsManager.GroupsV2APIHandler, map[string]docPathItem{
+			shardsmanager.CV2GroupsPath: docPathItem{
+				"get": jsonOperation(
+					"groups", "Returns all the groups of the user by group ID",
+					[]string{"userAuth"}, nil, nil, "200", map[string]*shardinfo.GroupInfo{}),
+				"post": jsonOperation(
+					"groups", "Creates a new group and returns the ID and key to access to it",
+					[]string{"userAuth"}, nil, shardsmanager.CreateGroupReq{}, "201", shardsmanager.GroupKeyResponse{}),
+			},
+		}},
+		&route{shardsmanager.CV2GroupsPath + "/", api.shardsManager.GroupsV2APIHandler, api.v2GroupsDoc()},
+		&route{accountsmanager.CV2AccountsPath, api.accountsManager.AccountsV2APIHandler, map[string]docPathItem{
+			accountsmanager.CV2AccountsPath: docPathItem{"post": jsonOperation(
+				"accounts", "Sends the verification e-mail to register a new account",
+				nil, nil, accountsmanager.CredentialsReq{}, "202", accountsmanager.StatusResponse{})},
+		}},
+		&route{accountsmanager.CV2AccountPath, api.accountsManager.AccountV2APIHandler, map[string]docPathItem{
+			accountsmanager.CV2AccountPath: docPathItem{"delete": jsonOperation(
+				"accounts", "Disables the account",
+				[]string{"userAuth"}, nil, nil, "204", nil)},
+		}},
+		&route{accountsmanager.CV2AccountPath + "/", api.accountsManager.AccountV2APIHandler, map[string]docPathItem{
+			accountsmanager.CV2AccountPath + "/logs": docPathItem{"get": jsonOperation(
+				"accounts", "Returns the activity logs of the account by log type",
+				[]string{"userAuth"}, nil, nil, "200", map[string][]*users.LogLine{})},
+			accountsmanager.CV2AccountPath + "/billing": docPathItem{"get": jsonOperation(
+				"accounts", "Returns the billing information of the account",
+				[]string{"userAuth"}, nil, nil, "200", users.BillingInfo{})},
+			accountsmanager.CV2AccountPath + "/password": docPathItem{"put": jsonOperation(
+				"accounts", "Changes the password of the account",
+				[]string{"userAuth"}, nil, accountsmanager.ChangePassReq{}, "204", nil)},
+			accountsmanager.CV2AccountPath + "/recover": docPathItem{"post": jsonOperation(
+				"accounts", "Sends the password recovery e-mail",
+				nil, nil, accountsmanager.RecoverPassReq{}, "202", accountsmanager.StatusResponse{})},
+		}},
+
+		&route{"/", api.staticHandler, map[string]docPathItem{
+			"/{file}": docPathItem{"get": &docOperation{
+				Summary:    "Static content of the web site, the paths without extension are served as HTML files",
+				Tags:       []string{"system"},
+				Parameters: []*docParameter{pathParam("file", "Path of the file")},
+				Responses: map[string]*docResponse{
+					"200": &docResponse{Description: "Content of the file"},
+				},
+			}},
+		}},
+	}...)
+}
+
+// v2GroupsDoc Returns the description of all the resources of a group on the
+// version 2 of the API
+func (api *API) v2GroupsDoc() map[string]docPathItem {
+	gid := pathParam("gid", "Group ID")
+	root := shardsmanager.CV2GroupsPath + "/{gid}"
+	management := []string{"userAuth", "groupKey"}
+	data := []string{"groupAuth"}
+
+	return map[string]docPathItem{
+		root: docPathItem{"delete": jsonOperation(
+			"groups", "Removes the group and all the content of the shards",
+			management, []*docParameter{gid}, nil, "204", nil)},
+		root + "/info": docPathItem{"get": jsonOperation(
+			"groups", "Returns the statistics of all the shards of the group",
+			data, []*docParameter{gid}, nil, "200", shardStatsSchema)},
+		root + "/key": docPathItem{"post": jsonOperation(
+			"groups", "Generates a new key for the group and returns it",
+			management, []*docParameter{gid}, nil, "200", shardsmanager.GroupKeyResponse{})},
+		root + "/shards": docPathItem{"put": jsonOperation(
+			"groups", "Sets the number of shards of the group",
+			management, []*docParameter{gid}, shardsmanager.SetShardsReq{}, "204", nil)},
+		root + "/records": docPathItem{"delete": jsonOperation(
+			"groups", "Removes all the records stored on the shards of the group",
+			management, []*docParameter{gid}, nil, "204", nil)},
+		root + "/records/{id}": docPathItem{"put": jsonOperation(
+			"recommendations", "Stores the scores of the record",
+			data, []*docParameter{gid, pathParam("id", "Record ID")}, shardsmanager.InsertReq{}, "200", shardsmanager.InsertResponse{})},
+		root + "/recs": docPathItem{"post": jsonOperation(
+			"recommendations", "Stores the scores of the record and returns the recommendations for it",
+			data, []*docParameter{gid}, shardsmanager.RecsReq{}, "200", shardsmanager.RecsResponse{})},
+		root + "/recs/batch": docPathItem{"post": jsonOperation(
+			"recommendations", "Returns the recommendations for a batch of records, each record counts as a query",
+			data, []*docParameter{gid}, shardsmanager.RecBatchReqs{}, "200", shardsmanager.RecBatchResponse{})},
+		root + "/scores": docPathItem{"post": jsonOperation(
+			"recommendations", "Returns the average scores of the requested items",
+			data, []*docParameter{gid}, shardsmanager.ScoresReq{}, "200", shardsmanager.ScoresResponse{})},
+	}
+}
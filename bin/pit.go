@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/alonsovidales/pit/accounts_manager"
 	"github.com/alonsovidales/pit/api"
 	"github.com/alonsovidales/pit/cfg"
@@ -11,6 +12,13 @@ import (
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
+)
+
+const (
+	// cShutdownTimeout Max time to wait for the requests in progress and
+	// for the hand off of the shards before exit
+	cShutdownTimeout = time.Minute
 )
 
 func main() {
@@ -42,16 +50,18 @@ func main() {
 		cfg.GetStr("aws", "prefix"),
 		cfg.GetStr("aws", "region"),
 		cfg.GetStr("aws", "s3-backups-path"),
-		int(cfg.GetInt("rec-api", "port")),
+		int(cfg.GetInt("rec-api", "cluster-port")),
 		usersModel,
 		cfg.GetStr("mail", "addr"))
 
-	api.Init(
+	apiServer, sslAPIServer := api.Init(
 		shardsManager,
 		accountsManager,
 		cfg.GetStr("rec-api", "static"),
 		int(cfg.GetInt("rec-api", "port")),
 		int(cfg.GetInt("rec-api", "ssl-port")),
+		int(cfg.GetInt("rec-api", "grpc-port")),
+		int(cfg.GetInt("rec-api", "cluster-port")),
 		cfg.GetStr("rec-api", "ssl-cert"),
 		cfg.GetStr("rec-api", "ssl-key"))
 
@@ -62,5 +72,24 @@ func main() {
 	<-c
 
 	log.Info("Stopping all the services")
+	ctx, cancel := context.WithTimeout(context.Background(), cShutdownTimeout)
+	defer cancel()
+
+	// No more shards are acquired and the health check fails, so the load
+	// balancer stops sending requests to the instance once it checks the
+	// health of the instance again
 	shardsManager.Stop()
+	select {
+	case <-time.After(time.Duration(cfg.GetInt("rec-api", "health-check-secs")) * time.Second):
+	case <-ctx.Done():
+	}
+	// Attend the requests in progress before hand off the shards, so the
+	// final backups contain all the records received
+	apiServer.Shutdown(ctx)
+	sslAPIServer.Shutdown(ctx)
+	if err := shardsManager.Drain(ctx); err != nil {
+		log.Error("Problem draining the shards, Error:", err)
+	}
+	apiServer.ShutdownCluster(ctx)
+	log.Info("All the services stopped")
 }
@@ -7,11 +7,16 @@ import (
 	"github.com/alonsovidales/pit/log"
 	"github.com/alyu/configparser"
 	"strconv"
+	"sync"
 )
 
 var cfg *configparser.Configuration
 var sections = make(map[string]*configparser.Section)
 
+// sectionsMutex Protects the cache of sections, the configuration can be read
+// concurrently
+var sectionsMutex sync.Mutex
+
 // Init Loads a INI file onto memory, first try to liad the config file from
 // the etc/ directory on the current path, and if the file can't be found, try
 // to load it from the /etc/ directory
@@ -65,6 +70,9 @@ func GetBool(sec, subsec string) (v bool) {
 
 // loadSection loads a section of the config file
 func loadSection(name string) (section *configparser.Section) {
+	sectionsMutex.Lock()
+	defer sectionsMutex.Unlock()
+
 	if section, ok := sections[name]; ok {
 		return section
 	}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"github.com/alonsovidales/pit/rest"
+)
+
+// GroupInfo Configuration of a group of shards
+type GroupInfo struct {
+	// UserID ID of the owner of the group
+	UserID string `json:"user_id"`
+	// GroupID ID of the group
+	GroupID string `json:"group_id"`
+	// Key Secret key of the group
+	Key string `json:"secret"`
+	// Type Type of the group
+	Type string `json:"type"`
+	// MaxScore Max score that can be assigned to an item
+	MaxScore uint8 `json:"max_score"`
+	// NumShards Number of shards that composes the group
+	NumShards int `json:"tot_shards"`
+	// MaxElements Max number of elements that can be stored by shard
+	MaxElements uint64 `json:"max_elems"`
+	// MaxReqSec Max number of requests / sec by shard
+	MaxReqSec uint64 `json:"max_req_sec"`
+	// MaxInsertReqSec Max number of insert requests / sec by shard
+	MaxInsertReqSec uint64 `json:"max_insert_serq"`
+	// Routing Routing mode of the requests, empty if the requests can be
+	// attended by any shard
+	Routing string `json:"routing,omitempty"`
+}
+
+// keyResponse ID and key of a group returned by the API
+type keyResponse struct {
+	GroupID string `json:"group_id"`
+	Key     string `json:"key"`
+}
+
+// Account Provides access to the management of the groups of a user account
+type Account struct {
+	cl  *Client
+	uid string
+	key string
+}
+
+// Account Returns the account of the user identified by the given ID and key
+func (cl *Client) Account(uid, key string) *Account {
+	return &Account{
+		cl:  cl,
+		uid: uid,
+		key: key,
+	}
+}
+
+// Groups Returns all the groups of the account by group ID
+func (ac *Account) Groups(ctx context.Context) (groups map[string]*GroupInfo, err error) {
+	groups = make(map[string]*GroupInfo)
+	err = ac.cl.do(ctx, &request{
+		method: "GET",
+		path:   rest.CV2Prefix + "groups",
+		uid:    ac.uid,
+		key:    ac.key,
+	}, &groups)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// CreateGroup Creates a new group and returns it, the name is used as prefix
+// of the generated group ID
+func (ac *Account) CreateGroup(ctx context.Context, name, groupType string, shards int, maxScore uint8) (*Group, error) {
+	return ac.CreateRoutedGroup(ctx, name, groupType, "", shards, maxScore)
+}
+
+// CreateRoutedGroup Creates a new group with the given routing mode and returns
+// it, with the "hash" routing each record is always stored on the same shard
+func (ac *Account) CreateRoutedGroup(ctx context.Context, name, groupType, routing string, shards int, maxScore uint8) (*Group, error) {
+	resp := &keyResponse{}
+	err := ac.cl.do(ctx, &request{
+		method: "POST",
+		path:   rest.CV2Prefix + "groups",
+		uid:    ac.uid,
+		key:    ac.key,
+		body: map[string]interface{}{
+			"name":      name,
+			"type":      groupType,
+			"shards":    shards,
+			"max_score": maxScore,
+			"routing":   routing,
+		},
+	}, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return ac.cl.Group(ac.uid, resp.GroupID, resp.Key), nil
+}
+
+// DeleteGroup Removes a group and all the records stored on it
+func (ac *Account) DeleteGroup(ctx context.Context, groupID, groupKey string) error {
+	return ac.cl.do(ctx, ac.groupRequest("DELETE", groupID, groupKey, nil), nil)
+}
+
+// RegenerateGroupKey Replaces the key of the group by a new random one and
+// returns it
+func (ac *Account) RegenerateGroupKey(ctx context.Context, groupID, groupKey string) (key string, err error) {
+	resp := &keyResponse{}
+	if err = ac.cl.do(ctx, ac.groupRequest("POST", groupID, groupKey, nil, "key"), resp); err != nil {
+		return
+	}
+
+	return resp.Key, nil
+}
+
+// SetShards Modifies the number of shards that composes a group
+func (ac *Account) SetShards(ctx context.Context, groupID, groupKey string, shards int) error {
+	return ac.cl.do(ctx, ac.groupRequest("PUT", groupID, groupKey, map[string]int{"shards": shards}, "shards"), nil)
+}
+
+// RemoveRecords Removes all the records stored on the shards of a group
+func (ac *Account) RemoveRecords(ctx context.Context, groupID, groupKey string) error {
+	return ac.cl.do(ctx, ac.groupRequest("DELETE", groupID, groupKey, nil, "records"), nil)
+}
+
+// groupRequest Returns a management request over a resource of a group
+func (ac *Account) groupRequest(method, groupID, groupKey string, body interface{}, resource ...string) *request {
+	return &request{
+		method:   method,
+		path:     groupPath(groupID, resource...),
+		uid:      ac.uid,
+		key:      ac.key,
+		groupKey: groupKey,
+		body:     body,
+	}
+}
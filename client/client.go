@@ -0,0 +1,239 @@
+package client
+
+// Package that provides the Go client of the version 2 of the Pit HTTP API.
+// The requests rejected because the shard of the group is still being
+// provisioned or because the requests / sec limit was reached are retried
+// after wait, and all the requests share the same HTTP client in order to
+// reuse the connections
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/alonsovidales/pit/rest"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// CDefaultTimeout Default time limit for a single HTTP request
+	CDefaultTimeout = 10 * time.Second
+	// CDefaultMaxRetries Default max number of times that a request is
+	// retried
+	CDefaultMaxRetries = 5
+	// CDefaultRetryWait Default time to wait before the first retry, the
+	// time is doubled on each retry
+	CDefaultRetryWait = 200 * time.Millisecond
+
+	// cMaxRetryWait Max time to wait between two retries
+	cMaxRetryWait = 10 * time.Second
+	// cMaxIdleConnsPerHost Max number of idle connections to keep open
+	// against the API
+	cMaxIdleConnsPerHost = 64
+	// cGroupKeyHeader Header used to send the key of the group on the
+	// management requests
+	cGroupKeyHeader = "X-Pit-Group-Key"
+)
+
+// Error Error returned by the API when a request can't be attended
+type Error struct {
+	// StatusCode HTTP status code of the response
+	StatusCode int
+	// Code Machine readable error code, see the rest.Code constants
+	Code string
+	// Message Human readable description of the error
+	Message string
+
+	retryAfter time.Duration
+}
+
+// Error Returns the description of the error
+func (e *Error) Error() string {
+	return fmt.Sprintf("Pit API error %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Temporary Returns true if the same request can succeed after wait, as when
+// the shard of the group is still being provisioned or when the requests /
+// sec limit was reached
+func (e *Error) Temporary() bool {
+	return e.StatusCode == 429 || (e.StatusCode == 503 && e.Code == rest.CodeProvisioning)
+}
+
+// Client Client of the API, a single client can be used concurrently by many
+// goroutines
+type Client struct {
+	baseURL    string
+	timeout    time.Duration
+	maxRetries int
+	retryWait  time.Duration
+	httpClient *http.Client
+}
+
+// Option Configuration option of the client
+type Option func(cl *Client)
+
+// WithTimeout Sets the time limit for each HTTP request, the retries have its
+// own time limit
+func WithTimeout(timeout time.Duration) Option {
+	return func(cl *Client) {
+		cl.timeout = timeout
+	}
+}
+
+// WithRetries Sets the max number of retries and the time to wait before the
+// first one, the time is doubled on each retry unless the API specifies how
+// much to wait using the Retry-After header. Zero retries disables them
+func WithRetries(maxRetries int, wait time.Duration) Option {
+	return func(cl *Client) {
+		cl.maxRetries = maxRetries
+		cl.retryWait = wait
+	}
+}
+
+// WithHTTPClient Uses the given HTTP client to perform the requests instead of
+// the one created by the client, the timeout option is ignored in this case
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(cl *Client) {
+		cl.httpClient = httpClient
+	}
+}
+
+// New Returns a client for the API on the given base URL, like
+// "http://api.pitia.info"
+func New(baseURL string, opts ...Option) (cl *Client) {
+	cl = &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		timeout:    CDefaultTimeout,
+		maxRetries: CDefaultMaxRetries,
+		retryWait:  CDefaultRetryWait,
+	}
+	for _, opt := range opts {
+		opt(cl)
+	}
+
+	if cl.httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = cMaxIdleConnsPerHost
+		cl.httpClient = &http.Client{
+			Transport: transport,
+			Timeout:   cl.timeout,
+		}
+	}
+
+	return
+}
+
+// request Description of a request to the API
+type request struct {
+	method   string
+	path     string
+	uid      string
+	key      string
+	groupKey string
+	body     interface{}
+}
+
+// do Performs the request retrying it while the API returns a temporary error,
+// the JSON response is decoded into result if it is not nil
+func (cl *Client) do(ctx context.Context, req *request, result interface{}) (err error) {
+	var payload []byte
+	if req.body != nil {
+		if payload, err = json.Marshal(req.body); err != nil {
+			return
+		}
+	}
+
+	wait := cl.retryWait
+	for retry := 0; ; retry++ {
+		err = cl.send(ctx, req, payload, result)
+		apiErr, ok := err.(*Error)
+		if !ok || !apiErr.Temporary() || retry >= cl.maxRetries {
+			return
+		}
+
+		sleep := wait
+		if apiErr.retryAfter > 0 {
+			sleep = apiErr.retryAfter
+		}
+		if sleep > cMaxRetryWait {
+			sleep = cMaxRetryWait
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleep):
+		}
+		wait *= 2
+	}
+}
+
+// send Performs a single HTTP request and decodes the response
+func (cl *Client) send(ctx context.Context, req *request, payload []byte, result interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	httpReq, err := http.NewRequest(req.method, cl.baseURL+req.path, body)
+	if err != nil {
+		return err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	if payload != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	httpReq.SetBasicAuth(req.uid, req.key)
+	if req.groupKey != "" {
+		httpReq.Header.Set(cGroupKeyHeader, req.groupKey)
+	}
+
+	resp, err := cl.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	// The whole body has to be read in order to reuse the connection
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		return responseError(resp, respBody)
+	}
+	if result == nil || len(respBody) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(respBody, result)
+}
+
+// responseError Returns the error described on an error response
+func responseError(resp *http.Response, body []byte) error {
+	apiErr := &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+	}
+	errResp := &struct {
+		Error *rest.Error `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, errResp); err == nil && errResp.Error != nil {
+		apiErr.Code = errResp.Error.Code
+		apiErr.Message = errResp.Error.Message
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		apiErr.retryAfter = time.Duration(secs) * time.Second
+	}
+
+	return apiErr
+}
+
+// groupPath Returns the path of a resource of a group
+func groupPath(groupID string, resource ...string) string {
+	return rest.CV2Prefix + "groups/" + strings.Join(append([]string{url.PathEscape(groupID)}, resource...), "/")
+}
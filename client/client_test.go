@@ -0,0 +1,190 @@
+package client
+
+import (
+	"context"
+	"github.com/alonsovidales/pit/api"
+	"github.com/alonsovidales/pit/cfg"
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/models/storage"
+	"github.com/alonsovidales/pit/models/users"
+	"github.com/alonsovidales/pit/rest"
+	"github.com/alonsovidales/pit/shards_manager"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	cTestUID = "user@test.com"
+	cTestKey = "user_key"
+)
+
+// newTestServer Starts an instance of the API that keeps all the information
+// in memory, with a registered user
+func newTestServer(t *testing.T) *httptest.Server {
+	if err := cfg.Init("pit", "test"); err != nil {
+		t.Fatal("The test config file can't be loaded, Error:", err)
+	}
+
+	usersModel := users.NewModel(storage.NewMemTable())
+	if _, err := usersModel.RegisterUser(cTestUID, cTestKey, "127.0.0.1"); err != nil {
+		t.Fatal("Problem registering the test user, Error:", err)
+	}
+
+	shardsManager := shardsmanager.New(
+		shardinfo.NewModel(storage.NewMemTable(), storage.NewMemTable(), "admin@test.com"),
+		instances.NewModel(storage.NewMemTable(), true),
+		usersModel,
+		"eu-west-1",
+		"/backups_test",
+		0)
+
+	return httptest.NewServer(api.New(shardsManager, nil, "", false))
+}
+
+func TestInProcessAPI(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	ctx := context.Background()
+	// The shard is provisioned in background after the group creation,
+	// the client waits for it retrying the requests
+	cl := New(server.URL, WithRetries(30, 100*time.Millisecond))
+	account := cl.Account(cTestUID, cTestKey)
+
+	group, err := account.CreateGroup(ctx, "test group", "s", 1, 5)
+	if err != nil {
+		t.Fatal("Problem creating the group, Error:", err)
+	}
+
+	for i := uint64(0); i < 10; i++ {
+		inserted, err := group.Insert(ctx, i, map[uint64]uint8{i: 5, i + 1: 3})
+		if err != nil || !inserted.Success {
+			t.Fatal("Problem inserting record:", i, "Response:", inserted, "Error:", err)
+		}
+	}
+
+	recs, err := group.Recommend(ctx, 100, map[uint64]uint8{1: 5}, 10)
+	if err != nil {
+		t.Fatal("Problem requesting recommendations, Error:", err)
+	}
+	// There are not enough records to calculate recommendations yet, the
+	// most popular items not scored by the record are returned instead
+	if !recs.Success || !recs.Fallback || recs.StoredElements != 21 || len(recs.Recs) != 10 || recs.Recs[0] == 1 {
+		t.Error("Unexpected recommendations:", recs)
+	}
+
+	batch, err := group.RecommendBatch(ctx, []*RecReq{
+		&RecReq{ID: 101, Scores: map[uint64]uint8{1: 5}, MaxRecs: 10},
+		&RecReq{ID: 102, Scores: map[uint64]uint8{2: 1}, MaxRecs: 10},
+	})
+	if err != nil || len(batch.Recs) != 2 || batch.Recs[1].ID != 102 {
+		t.Error("Unexpected batch recommendations:", batch, "Error:", err)
+	}
+
+	scores, err := group.Scores(ctx, []uint64{1, 2})
+	if err != nil || !scores.Success || len(scores.Scores) != 2 {
+		t.Error("Unexpected scores:", scores, "Error:", err)
+	}
+
+	info, err := group.Info(ctx)
+	if stats, ok := info[instances.GetHostName()]; err != nil || !ok || stats.StoredElements != 23 {
+		t.Error("Unexpected group info:", info, "Error:", err)
+	}
+
+	groups, err := account.Groups(ctx)
+	if err != nil || groups[group.ID()] == nil || groups[group.ID()].Key != group.Key() {
+		t.Error("The created group is not listed:", groups, "Error:", err)
+	}
+
+	if err = account.SetShards(ctx, group.ID(), group.Key(), 2); err != nil {
+		t.Error("Problem setting the number of shards, Error:", err)
+	}
+
+	key, err := account.RegenerateGroupKey(ctx, group.ID(), group.Key())
+	if err != nil || key == group.Key() {
+		t.Error("Problem regenerating the group key:", key, "Error:", err)
+	}
+	_, err = group.Scores(ctx, []uint64{1})
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != 401 || apiErr.Code != rest.CodeUnauthorized {
+		t.Error("Expected unauthorized error using the old key, obtained:", err)
+	}
+
+	if err = account.DeleteGroup(ctx, group.ID(), key); err != nil {
+		t.Error("Problem removing the group, Error:", err)
+	}
+
+	if _, err = cl.Account(cTestUID, "wrong").Groups(ctx); err == nil {
+		t.Error("Expected error using wrong user credentials")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var reqs int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&reqs, 1) {
+		case 1:
+			rest.WriteError(w, 503, rest.CodeProvisioning, "Provisioning")
+		case 2:
+			w.Header().Set("Retry-After", "1")
+			rest.WriteError(w, 429, rest.CodeTooManyRequests, "Too Many Requests")
+		default:
+			rest.WriteJSON(w, 200, map[string]interface{}{"success": true, "recs": []uint64{1, 2}})
+		}
+	}))
+	defer server.Close()
+
+	started := time.Now()
+	recs, err := New(server.URL, WithRetries(2, time.Millisecond)).Group("uid", "group", "key").Recommend(context.Background(), 1, nil, 2)
+	if err != nil || !recs.Success || len(recs.Recs) != 2 {
+		t.Error("Unexpected recommendations:", recs, "Error:", err)
+	}
+	if reqs != 3 {
+		t.Error("Expected 3 requests, performed:", reqs)
+	}
+	if time.Since(started) < time.Second {
+		t.Error("The Retry-After header was not respected")
+	}
+
+	// Non temporary errors and the errors after the last retry are returned
+	atomic.StoreInt32(&reqs, 0)
+	_, err = New(server.URL, WithRetries(0, time.Millisecond)).Group("uid", "group", "key").Info(context.Background())
+	if apiErr, ok := err.(*Error); !ok || !apiErr.Temporary() || apiErr.StatusCode != 503 || reqs != 1 {
+		t.Error("Expected provisioning error without retries, obtained:", err, "Requests:", reqs)
+	}
+}
+
+func TestTimeoutAndConnectionReuse(t *testing.T) {
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("slow") != "" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		rest.WriteJSON(w, 200, map[string]interface{}{"success": true})
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	cl := New(server.URL, WithTimeout(100*time.Millisecond))
+	for i := 0; i < 10; i++ {
+		if err := cl.do(context.Background(), &request{method: "GET", path: "/"}, nil); err != nil {
+			t.Fatal("Problem performing request, Error:", err)
+		}
+	}
+	if conns != 1 {
+		t.Error("Expected a single connection, opened:", conns)
+	}
+
+	if err := cl.do(context.Background(), &request{method: "GET", path: "/?slow=1"}, nil); err == nil {
+		t.Error("Expected timeout error")
+	}
+}
@@ -0,0 +1,201 @@
+package client
+
+import (
+	"context"
+	"fmt"
+)
+
+// Recs Recommendations returned for a record
+type Recs struct {
+	// Success Indicates if recommendations could be calculated, the
+	// recommendations can't be calculated until the group stores enough
+	// records
+	Success bool `json:"success"`
+	// Status Reason why the recommendations couldn't be calculated
+	Status string `json:"status"`
+	// StoredElements Current number of elements stored on the shard
+	StoredElements uint64 `json:"stored_elements"`
+	// ReqsSec Current number of queries / sec on the shard
+	ReqsSec uint64 `json:"reqs_sec"`
+	// Recs Recommended items IDs
+	Recs []uint64 `json:"recs"`
+	// Fallback Indicates that the recommended items are the most popular
+	// ones, since the shard couldn't calculate the recommendations yet
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// Inserted Result of store the scores of a record
+type Inserted struct {
+	// Success Indicates if the record was stored
+	Success bool `json:"success"`
+	// StoredElements Current number of elements stored on the shard
+	StoredElements uint64 `json:"stored_elements"`
+	// ReqsSec Current number of inserts / sec on the shard
+	ReqsSec uint64 `json:"reqs_sec"`
+}
+
+// Scores Average scores of some items
+type Scores struct {
+	// Success Indicates if the scores could be calculated
+	Success bool `json:"success"`
+	// StoredElements Current number of elements stored on the shard
+	StoredElements uint64 `json:"stored_elements"`
+	// ReqsSec Current number of queries / sec on the shard
+	ReqsSec uint64 `json:"reqs_sec"`
+	// Scores Average score by item ID
+	Scores map[uint64]float64 `json:"scores"`
+	// Fallback Indicates that the scores were calculated from the stored
+	// records, since the shard didn't calculate the tree yet
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// RecReq Recommendations request for a single record of a batch
+type RecReq struct {
+	// ID Record identifier
+	ID uint64 `json:"id"`
+	// Scores Scores by item ID of the record
+	Scores map[uint64]uint8 `json:"scores"`
+	// MaxRecs Max number of recommendations to be returned for this record
+	MaxRecs int `json:"max_recs"`
+}
+
+// RecBatchResult Recommendations returned for a single record of a batch
+type RecBatchResult struct {
+	// ID Record identifier
+	ID uint64 `json:"id"`
+	// Success Indicates if recommendations could be calculated for this
+	// record
+	Success bool `json:"success"`
+	// Recs Recommended items IDs
+	Recs []uint64 `json:"recs"`
+	// Fallback Indicates that the recommended items are the most popular
+	// ones, since the shard couldn't calculate the recommendations yet
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// RecBatch Recommendations returned for a batch of records
+type RecBatch struct {
+	// Success Indicates if the batch could be processed
+	Success bool `json:"success"`
+	// StoredElements Current number of elements stored on the shard
+	StoredElements uint64 `json:"stored_elements"`
+	// ReqsSec Current number of queries / sec on the shard
+	ReqsSec uint64 `json:"reqs_sec"`
+	// Recs Recommendations by record, in the same order than the requests
+	Recs []*RecBatchResult `json:"recs"`
+}
+
+// ShardStats Statistics of a shard of a group
+type ShardStats struct {
+	// StoredElements Number of stored elements on the shard
+	StoredElements uint64 `json:"stored_elements"`
+	// RecTreeStatus Current status of the recommender tree
+	RecTreeStatus string `json:"rec_tree_status"`
+	// RecTreeError Error that caused the current status of the shard, empty
+	// if the shard is healthy
+	RecTreeError string `json:"rec_tree_error,omitempty"`
+	// QueriesBySec Number of queries per second during the last minute
+	QueriesBySec []uint64 `json:"queries_by_sec"`
+	// QueriesByMin Number of queries per minute
+	QueriesByMin []uint64 `json:"queries_by_min"`
+}
+
+// Group Provides access to the records and recommendations of a group
+type Group struct {
+	cl  *Client
+	uid string
+	id  string
+	key string
+}
+
+// Group Returns the group of the given user identified by the group ID and
+// key
+func (cl *Client) Group(uid, groupID, key string) *Group {
+	return &Group{
+		cl:  cl,
+		uid: uid,
+		id:  groupID,
+		key: key,
+	}
+}
+
+// ID Returns the ID of the group
+func (gr *Group) ID() string {
+	return gr.id
+}
+
+// Key Returns the key used to access to the group
+func (gr *Group) Key() string {
+	return gr.key
+}
+
+// Recommend Stores the scores of the record and returns up to maxRecs
+// recommendations for it
+func (gr *Group) Recommend(ctx context.Context, recID uint64, scores map[uint64]uint8, maxRecs int) (recs *Recs, err error) {
+	recs = &Recs{}
+	err = gr.cl.do(ctx, gr.request("POST", &RecReq{
+		ID:      recID,
+		Scores:  scores,
+		MaxRecs: maxRecs,
+	}, "recs"), recs)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// RecommendBatch Returns the recommendations for a batch of records, each one
+// of the records counts as a query for the requests / sec limit
+func (gr *Group) RecommendBatch(ctx context.Context, reqs []*RecReq) (recs *RecBatch, err error) {
+	recs = &RecBatch{}
+	err = gr.cl.do(ctx, gr.request("POST", map[string][]*RecReq{"recs": reqs}, "recs", "batch"), recs)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Insert Stores the scores of a record without calculate recommendations
+func (gr *Group) Insert(ctx context.Context, recID uint64, scores map[uint64]uint8) (inserted *Inserted, err error) {
+	inserted = &Inserted{}
+	err = gr.cl.do(ctx, gr.request("PUT", map[string]map[uint64]uint8{"scores": scores}, "records", fmt.Sprintf("%d", recID)), inserted)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Scores Returns the average scores of the given items
+func (gr *Group) Scores(ctx context.Context, items []uint64) (scores *Scores, err error) {
+	scores = &Scores{}
+	if err = gr.cl.do(ctx, gr.request("POST", map[string][]uint64{"items": items}, "scores"), scores); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Info Returns the statistics of all the shards of the group by host name of
+// the instance that owns the shard
+func (gr *Group) Info(ctx context.Context) (info map[string]*ShardStats, err error) {
+	info = make(map[string]*ShardStats)
+	if err = gr.cl.do(ctx, gr.request("GET", nil, "info"), &info); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// request Returns a request over a resource of the group
+func (gr *Group) request(method string, body interface{}, resource ...string) *request {
+	return &request{
+		method: method,
+		path:   groupPath(gr.id, resource...),
+		uid:    gr.uid,
+		key:    gr.key,
+		body:   body,
+	}
+}
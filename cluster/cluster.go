@@ -0,0 +1,325 @@
+package cluster
+
+// Package that provides the internal RPC channel used by the instances to
+// forward requests between them. The calls are JSON documents sent over HTTP
+// to a dedicated port using a pool of keep-alive connections, each call has a
+// deadline and is signed with a HMAC of its content using a secret shared by
+// all the instances of the cluster, so the credentials of the users are never
+// propagated between instances. The ID of the request that originated the call
+// is propagated on all the calls in order to correlate the logs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alonsovidales/pit/log"
+	"github.com/alonsovidales/pit/rest"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// CRequestIDHeader Header that identifies a request on all the
+	// instances visited by it
+	CRequestIDHeader = "X-Request-Id"
+	// CDefaultTimeout Default deadline for a call to another instance
+	CDefaultTimeout = 5 * time.Second
+
+	// cPrefix Prefix of the path of all the internal methods
+	cPrefix = "/internal/"
+	// cHostsVisitedHeader Header used to propagate the list of instances
+	// already visited by a forwarded request
+	cHostsVisitedHeader = "X-Pit-Hosts-Visited"
+	// cTimestampHeader Header that contains the unix time when the call was
+	// signed
+	cTimestampHeader = "X-Pit-Timestamp"
+	// cSignatureHeader Header that contains the HMAC of the call
+	cSignatureHeader = "X-Pit-Signature"
+	// cMaxClockSkew Max difference between the time when a call was signed
+	// and the time when it is received
+	cMaxClockSkew = 30 * time.Second
+	// cMaxIdleConnsPerHost Max number of idle connections to keep open
+	// against each instance
+	cMaxIdleConnsPerHost = 32
+	// cSecretEnv Environment variable that contains the secret shared by all
+	// the instances
+	cSecretEnv = "PIT_CLUSTER_SECRET"
+)
+
+// ErrNoSecret The secret of the cluster is not configured
+var ErrNoSecret = errors.New("The cluster secret is not defined on the " + cSecretEnv + " environment variable")
+
+// ErrBadSignature The signature of the call is not valid or expired
+var ErrBadSignature = errors.New("Invalid call signature")
+
+// Error Error returned by a remote instance when a call can't be attended
+type Error struct {
+	// StatusCode HTTP status code of the response
+	StatusCode int
+	// Code Machine readable error code, see the rest.Code constants
+	Code string
+	// Message Human readable description of the error
+	Message string
+}
+
+// Error Returns the description of the error
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Handler Function that attends an internal method, receives the JSON body of
+// the call and returns the value to be sent as response. Returning an *Error
+// allows to specify the status code and error code of the response
+type Handler func(ctx context.Context, body []byte) (response interface{}, err error)
+
+// Secret Returns the secret shared by all the instances of the cluster
+func Secret() string {
+	return os.Getenv(cSecretEnv)
+}
+
+// ctxKey Type of the keys used to store values on the context
+type ctxKey int
+
+const (
+	ctxRequestID ctxKey = iota
+	ctxHostsVisited
+)
+
+// NewRequestID Returns a new random request ID
+func NewRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// WithRequestID Returns a context that propagates the given request ID on the
+// calls performed with it
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, ctxRequestID, requestID)
+}
+
+// RequestID Returns the ID of the request being attended
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxRequestID).(string)
+
+	return id
+}
+
+// WithHostsVisited Returns a context that propagates the list of visited
+// instances, separated by commas, on the calls performed with it
+func WithHostsVisited(ctx context.Context, hostsVisited string) context.Context {
+	return context.WithValue(ctx, ctxHostsVisited, hostsVisited)
+}
+
+// HostsVisited Returns the list of instances, separated by commas, already
+// visited by the request being attended
+func HostsVisited(ctx context.Context) string {
+	hosts, _ := ctx.Value(ctxHostsVisited).(string)
+
+	return hosts
+}
+
+// sign Returns the HMAC of the content of a call
+func sign(secret []byte, path, timestamp, requestID, hostsVisited string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{path, timestamp, requestID, hostsVisited}, "\n")))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Client Performs calls to the internal methods of the other instances, a
+// single client can be used concurrently by many goroutines
+type Client struct {
+	port       int
+	secret     []byte
+	timeout    time.Duration
+	httpClient *http.Client
+}
+
+// NewClient Returns a client that calls the instances listening on the given
+// port, each call is cancelled if it is not completed before the timeout
+func NewClient(port int, secret string, timeout time.Duration) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = cMaxIdleConnsPerHost
+
+	return NewClientWithTransport(port, secret, timeout, transport)
+}
+
+// NewClientWithTransport Returns a client as NewClient that performs the calls
+// using the given transport, that receives the requests addressed to the host
+// name and port of each instance
+func NewClientWithTransport(port int, secret string, timeout time.Duration, transport http.RoundTripper) *Client {
+	return &Client{
+		port:       port,
+		secret:     []byte(secret),
+		timeout:    timeout,
+		httpClient: &http.Client{Transport: transport},
+	}
+}
+
+// Call Calls the method on the instance with the given address, the request
+// is sent encoded as JSON and the response is decoded into resp if it is not
+// nil
+func (cl *Client) Call(ctx context.Context, addr, method string, req, resp interface{}) error {
+	if len(cl.secret) == 0 {
+		return ErrNoSecret
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cl.timeout)
+	defer cancel()
+
+	path := cPrefix + method
+	requestID := RequestID(ctx)
+	if requestID == "" {
+		requestID = NewRequestID()
+	}
+	hostsVisited := HostsVisited(ctx)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	httpReq, err := http.NewRequest("POST", fmt.Sprintf("http://%s:%d%s", addr, cl.port, path), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(CRequestIDHeader, requestID)
+	httpReq.Header.Set(cHostsVisitedHeader, hostsVisited)
+	httpReq.Header.Set(cTimestampHeader, timestamp)
+	httpReq.Header.Set(cSignatureHeader, sign(cl.secret, path, timestamp, requestID, hostsVisited, body))
+
+	httpResp, err := cl.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	// The whole body has to be read in order to reuse the connection
+	defer httpResp.Body.Close()
+	respBody, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+
+	if httpResp.StatusCode != 200 {
+		callErr := &Error{
+			StatusCode: httpResp.StatusCode,
+			Message:    strings.TrimSpace(string(respBody)),
+		}
+		errResp := &struct {
+			Error *rest.Error `json:"error"`
+		}{}
+		if json.Unmarshal(respBody, errResp) == nil && errResp.Error != nil {
+			callErr.Code = errResp.Error.Code
+			callErr.Message = errResp.Error.Message
+		}
+
+		return callErr
+	}
+	if resp == nil {
+		return nil
+	}
+
+	return json.Unmarshal(respBody, resp)
+}
+
+// Server Attends the calls to the internal methods performed by the other
+// instances, only the calls signed with the secret of the cluster are accepted
+type Server struct {
+	secret   []byte
+	handlers map[string]Handler
+}
+
+// NewServer Returns a server that accepts the calls signed with the given
+// secret
+func NewServer(secret string) *Server {
+	return &Server{
+		secret:   []byte(secret),
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Handle Registers the handler for the given method
+func (sv *Server) Handle(method string, handler Handler) {
+	sv.handlers[method] = handler
+}
+
+// ServeHTTP Verifies the signature of the call and dispatches it to the
+// handler of the method
+func (sv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get(CRequestIDHeader)
+	w.Header().Set(CRequestIDHeader, requestID)
+
+	handler, ok := sv.handlers[strings.TrimPrefix(r.URL.Path, cPrefix)]
+	if !ok || !strings.HasPrefix(r.URL.Path, cPrefix) {
+		rest.WriteError(w, 404, rest.CodeNotFound, "Unknown method")
+		return
+	}
+	if !rest.AllowMethods(w, r, "POST") {
+		return
+	}
+
+	body, err := rest.ReadBody(r)
+	if err != nil && err != rest.ErrEmptyBody {
+		rest.WriteError(w, 400, rest.CodeBadRequest, err.Error())
+		return
+	}
+	if err = sv.verify(r, body); err != nil {
+		log.Error("Rejected internal call from:", r.RemoteAddr, "Request:", requestID, "Error:", err)
+		rest.WriteError(w, 401, rest.CodeUnauthorized, err.Error())
+		return
+	}
+
+	ctx := WithHostsVisited(WithRequestID(r.Context(), requestID), r.Header.Get(cHostsVisitedHeader))
+	response, err := handler(ctx, body)
+	if err != nil {
+		if callErr, ok := err.(*Error); ok {
+			rest.WriteError(w, callErr.StatusCode, callErr.Code, callErr.Message)
+			return
+		}
+
+		log.Error("Problem attending internal call:", r.URL.Path, "Request:", requestID, "Error:", err)
+		rest.WriteError(w, 500, rest.CodeInternal, err.Error())
+		return
+	}
+
+	rest.WriteJSON(w, 200, response)
+}
+
+// verify Checks that the call was signed with the secret of the cluster
+// recently
+func (sv *Server) verify(r *http.Request, body []byte) error {
+	if len(sv.secret) == 0 {
+		return ErrNoSecret
+	}
+
+	timestamp := r.Header.Get(cTimestampHeader)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > cMaxClockSkew || skew < -cMaxClockSkew {
+		return ErrBadSignature
+	}
+
+	expected := sign(sv.secret, r.URL.Path, timestamp, r.Header.Get(CRequestIDHeader), r.Header.Get(cHostsVisitedHeader), body)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(cSignatureHeader))) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
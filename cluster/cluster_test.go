@@ -0,0 +1,163 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/alonsovidales/pit/rest"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoReq Request used by the test methods
+type echoReq struct {
+	Value string `json:"value"`
+}
+
+// echoResp Response returned by the test methods
+type echoResp struct {
+	Value        string `json:"value"`
+	RequestID    string `json:"request_id"`
+	HostsVisited string `json:"hosts_visited"`
+}
+
+// newTestServer Starts a server with an echo method, a method that returns an
+// error and a slow method, and returns the server and a client for it
+func newTestServer(secret string) (*httptest.Server, *Client) {
+	sv := NewServer(secret)
+	sv.Handle("echo", func(ctx context.Context, body []byte) (interface{}, error) {
+		req := &echoReq{}
+		if err := json.Unmarshal(body, req); err != nil {
+			return nil, err
+		}
+
+		return &echoResp{
+			Value:        req.Value,
+			RequestID:    RequestID(ctx),
+			HostsVisited: HostsVisited(ctx),
+		}, nil
+	})
+	sv.Handle("fail", func(ctx context.Context, body []byte) (interface{}, error) {
+		return nil, &Error{StatusCode: 429, Code: rest.CodeTooManyRequests, Message: "Too many requests"}
+	})
+	sv.Handle("slow", func(ctx context.Context, body []byte) (interface{}, error) {
+		time.Sleep(200 * time.Millisecond)
+		return nil, nil
+	})
+
+	server := httptest.NewServer(sv)
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	return server, NewClient(port, secret, 100*time.Millisecond)
+}
+
+func TestCall(t *testing.T) {
+	server, cl := newTestServer("secret")
+	defer server.Close()
+
+	ctx := WithHostsVisited(WithRequestID(context.Background(), "req-id"), "host1,host2")
+	resp := &echoResp{}
+	if err := cl.Call(ctx, "127.0.0.1", "echo", &echoReq{Value: "test"}, resp); err != nil {
+		t.Fatal("Problem performing the call, Error:", err)
+	}
+	if resp.Value != "test" || resp.RequestID != "req-id" || resp.HostsVisited != "host1,host2" {
+		t.Error("Unexpected response:", resp)
+	}
+
+	// A request ID is generated if the context doesn't contains one
+	if err := cl.Call(context.Background(), "127.0.0.1", "echo", &echoReq{}, resp); err != nil || resp.RequestID == "" {
+		t.Error("Expected a generated request ID, obtained:", resp.RequestID, "Error:", err)
+	}
+
+	err := cl.Call(ctx, "127.0.0.1", "fail", nil, nil)
+	if callErr, ok := err.(*Error); !ok || callErr.StatusCode != 429 || callErr.Code != rest.CodeTooManyRequests {
+		t.Error("Expected too many requests error, obtained:", err)
+	}
+
+	err = cl.Call(ctx, "127.0.0.1", "unknown", nil, nil)
+	if callErr, ok := err.(*Error); !ok || callErr.StatusCode != 404 {
+		t.Error("Expected not found error, obtained:", err)
+	}
+
+	if err = cl.Call(ctx, "127.0.0.1", "slow", nil, nil); err == nil {
+		t.Error("Expected deadline exceeded error")
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	server, _ := newTestServer("secret")
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	err := NewClient(port, "wrong", CDefaultTimeout).Call(context.Background(), "127.0.0.1", "echo", &echoReq{}, nil)
+	if callErr, ok := err.(*Error); !ok || callErr.StatusCode != 401 {
+		t.Error("Expected unauthorized error using a wrong secret, obtained:", err)
+	}
+
+	if err = NewClient(port, "", CDefaultTimeout).Call(context.Background(), "127.0.0.1", "echo", &echoReq{}, nil); err != ErrNoSecret {
+		t.Error("Expected no secret error, obtained:", err)
+	}
+
+	// Tampered and expired calls are rejected
+	body := []byte(`{"value":"test"}`)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	calls := []struct {
+		body      []byte
+		timestamp string
+		signature string
+		expected  int
+	}{
+		{body, timestamp, sign([]byte("secret"), cPrefix+"echo", timestamp, "", "", body), 200},
+		{[]byte(`{"value":"other"}`), timestamp, sign([]byte("secret"), cPrefix+"echo", timestamp, "", "", body), 401},
+		{body, expired, sign([]byte("secret"), cPrefix+"echo", expired, "", "", body), 401},
+		{body, timestamp, "", 401},
+	}
+	for i, call := range calls {
+		req, _ := http.NewRequest("POST", server.URL+cPrefix+"echo", bytes.NewReader(call.body))
+		req.Header.Set(cTimestampHeader, call.timestamp)
+		req.Header.Set(cSignatureHeader, call.signature)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Problem performing the call:", i, "Error:", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != call.expected {
+			t.Error("Call:", i, "expected status:", call.expected, "obtained:", resp.StatusCode)
+		}
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	server, cl := newTestServer("secret")
+	server.Close()
+
+	var conns int32
+	server = httptest.NewUnstartedServer(server.Config.Handler)
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	cl.port, _ = strconv.Atoi(serverURL.Port())
+
+	for i := 0; i < 10; i++ {
+		if err := cl.Call(context.Background(), "127.0.0.1", "echo", &echoReq{}, nil); err != nil {
+			t.Fatal("Problem performing the call, Error:", err)
+		}
+	}
+	if conns != 1 {
+		t.Error("Expected a single connection, opened:", conns)
+	}
+}
@@ -0,0 +1,559 @@
+package grpcapi
+
+import (
+	"errors"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+)
+
+// ErrMalformedMessage The received bytes can't be decoded as the expected
+// message
+var ErrMalformedMessage = errors.New("Malformed message")
+
+// ErrScoreOutOfRange One of the received scores doesn't fit on the 0 to 255
+// range accepted by the recommender
+var ErrScoreOutOfRange = errors.New("The scores have to be between 0 and 255")
+
+// Message Interface implemented by all the messages of the service, the
+// encoding follows the protobuf wire format defined on pit.proto
+type Message interface {
+	Marshal() []byte
+	Unmarshal(b []byte) error
+}
+
+// RecommendRequest Request of recommendations for a record
+type RecommendRequest struct {
+	UID     string
+	Key     string
+	Group   string
+	ID      uint64
+	Scores  map[uint64]uint8
+	MaxRecs int
+
+	invalid error
+}
+
+// RecommendResponse Recommendations for a record
+type RecommendResponse struct {
+	Success        bool
+	Status         string
+	StoredElements uint64
+	ReqsSec        uint64
+	Recs           []uint64
+	Fallback       bool
+}
+
+// InsertRequest Scores of a record to be stored
+type InsertRequest struct {
+	UID    string
+	Key    string
+	Group  string
+	ID     uint64
+	Scores map[uint64]uint8
+
+	invalid error
+}
+
+// InsertResponse Result of an insert request
+type InsertResponse struct {
+	Success        bool
+	StoredElements uint64
+	ReqsSec        uint64
+}
+
+// ScoresRequest Request of the average scores of some items
+type ScoresRequest struct {
+	UID   string
+	Key   string
+	Group string
+	Items []uint64
+}
+
+// ScoresResponse Average scores by item ID
+type ScoresResponse struct {
+	Success        bool
+	StoredElements uint64
+	ReqsSec        uint64
+	Scores         map[uint64]float64
+	Fallback       bool
+}
+
+// GroupInfoRequest Request of the statistics of a group
+type GroupInfoRequest struct {
+	UID   string
+	Key   string
+	Group string
+}
+
+// ShardStats Statistics of a single shard
+type ShardStats struct {
+	StoredElements uint64
+	RecTreeStatus  string
+	QueriesBySec   []uint64
+	QueriesByMin   []uint64
+	RecTreeError   string
+}
+
+// GroupInfoResponse Statistics of all the shards of a group by host name
+type GroupInfoResponse struct {
+	Shards map[string]*ShardStats
+}
+
+// BulkInsertResponse Result of a stream of inserts
+type BulkInsertResponse struct {
+	Inserted uint64
+	Failed   uint64
+}
+
+// Marshal Encodes the message
+func (m *RecommendRequest) Marshal() (b []byte) {
+	b = appendString(b, 1, m.UID)
+	b = appendString(b, 2, m.Key)
+	b = appendString(b, 3, m.Group)
+	b = appendUint(b, 4, m.ID)
+	b = appendScores(b, 5, m.Scores)
+	return appendUint(b, 6, uint64(m.MaxRecs))
+}
+
+// Validate Returns ErrScoreOutOfRange if any of the decoded scores was out of
+// range, the decoding doesn't fail in order to allow the service to reject the
+// request as an invalid argument
+func (m *RecommendRequest) Validate() error {
+	return m.invalid
+}
+
+// Unmarshal Decodes the message
+func (m *RecommendRequest) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) (err error) {
+		switch num {
+		case 1:
+			m.UID = string(v)
+		case 2:
+			m.Key = string(v)
+		case 3:
+			m.Group = string(v)
+		case 4:
+			m.ID = n
+		case 5:
+			if m.Scores == nil {
+				m.Scores = make(map[uint64]uint8)
+			}
+			if err = consumeScore(v, m.Scores); err == ErrScoreOutOfRange {
+				m.invalid, err = err, nil
+			}
+		case 6:
+			m.MaxRecs = int(n)
+		}
+		return
+	})
+}
+
+// Marshal Encodes the message
+func (m *RecommendResponse) Marshal() (b []byte) {
+	b = appendBool(b, 1, m.Success)
+	b = appendString(b, 2, m.Status)
+	b = appendUint(b, 3, m.StoredElements)
+	b = appendUint(b, 4, m.ReqsSec)
+	b = appendPacked(b, 5, m.Recs)
+	return appendBool(b, 6, m.Fallback)
+}
+
+// Unmarshal Decodes the message
+func (m *RecommendResponse) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) (err error) {
+		switch num {
+		case 1:
+			m.Success = n != 0
+		case 2:
+			m.Status = string(v)
+		case 3:
+			m.StoredElements = n
+		case 4:
+			m.ReqsSec = n
+		case 5:
+			m.Recs, err = consumeRepeated(typ, v, n, m.Recs)
+		case 6:
+			m.Fallback = n != 0
+		}
+		return
+	})
+}
+
+// Marshal Encodes the message
+func (m *InsertRequest) Marshal() (b []byte) {
+	b = appendString(b, 1, m.UID)
+	b = appendString(b, 2, m.Key)
+	b = appendString(b, 3, m.Group)
+	b = appendUint(b, 4, m.ID)
+	return appendScores(b, 5, m.Scores)
+}
+
+// Validate Returns ErrScoreOutOfRange if any of the decoded scores was out of
+// range
+func (m *InsertRequest) Validate() error {
+	return m.invalid
+}
+
+// Unmarshal Decodes the message
+func (m *InsertRequest) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) (err error) {
+		switch num {
+		case 1:
+			m.UID = string(v)
+		case 2:
+			m.Key = string(v)
+		case 3:
+			m.Group = string(v)
+		case 4:
+			m.ID = n
+		case 5:
+			if m.Scores == nil {
+				m.Scores = make(map[uint64]uint8)
+			}
+			if err = consumeScore(v, m.Scores); err == ErrScoreOutOfRange {
+				m.invalid, err = err, nil
+			}
+		}
+		return
+	})
+}
+
+// Marshal Encodes the message
+func (m *InsertResponse) Marshal() (b []byte) {
+	b = appendBool(b, 1, m.Success)
+	b = appendUint(b, 2, m.StoredElements)
+	return appendUint(b, 3, m.ReqsSec)
+}
+
+// Unmarshal Decodes the message
+func (m *InsertResponse) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) (err error) {
+		switch num {
+		case 1:
+			m.Success = n != 0
+		case 2:
+			m.StoredElements = n
+		case 3:
+			m.ReqsSec = n
+		}
+		return
+	})
+}
+
+// Marshal Encodes the message
+func (m *ScoresRequest) Marshal() (b []byte) {
+	b = appendString(b, 1, m.UID)
+	b = appendString(b, 2, m.Key)
+	b = appendString(b, 3, m.Group)
+	return appendPacked(b, 4, m.Items)
+}
+
+// Unmarshal Decodes the message
+func (m *ScoresRequest) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) (err error) {
+		switch num {
+		case 1:
+			m.UID = string(v)
+		case 2:
+			m.Key = string(v)
+		case 3:
+			m.Group = string(v)
+		case 4:
+			m.Items, err = consumeRepeated(typ, v, n, m.Items)
+		}
+		return
+	})
+}
+
+// Marshal Encodes the message
+func (m *ScoresResponse) Marshal() (b []byte) {
+	b = appendBool(b, 1, m.Success)
+	b = appendUint(b, 2, m.StoredElements)
+	b = appendUint(b, 3, m.ReqsSec)
+	for k, v := range m.Scores {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.VarintType)
+		entry = protowire.AppendVarint(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.Fixed64Type)
+		entry = protowire.AppendFixed64(entry, math.Float64bits(v))
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	return appendBool(b, 5, m.Fallback)
+}
+
+// Unmarshal Decodes the message
+func (m *ScoresResponse) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) (err error) {
+		switch num {
+		case 1:
+			m.Success = n != 0
+		case 2:
+			m.StoredElements = n
+		case 3:
+			m.ReqsSec = n
+		case 4:
+			var k, score uint64
+			err = consumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+				if num == 1 {
+					k = n
+				} else if num == 2 {
+					score = n
+				}
+				return nil
+			})
+			if m.Scores == nil {
+				m.Scores = make(map[uint64]float64)
+			}
+			m.Scores[k] = math.Float64frombits(score)
+		case 5:
+			m.Fallback = n != 0
+		}
+		return
+	})
+}
+
+// Marshal Encodes the message
+func (m *GroupInfoRequest) Marshal() (b []byte) {
+	b = appendString(b, 1, m.UID)
+	b = appendString(b, 2, m.Key)
+	return appendString(b, 3, m.Group)
+}
+
+// Unmarshal Decodes the message
+func (m *GroupInfoRequest) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) (err error) {
+		switch num {
+		case 1:
+			m.UID = string(v)
+		case 2:
+			m.Key = string(v)
+		case 3:
+			m.Group = string(v)
+		}
+		return
+	})
+}
+
+// Marshal Encodes the message
+func (m *ShardStats) Marshal() (b []byte) {
+	b = appendUint(b, 1, m.StoredElements)
+	b = appendString(b, 2, m.RecTreeStatus)
+	b = appendPacked(b, 3, m.QueriesBySec)
+	b = appendPacked(b, 4, m.QueriesByMin)
+	return appendString(b, 5, m.RecTreeError)
+}
+
+// Unmarshal Decodes the message
+func (m *ShardStats) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) (err error) {
+		switch num {
+		case 1:
+			m.StoredElements = n
+		case 2:
+			m.RecTreeStatus = string(v)
+		case 3:
+			m.QueriesBySec, err = consumeRepeated(typ, v, n, m.QueriesBySec)
+		case 4:
+			m.QueriesByMin, err = consumeRepeated(typ, v, n, m.QueriesByMin)
+		case 5:
+			m.RecTreeError = string(v)
+		}
+		return
+	})
+}
+
+// Marshal Encodes the message
+func (m *GroupInfoResponse) Marshal() (b []byte) {
+	for host, stats := range m.Shards {
+		var entry []byte
+		entry = appendString(entry, 1, host)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, stats.Marshal())
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	return
+}
+
+// Unmarshal Decodes the message
+func (m *GroupInfoResponse) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) (err error) {
+		if num != 1 {
+			return
+		}
+
+		var host string
+		stats := &ShardStats{}
+		err = consumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+			if num == 1 {
+				host = string(v)
+			} else if num == 2 {
+				return stats.Unmarshal(v)
+			}
+			return nil
+		})
+		if m.Shards == nil {
+			m.Shards = make(map[string]*ShardStats)
+		}
+		m.Shards[host] = stats
+
+		return
+	})
+}
+
+// Marshal Encodes the message
+func (m *BulkInsertResponse) Marshal() (b []byte) {
+	b = appendUint(b, 1, m.Inserted)
+	return appendUint(b, 2, m.Failed)
+}
+
+// Unmarshal Decodes the message
+func (m *BulkInsertResponse) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) (err error) {
+		switch num {
+		case 1:
+			m.Inserted = n
+		case 2:
+			m.Failed = n
+		}
+		return
+	})
+}
+
+// appendString Appends a string field, empty values are omitted as proto3
+// does
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendUint Appends a varint field, zero values are omitted
+func appendUint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendBool Appends a boolean field, false values are omitted
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+// appendPacked Appends a packed repeated varint field
+func appendPacked(b []byte, num protowire.Number, values []uint64) []byte {
+	if len(values) == 0 {
+		return b
+	}
+	var packed []byte
+	for _, v := range values {
+		packed = protowire.AppendVarint(packed, v)
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, packed)
+}
+
+// appendScores Appends a map<uint64, uint32> field with the scores by item
+func appendScores(b []byte, num protowire.Number, scores map[uint64]uint8) []byte {
+	for k, v := range scores {
+		var entry []byte
+		entry = appendUint(entry, 1, k)
+		entry = appendUint(entry, 2, uint64(v))
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	return b
+}
+
+// consumeScore Decodes a single entry of a map<uint64, uint32> field
+func consumeScore(entry []byte, scores map[uint64]uint8) error {
+	var k, score uint64
+	err := consumeFields(entry, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		if num == 1 {
+			k = n
+		} else if num == 2 {
+			score = n
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if score > math.MaxUint8 {
+		return ErrScoreOutOfRange
+	}
+	scores[k] = uint8(score)
+
+	return nil
+}
+
+// consumeRepeated Decodes a repeated varint field on both, packed and
+// unpacked representations
+func consumeRepeated(typ protowire.Type, v []byte, n uint64, values []uint64) ([]uint64, error) {
+	if typ == protowire.VarintType {
+		return append(values, n), nil
+	}
+
+	for len(v) > 0 {
+		value, l := protowire.ConsumeVarint(v)
+		if l < 0 {
+			return values, ErrMalformedMessage
+		}
+		values = append(values, value)
+		v = v[l:]
+	}
+
+	return values, nil
+}
+
+// consumeFields Iterates over all the fields of the encoded message calling to
+// fn with the content for bytes fields, or the numeric value for varint and
+// fixed fields
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return ErrMalformedMessage
+		}
+		b = b[l:]
+
+		var v []byte
+		var n uint64
+		switch typ {
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			n, l = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var n32 uint32
+			n32, l = protowire.ConsumeFixed32(b)
+			n = uint64(n32)
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if l < 0 {
+			return ErrMalformedMessage
+		}
+		b = b[l:]
+
+		if err := fn(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
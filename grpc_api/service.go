@@ -0,0 +1,283 @@
+package grpcapi
+
+// Package that provides the gRPC service used by the backend services to
+// request recommendations and insert records without pay the cost of the form
+// encoding of the HTTP API. The messages are encoded using the protobuf wire
+// format defined on pit.proto, so any gRPC client generated from it can be
+// used
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// CServiceName Full name of the gRPC service
+	CServiceName = "pit.Recommender"
+)
+
+// RecommenderServer Interface to be implemented in order to attend the
+// requests of the service
+type RecommenderServer interface {
+	Recommend(ctx context.Context, req *RecommendRequest) (*RecommendResponse, error)
+	Insert(ctx context.Context, req *InsertRequest) (*InsertResponse, error)
+	Scores(ctx context.Context, req *ScoresRequest) (*ScoresResponse, error)
+	GroupInfo(ctx context.Context, req *GroupInfoRequest) (*GroupInfoResponse, error)
+	BulkInsert(stream BulkInsertServer) error
+}
+
+// BulkInsertServer Server side of a bulk insert stream
+type BulkInsertServer interface {
+	Recv() (*InsertRequest, error)
+	SendAndClose(*BulkInsertResponse) error
+	Context() context.Context
+}
+
+// BulkInsertClient Client side of a bulk insert stream
+type BulkInsertClient interface {
+	Send(*InsertRequest) error
+	CloseAndRecv() (*BulkInsertResponse, error)
+}
+
+// Client gRPC client for the service
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+// codec Codec that encodes and decodes the messages of the service
+type codec struct{}
+
+// Marshal Encodes a message
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(Message)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported message type: %T", v)
+	}
+
+	return m.Marshal(), nil
+}
+
+// Unmarshal Decodes a message
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(Message)
+	if !ok {
+		return fmt.Errorf("Unsupported message type: %T", v)
+	}
+
+	return m.Unmarshal(data)
+}
+
+// Name Returns the name of the codec, the messages are compatible with the
+// standard protobuf codec
+func (codec) Name() string {
+	return "proto"
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: CServiceName,
+	HandlerType: (*RecommenderServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Recommend",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &RecommendRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if err := req.Validate(); err != nil {
+					return nil, status.Error(codes.InvalidArgument, err.Error())
+				}
+				return unary(ctx, req, "Recommend", interceptor, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(RecommenderServer).Recommend(ctx, req.(*RecommendRequest))
+				})
+			},
+		},
+		{
+			MethodName: "Insert",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &InsertRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if err := req.Validate(); err != nil {
+					return nil, status.Error(codes.InvalidArgument, err.Error())
+				}
+				return unary(ctx, req, "Insert", interceptor, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(RecommenderServer).Insert(ctx, req.(*InsertRequest))
+				})
+			},
+		},
+		{
+			MethodName: "Scores",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &ScoresRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return unary(ctx, req, "Scores", interceptor, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(RecommenderServer).Scores(ctx, req.(*ScoresRequest))
+				})
+			},
+		},
+		{
+			MethodName: "GroupInfo",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &GroupInfoRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return unary(ctx, req, "GroupInfo", interceptor, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(RecommenderServer).GroupInfo(ctx, req.(*GroupInfoRequest))
+				})
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "BulkInsert",
+			ClientStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(RecommenderServer).BulkInsert(&bulkInsertServer{stream})
+			},
+		},
+	},
+	Metadata: "pit.proto",
+}
+
+// unary Calls to the handler through the interceptor if any
+func unary(ctx context.Context, req interface{}, method string, interceptor grpc.UnaryServerInterceptor, handler grpc.UnaryHandler) (interface{}, error) {
+	if interceptor == nil {
+		return handler(ctx, req)
+	}
+
+	return interceptor(ctx, req, &grpc.UnaryServerInfo{
+		FullMethod: "/" + CServiceName + "/" + method,
+	}, handler)
+}
+
+// bulkInsertServer BulkInsertServer implementation over a gRPC stream
+type bulkInsertServer struct {
+	grpc.ServerStream
+}
+
+// Recv Returns the next record of the stream
+func (s *bulkInsertServer) Recv() (*InsertRequest, error) {
+	req := &InsertRequest{}
+	if err := s.ServerStream.RecvMsg(req); err != nil {
+		return nil, err
+	}
+	if err := req.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return req, nil
+}
+
+// SendAndClose Sends the result of the bulk insert to the client
+func (s *bulkInsertServer) SendAndClose(resp *BulkInsertResponse) error {
+	return s.ServerStream.SendMsg(resp)
+}
+
+// bulkInsertClient BulkInsertClient implementation over a gRPC stream
+type bulkInsertClient struct {
+	grpc.ClientStream
+}
+
+// Send Sends a record to be stored
+func (c *bulkInsertClient) Send(req *InsertRequest) error {
+	return c.ClientStream.SendMsg(req)
+}
+
+// CloseAndRecv Closes the stream and returns the result of the bulk insert
+func (c *bulkInsertClient) CloseAndRecv() (*BulkInsertResponse, error) {
+	if err := c.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	resp := &BulkInsertResponse{}
+	if err := c.ClientStream.RecvMsg(resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// NewServer Returns a gRPC server with the service registered using the given
+// implementation
+func NewServer(srv RecommenderServer, opts ...grpc.ServerOption) (server *grpc.Server) {
+	server = grpc.NewServer(append(opts, grpc.ForceServerCodec(codec{}))...)
+	server.RegisterService(&serviceDesc, srv)
+
+	return
+}
+
+// Dial Returns a client connected to the service on the given address
+func Dial(addr string, opts ...grpc.DialOption) (cl *Client, err error) {
+	conn, err := grpc.Dial(addr, append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})),
+	}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{conn: conn}, nil
+}
+
+// Close Closes the connection of the client
+func (cl *Client) Close() error {
+	return cl.conn.Close()
+}
+
+// Recommend Requests recommendations for a record
+func (cl *Client) Recommend(ctx context.Context, req *RecommendRequest, opts ...grpc.CallOption) (resp *RecommendResponse, err error) {
+	resp = &RecommendResponse{}
+	if err = cl.conn.Invoke(ctx, "/"+CServiceName+"/Recommend", req, resp, opts...); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Insert Stores the scores of a record
+func (cl *Client) Insert(ctx context.Context, req *InsertRequest, opts ...grpc.CallOption) (resp *InsertResponse, err error) {
+	resp = &InsertResponse{}
+	if err = cl.conn.Invoke(ctx, "/"+CServiceName+"/Insert", req, resp, opts...); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Scores Requests the average scores of some items
+func (cl *Client) Scores(ctx context.Context, req *ScoresRequest, opts ...grpc.CallOption) (resp *ScoresResponse, err error) {
+	resp = &ScoresResponse{}
+	if err = cl.conn.Invoke(ctx, "/"+CServiceName+"/Scores", req, resp, opts...); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// GroupInfo Requests the statistics of all the shards of a group
+func (cl *Client) GroupInfo(ctx context.Context, req *GroupInfoRequest, opts ...grpc.CallOption) (resp *GroupInfoResponse, err error) {
+	resp = &GroupInfoResponse{}
+	if err = cl.conn.Invoke(ctx, "/"+CServiceName+"/GroupInfo", req, resp, opts...); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// BulkInsert Opens a stream to send records to be stored
+func (cl *Client) BulkInsert(ctx context.Context, opts ...grpc.CallOption) (BulkInsertClient, error) {
+	stream, err := cl.conn.NewStream(ctx, &serviceDesc.Streams[0], "/"+CServiceName+"/BulkInsert", opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bulkInsertClient{stream}, nil
+}
@@ -0,0 +1,221 @@
+package grpcapi
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type testServer struct{}
+
+func (testServer) Recommend(ctx context.Context, req *RecommendRequest) (*RecommendResponse, error) {
+	recs := []uint64{}
+	for k := range req.Scores {
+		recs = append(recs, k+1)
+	}
+
+	return &RecommendResponse{Success: true, Recs: recs, ReqsSec: uint64(req.MaxRecs)}, nil
+}
+
+func (testServer) Insert(ctx context.Context, req *InsertRequest) (*InsertResponse, error) {
+	return &InsertResponse{Success: true, StoredElements: req.ID}, nil
+}
+
+func (testServer) Scores(ctx context.Context, req *ScoresRequest) (*ScoresResponse, error) {
+	scores := make(map[uint64]float64)
+	for _, item := range req.Items {
+		scores[item] = float64(item) / 2
+	}
+
+	return &ScoresResponse{Success: true, Scores: scores}, nil
+}
+
+func (testServer) GroupInfo(ctx context.Context, req *GroupInfoRequest) (*GroupInfoResponse, error) {
+	return &GroupInfoResponse{
+		Shards: map[string]*ShardStats{
+			"host1": &ShardStats{StoredElements: 10, RecTreeStatus: "ACTIVE", QueriesBySec: []uint64{0, 1, 2}},
+		},
+	}, nil
+}
+
+func (testServer) BulkInsert(stream BulkInsertServer) error {
+	resp := &BulkInsertResponse{}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(resp)
+		}
+		if err != nil {
+			return err
+		}
+		if len(req.Scores) > 0 {
+			resp.Inserted++
+		} else {
+			resp.Failed++
+		}
+	}
+}
+
+func TestMessagesEncoding(t *testing.T) {
+	req := &RecommendRequest{
+		UID:     "user@test.com",
+		Key:     "key",
+		Group:   "group:1234",
+		ID:      1 << 40,
+		Scores:  map[uint64]uint8{1: 5, 300: 1, 1 << 33: 3},
+		MaxRecs: 10,
+	}
+	decoded := &RecommendRequest{}
+	if err := decoded.Unmarshal(req.Marshal()); err != nil {
+		t.Fatal("Problem decoding the message, Error:", err)
+	}
+	if !reflect.DeepEqual(req, decoded) {
+		t.Error("Decoded message:", decoded, "doesn't match with the original:", req)
+	}
+
+	info := &GroupInfoResponse{
+		Shards: map[string]*ShardStats{
+			"host1": &ShardStats{StoredElements: 10, RecTreeStatus: "ACTIVE", QueriesBySec: []uint64{0, 1, 2}},
+			"host2": &ShardStats{RecTreeStatus: "RECOVERING", RecTreeError: "load_backup: unavailable"},
+		},
+	}
+	decodedInfo := &GroupInfoResponse{}
+	if err := decodedInfo.Unmarshal(info.Marshal()); err != nil {
+		t.Fatal("Problem decoding the message, Error:", err)
+	}
+	if !reflect.DeepEqual(info, decodedInfo) {
+		t.Error("Decoded message:", decodedInfo, "doesn't match with the original:", info)
+	}
+
+	if err := decoded.Unmarshal([]byte{0x0a, 0xff}); err != ErrMalformedMessage {
+		t.Error("Expected malformed message error, obtained:", err)
+	}
+}
+
+func TestService(t *testing.T) {
+	lis := bufconn.Listen(1 << 20)
+	server := NewServer(testServer{})
+	go server.Serve(lis)
+	defer server.Stop()
+
+	cl, err := Dial("bufnet", grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	if err != nil {
+		t.Fatal("Problem connecting to the server, Error:", err)
+	}
+	defer cl.Close()
+
+	ctx := context.Background()
+	recs, err := cl.Recommend(ctx, &RecommendRequest{Scores: map[uint64]uint8{1: 5}, MaxRecs: 3})
+	if err != nil || !recs.Success || len(recs.Recs) != 1 || recs.Recs[0] != 2 || recs.ReqsSec != 3 {
+		t.Error("Unexpected recommendations:", recs, "Error:", err)
+	}
+
+	scores, err := cl.Scores(ctx, &ScoresRequest{Items: []uint64{2, 4}})
+	if err != nil || scores.Scores[2] != 1 || scores.Scores[4] != 2 {
+		t.Error("Unexpected scores:", scores, "Error:", err)
+	}
+
+	info, err := cl.GroupInfo(ctx, &GroupInfoRequest{})
+	if err != nil || info.Shards["host1"] == nil || info.Shards["host1"].StoredElements != 10 {
+		t.Error("Unexpected group info:", info, "Error:", err)
+	}
+
+	stream, err := cl.BulkInsert(ctx)
+	if err != nil {
+		t.Fatal("Problem opening the bulk insert stream, Error:", err)
+	}
+	for i := uint64(0); i < 10; i++ {
+		scores := map[uint64]uint8{i: 1}
+		if i%2 == 0 {
+			scores = nil
+		}
+		if err = stream.Send(&InsertRequest{ID: i, Scores: scores}); err != nil {
+			t.Fatal("Problem sending record, Error:", err)
+		}
+	}
+	result, err := stream.CloseAndRecv()
+	if err != nil || result.Inserted != 5 || result.Failed != 5 {
+		t.Error("Unexpected bulk insert result:", result, "Error:", err)
+	}
+}
+
+// rawMessage Message already encoded, used to send values that can't be
+// represented by the typed messages
+type rawMessage []byte
+
+func (m rawMessage) Marshal() []byte {
+	return m
+}
+
+func (m rawMessage) Unmarshal(b []byte) error {
+	return nil
+}
+
+// scoreEntry Encodes a record with a single score without checking the range
+func scoreEntry(item, score uint64) rawMessage {
+	var entry []byte
+	entry = protowire.AppendTag(entry, 1, protowire.VarintType)
+	entry = protowire.AppendVarint(entry, item)
+	entry = protowire.AppendTag(entry, 2, protowire.VarintType)
+	entry = protowire.AppendVarint(entry, score)
+
+	b := protowire.AppendTag(nil, 5, protowire.BytesType)
+	return protowire.AppendBytes(b, entry)
+}
+
+func TestScoreOutOfRange(t *testing.T) {
+	req := &InsertRequest{}
+	if err := req.Unmarshal(scoreEntry(1, 255)); err != nil || req.Validate() != nil || req.Scores[1] != 255 {
+		t.Error("The max score should be accepted, scores:", req.Scores, "Error:", err)
+	}
+
+	req = &InsertRequest{}
+	if err := req.Unmarshal(scoreEntry(1, 300)); err != nil || req.Validate() != ErrScoreOutOfRange {
+		t.Error("Expected out of range score on validation, obtained:", req.Validate(), "Error:", err)
+	}
+	if _, ok := req.Scores[1]; ok {
+		t.Error("The out of range score shouldn't be truncated and stored:", req.Scores)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := NewServer(testServer{})
+	go server.Serve(lis)
+	defer server.Stop()
+
+	cl, err := Dial("bufnet", grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	if err != nil {
+		t.Fatal("Problem connecting to the server, Error:", err)
+	}
+	defer cl.Close()
+
+	ctx := context.Background()
+	for _, method := range []string{"Recommend", "Insert"} {
+		err = cl.conn.Invoke(ctx, "/"+CServiceName+"/"+method, scoreEntry(1, 300), &InsertResponse{})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Error("Expected invalid argument for method:", method, "obtained:", err)
+		}
+	}
+
+	stream, err := cl.conn.NewStream(ctx, &serviceDesc.Streams[0], "/"+CServiceName+"/BulkInsert")
+	if err != nil {
+		t.Fatal("Problem opening the bulk insert stream, Error:", err)
+	}
+	if err = stream.SendMsg(scoreEntry(1, 300)); err != nil {
+		t.Fatal("Problem sending record, Error:", err)
+	}
+	_, err = (&bulkInsertClient{stream}).CloseAndRecv()
+	if status.Code(err) != codes.InvalidArgument {
+		t.Error("Expected invalid argument on the bulk insert, obtained:", err)
+	}
+}
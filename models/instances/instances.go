@@ -1,8 +1,10 @@
 package instances
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/alonsovidales/pit/log"
+	"github.com/alonsovidales/pit/models/storage"
 	"github.com/goamz/goamz/aws"
 	"github.com/goamz/goamz/dynamodb"
 	"os"
@@ -22,6 +24,37 @@ const (
 	cDefaultWRCapacity = 5
 	// cTTL time in seconds to wait until set as instance as abandoned
 	cTTL = 30
+	// cChangesTable DynamoDB table where the changes of the instances are
+	// published
+	cChangesTable = "instances_changes"
+	// cPublishPeriod Max seconds between two registrations of the local
+	// instance, the instance is registered before if its bid changes
+	cPublishPeriod = cTTL / 3
+	// cResyncPeriod Seconds between two full loads of the instances table,
+	// between them only the registrations published are loaded
+	cResyncPeriod = 60
+	// cBidChange Relative change of the resources of the local instance
+	// that requires to publish its bid
+	cBidChange = 0.1
+	// cMinDemandChange Min change of the requests / sec received for a
+	// group that requires to publish the bid, avoids publish the bid for
+	// the small variations of the groups with low traffic
+	cMinDemandChange = 1.0
+	// cLeaderTable DynamoDB table that stores the lease of the leader, the
+	// lease is not stored on the instances table since all the rows of
+	// that table are considered instances
+	cLeaderTable = "leader"
+	// cLeaderPrimKey Primary key of the leader table
+	cLeaderPrimKey = "lease"
+	// cLeaderKey Key of the item of the leader table that stores the lease
+	// of the leader of the cluster
+	cLeaderKey = "cluster"
+	// cLeaderTTL Seconds after which the lease of the leader expires if it
+	// is not kept alive
+	cLeaderTTL = 20
+	// cPruneChangesPeriod Time between two removals of the old changes of
+	// the feed by the leader, see storage.ChangeFeed.Prune
+	cPruneChangesPeriod = 10 * time.Minute
 )
 
 // ModelInt Interface used to control the content on the persistence table
@@ -30,19 +63,75 @@ type ModelInt interface {
 	GetTotalInstances() int
 	// GetInstances Returns the host name of all the active instances
 	GetInstances() (instances []string)
-	// GetMaxShardsToAcquire Returns the max number of shards that still
-	// has to be adquired for a group
-	GetMaxShardsToAcquire(totalShards int) int
+	// SetLocalBid Sets the resources of the local instance to be
+	// published on the instances table
+	SetLocalBid(bid Bid)
+	// GetBids Returns the last published bid of each active instance by
+	// host name
+	GetBids() map[string]Bid
+	// HostName Returns the host name of the local instance
+	HostName() string
+	// IsLeader Returns if the local instance is the leader of the cluster,
+	// the only one that runs the cluster-wide tasks
+	IsLeader() bool
+}
+
+// Bid Resources of an instance published on the instances table, used to
+// decide which instance acquires each free shard
+type Bid struct {
+	// HostName Host name of the instance
+	HostName string
+	// Zone Availability zone of the instance, empty if unknown
+	Zone string
+	// FreeMem Bytes of memory that can still be allocated by new shards
+	FreeMem uint64
+	// BytesByElem Bytes of memory used by each element stored on the
+	// shards of the instance, zero if unknown
+	BytesByElem float64
+	// Load CPU load of the instance divided by the number of CPUs
+	Load float64
+	// QPS Number of queries / sec attended by the shards of the instance
+	QPS uint64
+	// Demand Requests / sec received by the instance from the clients by
+	// rate limit key of the groups, used to share the rate limits of the
+	// groups between the instances
+	Demand map[string]float64
 }
 
 // Model Manages the accesses to the DynamoDB table
 type Model struct {
 	prefix         string
-	table          *dynamodb.Table
+	hostName       string
+	table          storage.Table
 	instancesAlive []string
+	bids           map[string]Bid
+	localBid       Bid
 	conn           *dynamodb.Server
 	tableName      string
 	mutex          sync.Mutex
+
+	// feed Registrations of the instances identified by host name
+	feed     *storage.ChangeFeed
+	follower *storage.Follower
+	// registered Last bid and registration time stamp of each instance by
+	// host name, including the expired ones
+	registered map[string]registration
+	// published Last bid of the local instance published and when it was
+	// published, only accessed by the keep alive process
+	published registration
+	// leader Lease of the leader of the cluster stored on the leader
+	// table, nil if the local instance is not registered
+	leader      *storage.Lease
+	leaderTable storage.Table
+	// lastPrune Last time that the old changes of the feed were removed,
+	// only accessed by the keep alive process
+	lastPrune time.Time
+}
+
+// registration Bid of an instance and the time stamp when it was registered
+type registration struct {
+	bid Bid
+	ts  int64
 }
 
 type byName []string
@@ -72,6 +161,16 @@ func SetHostname(hn string) {
 	hostName = hn
 }
 
+// HostName Returns the host name of the local instance, the one of the machine
+// if the model was not created for a specific host
+func (im *Model) HostName() string {
+	if im.hostName == "" {
+		return hostName
+	}
+
+	return im.hostName
+}
+
 // InitAndKeepAlive Initializes the table, connection, etc and keeps a process
 // in background to update all the information
 func InitAndKeepAlive(prefix string, awsRegion string, keepAlive bool) (im *Model) {
@@ -84,21 +183,10 @@ func InitAndKeepAlive(prefix string, awsRegion string, keepAlive bool) (im *Mode
 				Region: aws.Regions[awsRegion],
 			},
 		}
-		im.initTable()
-
-		if keepAlive {
-			im.registerHostName(hostName)
-		}
-		im.updateInstances()
-		if keepAlive {
-			go func() {
-				for {
-					im.registerHostName(hostName)
-					im.updateInstances()
-					time.Sleep(time.Second)
-				}
-			}()
-		}
+		im.table = im.initTable(im.tableName, cPrimKey)
+		im.feed = storage.NewChangeFeed(im.initTable(fmt.Sprintf("%s_%s", prefix, cChangesTable), storage.CChangesPrimKey))
+		im.leaderTable = im.initTable(fmt.Sprintf("%s_%s", prefix, cLeaderTable), cLeaderPrimKey)
+		im.start(keepAlive)
 	} else {
 		log.Error("Problem trying to connect with DynamoDB, Error:", err)
 		return
@@ -107,27 +195,181 @@ func InitAndKeepAlive(prefix string, awsRegion string, keepAlive bool) (im *Mode
 	return
 }
 
-// GetMaxShardsToAcquire Returns the max number of shards that still has to be
-// adquired for a group
-func (im *Model) GetMaxShardsToAcquire(totalShards int) (total int) {
+// NewModel Returns a model that stores the instances on the given table, in
+// case of keepAlive is true, the local instance is registered and a process in
+// background keeps updated all the information. The registrations are
+// published on a feed, and the lease of the leader is stored, on tables only
+// visible by this model
+func NewModel(table storage.Table, keepAlive bool) (im *Model) {
+	return NewModelForHost(table, storage.NewMemTable(), storage.NewMemTable(), "", keepAlive)
+}
+
+// NewModelForHost Returns a model as NewModel that publishes the registrations
+// on the given changes table and stores the lease of the leader on the given
+// leader table, where the local instance is registered with the given host
+// name instead of the one of the machine, allowing to run many instances on the
+// same process
+func NewModelForHost(table, changesTable, leaderTable storage.Table, hostName string, keepAlive bool) (im *Model) {
+	im = &Model{
+		table:       table,
+		feed:        storage.NewChangeFeed(changesTable),
+		leaderTable: leaderTable,
+		hostName:    hostName,
+	}
+	im.start(keepAlive)
+
+	return
+}
+
+// start Loads the list of active instances and registers the local one in
+// case of keepAlive is true, the registrations of the other instances are
+// read from the changes feed
+func (im *Model) start(keepAlive bool) {
+	im.follower = storage.NewFollower(im.feed, time.Second*cResyncPeriod, im.applyChanges, im.updateInstances)
+	if keepAlive {
+		im.registerHostName(im.HostName())
+		im.leader = storage.NewLease(im.leaderTable, cLeaderKey, cLeaderPrimKey, im.HostName(), cLeaderTTL)
+	}
+	im.follower.Sync()
+	if keepAlive {
+		go func() {
+			for {
+				im.keepLeadership()
+				im.pruneChanges()
+				time.Sleep(time.Second)
+				im.keepRegistered()
+				im.follower.Sync()
+				im.refresh()
+			}
+		}()
+	}
+}
+
+// keepLeadership Acquires the lease of the leader if it is free or expired, or
+// keeps it alive if the local instance is the leader
+func (im *Model) keepLeadership() {
+	wasLeader := im.leader.Held()
+	if leader := im.leader.Keep(); leader != wasLeader {
+		if leader {
+			log.Info("This instance is now the leader of the cluster:", im.HostName())
+		} else {
+			log.Info("This instance is not the leader of the cluster anymore:", im.HostName())
+		}
+	}
+}
+
+// pruneChanges Removes the old changes of the feed each cPruneChangesPeriod if
+// the local instance is the leader
+func (im *Model) pruneChanges() {
+	if !im.IsLeader() || time.Since(im.lastPrune) < cPruneChangesPeriod {
+		return
+	}
+	im.lastPrune = time.Now()
+
+	if removed, err := im.feed.Prune(); err != nil {
+		log.Error("Problem trying to remove the old changes of the instances, Error:", err)
+	} else if removed > 0 {
+		log.Debug("Removed old changes of the instances:", removed)
+	}
+}
+
+// IsLeader Returns if the local instance is the leader of the cluster, the
+// only one that runs the cluster-wide tasks
+func (im *Model) IsLeader() bool {
+	return im.leader != nil && im.leader.Held()
+}
+
+// keepRegistered Registers again the local instance if the registration is
+// about to expire, or if its bid changed
+func (im *Model) keepRegistered() {
 	im.mutex.Lock()
-	defer im.mutex.Unlock()
+	bid := im.localBid
+	im.mutex.Unlock()
 
-	log.Debug("Instances alive:", im.instancesAlive)
-	if len(im.instancesAlive) == 0 {
-		return 0
+	if time.Now().Unix()-im.published.ts >= cPublishPeriod || bidChanged(im.published.bid, bid) {
+		im.registerHostName(im.HostName())
 	}
+}
 
-	total = totalShards / len(im.instancesAlive)
-	if im.instancesAlive[len(im.instancesAlive)-1] == hostName {
-		total += totalShards % len(im.instancesAlive)
+// bidChanged Returns if the resources of the bid changed enough from the
+// published one to publish it again
+func bidChanged(published, bid Bid) bool {
+	changed := func(prev, curr float64) bool {
+		diff := curr - prev
+		if diff < 0 {
+			diff = -diff
+		}
+
+		return diff > prev*cBidChange
 	}
 
-	return
+	return published.Zone != bid.Zone ||
+		changed(float64(published.FreeMem), float64(bid.FreeMem)) ||
+		changed(published.BytesByElem, bid.BytesByElem) ||
+		changed(float64(published.QPS), float64(bid.QPS)) ||
+		changed(published.Load, bid.Load) ||
+		demandChanged(published.Demand, bid.Demand)
+}
+
+// demandChanged Returns if the requests / sec received for any group changed
+// enough from the published ones to publish the bid again
+func demandChanged(published, demand map[string]float64) bool {
+	changed := func(prev, curr float64) bool {
+		diff := curr - prev
+		if diff < 0 {
+			diff = -diff
+		}
+
+		return diff > cMinDemandChange && diff > prev*cBidChange
+	}
+
+	for key, curr := range demand {
+		if changed(published[key], curr) {
+			return true
+		}
+	}
+	for key, prev := range published {
+		if _, ok := demand[key]; !ok && changed(prev, 0) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetLocalBid Sets the resources of the local instance to be published on the
+// instances table
+func (im *Model) SetLocalBid(bid Bid) {
+	im.mutex.Lock()
+	im.localBid = bid
+	im.mutex.Unlock()
+}
+
+// GetBids Returns the last published bid of each active instance by host name,
+// the bid of the local instance is the last one set even if it was not yet
+// published
+func (im *Model) GetBids() map[string]Bid {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+
+	bids := make(map[string]Bid, len(im.bids))
+	for host, bid := range im.bids {
+		bids[host] = bid
+	}
+	if _, alive := bids[im.HostName()]; alive {
+		local := im.localBid
+		local.HostName = im.HostName()
+		bids[im.HostName()] = local
+	}
+
+	return bids
 }
 
 // GetTotalInstances Returns the total number of active instances
 func (im *Model) GetTotalInstances() int {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+
 	if len(im.instancesAlive) == 0 {
 		return 1
 	}
@@ -156,60 +398,163 @@ func (im *Model) delTable() {
 }
 
 func (im *Model) registerHostName(hostName string) {
+	im.mutex.Lock()
+	bid := im.localBid
+	im.mutex.Unlock()
+
+	demand, _ := json.Marshal(bid.Demand)
 	attribs := []dynamodb.Attribute{
 		*dynamodb.NewStringAttribute(cPrimKey, hostName),
 		*dynamodb.NewStringAttribute("ts", fmt.Sprintf("%d", time.Now().Unix())),
+		*dynamodb.NewStringAttribute("zone", bid.Zone),
+		*dynamodb.NewStringAttribute("free_mem", strconv.FormatUint(bid.FreeMem, 10)),
+		*dynamodb.NewStringAttribute("bytes_by_elem", strconv.FormatFloat(bid.BytesByElem, 'f', -1, 64)),
+		*dynamodb.NewStringAttribute("load", strconv.FormatFloat(bid.Load, 'f', -1, 64)),
+		*dynamodb.NewStringAttribute("qps", strconv.FormatUint(bid.QPS, 10)),
+		*dynamodb.NewStringAttribute("demand", string(demand)),
 	}
 
 	if _, err := im.table.PutItem(hostName, cPrimKey, attribs); err != nil {
 		log.Fatal("The hostname can't be registered on the instances table, Error:", err)
 	}
+	im.published = registration{bid: bid, ts: time.Now().Unix()}
+	im.publish(hostName)
 }
 
-func (im *Model) updateInstances() {
-	if rows, err := im.table.Scan(nil); err == nil {
-		instances := []string{}
-		for _, row := range rows {
-			lastTs, _ := strconv.ParseInt(row["ts"].Value, 10, 64)
-			if lastTs, _ = strconv.ParseInt(row["ts"].Value, 10, 64); lastTs+cTTL > time.Now().Unix() {
-				instances = append(instances, row[cPrimKey].Value)
-			} else if row[cPrimKey].Value != hostName {
-				log.Info("Outdated instance detected, removing it, name:", row[cPrimKey].Value)
-				attKey := &dynamodb.Key{
-					HashKey:  row[cPrimKey].Value,
-					RangeKey: "",
-				}
-
-				_, err = im.table.DeleteItem(attKey)
-				if err != nil {
-					log.Error("The instance:", row[cPrimKey].Value, "can't be removed, Error:", err)
-				}
-			}
-		}
+// publish Publishes on the changes feed that the registration of the instance
+// changed
+func (im *Model) publish(hostName string) {
+	if err := im.feed.Publish(cTable, hostName); err != nil {
+		log.Error("The registration of the instance:", hostName, "can't be published, Error:", err)
+	}
+}
 
-		sort.Sort(byName(instances))
+// applyChanges Loads the registrations of the instances that changed
+func (im *Model) applyChanges(changes []storage.Change) {
+	for _, change := range changes {
+		row, err := im.table.GetItemConsistent(&dynamodb.Key{HashKey: change.Key}, true)
 		im.mutex.Lock()
-		im.instancesAlive = instances
+		switch err {
+		case nil:
+			im.registered[change.Key] = parseRegistration(row)
+		case dynamodb.ErrNotFound:
+			delete(im.registered, change.Key)
+		default:
+			log.Error("Problem trying to get the instance:", change.Key, "from Dynamo DB, Error:", err)
+		}
 		im.mutex.Unlock()
-	} else {
+	}
+	im.refresh()
+}
+
+// refresh Updates the list of active instances and their bids from the
+// registrations that didn't expire
+func (im *Model) refresh() {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+
+	instances := []string{}
+	bids := make(map[string]Bid)
+	for hostName, reg := range im.registered {
+		if reg.ts+cTTL > time.Now().Unix() {
+			instances = append(instances, hostName)
+			bids[hostName] = reg.bid
+		}
+	}
+
+	sort.Sort(byName(instances))
+	im.instancesAlive = instances
+	im.bids = bids
+}
+
+// updateInstances Loads all the registrations of the instances, the expired
+// ones are removed from the table by the leader
+func (im *Model) updateInstances() error {
+	rows, err := im.table.Scan(nil)
+	if err != nil {
 		log.Error("Problem trying to get the list of instances from Dynamo DB, Error:", err)
+		return err
+	}
+
+	registered := make(map[string]registration)
+	leader := im.IsLeader()
+	for _, row := range rows {
+		reg := parseRegistration(row)
+		if reg.ts+cTTL > time.Now().Unix() {
+			registered[row[cPrimKey].Value] = reg
+		} else if leader && row[cPrimKey].Value != im.HostName() {
+			log.Info("Outdated instance detected, removing it, name:", row[cPrimKey].Value)
+			attKey := &dynamodb.Key{
+				HashKey:  row[cPrimKey].Value,
+				RangeKey: "",
+			}
+
+			if _, err = im.table.DeleteItem(attKey); err != nil {
+				log.Error("The instance:", row[cPrimKey].Value, "can't be removed, Error:", err)
+			} else {
+				im.publish(row[cPrimKey].Value)
+			}
+		}
+	}
+
+	im.mutex.Lock()
+	im.registered = registered
+	im.mutex.Unlock()
+	im.refresh()
+
+	return nil
+}
+
+// parseRegistration Returns the bid and the registration time stamp stored on
+// a row of the instances table
+func parseRegistration(row map[string]*dynamodb.Attribute) (reg registration) {
+	reg.bid = parseBid(row)
+	if attr, ok := row["ts"]; ok {
+		reg.ts, _ = strconv.ParseInt(attr.Value, 10, 64)
+	}
+
+	return
+}
+
+// parseBid Returns the bid published on a row of the instances table, the
+// resources not published are considered as zero
+func parseBid(row map[string]*dynamodb.Attribute) (bid Bid) {
+	value := func(name string) string {
+		if attr, ok := row[name]; ok {
+			return attr.Value
+		}
+		return ""
+	}
+
+	bid.HostName = value(cPrimKey)
+	bid.Zone = value("zone")
+	bid.FreeMem, _ = strconv.ParseUint(value("free_mem"), 10, 64)
+	bid.BytesByElem, _ = strconv.ParseFloat(value("bytes_by_elem"), 64)
+	bid.Load, _ = strconv.ParseFloat(value("load"), 64)
+	bid.QPS, _ = strconv.ParseUint(value("qps"), 10, 64)
+	if demand := value("demand"); demand != "" {
+		json.Unmarshal([]byte(demand), &bid.Demand)
 	}
+
+	return
 }
 
-func (im *Model) initTable() {
-	pKey := dynamodb.PrimaryKey{dynamodb.NewStringAttribute(cPrimKey, ""), nil}
-	im.table = im.conn.NewTable(im.tableName, pKey)
+// initTable Returns the table with the given name and primary key, the table
+// is created if it doesn't exist
+func (im *Model) initTable(tableName, primKey string) (table *dynamodb.Table) {
+	pKey := dynamodb.PrimaryKey{dynamodb.NewStringAttribute(primKey, ""), nil}
+	table = im.conn.NewTable(tableName, pKey)
 
-	res, err := im.table.DescribeTable()
+	res, err := table.DescribeTable()
 	if err != nil {
-		log.Info("Creating a new table on DynamoDB:", im.tableName)
+		log.Info("Creating a new table on DynamoDB:", tableName)
 		td := dynamodb.TableDescriptionT{
-			TableName: im.tableName,
+			TableName: tableName,
 			AttributeDefinitions: []dynamodb.AttributeDefinitionT{
-				dynamodb.AttributeDefinitionT{cPrimKey, "S"},
+				dynamodb.AttributeDefinitionT{primKey, "S"},
 			},
 			KeySchema: []dynamodb.KeySchemaT{
-				dynamodb.KeySchemaT{cPrimKey, "HASH"},
+				dynamodb.KeySchemaT{primKey, "HASH"},
 			},
 			ProvisionedThroughput: dynamodb.ProvisionedThroughputT{
 				ReadCapacityUnits:  cDefaultWRCapacity,
@@ -218,17 +563,19 @@ func (im *Model) initTable() {
 		}
 
 		if _, err := im.conn.CreateTable(td); err != nil {
-			log.Error("Error trying to create a table on Dynamo DB, table:", im.tableName, "Error:", err)
+			log.Error("Error trying to create a table on Dynamo DB, table:", tableName, "Error:", err)
 		}
-		if res, err = im.table.DescribeTable(); err != nil {
-			log.Error("Error trying to describe a table on Dynamo DB, table:", im.tableName, "Error:", err)
+		if res, err = table.DescribeTable(); err != nil {
+			log.Error("Error trying to describe a table on Dynamo DB, table:", tableName, "Error:", err)
 		}
 	}
 	for "ACTIVE" != res.TableStatus {
-		if res, err = im.table.DescribeTable(); err != nil {
+		if res, err = table.DescribeTable(); err != nil {
 			log.Error("Can't describe Dynamo DB instances table, Error:", err)
 		}
 		log.Debug("Waiting for active table, current status:", res.TableStatus)
 		time.Sleep(time.Second)
 	}
+
+	return
 }
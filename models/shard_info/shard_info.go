@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/alonsovidales/pit/log"
 	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/storage"
 	"github.com/alonsovidales/pit/recommender"
 	"github.com/goamz/goamz/aws"
 	"github.com/goamz/goamz/dynamodb"
@@ -23,9 +24,34 @@ const (
 	cShardsPrimKey           = "shardId"
 	cShardsDefaultWRCapacity = 10
 
-	cUpdatePeriod      = 5
+	cChangesTable             = "rec_changes"
+	cChangesDefaultWRCapacity = 10
+
+	cUpdatePeriod      = 1
 	cUpdateShardPeriod = 2
 	cShardTTL          = 10
+	// cResyncPeriod Seconds between two full loads of the groups and shards,
+	// between them only the changed groups are loaded
+	cResyncPeriod = 60
+	// cPublishAlivePeriod Min seconds between two keep alives of a shard
+	// published on the changes feed, the other instances consider the
+	// shard expired if they don't receive a keep alive in cShardTTL
+	cPublishAlivePeriod = cShardTTL / 3
+
+	// CRoutingHash Routing mode where the record IDs are consistently
+	// hashed onto the shards of the group, so all the scores of a record
+	// are stored and served by the shard that owns it. By default the
+	// requests are served by any shard of the group.
+	// The records are assigned using jump consistent hash over the number
+	// of shards, when the number of shards changes:
+	//   - Growing: only the records assigned to the new shards change of
+	//     owner, the previous owners hand off them once the new shards are
+	//     acquired
+	//   - Shrinking: the owners of the removed shards hand off all their
+	//     records to the remaining shards before release them
+	// The requests for records which owner shard is not acquired yet are
+	// rejected as the shard was still being provisioned
+	CRoutingHash = "hash"
 )
 
 // ErrGroupUserNotFound User not found on the system
@@ -37,6 +63,9 @@ var ErrGroupInUse = errors.New("Group ID in use")
 // ErrGroupNotFound The group wwas not found on the system
 var ErrGroupNotFound = errors.New("Group not found")
 
+// ErrUnknownRouting The specified routing mode is not supported
+var ErrUnknownRouting = errors.New("Unknown routing mode")
+
 // ErrAuth Problem trying to authenticate the user
 var ErrAuth = errors.New("Authentication problem")
 
@@ -48,6 +77,13 @@ var ErrMaxShardsByGroup = errors.New("Max number of shards for this group reache
 // instance on this group
 var ErrSharPrevOwnedGroup = errors.New("This instance already owns a shard on this group")
 
+// ErrShardNotFree The requested shard of the group is owned by another instance
+var ErrShardNotFree = errors.New("The shard is owned by another instance")
+
+// ErrShardFenced The shard was acquired by another instance, or again by this
+// instance, after the ownership epoch checked
+var ErrShardFenced = storage.ErrFenced
+
 // GroupInfoInt Interface that provides access to management of a group
 type GroupInfoInt interface {
 	AcquireShard() (adquired bool, err error)
@@ -68,6 +104,11 @@ type Shard struct {
 	ShardID int `json:"shard_id"`
 	// LastTs Last time stamp when the shard information was updated
 	LastTs int64 `json:"last_ts"`
+	// Epoch Ownership epoch of the shard, it is increased each time the
+	// shard is acquired, so an instance that lost the ownership, after a
+	// GC pause or because of the clock skew, can detect that it was
+	// fenced off by a newer owner
+	Epoch uint64 `json:"epoch"`
 
 	expire bool
 	md     *Model
@@ -94,6 +135,9 @@ type GroupInfo struct {
 	MaxReqSec uint64 `json:"max_req_sec"`
 	// MaxInsertReqSec Max number of insert requests by shard
 	MaxInsertReqSec uint64 `json:"max_insert_serq"`
+	// Routing How the requests are distributed across the shards, see
+	// CRoutingHash
+	Routing string `json:"routing,omitempty"`
 
 	// Shards the key of this map is the host name of the owner of the
 	// shard, and the value the shard
@@ -115,6 +159,9 @@ type ModelInt interface {
 	GetGroupByUserKeyID(userID, secret, groupID string) (gr *GroupInfo, err error)
 	// GetGroupByID Returns a group by Group ID
 	GetGroupByID(groupID string) (gr *GroupInfo)
+	// ReloadGroup Loads again from the DB the group with the given ID
+	// and its shards, and returns it
+	ReloadGroup(groupID string) (gr *GroupInfo)
 	// AddUpdateGroup Creates a group based on the provided information, or
 	// updated the information on an existing group
 	AddUpdateGroup(grType, userID, groupID string, numShards int, maxElements, maxReqSec, maxInsertReqSec uint64, maxScore uint8) (gr *GroupInfo, key string, err error)
@@ -125,6 +172,10 @@ type ModelInt interface {
 	GetTotalNumberOfShards() (tot int)
 	// RemoveGroup Removes a group by ID and all the information of this group
 	RemoveGroup(groupID string) (err error)
+	// PruneChanges Removes the old changes of the groups from the changes
+	// feed, and returns the number of removed changes, only the leader of
+	// the cluster has to call it
+	PruneChanges() (removed int, err error)
 }
 
 // Model Manages all the information relative to a shard
@@ -132,14 +183,20 @@ type Model struct {
 	// groups by user ID and Group ID
 	groups map[string]map[string]*GroupInfo
 
-	groupsTable     *dynamodb.Table
-	shardsTable     *dynamodb.Table
+	groupsTable     storage.Table
+	shardsTable     storage.Table
 	groupsTableName string
 	shardsTableName string
-	adminEmail      string
-	groupsMutex     sync.Mutex
-	shardsMutex     sync.Mutex
-	conn            *dynamodb.Server
+	// feed Changes of the groups and their shards identified by group ID
+	feed       *storage.ChangeFeed
+	follower   *storage.Follower
+	adminEmail string
+	// hostName Host name of the local instance, the one of the machine if
+	// it is empty
+	hostName    string
+	groupsMutex sync.Mutex
+	shardsMutex sync.Mutex
+	conn        *dynamodb.Server
 }
 
 // GetModel Initializes a new model and launches a process that getting the
@@ -168,14 +225,14 @@ func GetModel(prefix, awsRegion, adminEmail string) (md *Model) {
 			cShardsDefaultWRCapacity,
 			md.shardsMutex,
 		)
+		md.feed = storage.NewChangeFeed(md.getTable(
+			fmt.Sprintf("%s_%s", prefix, cChangesTable),
+			storage.CChangesPrimKey,
+			cChangesDefaultWRCapacity,
+			md.shardsMutex,
+		))
 
-		md.updateInfo()
-		go func() {
-			for {
-				md.updateInfo()
-				time.Sleep(time.Second * cUpdatePeriod)
-			}
-		}()
+		md.keepUpdated()
 	} else {
 		log.Error("Problem trying to connect with DynamoDB, Error:", err)
 		return
@@ -184,11 +241,109 @@ func GetModel(prefix, awsRegion, adminEmail string) (md *Model) {
 	return
 }
 
+// NewModel Initializes a new model that persists the information on the given
+// tables and launches the process that keeps updated the information in memory,
+// the changes are published on a feed only visible by this model
+func NewModel(groupsTable, shardsTable storage.Table, adminEmail string) (md *Model) {
+	return NewModelForHost(groupsTable, shardsTable, storage.NewMemTable(), adminEmail, "")
+}
+
+// NewModelForHost Initializes a model as NewModel that publishes the changes
+// on the given table, where the shards are owned with the given host name
+// instead of the one of the machine, allowing to run many instances on the
+// same process
+func NewModelForHost(groupsTable, shardsTable, changesTable storage.Table, adminEmail, hostName string) (md *Model) {
+	md = &Model{
+		groups:      make(map[string]map[string]*GroupInfo),
+		adminEmail:  adminEmail,
+		groupsTable: groupsTable,
+		shardsTable: shardsTable,
+		feed:        storage.NewChangeFeed(changesTable),
+		hostName:    hostName,
+	}
+	md.keepUpdated()
+
+	return
+}
+
+// localHost Returns the host name used to own the shards
+func (md *Model) localHost() string {
+	if md == nil || md.hostName == "" {
+		return instances.GetHostName()
+	}
+
+	return md.hostName
+}
+
+// keepUpdated Loads the information from the DB and launches the process that
+// keeps it synchronized in background loading only the changed groups
+func (md *Model) keepUpdated() {
+	md.follower = storage.NewFollower(md.feed, time.Second*cResyncPeriod, md.applyChanges, md.updateInfo)
+	md.follower.Sync()
+	go func() {
+		for {
+			time.Sleep(time.Second * cUpdatePeriod)
+			md.follower.Sync()
+			md.expireShards()
+		}
+	}()
+}
+
+// publish Publishes on the changes feed that the group, or any of its shards,
+// changed
+func (md *Model) publish(groupID string) {
+	if err := md.feed.Publish(cGroupsTable, groupID); err != nil {
+		log.Error("The change of the group:", groupID, "can't be published, Error:", err)
+	}
+}
+
+// applyChanges Loads again the groups changed
+func (md *Model) applyChanges(changes []storage.Change) {
+	loaded := make(map[string]bool)
+	for _, change := range changes {
+		if !loaded[change.Key] {
+			md.loadGroup(change.Key)
+			loaded[change.Key] = true
+		}
+	}
+}
+
+// expireShards Replaces the groups with shards which ownership expired by
+// copies where the shards are released, the groups are accessed concurrently
+// without the mutex
+func (md *Model) expireShards() {
+	md.groupsMutex.Lock()
+	defer md.groupsMutex.Unlock()
+
+	now := time.Now().Unix()
+	for _, groups := range md.groups {
+		for groupID, group := range groups {
+			expired := false
+			for _, shard := range group.ShardsByAddr {
+				expired = expired || shard.LastTs+cShardTTL < now
+			}
+			if !expired {
+				continue
+			}
+
+			shards := make(map[int]*Shard, len(group.Shards))
+			for shardID, shard := range group.Shards {
+				shardCopy := *shard
+				shards[shardID] = &shardCopy
+			}
+			groupCopy := *group
+			groupCopy.setShards(shards)
+			groups[groupID] = &groupCopy
+		}
+	}
+}
+
 // AddUpdateGroup Creates a group based on the provided information, or updated
 // the information on an existing group
 func (md *Model) AddUpdateGroup(grType, userID, groupID string, numShards int, maxElements, maxReqSec, maxInsertReqSec uint64, maxScore uint8) (gr *GroupInfo, key string, err error) {
 	var grOk bool
 
+	md.groupsMutex.Lock()
 	userGroups, ugOk := md.groups[userID]
 	if gr, grOk = userGroups[groupID]; ugOk && grOk {
 		gr.Type = grType
@@ -237,6 +392,7 @@ func (md *Model) AddUpdateGroup(grType, userID, groupID string, numShards int, m
 			gr.addShard(i)
 		}
 	}
+	md.groupsMutex.Unlock()
 
 	return gr, gr.Secret, gr.persist()
 }
@@ -257,25 +413,57 @@ func (md *Model) GetGroupByID(groupID string) (gr *GroupInfo) {
 	return
 }
 
+// ReloadGroup Loads again from the DB the group with the given ID and its
+// shards without wait for the changes feed, and returns it, nil if the group
+// doesn't exist
+func (md *Model) ReloadGroup(groupID string) (gr *GroupInfo) {
+	md.loadGroup(groupID)
+
+	return md.GetGroupByID(groupID)
+}
+
 // GetAllGroupsByUserID Returns all the groups of shards for a single user
 func (md *Model) GetAllGroupsByUserID(uid string) map[string]*GroupInfo {
-	if uid == md.adminEmail {
-		result := make(map[string]*GroupInfo)
-		for _, userGroups := range md.groups {
-			for k, v := range userGroups {
-				result[k] = v
-			}
+	md.groupsMutex.Lock()
+	defer md.groupsMutex.Unlock()
+
+	if uid != md.adminEmail {
+		userGroups, ok := md.groups[uid]
+		if !ok {
+			return nil
+		}
+		result := make(map[string]*GroupInfo, len(userGroups))
+		for k, v := range userGroups {
+			result[k] = v
 		}
 
 		return result
 	}
 
-	return md.groups[uid]
+	result := make(map[string]*GroupInfo)
+	for _, userGroups := range md.groups {
+		for k, v := range userGroups {
+			result[k] = v
+		}
+	}
+
+	return result
 }
 
 // GetAllGroups Returns all the groups of shards by user
 func (md *Model) GetAllGroups() map[string]map[string]*GroupInfo {
-	return md.groups
+	md.groupsMutex.Lock()
+	defer md.groupsMutex.Unlock()
+
+	result := make(map[string]map[string]*GroupInfo, len(md.groups))
+	for userID, userGroups := range md.groups {
+		result[userID] = make(map[string]*GroupInfo, len(userGroups))
+		for k, v := range userGroups {
+			result[userID][k] = v
+		}
+	}
+
+	return result
 }
 
 // GetGroupByUserKeyID Returns a group by a specified UserID checking out if
@@ -356,161 +544,471 @@ func (gr *GroupInfo) RegenerateKey() (key string, err error) {
 // IsThisInstanceOwner Returns is the current host owns an instance of this
 // group
 func (gr *GroupInfo) IsThisInstanceOwner() bool {
-	_, is := gr.ShardsByAddr[instances.GetHostName()]
+	if gr.md != nil {
+		gr.md.groupsMutex.Lock()
+		defer gr.md.groupsMutex.Unlock()
+	}
+	_, is := gr.ShardsByAddr[gr.md.localHost()]
 
 	return is
 }
 
-// AcquireShard Try to adquire a shard on the current group, this action is
-// based on a competition strategy to adquire the shard in a persistance system
-// with eventual consistency as DynamoDB
+// GetOwners Returns the addresses of the instances that own a shard of the
+// group in random order, the shards of the group can be released or acquired
+// while the addresses are used
+func (gr *GroupInfo) GetOwners() (owners []string) {
+	if gr.md != nil {
+		gr.md.groupsMutex.Lock()
+		defer gr.md.groupsMutex.Unlock()
+	}
+
+	owners = make([]string, 0, len(gr.ShardsByAddr))
+	for addr := range gr.ShardsByAddr {
+		owners = append(owners, addr)
+	}
+
+	return
+}
+
+// SetRouting Sets how the requests are distributed across the shards of the
+// group, an empty string routes the requests to any shard
+func (gr *GroupInfo) SetRouting(routing string) error {
+	if routing != "" && routing != CRoutingHash {
+		return ErrUnknownRouting
+	}
+	gr.Routing = routing
+
+	return gr.persist()
+}
+
+// HashRouting Returns true if the record IDs are consistently hashed onto the
+// shards of the group
+func (gr *GroupInfo) HashRouting() bool {
+	return gr.Routing == CRoutingHash
+}
+
+// RecordShard Returns the ID of the shard that owns the record on groups with
+// hash routing
+func (gr *GroupInfo) RecordShard(recID uint64) int {
+	return jumpHash(recID, gr.NumShards)
+}
+
+// RecordOwner Returns the address of the instance that owns the shard of the
+// record, ok is false if the shard is not acquired by any instance
+func (gr *GroupInfo) RecordOwner(recID uint64) (addr string, ok bool) {
+	if gr.md != nil {
+		gr.md.groupsMutex.Lock()
+		defer gr.md.groupsMutex.Unlock()
+	}
+
+	shard, ok := gr.Shards[gr.RecordShard(recID)]
+	if !ok || shard.Addr == "" || gr.ShardsByAddr[shard.Addr] != shard {
+		return "", false
+	}
+
+	return shard.Addr, true
+}
+
+// IsRecordOwner Returns true if the current host owns the shard of the record
+func (gr *GroupInfo) IsRecordOwner(recID uint64) bool {
+	if gr.md != nil {
+		gr.md.groupsMutex.Lock()
+		defer gr.md.groupsMutex.Unlock()
+	}
+
+	shard, ok := gr.ShardsByAddr[gr.md.localHost()]
+
+	return ok && shard.ShardID == gr.RecordShard(recID)
+}
+
+// jumpHash Returns the bucket for the key in the range [0, buckets) using the
+// jump consistent hash algorithm, when the number of buckets grows from n to
+// m, only (m-n)/m of the keys are moved, and all of them to the new buckets
+func jumpHash(key uint64, buckets int) int {
+	if buckets <= 0 {
+		return 0
+	}
+
+	// Mix the bits of the key since the records IDs are usually sequential
+	key ^= key >> 33
+	key *= 0xff51afd7ed558ccd
+	key ^= key >> 33
+	key *= 0xc4ceb9fe1a85ec53
+	key ^= key >> 33
+
+	b, j := int64(-1), int64(0)
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
+
+// AcquireShard Try to adquire a shard on the current group, the ownership of
+// a free shard is acquired with a conditional write, see storage.Ownership, so
+// only one of the instances that compete for the same shard can acquire it
 func (gr *GroupInfo) AcquireShard() (adquired bool, err error) {
+	free, err := gr.freeShards()
+	if err != nil {
+		return false, err
+	}
+
+	return gr.acquireFree(free)
+}
+
+// AcquireShardByID Try to adquire the shard of the group with the given ID,
+// used to acquire the shard handed off by another instance so its backup can be
+// restored. Returns ErrShardNotFree if the shard is owned by another instance
+func (gr *GroupInfo) AcquireShardByID(shardID int) (adquired bool, err error) {
+	free, err := gr.freeShards()
+	if err != nil {
+		return false, err
+	}
+
+	for _, shard := range free {
+		if shard.ShardID == shardID {
+			return gr.acquireFree([]*Shard{shard})
+		}
+	}
+
+	return false, ErrShardNotFree
+}
+
+// acquireFree Acquires the first of the free shards that can be acquired by
+// the current host, see freeShards
+func (gr *GroupInfo) acquireFree(free []*Shard) (adquired bool, err error) {
+	for _, shard := range free {
+		if err = shard.acquire(gr.md.localHost()); err != nil {
+			log.Debug("The shard:", shard.ShardID, "of the group:", gr.GroupID, "can't be acquired, Error:", err)
+			continue
+		}
+
+		gr.md.groupsMutex.Lock()
+		gr.ShardsByAddr[gr.md.localHost()] = shard
+		gr.md.groupsMutex.Unlock()
+		go gr.md.keepAliveOwnedShard(gr.GroupID, gr.md.localHost())
+
+		return true, nil
+	}
+	if err == nil {
+		return false, errors.New("Consistency error trying to adquire")
+	}
+
+	return false, errors.New(fmt.Sprint("Race condition trying to adquire a shard of the group:", gr.GroupID, "Error:", err))
+}
+
+// freeShards Returns the shards of the group that are not owned by any instance
+// or whose ownership expired, the ownership of the shards is modified by the
+// keep alive and release of the shards under the groups mutex
+func (gr *GroupInfo) freeShards() (free []*Shard, err error) {
+	gr.md.groupsMutex.Lock()
+	defer gr.md.groupsMutex.Unlock()
+
 	if len(gr.ShardsByAddr) == len(gr.Shards) {
 		log.Debug("Max number of shards allowed, can't adquire more")
-		return false, ErrMaxShardsByGroup
+		return nil, ErrMaxShardsByGroup
 	}
 
-	if _, in := gr.ShardsByAddr[instances.GetHostName()]; in {
+	if _, in := gr.ShardsByAddr[gr.md.localHost()]; in {
 		log.Debug("This instance owns a shard on this group:", gr.GroupID)
-		return false, ErrSharPrevOwnedGroup
-	}
-
-	// Get a free shard
-	var shard *Shard
-	found := false
-	for _, shard = range gr.Shards {
-		// Double check in order to be as sure as possible that this
-		// shard is still available
-		if shard.Addr == "" || shard.LastTs+cShardTTL < time.Now().Unix() {
-			shard.consistentUpdate()
-			if shard.Addr == "" || shard.LastTs+cShardTTL < time.Now().Unix() {
-				found = true
-				break
-			}
+		return nil, ErrSharPrevOwnedGroup
+	}
+
+	now := time.Now().Unix()
+	for _, shard := range gr.Shards {
+		if shard.Addr == "" || shard.LastTs+cShardTTL < now {
+			free = append(free, shard)
 		}
 	}
-	if !found {
-		return false, errors.New("Consistency error trying to adquire")
+
+	return
+}
+
+// ReleaseShard Releases the shard of the group owned by this instance in order
+// to allow other instances to acquire it
+func (gr *GroupInfo) ReleaseShard() {
+	gr.md.groupsMutex.Lock()
+	defer gr.md.groupsMutex.Unlock()
+
+	if shard, ok := gr.ShardsByAddr[gr.md.localHost()]; ok {
+		shard.release(gr.md.localHost())
+	}
+	delete(gr.ShardsByAddr, gr.md.localHost())
+}
+
+// LocalOwnership Returns the ID and the ownership epoch of the shard of the
+// group owned by this instance, ok is false if the instance doesn't own a shard
+// of the group
+func (gr *GroupInfo) LocalOwnership() (shardID int, epoch uint64, ok bool) {
+	gr.md.groupsMutex.Lock()
+	defer gr.md.groupsMutex.Unlock()
+
+	shard, ok := gr.ShardsByAddr[gr.md.localHost()]
+	if !ok {
+		return 0, 0, false
 	}
 
-	shard.Addr = instances.GetHostName()
-	shard.LastTs = time.Now().Unix()
+	return shard.ShardID, shard.Epoch, true
+}
 
-	// Adquire
-	shard.persist()
-	// Wait just by caution in order to avoid race conditions between
-	// instances on the revious call
-	time.Sleep(time.Millisecond * 200)
-	shard.consistentUpdate()
+// CheckEpoch Returns ErrShardFenced if the shard of the group owned by this
+// instance with the given ownership epoch was acquired by another instance or
+// with a newer epoch, the information of the shard is read from the DB
+func (gr *GroupInfo) CheckEpoch(epoch uint64) error {
+	gr.md.groupsMutex.Lock()
+	shard, ok := gr.ShardsByAddr[gr.md.localHost()]
+	gr.md.groupsMutex.Unlock()
+	if !ok {
+		return ErrShardFenced
+	}
 
-	if shard.Addr == instances.GetHostName() {
-		go gr.md.keepAliveOwnedShard(gr.GroupID, instances.GetHostName())
-		gr.ShardsByAddr[instances.GetHostName()] = shard
+	return shard.checkEpoch(gr.md.localHost(), epoch)
+}
 
-		return true, nil
+// checkEpoch Returns ErrShardFenced if the stored shard is not owned by the
+// given host with the given ownership epoch
+func (sh *Shard) checkEpoch(hostName string, epoch uint64) error {
+	return storage.CheckOwnership(sh.md.shardsTable, sh.getDynamoDbKey(), storage.Ownership{Owner: hostName, Epoch: epoch})
+}
+
+// acquire Acquires the ownership of the shard for the host increasing its
+// epoch, the shard has to be free or its ownership expired
+func (sh *Shard) acquire(hostName string) error {
+	own, err := storage.AcquireOwnership(sh.md.shardsTable, sh.getDynamoDbKey(), cShardsPrimKey, hostName, cShardTTL, time.Now().Unix(), sh.item)
+	if err != nil {
+		return err
+	}
+
+	sh.md.groupsMutex.Lock()
+	sh.Addr, sh.Epoch, sh.LastTs = own.Owner, own.Epoch, own.LastTs
+	sh.md.groupsMutex.Unlock()
+	sh.md.publish(sh.GroupID)
+
+	return nil
+}
+
+// keepAlive Updates the time stamp of the shard owned by the host with the
+// given epoch, returns ErrShardFenced if the ownership of the shard changed
+func (sh *Shard) keepAlive(hostName string, epoch uint64) error {
+	own, err := storage.KeepOwnership(sh.md.shardsTable, sh.getDynamoDbKey(), cShardsPrimKey, storage.Ownership{Owner: hostName, Epoch: epoch}, time.Now().Unix(), sh.item)
+	if err != nil {
+		return err
+	}
+
+	sh.md.groupsMutex.Lock()
+	sh.LastTs = own.LastTs
+	sh.md.groupsMutex.Unlock()
+
+	return nil
+}
+
+// release Releases the ownership of the shard owned by the host keeping its
+// epoch, the shard is not modified if it was fenced off by a newer owner. The
+// caller has to hold the groups mutex
+func (sh *Shard) release(hostName string) {
+	if err := storage.ReleaseOwnership(sh.md.shardsTable, sh.getDynamoDbKey(), cShardsPrimKey, storage.Ownership{Owner: hostName, Epoch: sh.Epoch}, sh.item); err != nil {
+		log.Info("The shard:", sh.ShardID, "of the group:", sh.GroupID, "was not released, Error:", err)
+		return
 	}
 
-	return false, errors.New(fmt.Sprint("Race condition trying to adquire the shard:", gr.GroupID, ":", shard.ShardID))
+	sh.Addr = ""
+	sh.md.publish(sh.GroupID)
 }
 
 // keepAliveOwnedShard Updates the timestamp of an adquired shard in order to
-// inform to the other hosts that the ownership is still valid
+// inform to the other hosts that the ownership is still valid, the shard is
+// released locally if its ownership has a newer epoch on the DB
 func (md *Model) keepAliveOwnedShard(groupID string, hostName string) {
+	// The acquisition was published
+	published := time.Now().Unix()
 	for {
-		if gr := md.GetGroupByID(groupID); gr == nil {
+		gr := md.GetGroupByID(groupID)
+		if gr == nil {
 			break
-		} else {
-			if shard, ok := gr.ShardsByAddr[hostName]; ok {
-				shard.LastTs = time.Now().Unix()
-				shard.persist()
-				time.Sleep(time.Second * cUpdateShardPeriod)
-			} else {
-				break
+		}
+
+		// The shard can be released concurrently
+		md.groupsMutex.Lock()
+		shard, ok := gr.ShardsByAddr[hostName]
+		var epoch uint64
+		if ok {
+			epoch = shard.Epoch
+		}
+		md.groupsMutex.Unlock()
+		if !ok {
+			break
+		}
+
+		// A failed write because of a concurrent modification is
+		// checked again on the next keep alive
+		err := shard.keepAlive(hostName, epoch)
+		if err == nil && time.Now().Unix()-published >= cPublishAlivePeriod {
+			md.publish(groupID)
+			published = time.Now().Unix()
+		}
+		if err == ErrShardFenced {
+			log.Error("The shard:", shard.ShardID, "of the group:", groupID, "was fenced off by a newer owner, epoch:", epoch)
+			md.groupsMutex.Lock()
+			if gr.ShardsByAddr[hostName] == shard {
+				delete(gr.ShardsByAddr, hostName)
 			}
+			md.groupsMutex.Unlock()
+
+			break
 		}
+		time.Sleep(time.Second * cUpdateShardPeriod)
 	}
 }
 
 // updateInfo syncronize the information in memory with the information on the
-// DB
-func (md *Model) updateInfo() {
-	// This structure will be used in order to determine what groups are
-	// still in use and what not
-	updatedInfo := make(map[string]map[string]bool)
-	if groupsRows, err := md.groupsTable.Scan(nil); err == nil {
-		if shardsRows, err := md.shardsTable.Scan(nil); err == nil {
-			md.shardsMutex.Lock()
-
-			shardInfoByGroup := make(map[string]map[int]*Shard)
-			for _, shardInfoRow := range shardsRows {
-				shardInfo := new(Shard)
-				if err := json.Unmarshal([]byte(shardInfoRow["info"].Value), &shardInfo); err != nil {
-					log.Error("The returned data from Dynamo DB for the shards info can't be unmarshalled, Error:", err)
-					continue
-				}
-				shardInfo.md = md
-				if _, ok := shardInfoByGroup[shardInfo.GroupID]; ok {
-					shardInfoByGroup[shardInfo.GroupID][shardInfo.ShardID] = shardInfo
-				} else {
-					shardInfoByGroup[shardInfo.GroupID] = map[int]*Shard{
-						shardInfo.ShardID: shardInfo,
-					}
-				}
+// DB loading all the groups and shards
+func (md *Model) updateInfo() error {
+	groupsRows, err := md.groupsTable.Scan(nil)
+	if err != nil {
+		log.Error("Problem trying to get the list of groups from Dynamo DB, Error:", err)
+		return err
+	}
+	shardsRows, err := md.shardsTable.Scan(nil)
+	if err != nil {
+		log.Error("Problem trying to get the list of shards from Dynamo DB, Error:", err)
+		return err
+	}
+
+	md.shardsMutex.Lock()
+	defer md.shardsMutex.Unlock()
+
+	shardInfoByGroup := make(map[string]map[int]*Shard)
+	for _, shardInfoRow := range shardsRows {
+		shardInfo, err := md.parseShard(shardInfoRow)
+		if err != nil {
+			continue
+		}
+		if _, ok := shardInfoByGroup[shardInfo.GroupID]; ok {
+			shardInfoByGroup[shardInfo.GroupID][shardInfo.ShardID] = shardInfo
+		} else {
+			shardInfoByGroup[shardInfo.GroupID] = map[int]*Shard{
+				shardInfo.ShardID: shardInfo,
 			}
+		}
+	}
 
-			md.groupsMutex.Lock()
+	md.groupsMutex.Lock()
+	defer md.groupsMutex.Unlock()
 
-			md.groups = make(map[string]map[string]*GroupInfo)
-			for _, groupInfoRow := range groupsRows {
-				groupInfo := new(GroupInfo)
-				if err := json.Unmarshal([]byte(groupInfoRow["info"].Value), &groupInfo); err != nil {
-					log.Error("The returned data from Dynamo DB for the shards info can't be unmarshalled, Error:", err)
-					continue
-				}
+	md.groups = make(map[string]map[string]*GroupInfo)
+	for _, groupInfoRow := range groupsRows {
+		groupInfo, err := md.parseGroup(groupInfoRow)
+		if err != nil {
+			continue
+		}
+		groupInfo.setShards(shardInfoByGroup[groupInfo.GroupID])
+		md.setGroup(groupInfo)
+	}
 
-				groupInfo.md = md
+	return nil
+}
 
-				groupInfo.Shards = make(map[int]*Shard)
-				for k, v := range shardInfoByGroup[groupInfo.GroupID] {
-					if k < groupInfo.NumShards {
-						groupInfo.Shards[k] = v
-					}
-				}
+// loadGroup Loads from the DB the group with the given ID and its shards
+// replacing the group in memory, the group is removed if it doesn't exist
+func (md *Model) loadGroup(groupID string) {
+	groupInfoRow, err := md.groupsTable.GetItemConsistent(&dynamodb.Key{HashKey: groupID}, true)
+	if err == dynamodb.ErrNotFound {
+		md.groupsMutex.Lock()
+		for _, groups := range md.groups {
+			delete(groups, groupID)
+		}
+		md.groupsMutex.Unlock()
 
-				groupInfo.ShardsByAddr = make(map[string]*Shard)
-				for _, shard := range groupInfo.Shards {
-					if shard.Addr != "" && shard.LastTs+cShardTTL >= time.Now().Unix() && shard.ShardID < groupInfo.NumShards {
-						groupInfo.ShardsByAddr[shard.Addr] = shard
-					} else {
-						// This shard ownership has expired, release it
-						shard.Addr = ""
-					}
-				}
+		return
+	}
+	if err != nil {
+		log.Error("Problem trying to get the group:", groupID, "from Dynamo DB, Error:", err)
+		return
+	}
 
-				if _, ok := md.groups[groupInfo.UserID]; ok {
-					md.groups[groupInfo.UserID][groupInfo.GroupID] = groupInfo
-				} else {
-					md.groups[groupInfo.UserID] = map[string]*GroupInfo{
-						groupInfo.GroupID: groupInfo,
-					}
-				}
+	groupInfo, err := md.parseGroup(groupInfoRow)
+	if err != nil {
+		return
+	}
+	shards := make(map[int]*Shard)
+	for shardID := 0; shardID < groupInfo.NumShards; shardID++ {
+		key := (&Shard{GroupID: groupID, ShardID: shardID}).getDynamoDbKey()
+		shardInfoRow, err := md.shardsTable.GetItemConsistent(&dynamodb.Key{HashKey: key}, true)
+		if err == dynamodb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			log.Error("Problem trying to get the shard:", key, "from Dynamo DB, Error:", err)
+			return
+		}
+		if shards[shardID], err = md.parseShard(shardInfoRow); err != nil {
+			return
+		}
+	}
 
-				if _, ok := updatedInfo[groupInfo.UserID]; ok {
-					updatedInfo[groupInfo.UserID][groupInfo.GroupID] = true
-				} else {
-					updatedInfo[groupInfo.UserID] = map[string]bool{
-						groupInfo.GroupID: true,
-					}
-				}
-			}
+	groupInfo.setShards(shards)
+	md.groupsMutex.Lock()
+	md.setGroup(groupInfo)
+	md.groupsMutex.Unlock()
+}
 
-			md.groupsMutex.Unlock()
-			md.shardsMutex.Unlock()
+// parseShard Returns the shard stored on a row of the shards table
+func (md *Model) parseShard(shardInfoRow map[string]*dynamodb.Attribute) (shardInfo *Shard, err error) {
+	shardInfo = new(Shard)
+	if err = json.Unmarshal([]byte(shardInfoRow["info"].Value), &shardInfo); err != nil {
+		log.Error("The returned data from Dynamo DB for the shards info can't be unmarshalled, Error:", err)
+		return nil, err
+	}
+	shardInfo.md = md
+
+	return
+}
+
+// parseGroup Returns the group stored on a row of the groups table without
+// shards
+func (md *Model) parseGroup(groupInfoRow map[string]*dynamodb.Attribute) (groupInfo *GroupInfo, err error) {
+	groupInfo = new(GroupInfo)
+	if err = json.Unmarshal([]byte(groupInfoRow["info"].Value), &groupInfo); err != nil {
+		log.Error("The returned data from Dynamo DB for the shards info can't be unmarshalled, Error:", err)
+		return nil, err
+	}
+	groupInfo.md = md
+
+	return
+}
+
+// setShards Sets the shards of the group by shard ID, the shards which
+// ownership expired are released
+func (gr *GroupInfo) setShards(shards map[int]*Shard) {
+	gr.Shards = make(map[int]*Shard)
+	for k, v := range shards {
+		if k < gr.NumShards {
+			gr.Shards[k] = v
+		}
+	}
+
+	gr.ShardsByAddr = make(map[string]*Shard)
+	for _, shard := range gr.Shards {
+		if shard.Addr != "" && shard.LastTs+cShardTTL >= time.Now().Unix() && shard.ShardID < gr.NumShards {
+			gr.ShardsByAddr[shard.Addr] = shard
 		} else {
-			log.Error("Problem trying to get the list of shards from Dynamo DB, Error:", err)
+			// This shard ownership has expired, release it
+			shard.Addr = ""
 		}
+	}
+}
+
+// setGroup Adds or replaces the group in memory, the caller has to hold the
+// groups mutex
+func (md *Model) setGroup(groupInfo *GroupInfo) {
+	if _, ok := md.groups[groupInfo.UserID]; ok {
+		md.groups[groupInfo.UserID][groupInfo.GroupID] = groupInfo
 	} else {
-		log.Error("Problem trying to get the list of groups from Dynamo DB, Error:", err)
+		md.groups[groupInfo.UserID] = map[string]*GroupInfo{
+			groupInfo.GroupID: groupInfo,
+		}
 	}
 }
 
@@ -522,6 +1020,7 @@ func (gr *GroupInfo) addShard(shardID int) (shard *Shard, err error) {
 		md:      gr.md,
 		expire:  false,
 	}
+	shard.keepStoredEpoch()
 
 	shard.persist()
 	gr.Shards[shardID] = shard
@@ -537,62 +1036,60 @@ func (gr *GroupInfo) delShard(shardID int) {
 		md:      gr.md,
 		expire:  true,
 	}
+	shard.keepStoredEpoch()
 
 	shard.persist()
 	delete(gr.Shards, shardID)
 }
 
+// keepStoredEpoch Sets the epoch of the shard previously stored with the same
+// ID, if any, so the epochs of a shard never decrease after remove it from the
+// group and add it again
+func (sh *Shard) keepStoredEpoch() {
+	if own, _, err := storage.ReadOwnership(sh.md.shardsTable, sh.getDynamoDbKey()); err == nil {
+		sh.Epoch = own.Epoch
+	}
+}
+
 // getDynamoDbKey Returns the string that will identify a shard on the DB
 func (sh *Shard) getDynamoDbKey() string {
 	return fmt.Sprintf("%s:%d", sh.GroupID, sh.ShardID)
 }
 
-// consistentUpdate Performs an update on an eventual consistent DB as DynamoDB
-// making it consistent based on a wait and ask strategy
-func (sh *Shard) consistentUpdate() (success bool) {
-	attKey := &dynamodb.Key{
-		HashKey:  sh.getDynamoDbKey(),
-		RangeKey: "",
+// item Returns the attributes of the row that stores the shard on the DB with
+// the given ownership
+func (sh *Shard) item(own storage.Ownership) []dynamodb.Attribute {
+	stored := &Shard{
+		Addr:    own.Owner,
+		GroupID: sh.GroupID,
+		ShardID: sh.ShardID,
+		LastTs:  own.LastTs,
+		Epoch:   own.Epoch,
 	}
-	if data, err := sh.md.shardsTable.GetItemConsistent(attKey, true); err == nil {
-		log.Debug("Consistent update shard:", sh.GroupID, sh.ShardID)
-		sh.md.shardsMutex.Lock()
-		defer sh.md.shardsMutex.Unlock()
-		if err := json.Unmarshal([]byte(data["info"].Value), &sh); err != nil {
-			log.Error("Problem trying to update the shard information for shard in group ID:", sh.GroupID, "and shard ID:", sh.ShardID, "Error:", err)
-			return false
-		}
-	} else {
-		log.Error("Problem trying to update the shard information for shard in group ID:", sh.GroupID, "and shard ID:", sh.ShardID, "Error:", err)
-		return false
+	shJSON, err := json.Marshal(stored)
+	if err != nil {
+		log.Error("The shard info can't be converted to JSON, Erro:", err)
 	}
 
-	return true
+	attribs := []dynamodb.Attribute{
+		*dynamodb.NewStringAttribute(cShardsPrimKey, sh.getDynamoDbKey()),
+		*dynamodb.NewStringAttribute("info", string(shJSON)),
+	}
+	if sh.expire {
+		attribs = append(attribs, *dynamodb.NewStringAttribute("expire", "1"))
+	}
+
+	return attribs
 }
 
 // persist Persists on the DB the information of the shard
 func (sh *Shard) persist() (err error) {
-	// Persis the shard row
-	if shJSON, err := json.Marshal(sh); err == nil {
-		keyStr := sh.getDynamoDbKey()
-		attribs := []dynamodb.Attribute{
-			*dynamodb.NewStringAttribute(cShardsPrimKey, keyStr),
-			*dynamodb.NewStringAttribute("info", string(shJSON)),
-		}
-
-		if sh.expire {
-			attribs = append(attribs, *dynamodb.NewStringAttribute("expire", "1"))
-		}
-
-		if _, err := sh.md.shardsTable.PutItem(keyStr, cShardsPrimKey, attribs); err != nil {
-			log.Error("The shard information for the shard of the group:", sh.GroupID, "And Shard ID:", sh.ShardID, " can't be persisted on Dynamo DB, Error:", err)
-			return err
-		}
-	} else {
-		log.Error("The shard info can't be converted to JSON, Erro:", err)
-
-		return err
+	own := storage.Ownership{Owner: sh.Addr, Epoch: sh.Epoch, LastTs: sh.LastTs}
+	if _, err = sh.md.shardsTable.PutItem(sh.getDynamoDbKey(), cShardsPrimKey, own.Item(sh.item)); err != nil {
+		log.Error("The shard information for the shard of the group:", sh.GroupID, "And Shard ID:", sh.ShardID, " can't be persisted on Dynamo DB, Error:", err)
+		return
 	}
+	sh.md.publish(sh.GroupID)
 
 	return
 }
@@ -625,6 +1122,7 @@ func (gr *GroupInfo) persist() (err error) {
 			return err
 		}
 		log.Debug("Group persisted:", gr.GroupID)
+		gr.md.publish(gr.GroupID)
 	} else {
 		log.Error("The group info can't be converted to JSON, Erro:", err)
 
@@ -634,6 +1132,12 @@ func (gr *GroupInfo) persist() (err error) {
 	return
 }
 
+// PruneChanges Removes the old changes of the groups from the changes feed,
+// and returns the number of removed changes, see storage.ChangeFeed.Prune
+func (md *Model) PruneChanges() (removed int, err error) {
+	return md.feed.Prune()
+}
+
 // RemoveGroup Removes a group by ID and all the information of this group
 func (md *Model) RemoveGroup(groupID string) (err error) {
 	attKey := &dynamodb.Key{
@@ -650,6 +1154,7 @@ func (md *Model) RemoveGroup(groupID string) (err error) {
 		md.shardsTable.DeleteItem(shardAttKey)
 	}
 	_, err = md.groupsTable.DeleteItem(attKey)
+	md.publish(groupID)
 
 	return
 }
@@ -662,12 +1167,11 @@ func (md *Model) ReleaseAllAcquiredShards() {
 
 	for _, groups := range md.groups {
 		for _, group := range groups {
-			if shard, ok := group.ShardsByAddr[instances.GetHostName()]; ok {
-				shard.Addr = ""
-				shard.persist()
+			if shard, ok := group.ShardsByAddr[md.localHost()]; ok {
+				shard.release(md.localHost())
 			}
 
-			delete(group.ShardsByAddr, instances.GetHostName())
+			delete(group.ShardsByAddr, md.localHost())
 			group.persist()
 		}
 	}
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"errors"
+	"github.com/alonsovidales/pit/log"
+	"github.com/goamz/goamz/dynamodb"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// CChangesPrimKey Primary key of the tables that store the change feeds
+	CChangesPrimKey = "id"
+
+	// cCounterKey Key of the item that stores the sequence number of the
+	// last change published
+	cCounterKey = "counter"
+	// cSeqAttr, cSourceAttr, cKeyAttr and cExpireAttr Attributes of the
+	// items that store the changes, the items are removed by Prune after
+	// the time stamp of the expire attribute
+	cSeqAttr    = "seq"
+	cSourceAttr = "source"
+	cKeyAttr    = "key"
+	cExpireAttr = "expire_ts"
+	// cChangesTTL Seconds that the changes are kept on the feed
+	cChangesTTL = 3600
+	// cMaxPublishRetries Max number of attempts to reserve a sequence
+	// number when many changes are published concurrently
+	cMaxPublishRetries = 20
+	// cMaxChangesBehind Max number of changes to be read from the feed, the
+	// followers that are more changes behind load the full state again
+	cMaxChangesBehind = 1000
+	// cMaxGapWait Max time to wait for a change which sequence number was
+	// reserved but that was not stored yet, the publisher could have died
+	cMaxGapWait = 10 * time.Second
+)
+
+// ErrFeedGap A change of the feed is not available, it was not stored yet, or
+// it expired
+var ErrFeedGap = errors.New("A change of the feed is not available")
+
+// ErrFeedBehind The number of changes to be read is too big, or the feed was
+// created again
+var ErrFeedBehind = errors.New("Too many changes to be read from the feed")
+
+// ErrPublishContention The sequence number of the change couldn't be reserved
+// because of the concurrent changes
+var ErrPublishContention = errors.New("The change couldn't be published because of the contention")
+
+// Change Change of an item published on a change feed
+type Change struct {
+	// Seq Sequence number of the change on the feed
+	Seq uint64
+	// Source Table or kind of the changed item
+	Source string
+	// Key Key of the changed item
+	Key string
+}
+
+// ChangeFeed Sequence of the changes of the items of one or many tables,
+// stored on a table where each change is an item identified by its sequence
+// number. The publishers reserve the sequence number of each change with a
+// conditional write over a counter, so the readers only have to read the
+// changes after the last one read instead of scan all the tables
+type ChangeFeed struct {
+	table Table
+}
+
+// NewChangeFeed Returns a change feed stored on the given table
+func NewChangeFeed(table Table) *ChangeFeed {
+	return &ChangeFeed{table: table}
+}
+
+// Publish Appends to the feed the change of the item identified by the key on
+// the given source
+func (cf *ChangeFeed) Publish(source, key string) error {
+	for i := 0; i < cMaxPublishRetries; i++ {
+		row, err := cf.table.GetItemConsistent(&dynamodb.Key{HashKey: cCounterKey}, true)
+		if err != nil && err != dynamodb.ErrNotFound {
+			return err
+		}
+
+		seq := parseSeq(row) + 1
+		err = CompareAndSet(cf.table, cCounterKey, CChangesPrimKey, []dynamodb.Attribute{
+			*dynamodb.NewStringAttribute(CChangesPrimKey, cCounterKey),
+			*dynamodb.NewStringAttribute(cSeqAttr, strconv.FormatUint(seq, 10)),
+		}, row, cSeqAttr)
+		if err == ErrConditionFailed {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		id := strconv.FormatUint(seq, 10)
+		_, err = cf.table.PutItem(id, CChangesPrimKey, []dynamodb.Attribute{
+			*dynamodb.NewStringAttribute(CChangesPrimKey, id),
+			*dynamodb.NewStringAttribute(cSourceAttr, source),
+			*dynamodb.NewStringAttribute(cKeyAttr, key),
+			*dynamodb.NewStringAttribute(cExpireAttr, strconv.FormatInt(time.Now().Unix()+cChangesTTL, 10)),
+		})
+
+		return err
+	}
+
+	return ErrPublishContention
+}
+
+// Last Returns the sequence number of the last change published
+func (cf *ChangeFeed) Last() (uint64, error) {
+	row, err := cf.table.GetItemConsistent(&dynamodb.Key{HashKey: cCounterKey}, true)
+	if err == dynamodb.ErrNotFound {
+		return 0, nil
+	}
+
+	return parseSeq(row), err
+}
+
+// Since Returns the changes published after the given sequence number sorted
+// by sequence number. In case of a change is not available the changes
+// previous to it are returned with ErrFeedGap, and ErrFeedBehind is returned
+// if there are too many changes to read
+func (cf *ChangeFeed) Since(seq uint64) (changes []Change, err error) {
+	last, err := cf.Last()
+	if err != nil {
+		return
+	}
+	// A feed older than the sequence number was stored again from scratch
+	if last < seq || last-seq > cMaxChangesBehind {
+		return nil, ErrFeedBehind
+	}
+
+	for next := seq + 1; next <= last; next++ {
+		row, err := cf.table.GetItemConsistent(&dynamodb.Key{HashKey: strconv.FormatUint(next, 10)}, true)
+		if err == dynamodb.ErrNotFound {
+			return changes, ErrFeedGap
+		}
+		if err != nil {
+			return changes, err
+		}
+
+		change := Change{Seq: next}
+		if attr, ok := row[cSourceAttr]; ok {
+			change.Source = attr.Value
+		}
+		if attr, ok := row[cKeyAttr]; ok {
+			change.Key = attr.Value
+		}
+		changes = append(changes, change)
+	}
+
+	return
+}
+
+// Prune Removes from the feed the changes that expired, and the ones that are
+// too old to be read by the followers, see cMaxChangesBehind. The storage
+// doesn't remove the expired changes by itself, so the leader of the cluster
+// prunes the feeds periodically. Returns the number of removed changes
+func (cf *ChangeFeed) Prune() (removed int, err error) {
+	last, err := cf.Last()
+	if err != nil {
+		return
+	}
+	rows, err := cf.table.Scan(nil)
+	if err != nil {
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, row := range rows {
+		attr, ok := row[CChangesPrimKey]
+		if !ok || attr.Value == cCounterKey {
+			continue
+		}
+		seq, parseErr := strconv.ParseUint(attr.Value, 10, 64)
+		if parseErr != nil {
+			continue
+		}
+		expired := false
+		if expire, ok := row[cExpireAttr]; ok {
+			ts, _ := strconv.ParseInt(expire.Value, 10, 64)
+			expired = ts <= now
+		}
+		if !expired && seq+cMaxChangesBehind > last {
+			continue
+		}
+
+		if _, err = cf.table.DeleteItem(&dynamodb.Key{HashKey: attr.Value}); err != nil {
+			return
+		}
+		removed++
+	}
+
+	return
+}
+
+// parseSeq Returns the sequence number stored on the counter, zero if it was
+// not stored yet
+func parseSeq(row map[string]*dynamodb.Attribute) (seq uint64) {
+	if attr, ok := row[cSeqAttr]; ok {
+		seq, _ = strconv.ParseUint(attr.Value, 10, 64)
+	}
+
+	return
+}
+
+// Follower Keeps updated a state in memory applying the changes of a feed,
+// the full state is loaded again periodically, and when the follower can't get
+// all the changes, so the state is eventually consistent even if a change is
+// lost
+type Follower struct {
+	feed         *ChangeFeed
+	resyncPeriod time.Duration
+	apply        func(changes []Change)
+	resync       func() error
+
+	// seq Sequence number of the last change applied
+	seq        uint64
+	lastResync time.Time
+	// gapSince Time when the change after seq was found missing for the
+	// first time, zero if there is no gap
+	gapSince time.Time
+	mutex    sync.Mutex
+}
+
+// NewFollower Returns a follower of the feed that calls apply with the new
+// changes, and resync in order to load the full state on the first sync, after
+// each resync period, and when the changes can't be read from the feed
+func NewFollower(feed *ChangeFeed, resyncPeriod time.Duration, apply func(changes []Change), resync func() error) *Follower {
+	return &Follower{
+		feed:         feed,
+		resyncPeriod: resyncPeriod,
+		apply:        apply,
+		resync:       resync,
+	}
+}
+
+// Sync Applies the changes published since the last sync, or loads the full
+// state if it is required
+func (fl *Follower) Sync() {
+	fl.mutex.Lock()
+	defer fl.mutex.Unlock()
+
+	if fl.lastResync.IsZero() || time.Since(fl.lastResync) > fl.resyncPeriod {
+		fl.fullSync()
+		return
+	}
+
+	changes, err := fl.feed.Since(fl.seq)
+	if len(changes) > 0 {
+		fl.apply(changes)
+		fl.seq = changes[len(changes)-1].Seq
+		fl.gapSince = time.Time{}
+	}
+
+	switch err {
+	case nil:
+		fl.gapSince = time.Time{}
+	case ErrFeedGap:
+		// The change could be still being published
+		if fl.gapSince.IsZero() {
+			fl.gapSince = time.Now()
+		} else if time.Since(fl.gapSince) > cMaxGapWait {
+			log.Info("A change after:", fl.seq, "is not available on the feed, loading the full state")
+			fl.fullSync()
+		}
+	case ErrFeedBehind:
+		fl.fullSync()
+	default:
+		log.Error("Problem trying to read the changes from the feed, Error:", err)
+	}
+}
+
+// fullSync Loads the full state, the sequence number is read before load it,
+// so the changes published during the load are applied again by the next sync
+func (fl *Follower) fullSync() {
+	last, err := fl.feed.Last()
+	if err != nil {
+		log.Error("Problem trying to read the last change of the feed, Error:", err)
+		return
+	}
+	if err = fl.resync(); err != nil {
+		return
+	}
+
+	fl.seq = last
+	fl.lastResync = time.Now()
+	fl.gapSince = time.Time{}
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"github.com/goamz/goamz/dynamodb"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestChangeFeedSince(t *testing.T) {
+	table := NewMemTable()
+	feed := NewChangeFeed(table)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := feed.Publish("groups", key); err != nil {
+			t.Fatal("Problem publishing the change of:", key, "Error:", err)
+		}
+	}
+
+	if last, err := feed.Last(); err != nil || last != 3 {
+		t.Error("Expected three changes on the feed, last:", last, "Error:", err)
+	}
+
+	changes, err := feed.Since(1)
+	if err != nil || len(changes) != 2 {
+		t.Fatal("Expected two changes after the first one, changes:", changes, "Error:", err)
+	}
+	if changes[0].Seq != 2 || changes[0].Key != "b" || changes[1].Seq != 3 || changes[1].Key != "c" || changes[1].Source != "groups" {
+		t.Error("Unexpected changes:", changes)
+	}
+
+	// A change which sequence number was reserved but that was not stored
+	table.DeleteItem(&dynamodb.Key{HashKey: "3"})
+	changes, err = feed.Since(0)
+	if err != ErrFeedGap || len(changes) != 2 {
+		t.Error("Expected the changes previous to the gap, changes:", changes, "Error:", err)
+	}
+
+	if _, err = feed.Since(10); err != ErrFeedBehind {
+		t.Error("Expected ErrFeedBehind for a sequence number after the last change, Error:", err)
+	}
+}
+
+func TestChangeFeedPrune(t *testing.T) {
+	table := NewMemTable()
+	feed := NewChangeFeed(table)
+
+	for i := 0; i < cMaxChangesBehind+5; i++ {
+		if err := feed.Publish("groups", strconv.Itoa(i)); err != nil {
+			t.Fatal("Problem publishing the change:", i, "Error:", err)
+		}
+	}
+	// An expired change that could be still read by the followers
+	expired := strconv.Itoa(cMaxChangesBehind + 2)
+	table.PutItem(expired, CChangesPrimKey, []dynamodb.Attribute{
+		*dynamodb.NewStringAttribute(CChangesPrimKey, expired),
+		*dynamodb.NewStringAttribute(cKeyAttr, "expired"),
+		*dynamodb.NewStringAttribute(cExpireAttr, strconv.FormatInt(time.Now().Unix()-1, 10)),
+	})
+
+	if removed, err := feed.Prune(); err != nil || removed != 6 {
+		t.Error("Expected the five changes too old to be read and the expired one to be removed, removed:", removed, "Error:", err)
+	}
+	if removed, err := feed.Prune(); err != nil || removed != 0 {
+		t.Error("No changes were expected to be removed again, removed:", removed, "Error:", err)
+	}
+
+	// The counter and the changes after the last cMaxChangesBehind are kept
+	if last, err := feed.Last(); err != nil || last != cMaxChangesBehind+5 {
+		t.Error("The counter of the feed was modified, last:", last, "Error:", err)
+	}
+	changes, err := feed.Since(cMaxChangesBehind + 2)
+	if err != nil || len(changes) != 3 {
+		t.Error("Expected the last three changes, changes:", changes, "Error:", err)
+	}
+	if _, err = feed.Since(5); err != ErrFeedGap {
+		t.Error("Expected ErrFeedGap for the expired change, Error:", err)
+	}
+	if _, err = feed.Since(4); err != ErrFeedBehind {
+		t.Error("Expected ErrFeedBehind for the removed changes, Error:", err)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	table := NewMemTable()
+	feed := NewChangeFeed(table)
+	resyncs := 0
+	applied := []string{}
+	follower := NewFollower(feed, time.Hour, func(changes []Change) {
+		for _, change := range changes {
+			applied = append(applied, change.Key)
+		}
+	}, func() error {
+		resyncs++
+		return nil
+	})
+
+	feed.Publish("instances", "before")
+	follower.Sync()
+	if resyncs != 1 || len(applied) != 0 {
+		t.Error("Expected a full sync without changes on the first sync, resyncs:", resyncs, "applied:", applied)
+	}
+
+	feed.Publish("instances", "a")
+	feed.Publish("instances", "b")
+	follower.Sync()
+	follower.Sync()
+	if resyncs != 1 || len(applied) != 2 || applied[0] != "a" || applied[1] != "b" {
+		t.Error("Expected the changes after the first sync applied once, resyncs:", resyncs, "applied:", applied)
+	}
+
+	// The feed was stored again from scratch
+	table.DeleteItem(&dynamodb.Key{HashKey: cCounterKey})
+	follower.Sync()
+	if resyncs != 2 {
+		t.Error("Expected a full sync after the feed was recreated, resyncs:", resyncs)
+	}
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"github.com/alonsovidales/pit/log"
+	"github.com/goamz/goamz/dynamodb"
+	"sync"
+	"time"
+)
+
+// Lease Ownership of an item kept alive periodically by its owner, used to
+// elect a single instance of the cluster. The lease is acquired when it is
+// free or expired, and its owner considers it held only during the half of the
+// ttl after the last time that it was kept alive, so the owner stops to use it
+// before another instance can acquire it even if their clocks are skewed up to
+// the half of the ttl
+type Lease struct {
+	table   Table
+	hashKey string
+	primKey string
+	owner   string
+	ttl     int64
+
+	own Ownership
+	// heldUntil Time stamp until which the lease is considered held
+	heldUntil int64
+	mutex     sync.Mutex
+}
+
+// NewLease Returns a lease of the given owner stored on the item identified by
+// the hash key, the lease expires after ttl seconds without be kept alive
+func NewLease(table Table, hashKey, primKey, owner string, ttl int64) *Lease {
+	return &Lease{
+		table:   table,
+		hashKey: hashKey,
+		primKey: primKey,
+		owner:   owner,
+		ttl:     ttl,
+	}
+}
+
+// Keep Acquires the lease if it is free or expired, or keeps it alive if it is
+// already owned, returns if the lease is held
+func (ls *Lease) Keep() bool {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	now := time.Now().Unix()
+	if ls.own.Owner == "" {
+		own, err := AcquireOwnership(ls.table, ls.hashKey, ls.primKey, ls.owner, ls.ttl, now, ls.item)
+		if err == nil {
+			ls.own = own
+			ls.heldUntil = now + ls.ttl/2
+		} else if err != ErrOwned && err != ErrConditionFailed {
+			log.Error("Problem trying to acquire the lease:", ls.hashKey, "Error:", err)
+		}
+
+		return ls.held(now)
+	}
+
+	own, err := KeepOwnership(ls.table, ls.hashKey, ls.primKey, ls.own, now, ls.item)
+	switch err {
+	case nil:
+		ls.own = own
+		ls.heldUntil = now + ls.ttl/2
+	case ErrFenced:
+		log.Info("The lease:", ls.hashKey, "was acquired by another owner")
+		ls.own = Ownership{}
+		ls.heldUntil = 0
+	default:
+		// The lease is kept alive again on the next call, in the
+		// meantime it expires locally
+		log.Error("Problem trying to keep alive the lease:", ls.hashKey, "Error:", err)
+	}
+
+	return ls.held(now)
+}
+
+// Held Returns if the lease is held by the owner
+func (ls *Lease) Held() bool {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	return ls.held(time.Now().Unix())
+}
+
+func (ls *Lease) held(now int64) bool {
+	return now < ls.heldUntil
+}
+
+// item Returns the attributes of the item that stores the lease
+func (ls *Lease) item(own Ownership) []dynamodb.Attribute {
+	return []dynamodb.Attribute{
+		*dynamodb.NewStringAttribute(ls.primKey, ls.hashKey),
+	}
+}
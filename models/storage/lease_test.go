@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"github.com/goamz/goamz/dynamodb"
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	table := NewMemTable()
+	leaseA := NewLease(table, "leader", "id", "a", 10)
+	leaseB := NewLease(table, "leader", "id", "b", 10)
+
+	if !leaseA.Keep() || !leaseA.Held() {
+		t.Fatal("The free lease was not acquired")
+	}
+	if leaseB.Keep() || leaseB.Held() {
+		t.Error("The lease was acquired while it is held by another owner")
+	}
+	if !leaseA.Keep() {
+		t.Error("The lease was not kept alive by its owner")
+	}
+
+	// The owner stops to keep alive the lease until it expires
+	own, _, _ := ReadOwnership(table, "leader")
+	own.LastTs = time.Now().Unix() - 11
+	table.PutItem("leader", "id", own.Item(func(own Ownership) []dynamodb.Attribute {
+		return []dynamodb.Attribute{*dynamodb.NewStringAttribute("id", "leader")}
+	}))
+
+	if !leaseB.Keep() {
+		t.Fatal("The expired lease was not acquired")
+	}
+	if leaseA.Keep() || leaseA.Held() {
+		t.Error("The lease is still held after be acquired by another owner")
+	}
+	if !leaseB.Held() {
+		t.Error("The lease is not held by the new owner")
+	}
+}
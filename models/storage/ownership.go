@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"errors"
+	"github.com/goamz/goamz/dynamodb"
+	"strconv"
+)
+
+const (
+	// cOwnerAttr, cEpochAttr and cLastTsAttr Attributes of the items that
+	// store the ownership, compared by the conditional writes
+	cOwnerAttr  = "owner"
+	cEpochAttr  = "epoch"
+	cLastTsAttr = "last_ts"
+)
+
+// ErrOwned The item is owned by another owner and its ownership didn't expire
+var ErrOwned = errors.New("The item is owned by another instance")
+
+// ErrFenced The item was acquired by another owner, or again by the same
+// owner, after the ownership used
+var ErrFenced = errors.New("The ownership of the item has a newer epoch")
+
+// Ownership Owner of an item of a table, the ownership is acquired, kept alive
+// and released using conditional writes over the owner, the epoch and the time
+// stamp of the item, so only one of the instances that compete for a free item
+// can acquire it, and an instance that lost the ownership can't modify it
+type Ownership struct {
+	// Owner Host name of the owner, empty if the item is free
+	Owner string
+	// Epoch Increased each time the item is acquired
+	Epoch uint64
+	// LastTs Time stamp when the ownership was acquired or kept alive for
+	// the last time
+	LastTs int64
+}
+
+// ItemFunc Returns the attributes of the item to be stored with the given
+// ownership, the attributes of the ownership are added to them
+type ItemFunc func(own Ownership) []dynamodb.Attribute
+
+// Item Returns the attributes of the item returned by the function with the
+// attributes of the ownership
+func (own Ownership) Item(item ItemFunc) []dynamodb.Attribute {
+	return append(item(own),
+		*dynamodb.NewStringAttribute(cOwnerAttr, own.Owner),
+		*dynamodb.NewStringAttribute(cEpochAttr, strconv.FormatUint(own.Epoch, 10)),
+		*dynamodb.NewStringAttribute(cLastTsAttr, strconv.FormatInt(own.LastTs, 10)))
+}
+
+// ReadOwnership Returns the ownership of the item identified by the hash key
+// and the stored item using a consistent read
+func ReadOwnership(table Table, hashKey string) (own Ownership, row map[string]*dynamodb.Attribute, err error) {
+	row, err = table.GetItemConsistent(&dynamodb.Key{HashKey: hashKey}, true)
+	if err != nil {
+		return
+	}
+
+	if attr, ok := row[cOwnerAttr]; ok {
+		own.Owner = attr.Value
+	}
+	if attr, ok := row[cEpochAttr]; ok {
+		own.Epoch, _ = strconv.ParseUint(attr.Value, 10, 64)
+	}
+	if attr, ok := row[cLastTsAttr]; ok {
+		own.LastTs, _ = strconv.ParseInt(attr.Value, 10, 64)
+	}
+
+	return
+}
+
+// AcquireOwnership Acquires the ownership of the item for the owner increasing
+// its epoch, the item has to be free, or its ownership has to be older than ttl
+// at now. The item is created if it doesn't exist. Returns ErrOwned if the item
+// is owned, or ErrConditionFailed if the item was modified concurrently
+func AcquireOwnership(table Table, hashKey, rangeKey, owner string, ttl, now int64, item ItemFunc) (own Ownership, err error) {
+	prev, row, err := ReadOwnership(table, hashKey)
+	if err != nil && err != dynamodb.ErrNotFound {
+		return
+	}
+	if prev.Owner != "" && prev.LastTs+ttl >= now {
+		return prev, ErrOwned
+	}
+
+	own = Ownership{Owner: owner, Epoch: prev.Epoch + 1, LastTs: now}
+
+	return own, CompareAndSet(table, hashKey, rangeKey, own.Item(item), row, cOwnerAttr, cEpochAttr, cLastTsAttr)
+}
+
+// KeepOwnership Updates the time stamp of the item owned with the given
+// ownership to now. Returns ErrFenced if the item was acquired after it, or
+// ErrConditionFailed if the item was modified concurrently
+func KeepOwnership(table Table, hashKey, rangeKey string, own Ownership, now int64, item ItemFunc) (Ownership, error) {
+	prev, row, err := ReadOwnership(table, hashKey)
+	if err != nil {
+		return own, err
+	}
+	if prev.Owner != own.Owner || prev.Epoch != own.Epoch {
+		return own, ErrFenced
+	}
+
+	own.LastTs = now
+
+	return own, CompareAndSet(table, hashKey, rangeKey, own.Item(item), row, cOwnerAttr, cEpochAttr, cLastTsAttr)
+}
+
+// ReleaseOwnership Frees the item owned with the given ownership keeping its
+// epoch. Returns ErrFenced if the item was acquired after it, or
+// ErrConditionFailed if the item was modified concurrently
+func ReleaseOwnership(table Table, hashKey, rangeKey string, own Ownership, item ItemFunc) error {
+	prev, row, err := ReadOwnership(table, hashKey)
+	if err != nil {
+		return err
+	}
+	if prev.Owner != own.Owner || prev.Epoch != own.Epoch {
+		return ErrFenced
+	}
+
+	free := Ownership{Epoch: prev.Epoch, LastTs: prev.LastTs}
+
+	return CompareAndSet(table, hashKey, rangeKey, free.Item(item), row, cOwnerAttr, cEpochAttr, cLastTsAttr)
+}
+
+// CheckOwnership Returns ErrFenced if the item is not owned anymore with the
+// given ownership
+func CheckOwnership(table Table, hashKey string, own Ownership) error {
+	prev, _, err := ReadOwnership(table, hashKey)
+	if err != nil {
+		return err
+	}
+	if prev.Owner != own.Owner || prev.Epoch != own.Epoch {
+		return ErrFenced
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/goamz/goamz/dynamodb"
+	"math/rand"
+	"testing"
+)
+
+const (
+	cSimInstances = 10
+	cSimItems     = 3
+	cSimSteps     = 20000
+	cSimTTL       = 10
+	// cSimMaxInterleaved Max number of operations of other instances
+	// nested between the read and the write of an item
+	cSimMaxInterleaved = 3
+)
+
+// interleavedTable Table that runs the operations of other instances after
+// each read of an item, so between the read and the write of the item,
+// simulating the races between the instances that compete for the same items
+type interleavedTable struct {
+	*MemTable
+
+	interleave func()
+	depth      int
+}
+
+func (it *interleavedTable) GetItemConsistent(key *dynamodb.Key, consistentRead bool) (map[string]*dynamodb.Attribute, error) {
+	row, err := it.MemTable.GetItemConsistent(key, consistentRead)
+	if it.interleave != nil && it.depth < cSimMaxInterleaved {
+		it.depth++
+		it.interleave()
+		it.depth--
+	}
+
+	return row, err
+}
+
+// simInstance Instance of the simulation, the clock of each instance is
+// skewed, and the instances can believe that they own items after lose them
+type simInstance struct {
+	name  string
+	skew  int64
+	owned map[string]Ownership
+}
+
+func simItem(key string) ItemFunc {
+	return func(own Ownership) []dynamodb.Attribute {
+		return []dynamodb.Attribute{
+			*dynamodb.NewStringAttribute("id", key),
+			*dynamodb.NewStringAttribute("info", fmt.Sprint(own)),
+		}
+	}
+}
+
+func TestOwnershipProperties(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	table := &interleavedTable{MemTable: NewMemTable()}
+
+	instances := make([]*simInstance, cSimInstances)
+	for i := range instances {
+		instances[i] = &simInstance{
+			name:  fmt.Sprintf("instance-%d", i),
+			skew:  rnd.Int63n(cSimTTL) - cSimTTL/2,
+			owned: make(map[string]Ownership),
+		}
+	}
+	keys := make([]string, cSimItems)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("item-%d", i)
+	}
+
+	now := int64(1000)
+	// lastAcquired The last successful acquisition of each item, and if
+	// the owner released it after that
+	lastAcquired := make(map[string]Ownership)
+	released := make(map[string]bool)
+	acquired, conflicts, fenced := 0, 0, 0
+
+	step := func() {
+		inst := instances[rnd.Intn(len(instances))]
+		key := keys[rnd.Intn(len(keys))]
+		clock := now + inst.skew
+
+		switch op := rnd.Intn(6); {
+		case op < 2:
+			own, err := AcquireOwnership(table, key, "id", inst.name, cSimTTL, clock, simItem(key))
+			switch err {
+			case nil:
+				if own.Epoch != lastAcquired[key].Epoch+1 {
+					t.Fatal("The item:", key, "was acquired with the epoch:", own.Epoch, "after the epoch:", lastAcquired[key].Epoch)
+				}
+				lastAcquired[key], released[key] = own, false
+				inst.owned[key] = own
+				acquired++
+			case ErrConditionFailed:
+				conflicts++
+			case ErrOwned:
+			default:
+				t.Fatal("Unexpected error acquiring the item:", key, "Error:", err)
+			}
+		case op < 4:
+			own, ok := inst.owned[key]
+			if !ok {
+				return
+			}
+			own, err := KeepOwnership(table, key, "id", own, clock, simItem(key))
+			switch err {
+			case nil:
+				if own.Owner != lastAcquired[key].Owner || own.Epoch != lastAcquired[key].Epoch || released[key] {
+					t.Fatal("The ownership:", own, "of the item:", key, "was kept alive after the acquisition:", lastAcquired[key], "released:", released[key])
+				}
+				inst.owned[key] = own
+			case ErrFenced:
+				delete(inst.owned, key)
+				fenced++
+			case ErrConditionFailed:
+				conflicts++
+			default:
+				t.Fatal("Unexpected error keeping alive the item:", key, "Error:", err)
+			}
+		case op < 5:
+			own, ok := inst.owned[key]
+			if !ok {
+				return
+			}
+			err := ReleaseOwnership(table, key, "id", own, simItem(key))
+			switch err {
+			case nil:
+				if own.Owner != lastAcquired[key].Owner || own.Epoch != lastAcquired[key].Epoch || released[key] {
+					t.Fatal("The ownership:", own, "of the item:", key, "was released after the acquisition:", lastAcquired[key], "released:", released[key])
+				}
+				released[key] = true
+				delete(inst.owned, key)
+			case ErrFenced:
+				delete(inst.owned, key)
+				fenced++
+			case ErrConditionFailed:
+				conflicts++
+			default:
+				t.Fatal("Unexpected error releasing the item:", key, "Error:", err)
+			}
+		default:
+			// The time passes, the owners that don't keep alive
+			// their items lose them, as after a GC pause
+			now += rnd.Int63n(cSimTTL)
+		}
+	}
+	table.interleave = func() {
+		if rnd.Intn(2) == 0 {
+			step()
+		}
+	}
+
+	for i := 0; i < cSimSteps; i++ {
+		step()
+
+		for _, key := range keys {
+			stored, _, err := ReadOwnership(table.MemTable, key)
+			if err == dynamodb.ErrNotFound && lastAcquired[key].Epoch == 0 {
+				continue
+			}
+			expected := lastAcquired[key]
+			if released[key] {
+				expected.Owner = ""
+			}
+			if err != nil || stored.Owner != expected.Owner || stored.Epoch != expected.Epoch {
+				t.Fatal("The stored ownership:", stored, "of the item:", key, "doesn't match the last acquisition:", expected, "Error:", err)
+			}
+		}
+	}
+
+	if acquired == 0 || conflicts == 0 || fenced == 0 {
+		t.Error("The simulation didn't exercise the protocol, acquisitions:", acquired, "conflicts:", conflicts, "fenced:", fenced)
+	}
+}
@@ -0,0 +1,187 @@
+package storage
+
+// Package that defines the operations used by the models over the DynamoDB
+// tables, allowing to replace the tables by an in memory implementation in
+// order to run instances of the system without access to AWS
+
+import (
+	"errors"
+	"github.com/goamz/goamz/dynamodb"
+	"strings"
+	"sync"
+)
+
+const (
+	// cConditionFailedCode Code of the errors returned by DynamoDB when the
+	// condition of a conditional write is not satisfied
+	cConditionFailedCode = "ConditionalCheckFailedException"
+)
+
+// ErrUnsupportedComparison The comparison operator used on a scan is not
+// supported by the in memory table
+var ErrUnsupportedComparison = errors.New("Unsupported comparison operator")
+
+// ErrConditionFailed The stored item doesn't satisfy the condition of a
+// conditional write
+var ErrConditionFailed = errors.New("The conditional write failed")
+
+// Table Operations performed by the models over a table, this interface is
+// implemented by *dynamodb.Table
+type Table interface {
+	// PutItem Stores the attributes of an item identified by the hash key
+	PutItem(hashKey, rangeKey string, attributes []dynamodb.Attribute) (bool, error)
+	// ConditionalPutItem Stores the attributes of an item only if the
+	// stored item has the expected attributes, the expected attributes
+	// with Exists set to "false" can't be present on the stored item
+	ConditionalPutItem(hashKey, rangeKey string, attributes, expected []dynamodb.Attribute) (bool, error)
+	// GetItemConsistent Returns the attributes of the item identified by
+	// the key
+	GetItemConsistent(key *dynamodb.Key, consistentRead bool) (map[string]*dynamodb.Attribute, error)
+	// DeleteItem Removes the item identified by the key
+	DeleteItem(key *dynamodb.Key) (bool, error)
+	// Scan Returns all the items that matches with all the comparisons
+	Scan(attributeComparisons []dynamodb.AttributeComparison) ([]map[string]*dynamodb.Attribute, error)
+}
+
+// MemTable Table that keeps all the items in memory, the items are identified
+// only by the hash key
+type MemTable struct {
+	items map[string][]dynamodb.Attribute
+	mutex sync.Mutex
+}
+
+// NewMemTable Returns an empty in memory table
+func NewMemTable() *MemTable {
+	return &MemTable{
+		items: make(map[string][]dynamodb.Attribute),
+	}
+}
+
+// PutItem Stores the attributes of an item replacing the previous ones
+func (mt *MemTable) PutItem(hashKey, rangeKey string, attributes []dynamodb.Attribute) (bool, error) {
+	item := make([]dynamodb.Attribute, len(attributes))
+	copy(item, attributes)
+
+	mt.mutex.Lock()
+	mt.items[hashKey] = item
+	mt.mutex.Unlock()
+
+	return true, nil
+}
+
+// ConditionalPutItem Stores the attributes of an item replacing the previous
+// ones only if the stored item has the expected attributes, see Table,
+// ErrConditionFailed is returned otherwise
+func (mt *MemTable) ConditionalPutItem(hashKey, rangeKey string, attributes, expected []dynamodb.Attribute) (bool, error) {
+	item := make([]dynamodb.Attribute, len(attributes))
+	copy(item, attributes)
+
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	stored := attributesMap(mt.items[hashKey])
+	for _, exp := range expected {
+		attr, ok := stored[exp.Name]
+		if exp.Exists == "false" {
+			if ok {
+				return false, ErrConditionFailed
+			}
+		} else if !ok || attr.Value != exp.Value {
+			return false, ErrConditionFailed
+		}
+	}
+	mt.items[hashKey] = item
+
+	return true, nil
+}
+
+// GetItemConsistent Returns the attributes of the item identified by the hash
+// key, or dynamodb.ErrNotFound if the item doesn't exists
+func (mt *MemTable) GetItemConsistent(key *dynamodb.Key, consistentRead bool) (map[string]*dynamodb.Attribute, error) {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	item, ok := mt.items[key.HashKey]
+	if !ok {
+		return nil, dynamodb.ErrNotFound
+	}
+
+	return attributesMap(item), nil
+}
+
+// DeleteItem Removes the item identified by the hash key
+func (mt *MemTable) DeleteItem(key *dynamodb.Key) (bool, error) {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	if _, ok := mt.items[key.HashKey]; !ok {
+		return false, dynamodb.ErrNotFound
+	}
+	delete(mt.items, key.HashKey)
+
+	return true, nil
+}
+
+// Scan Returns all the items with an attribute equal to the value of each one
+// of the comparisons, only the equal operator is supported
+func (mt *MemTable) Scan(attributeComparisons []dynamodb.AttributeComparison) (rows []map[string]*dynamodb.Attribute, err error) {
+	for _, comp := range attributeComparisons {
+		if comp.ComparisonOperator != dynamodb.COMPARISON_EQUAL || len(comp.AttributeValueList) != 1 {
+			return nil, ErrUnsupportedComparison
+		}
+	}
+
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	rows = []map[string]*dynamodb.Attribute{}
+	for _, item := range mt.items {
+		row := attributesMap(item)
+		matches := true
+		for _, comp := range attributeComparisons {
+			attr, ok := row[comp.AttributeName]
+			matches = matches && ok && attr.Value == comp.AttributeValueList[0].Value
+		}
+		if matches {
+			rows = append(rows, row)
+		}
+	}
+
+	return
+}
+
+// CompareAndSet Stores the attributes of an item only if the named attributes
+// of the stored item didn't change since it was read as prev, the attributes
+// not present on prev can't be present on the stored item. ErrConditionFailed
+// is returned if the stored item was modified
+func CompareAndSet(table Table, hashKey, rangeKey string, attributes []dynamodb.Attribute, prev map[string]*dynamodb.Attribute, names ...string) error {
+	expected := make([]dynamodb.Attribute, len(names))
+	for i, name := range names {
+		if attr, ok := prev[name]; ok {
+			expected[i] = *dynamodb.NewStringAttribute(name, attr.Value)
+		} else {
+			expected[i] = dynamodb.Attribute{Name: name, Exists: "false"}
+		}
+	}
+
+	if _, err := table.ConditionalPutItem(hashKey, rangeKey, attributes, expected); err != nil {
+		if err == ErrConditionFailed || strings.Contains(err.Error(), cConditionFailedCode) {
+			return ErrConditionFailed
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// attributesMap Returns a copy of the attributes of an item by name
+func attributesMap(item []dynamodb.Attribute) (attrs map[string]*dynamodb.Attribute) {
+	attrs = make(map[string]*dynamodb.Attribute, len(item))
+	for _, attr := range item {
+		attrCopy := attr
+		attrs[attr.Name] = &attrCopy
+	}
+
+	return
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"github.com/goamz/goamz/dynamodb"
+	"testing"
+)
+
+// Check that the DynamoDB tables can be used by the models
+var _ Table = (*dynamodb.Table)(nil)
+
+func TestMemTable(t *testing.T) {
+	table := NewMemTable()
+	for _, key := range []string{"a", "b", "c"} {
+		attribs := []dynamodb.Attribute{
+			*dynamodb.NewStringAttribute("id", key),
+			*dynamodb.NewStringAttribute("info", "info_"+key),
+		}
+		if _, err := table.PutItem(key, "id", attribs); err != nil {
+			t.Fatal("Problem storing item:", key, "Error:", err)
+		}
+	}
+
+	item, err := table.GetItemConsistent(&dynamodb.Key{HashKey: "b"}, true)
+	if err != nil || item["info"].Value != "info_b" {
+		t.Error("Unexpected item:", item, "Error:", err)
+	}
+
+	// The returned items can't modify the stored ones
+	item["info"].Value = "modified"
+	if item, _ = table.GetItemConsistent(&dynamodb.Key{HashKey: "b"}, true); item["info"].Value != "info_b" {
+		t.Error("The stored item was modified:", item["info"].Value)
+	}
+
+	if _, err = table.DeleteItem(&dynamodb.Key{HashKey: "a"}); err != nil {
+		t.Error("Problem removing item, Error:", err)
+	}
+	if _, err = table.GetItemConsistent(&dynamodb.Key{HashKey: "a"}, true); err != dynamodb.ErrNotFound {
+		t.Error("Expected not found error for a removed item, obtained:", err)
+	}
+
+	rows, err := table.Scan(nil)
+	if err != nil || len(rows) != 2 {
+		t.Error("Expected two items, obtained:", rows, "Error:", err)
+	}
+
+	rows, err = table.Scan([]dynamodb.AttributeComparison{
+		*dynamodb.NewStringAttributeComparison("info", dynamodb.COMPARISON_EQUAL, "info_c"),
+	})
+	if err != nil || len(rows) != 1 || rows[0]["id"].Value != "c" {
+		t.Error("Expected only the item c, obtained:", rows, "Error:", err)
+	}
+
+	_, err = table.Scan([]dynamodb.AttributeComparison{
+		*dynamodb.NewStringAttributeComparison("info", dynamodb.COMPARISON_GREATER_THAN, "info_c"),
+	})
+	if err != ErrUnsupportedComparison {
+		t.Error("Expected unsupported comparison error, obtained:", err)
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	table := NewMemTable()
+	item := func(owner, epoch string) []dynamodb.Attribute {
+		return []dynamodb.Attribute{
+			*dynamodb.NewStringAttribute("id", "a"),
+			*dynamodb.NewStringAttribute("owner", owner),
+			*dynamodb.NewStringAttribute("epoch", epoch),
+		}
+	}
+
+	// The item can be created only if it doesn't exist
+	if err := CompareAndSet(table, "a", "id", item("x", "1"), nil, "owner", "epoch"); err != nil {
+		t.Fatal("Problem creating the item, Error:", err)
+	}
+	if err := CompareAndSet(table, "a", "id", item("y", "1"), nil, "owner", "epoch"); err != ErrConditionFailed {
+		t.Error("An existing item was created again, Error:", err)
+	}
+
+	prev, _ := table.GetItemConsistent(&dynamodb.Key{HashKey: "a"}, true)
+	if err := CompareAndSet(table, "a", "id", item("y", "2"), prev, "owner", "epoch"); err != nil {
+		t.Error("Problem updating the item, Error:", err)
+	}
+	// The item was modified after read it
+	if err := CompareAndSet(table, "a", "id", item("z", "2"), prev, "owner", "epoch"); err != ErrConditionFailed {
+		t.Error("The item was updated from an outdated version, Error:", err)
+	}
+
+	stored, _ := table.GetItemConsistent(&dynamodb.Key{HashKey: "a"}, true)
+	if stored["owner"].Value != "y" || stored["epoch"].Value != "2" {
+		t.Error("Unexpected stored item:", stored["owner"], stored["epoch"])
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"github.com/alonsovidales/pit/cfg"
 	"github.com/alonsovidales/pit/log"
+	"github.com/alonsovidales/pit/models/storage"
 	"github.com/goamz/goamz/aws"
 	"github.com/goamz/goamz/dynamodb"
 	"golang.org/x/crypto/pbkdf2"
@@ -90,7 +91,7 @@ type Model struct {
 	secret    []byte
 	tableName string
 	conn      *dynamodb.Server
-	table     *dynamodb.Table
+	table     storage.Table
 	cache     map[string]*User
 	mutex     sync.Mutex
 }
@@ -190,10 +191,26 @@ func GetModel(prefix string, awsRegion string) (um *Model) {
 	return
 }
 
+// NewModel Returns a new user model that persists the users on the given table
+// and starts the task that keeps synchronized the information in memory
+func NewModel(table storage.Table) (um *Model) {
+	um = &Model{
+		secret: []byte(os.Getenv("PIT_SECRET")),
+		cache:  make(map[string]*User),
+		table:  table,
+	}
+
+	go um.cacheManager()
+
+	return
+}
+
 func (um *Model) cacheManager() {
 	c := time.Tick(cCacheTTL)
 	for _ = range c {
+		um.mutex.Lock()
 		um.cache = make(map[string]*User)
+		um.mutex.Unlock()
 	}
 }
 
@@ -284,7 +301,11 @@ func (um *Model) AdminGetUserInfoByID(uid string) (user *User) {
 		log.Error("Problem trying to read the user information for user:", uid, "Error:", err)
 	}
 
-	um.cache[uid] = user
+	// Users not found are not cached in order to allow to access to them
+	// just after the registration
+	if user != nil {
+		um.cache[uid] = user
+	}
 	return
 }
 
@@ -548,9 +569,10 @@ func (us *User) persist() bool {
 
 func (um *Model) initTable() {
 	pKey := dynamodb.PrimaryKey{dynamodb.NewStringAttribute(cPrimKey, ""), nil}
-	um.table = um.conn.NewTable(um.tableName, pKey)
+	table := um.conn.NewTable(um.tableName, pKey)
+	um.table = table
 
-	res, err := um.table.DescribeTable()
+	res, err := table.DescribeTable()
 	if err != nil {
 		log.Info("Creating a new table on DynamoDB:", um.tableName)
 		td := dynamodb.TableDescriptionT{
@@ -570,12 +592,12 @@ func (um *Model) initTable() {
 		if _, err := um.conn.CreateTable(td); err != nil {
 			log.Error("Error trying to create a table on Dynamo DB, table:", um.tableName, "Error:", err)
 		}
-		if res, err = um.table.DescribeTable(); err != nil {
+		if res, err = table.DescribeTable(); err != nil {
 			log.Error("Error trying to describe a table on Dynamo DB, table:", um.tableName, "Error:", err)
 		}
 	}
 	for "ACTIVE" != res.TableStatus {
-		if res, err = um.table.DescribeTable(); err != nil {
+		if res, err = table.DescribeTable(); err != nil {
 			log.Error("Can't describe Dynamo DB instances table, Error:", err)
 		}
 		log.Debug("Waiting for active table, current status:", res.TableStatus)
@@ -0,0 +1,120 @@
+// Package ratelimit Token bucket limiter used to control the number of
+// requests / sec that can be performed against a resource
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// cIdleTTL Time after which the buckets that were not used are removed
+const cIdleTTL = 5 * time.Minute
+
+// Quota State of a bucket after try to take tokens from it
+type Quota struct {
+	// Allowed Indicates if the tokens could be taken
+	Allowed bool
+	// Remaining Number of tokens that are still available on the bucket
+	Remaining float64
+	// RetryAfter Time to wait until the requested tokens are available,
+	// only defined if the tokens couldn't be taken
+	RetryAfter time.Duration
+}
+
+// bucket Token bucket refilled at rate tokens / sec up to burst tokens
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Limiter Set of token buckets identified by key, the rate and burst of each
+// bucket are specified on each call in order to allow them to change over the
+// time
+type Limiter struct {
+	buckets   map[string]*bucket
+	lastPurge time.Time
+	now       func() time.Time
+	mutex     sync.Mutex
+}
+
+// New Returns an empty limiter
+func New() *Limiter {
+	return &Limiter{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take Tries to take n tokens from the bucket identified by the key, the bucket
+// is refilled at rate tokens / sec and can accumulate up to burst tokens. The
+// requests of more tokens than the burst are allowed when the bucket is full,
+// leaving the bucket in debt until it is refilled
+func (lm *Limiter) Take(key string, rate, burst float64, n int) Quota {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	now := lm.now()
+	lm.purge(now)
+
+	b, ok := lm.buckets[key]
+	if !ok {
+		b = &bucket{rate: rate, burst: burst, tokens: burst, last: now}
+		lm.buckets[key] = b
+	}
+	// The tokens generated until now use the previous rate
+	b.refill(now)
+	b.rate = rate
+	b.burst = burst
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+
+	if rate <= 0 {
+		return Quota{Allowed: false, RetryAfter: time.Second}
+	}
+
+	required := math.Min(float64(n), burst)
+	if b.tokens < required {
+		return Quota{
+			Allowed:    false,
+			Remaining:  math.Max(b.tokens, 0),
+			RetryAfter: time.Duration((required - b.tokens) / rate * float64(time.Second)),
+		}
+	}
+
+	b.tokens -= float64(n)
+	return Quota{
+		Allowed:   true,
+		Remaining: math.Max(b.tokens, 0),
+	}
+}
+
+// refill Adds the tokens generated since the last time that the bucket was
+// used
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// purge Removes the buckets that were not used during cIdleTTL, the removed
+// buckets would be full if used again
+func (lm *Limiter) purge(now time.Time) {
+	if now.Sub(lm.lastPurge) < cIdleTTL {
+		return
+	}
+	lm.lastPurge = now
+
+	for key, b := range lm.buckets {
+		if now.Sub(b.last) >= cIdleTTL {
+			delete(lm.buckets, key)
+		}
+	}
+}
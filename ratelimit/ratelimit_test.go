@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestLimiter Returns a limiter that uses a clock controlled by the test
+func newTestLimiter() (*Limiter, *time.Time) {
+	now := time.Unix(1000, 0)
+	lm := New()
+	lm.now = func() time.Time { return now }
+
+	return lm, &now
+}
+
+func TestBurst(t *testing.T) {
+	lm, now := newTestLimiter()
+
+	for i := 0; i < 20; i++ {
+		if quota := lm.Take("group", 10, 20, 1); !quota.Allowed || quota.Remaining != float64(19-i) {
+			t.Fatal("Request:", i, "inside the burst was rejected, quota:", quota)
+		}
+	}
+
+	quota := lm.Take("group", 10, 20, 1)
+	if quota.Allowed || quota.RetryAfter != 100*time.Millisecond {
+		t.Error("Expected rejected request with 100ms to retry, obtained:", quota)
+	}
+
+	// Other keys use their own buckets
+	if quota = lm.Take("other", 10, 20, 1); !quota.Allowed {
+		t.Error("The request for another key was rejected, quota:", quota)
+	}
+
+	*now = now.Add(time.Second)
+	for i := 0; i < 10; i++ {
+		if quota = lm.Take("group", 10, 20, 1); !quota.Allowed {
+			t.Fatal("Request:", i, "was rejected after refill the bucket, quota:", quota)
+		}
+	}
+	if quota = lm.Take("group", 10, 20, 1); quota.Allowed {
+		t.Error("Expected rejected request after consume the refilled tokens")
+	}
+
+	// The bucket doesn't accumulate more than the burst
+	*now = now.Add(time.Hour)
+	if quota = lm.Take("group", 10, 20, 1); !quota.Allowed || quota.Remaining != 19 {
+		t.Error("Expected 19 remaining tokens after a long idle period, obtained:", quota)
+	}
+}
+
+func TestBigRequests(t *testing.T) {
+	lm, now := newTestLimiter()
+
+	// Requests bigger than the burst are allowed with the bucket full
+	if quota := lm.Take("group", 10, 20, 50); !quota.Allowed || quota.Remaining != 0 {
+		t.Fatal("The big request was rejected with the bucket full, quota:", quota)
+	}
+
+	// and the debt has to be paid before accept more requests
+	*now = now.Add(2 * time.Second)
+	quota := lm.Take("group", 10, 20, 1)
+	if quota.Allowed || quota.RetryAfter != 1100*time.Millisecond {
+		t.Error("Expected rejected request with 1.1s to retry, obtained:", quota)
+	}
+
+	if quota = lm.Take("disabled", 0, 0, 1); quota.Allowed {
+		t.Error("The request was allowed without rate")
+	}
+}
+
+func TestRateChange(t *testing.T) {
+	lm, now := newTestLimiter()
+
+	lm.Take("group", 10, 20, 20)
+	*now = now.Add(time.Second)
+
+	// The new rate and burst are applied to the existing tokens
+	if quota := lm.Take("group", 5, 5, 1); !quota.Allowed || quota.Remaining != 4 {
+		t.Error("Expected 4 remaining tokens after reduce the burst, obtained:", quota)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	lm, now := newTestLimiter()
+
+	lm.Take("idle", 10, 20, 1)
+	*now = now.Add(cIdleTTL)
+	lm.Take("group", 10, 20, 1)
+
+	if _, ok := lm.buckets["idle"]; ok || len(lm.buckets) != 1 {
+		t.Error("Expected only the used bucket, obtained:", lm.buckets)
+	}
+}
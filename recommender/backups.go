@@ -0,0 +1,121 @@
+package recommender
+
+import (
+	"fmt"
+	"github.com/goamz/goamz/s3"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backupKey Backup stored on S3 by the owner of a shard of a group. Each owner
+// stores its backups under its own key, identified by the ID of the shard and
+// the ownership epoch, so the backup of an owner is never overwritten by the
+// owners of other shards or other epochs
+type backupKey struct {
+	key     string
+	shardID int
+	epoch   uint64
+	stored  time.Time
+}
+
+// backupPath Returns the key of the backups stored by the owner of the shard of
+// the group with the given epoch, the epoch is padded so the keys are sorted
+// by epoch
+func backupPath(s3Path, identifier string, shardID int, epoch uint64) string {
+	return fmt.Sprintf("%s/%s/%d/%020d%s", s3Path, identifier, shardID, epoch, cBackupExt)
+}
+
+// legacyBackupPath Returns the key of the backup shared by all the shards of
+// the group, used before store a backup by owner. The legacy backup is only
+// loaded if no shard of the group stored its own backup
+func legacyBackupPath(s3Path, identifier string) string {
+	return fmt.Sprintf("%s/%s%s", s3Path, identifier, cBackupExt)
+}
+
+// parseBackupKey Returns the identifier of the group of a key stored under the
+// given path and the backup that it contains, the backup is nil for the legacy
+// backups. Returns false if the key is not a backup
+func parseBackupKey(s3Path string, key s3.Key) (identifier string, backup *backupKey, ok bool) {
+	name := strings.TrimPrefix(key.Key, s3Path+"/")
+	if name == key.Key || !strings.HasSuffix(name, cBackupExt) {
+		return "", nil, false
+	}
+	parts := strings.Split(strings.TrimSuffix(name, cBackupExt), "/")
+	if len(parts) == 1 {
+		return parts[0], nil, true
+	}
+	if len(parts) < 3 {
+		return "", nil, false
+	}
+
+	shardID, err := strconv.Atoi(parts[len(parts)-2])
+	if err != nil {
+		return "", nil, false
+	}
+	epoch, err := strconv.ParseUint(parts[len(parts)-1], 10, 64)
+	if err != nil {
+		return "", nil, false
+	}
+	stored, err := time.Parse(time.RFC3339, key.LastModified)
+	if err != nil {
+		return "", nil, false
+	}
+
+	return strings.Join(parts[:len(parts)-2], "/"), &backupKey{
+		key:     key.Key,
+		shardID: shardID,
+		epoch:   epoch,
+		stored:  stored,
+	}, true
+}
+
+// selectBackup Returns the backup to be loaded by an owner of the given shard,
+// the backup of the newest epoch of the shard, or the most recent backup of
+// the group if the shard didn't store any backup yet. Returns nil if there is
+// no backup
+func selectBackup(backups []*backupKey, shardID int) (selected *backupKey) {
+	for _, backup := range backups {
+		switch {
+		case selected == nil:
+			selected = backup
+		case backup.shardID == shardID && selected.shardID != shardID:
+			selected = backup
+		case backup.shardID == shardID && backup.epoch > selected.epoch:
+			selected = backup
+		case selected.shardID != shardID && backup.stored.After(selected.stored):
+			selected = backup
+		}
+	}
+
+	return
+}
+
+// listBackups Returns the backups of the shards of the group stored on the
+// bucket
+func listBackups(bucket *s3.Bucket, s3Path, identifier string) (backups []*backupKey, err error) {
+	err = listKeys(bucket, fmt.Sprintf("%s/%s/", s3Path, identifier), func(key s3.Key) {
+		if keyIdentifier, backup, ok := parseBackupKey(s3Path, key); ok && backup != nil && keyIdentifier == identifier {
+			backups = append(backups, backup)
+		}
+	})
+
+	return
+}
+
+// listKeys Calls fn with each key stored on the bucket under the given prefix
+func listKeys(bucket *s3.Bucket, prefix string, fn func(key s3.Key)) error {
+	for marker := ""; ; {
+		resp, err := bucket.List(prefix, "", marker, cMaxBackupsListed)
+		if err != nil {
+			return err
+		}
+		for _, key := range resp.Contents {
+			marker = key.Key
+			fn(key)
+		}
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			return nil
+		}
+	}
+}
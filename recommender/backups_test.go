@@ -0,0 +1,50 @@
+package recommender
+
+import (
+	"github.com/goamz/goamz/s3"
+	"testing"
+	"time"
+)
+
+func TestParseBackupKey(t *testing.T) {
+	stored := "2026-10-19T10:00:00Z"
+	key := s3.Key{Key: backupPath("/backups", "g:1", 2, 7), LastModified: stored}
+	identifier, backup, ok := parseBackupKey("/backups", key)
+	if !ok || identifier != "g:1" || backup == nil || backup.shardID != 2 || backup.epoch != 7 || backup.stored.Format(time.RFC3339) != stored {
+		t.Error("Unexpected backup:", identifier, backup, ok)
+	}
+
+	identifier, backup, ok = parseBackupKey("/backups", s3.Key{Key: legacyBackupPath("/backups", "g:1"), LastModified: stored})
+	if !ok || identifier != "g:1" || backup != nil {
+		t.Error("Unexpected legacy backup:", identifier, backup, ok)
+	}
+
+	for _, name := range []string{"/backups/g/2.json.gz", "/backups/g/x/7.json.gz", "/backups/g/2/7.txt", "/other/g.json.gz"} {
+		if _, _, ok := parseBackupKey("/backups", s3.Key{Key: name, LastModified: stored}); ok {
+			t.Error("The key is not a backup:", name)
+		}
+	}
+}
+
+func TestSelectBackup(t *testing.T) {
+	now := time.Now()
+	oldEpoch := &backupKey{shardID: 1, epoch: 3, stored: now}
+	newEpoch := &backupKey{shardID: 1, epoch: 5, stored: now.Add(-time.Hour)}
+	otherShard := &backupKey{shardID: 0, epoch: 9, stored: now.Add(time.Minute)}
+	backups := []*backupKey{otherShard, newEpoch, oldEpoch}
+
+	// The backup of the newest epoch of the shard is loaded even if an
+	// older epoch stored it later
+	if backup := selectBackup(backups, 1); backup != newEpoch {
+		t.Error("Expected the backup of the newest epoch of the shard, obtained:", backup)
+	}
+
+	// Without backups of the shard the most recent one of the group is
+	// loaded
+	if backup := selectBackup(backups, 2); backup != otherShard {
+		t.Error("Expected the most recent backup of the group, obtained:", backup)
+	}
+	if backup := selectBackup(nil, 1); backup != nil {
+		t.Error("Backup selected without backups:", backup)
+	}
+}
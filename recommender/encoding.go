@@ -0,0 +1,51 @@
+package recommender
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// encodeScores Appends to buf the scores of a record encoded as a list of
+// pairs of item ID and score sorted by item ID. Each item ID is stored as the
+// varint encoded difference with the previous one, followed by a byte with the
+// score, so the most of the classifications of a record are stored using
+// between two and four bytes
+func encodeScores(buf []byte, scores map[uint64]uint8) []byte {
+	items := make([]uint64, 0, len(scores))
+	for itemID := range scores {
+		items = append(items, itemID)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i] < items[j]
+	})
+
+	var varint [binary.MaxVarintLen64]byte
+	prev := uint64(0)
+	for _, itemID := range items {
+		n := binary.PutUvarint(varint[:], itemID-prev)
+		buf = append(buf, varint[:n]...)
+		buf = append(buf, scores[itemID])
+		prev = itemID
+	}
+
+	return buf
+}
+
+// decodeScores Returns the scores encoded on data by encodeScores
+func decodeScores(data []byte, classif int) map[uint64]uint8 {
+	scores := make(map[uint64]uint8, classif)
+	itemID := uint64(0)
+	for len(data) > 0 {
+		delta, n := binary.Uvarint(data)
+		if n <= 0 || n >= len(data) {
+			// Corrupted data, this should never happen since the
+			// data is only encoded by encodeScores
+			break
+		}
+		itemID += delta
+		scores[itemID] = data[n]
+		data = data[n+1:]
+	}
+
+	return scores
+}
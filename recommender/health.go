@@ -0,0 +1,171 @@
+package recommender
+
+import (
+	"fmt"
+	"github.com/alonsovidales/pit/adaptative_bootstrap_tree"
+	"github.com/alonsovidales/pit/log"
+	"time"
+)
+
+const (
+	// cOpLoad and cOpRebuild Operations of the shard that are retried by
+	// Recover after fail
+	cOpLoad    = "load_backup"
+	cOpRebuild = "rebuild_tree"
+
+	// cRecoveryBackoff Time to wait before retry an operation after its
+	// first failure, the time is doubled after each failure up to
+	// cMaxRecoveryBackoff
+	cRecoveryBackoff    = 2 * time.Second
+	cMaxRecoveryBackoff = 2 * time.Minute
+	// cMaxRecoveryAttempts Max number of consecutive failures of an
+	// operation before consider the shard failed
+	cMaxRecoveryAttempts = 8
+)
+
+// health Operation of the shard that failed, the zero value is a healthy shard
+type health struct {
+	// op Operation that failed, empty if the shard is healthy
+	op string
+	// err Error of the last failure
+	err error
+	// failures Number of consecutive failures of the operation
+	failures int
+	// nextRetry Time when the operation can be retried
+	nextRetry time.Time
+}
+
+// recovered Marks the operation as succeeded
+func (hl *health) recovered(op string) {
+	if hl.op == op {
+		*hl = health{}
+	}
+}
+
+// GetStatusReason Returns the error of the last operation that failed while the
+// shard is not healthy, empty if it is healthy
+func (rc *Recommender) GetStatusReason() string {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if rc.health.err == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%s: %s", rc.health.op, rc.health.err)
+}
+
+// Recover Retries the operation that failed once its backoff expires, the load
+// of the backup is retried before any calculation of the tree. Returns the
+// current status of the shard
+func (rc *Recommender) Recover() string {
+	rc.mutex.Lock()
+	op := rc.health.op
+	rc.mutex.Unlock()
+
+	switch op {
+	case cOpLoad:
+		if rc.canRun(cOpLoad) {
+			rc.LoadBackup()
+			rc.RecalculateTree()
+		}
+	case cOpRebuild:
+		rc.RecalculateTree()
+	}
+
+	return rc.GetStatus()
+}
+
+// NextRecovery Returns the time when the operation that failed can be retried
+// by Recover, the zero time if the shard is healthy
+func (rc *Recommender) NextRecovery() time.Time {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if rc.health.op == "" {
+		return time.Time{}
+	}
+
+	return rc.health.nextRetry
+}
+
+// canRun Returns if the operation can be performed, the tree can't be
+// calculated while the backup is being loaded or couldn't be loaded, and the
+// operations that failed can't be performed during their backoff, or after the
+// shard failed
+func (rc *Recommender) canRun(op string) bool {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	switch {
+	case rc.status == StatusFailed:
+		return false
+	case rc.status == StatusLoading && op != cOpLoad:
+		return false
+	case rc.health.op == cOpLoad && op != cOpLoad:
+		return false
+	case rc.health.op == op:
+		return !time.Now().Before(rc.health.nextRetry)
+	}
+
+	return true
+}
+
+// fail Registers the failure of the operation, the operation is retried after
+// a backoff that grows with the consecutive failures, and the shard fails after
+// cMaxRecoveryAttempts
+func (rc *Recommender) fail(op string, err error) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if rc.health.op != op {
+		rc.health = health{op: op}
+	}
+	rc.health.err = err
+	rc.health.failures++
+
+	backoff := cRecoveryBackoff
+	for i := 1; i < rc.health.failures && backoff < cMaxRecoveryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > cMaxRecoveryBackoff {
+		backoff = cMaxRecoveryBackoff
+	}
+	rc.health.nextRetry = time.Now().Add(backoff)
+
+	switch {
+	case rc.health.failures >= cMaxRecoveryAttempts:
+		rc.status = StatusFailed
+	case op == cOpRebuild && rc.recTree != nil:
+		rc.status = StatusDegraded
+	default:
+		rc.status = StatusRecovering
+	}
+	log.Error("The operation:", op, "failed on shard:", rc.identifier, "failures:", rc.health.failures, "status:", rc.status, "Error:", err)
+}
+
+// safeBuildTree Calculates or updates the tree using the given function, a
+// panic during the calculation is returned as an error
+func safeBuildTree(build func() (*rectree.Tree, map[uint64]float64)) (recTree *rectree.Tree, avgScoreElems map[uint64]float64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("The calculation of the tree panicked: %v", r)
+		}
+	}()
+
+	recTree, avgScoreElems = build()
+
+	return
+}
+
+// processNewTrees Calculates the trees for the records with the parameters of
+// the shards
+func processNewTrees(records []map[uint64]uint8, maxScore uint8) (*rectree.Tree, map[uint64]float64) {
+	return rectree.ProcessNewTrees(records, cRecTreeMaxDeep, maxScore, cRecTreeNumOfTrees)
+}
+
+// updateTree Updates incrementally the tree with the added records, see
+// rectree.Tree.Update
+func updateTree(recTree *rectree.Tree, added []map[uint64]uint8, getRecords func() []map[uint64]uint8) (*rectree.Tree, map[uint64]float64, int) {
+	return recTree.Update(added, getRecords)
+}
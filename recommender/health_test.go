@@ -0,0 +1,161 @@
+package recommender
+
+import (
+	"errors"
+	"github.com/alonsovidales/pit/adaptative_bootstrap_tree"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addRandomRecords Adds records enough to calculate a tree
+func addRandomRecords(sh *Recommender, from uint64) {
+	rnd := rand.New(rand.NewSource(int64(from)))
+	for recID := from; recID < from+cMinRecordsToStart; recID++ {
+		scores := make(map[uint64]uint8)
+		for len(scores) < 10 {
+			scores[uint64(rnd.Intn(100))] = uint8(rnd.Intn(6))
+		}
+		sh.AddRecord(recID, scores)
+	}
+}
+
+// brokenTree Fails the calculation of the tree
+func brokenTree(records []map[uint64]uint8, maxScore uint8) (*rectree.Tree, map[uint64]float64) {
+	panic("broken tree")
+}
+
+// expireBackoff Allows to retry the failed operation without wait
+func expireBackoff(sh *Recommender) {
+	sh.mutex.Lock()
+	sh.health.nextRetry = time.Now()
+	sh.mutex.Unlock()
+}
+
+func TestRecoverLoadBackup(t *testing.T) {
+	sh := NewShard("/testing", "test_recover_load", 1000, 5, "eu-west-1")
+	defer sh.Stop()
+	sh.fetchBackup = func() ([]byte, error) {
+		return nil, errors.New("unavailable")
+	}
+	fenced := false
+	sh.SetFence(0, 1, func() error {
+		fenced = true
+		return nil
+	})
+
+	if sh.LoadBackup() || sh.GetStatus() != StatusRecovering || !strings.Contains(sh.GetStatusReason(), "unavailable") {
+		t.Fatal("Unexpected status after fail the load of the backup:", sh.GetStatus(), "reason:", sh.GetStatusReason())
+	}
+	if next := sh.NextRecovery(); !next.After(time.Now()) || next.After(time.Now().Add(cRecoveryBackoff)) {
+		t.Error("The recovery was not scheduled after the backoff:", next)
+	}
+
+	// The previous backup can't be overwritten neither the tree calculated
+	sh.SaveBackup()
+	if fenced {
+		t.Error("The backup was stored after fail the load of the previous one")
+	}
+	sh.RecalculateTree()
+	if sh.GetStatus() != StatusRecovering {
+		t.Error("The tree was calculated before load the backup, status:", sh.GetStatus())
+	}
+
+	// The load is not retried during the backoff
+	sh.fetchBackup = func() ([]byte, error) {
+		return sh.compress([]byte("[[1,2,3]]")), nil
+	}
+	if status := sh.Recover(); status != StatusRecovering {
+		t.Error("The load was retried during the backoff, status:", status)
+	}
+
+	expireBackoff(sh)
+	if status := sh.Recover(); status != StatusNoRecords || sh.GetStatusReason() != "" || sh.GetStoredElements() != 1 {
+		t.Error("The shard didn't recover after load the backup, status:", status, "reason:", sh.GetStatusReason())
+	}
+	if !sh.NextRecovery().IsZero() {
+		t.Error("A recovery is pending on a healthy shard:", sh.NextRecovery())
+	}
+}
+
+func TestLoadingBackup(t *testing.T) {
+	sh := NewShard("/testing", "test_loading", 1000, 5, "eu-west-1")
+	defer sh.Stop()
+	loading, load := make(chan struct{}), make(chan struct{})
+	sh.fetchBackup = func() ([]byte, error) {
+		close(loading)
+		<-load
+		return nil, nil
+	}
+	fenced := false
+	sh.SetFence(0, 1, func() error {
+		fenced = true
+		return nil
+	})
+
+	loaded := make(chan bool)
+	go func() {
+		loaded <- sh.LoadBackup()
+	}()
+	<-loading
+
+	// The backup being loaded can't be overwritten neither the tree
+	// calculated with the records loaded so far
+	addRandomRecords(sh, 0)
+	sh.SaveBackup()
+	if fenced {
+		t.Error("The backup was stored while the previous one was being loaded")
+	}
+	sh.RecalculateTree()
+	if sh.GetStatus() != StatusLoading {
+		t.Error("The tree was calculated while the backup was being loaded, status:", sh.GetStatus())
+	}
+
+	close(load)
+	<-loaded
+	if sh.RecalculateTree(); sh.GetStatus() != StatusActive {
+		t.Error("The tree was not calculated after load the backup, status:", sh.GetStatus())
+	}
+}
+
+func TestRecoverRebuildTree(t *testing.T) {
+	sh := NewShard("/testing", "test_recover_rebuild", 10000, 5, "eu-west-1")
+	defer sh.Stop()
+	buildTree := sh.buildTree
+	sh.buildTree = brokenTree
+
+	addRandomRecords(sh, 0)
+	sh.RecalculateTree()
+	if sh.GetStatus() != StatusRecovering || !strings.Contains(sh.GetStatusReason(), "broken tree") {
+		t.Fatal("Unexpected status after a panic without previous tree:", sh.GetStatus(), "reason:", sh.GetStatusReason())
+	}
+
+	sh.buildTree = buildTree
+	expireBackoff(sh)
+	if status := sh.Recover(); status != StatusActive {
+		t.Fatal("The shard didn't recover after calculate the tree, status:", status)
+	}
+
+	// The previous tree is used while the new one can't be calculated
+	sh.buildTree = brokenTree
+	addRandomRecords(sh, cMinRecordsToStart)
+	sh.RecalculateTree()
+	if sh.GetStatus() != StatusDegraded {
+		t.Error("Expected a degraded shard, status:", sh.GetStatus())
+	}
+
+	for i := 1; i < cMaxRecoveryAttempts; i++ {
+		expireBackoff(sh)
+		sh.Recover()
+	}
+	if sh.GetStatus() != StatusFailed {
+		t.Error("The shard didn't fail after:", cMaxRecoveryAttempts, "attempts, status:", sh.GetStatus())
+	}
+
+	sh.buildTree = buildTree
+	expireBackoff(sh)
+	if status := sh.Recover(); status != StatusFailed {
+		t.Error("A failed shard was recovered, status:", status)
+	}
+}
@@ -0,0 +1,123 @@
+package recommender
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// cPopularityTTL Min time between two calculations of the popular
+	// items, the records added meanwhile are considered on the next one
+	cPopularityTTL = 10 * time.Second
+	// cPopularityPriorRecords Number of records with a score of zero that
+	// are added to the average score of each item to rank them, so the
+	// items scored by only a few records don't rank over the items with a
+	// slightly lower average scored by many of them
+	cPopularityPriorRecords = 3
+)
+
+// popularity Items of the shard sorted by popularity, used as fallback while
+// the tree is not available. The items are calculated from the stored records
+// on demand, and recalculated only if the store was modified and after
+// cPopularityTTL, so the records loaded from the backup are considered while
+// it is being loaded
+type popularity struct {
+	// version Version of the store used to calculate the items
+	version    uint64
+	calculated time.Time
+	// ranking Items sorted by their average score weighted by the number
+	// of records that scored them, then by that number, and then by item
+	// ID, see calcPopularity
+	ranking   []uint64
+	avgScores map[uint64]float64
+
+	mutex sync.Mutex
+}
+
+// get Returns the items sorted by popularity and their average scores, the
+// returned values are never modified
+func (pp *popularity) get(store *recordStore) (ranking []uint64, avgScores map[uint64]float64) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	version := store.getVersion()
+	if pp.avgScores == nil || (version != pp.version && time.Since(pp.calculated) >= cPopularityTTL) {
+		pp.ranking, pp.avgScores = calcPopularity(store)
+		pp.version = version
+		pp.calculated = time.Now()
+	}
+
+	return pp.ranking, pp.avgScores
+}
+
+// calcPopularity Returns all the items scored on the records of the store
+// sorted by popularity, and their average scores. The popularity of an item
+// is its average score weighted by the number of records that scored it:
+// avg * count / (count + cPopularityPriorRecords)
+func calcPopularity(store *recordStore) (ranking []uint64, avgScores map[uint64]float64) {
+	_, records := store.snapshot()
+	sums := make(map[uint64]uint64)
+	counts := make(map[uint64]uint64)
+	for _, scores := range records {
+		for item, score := range scores {
+			sums[item] += uint64(score)
+			counts[item]++
+		}
+	}
+
+	ranking = make([]uint64, 0, len(counts))
+	avgScores = make(map[uint64]float64, len(counts))
+	weighted := make(map[uint64]float64, len(counts))
+	for item, count := range counts {
+		ranking = append(ranking, item)
+		avgScores[item] = float64(sums[item]) / float64(count)
+		weighted[item] = avgScores[item] * float64(count) / float64(count+cPopularityPriorRecords)
+	}
+	sort.Slice(ranking, func(i, j int) bool {
+		a, b := ranking[i], ranking[j]
+		if weighted[a] != weighted[b] {
+			return weighted[a] > weighted[b]
+		}
+		if counts[a] != counts[b] {
+			return counts[a] > counts[b]
+		}
+		return a < b
+	})
+
+	return
+}
+
+// PopularItems Returns the most popular items of the shard excluding the
+// given ones, the items are sorted by their average score weighted by the
+// number of records that scored them, so the items with higher scores go
+// first unless only a few records scored them. Used as fallback while the
+// recommendations can't be calculated
+func (rc *Recommender) PopularItems(exclude map[uint64]uint8, maxToReturn int) (result []uint64) {
+	ranking, _ := rc.popularity.get(rc.store)
+
+	result = []uint64{}
+	for _, item := range ranking {
+		if len(result) >= maxToReturn {
+			break
+		}
+		if _, excluded := exclude[item]; !excluded {
+			result = append(result, item)
+		}
+	}
+
+	return
+}
+
+// PopularAvgScores Returns the average score of the given items calculated
+// from the stored records, used as fallback while the tree is not available
+func (rc *Recommender) PopularAvgScores(itemIDs []uint64) (scores map[uint64]float64) {
+	_, avgScores := rc.popularity.get(rc.store)
+
+	scores = make(map[uint64]float64)
+	for _, item := range itemIDs {
+		scores[item] = avgScores[item]
+	}
+
+	return
+}
@@ -0,0 +1,58 @@
+package recommender
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPopularItems(t *testing.T) {
+	sh := NewShard("/testing", "test_popular", 1000, 5, "eu-west-1")
+	defer sh.Stop()
+
+	sh.AddRecord(1, map[uint64]uint8{10: 5, 20: 1, 30: 4})
+	sh.AddRecord(2, map[uint64]uint8{10: 3, 20: 1, 40: 4})
+	sh.AddRecord(3, map[uint64]uint8{20: 2, 40: 4})
+
+	if items := sh.PopularItems(nil, 10); !reflect.DeepEqual(items, []uint64{10, 40, 30, 20}) {
+		t.Error("Unexpected popular items:", items)
+	}
+	if items := sh.PopularItems(map[uint64]uint8{10: 2}, 2); !reflect.DeepEqual(items, []uint64{40, 30}) {
+		t.Error("The scored items were not excluded:", items)
+	}
+	if scores := sh.PopularAvgScores([]uint64{10, 20, 50}); !reflect.DeepEqual(scores, map[uint64]float64{10: 4, 20: 4.0 / 3, 50: 0}) {
+		t.Error("Unexpected average scores:", scores)
+	}
+
+	// The items are not recalculated before cPopularityTTL
+	sh.AddRecord(4, map[uint64]uint8{50: 5, 60: 5})
+	if items := sh.PopularItems(nil, 1); !reflect.DeepEqual(items, []uint64{10}) {
+		t.Error("The popular items were recalculated before cPopularityTTL:", items)
+	}
+
+	sh.popularity.mutex.Lock()
+	sh.popularity.calculated = sh.popularity.calculated.Add(-cPopularityTTL)
+	sh.popularity.mutex.Unlock()
+	if items := sh.PopularItems(nil, 10); len(items) != 6 {
+		t.Error("The new records were not considered after cPopularityTTL:", items)
+	}
+}
+
+func TestPopularItemsByAverage(t *testing.T) {
+	sh := NewShard("/testing", "test_popular_avg", 1000, 5, "eu-west-1")
+	defer sh.Stop()
+
+	// The item 10 has the highest sum of scores, but the item 20 has a
+	// much higher average on enough records
+	for i := uint64(0); i < 10; i++ {
+		sh.AddRecord(i, map[uint64]uint8{10: 2})
+	}
+	for i := uint64(10); i < 13; i++ {
+		sh.AddRecord(i, map[uint64]uint8{20: 5})
+	}
+	// A single record with the max score doesn't rank over them
+	sh.AddRecord(13, map[uint64]uint8{30: 5})
+
+	if items := sh.PopularItems(nil, 10); !reflect.DeepEqual(items, []uint64{20, 10, 30}) {
+		t.Error("The popular items were not sorted by their weighted average:", items)
+	}
+}
@@ -4,12 +4,13 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
-	"fmt"
 	"github.com/alonsovidales/pit/adaptative_bootstrap_tree"
 	"github.com/alonsovidales/pit/log"
 	"github.com/goamz/goamz/aws"
 	"github.com/goamz/goamz/s3"
 	"io/ioutil"
+	"math"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -26,6 +27,17 @@ const (
 	// StatusNoRecords There is not enought records in memory to start the
 	// tree calculations, see cMinRecordsToStart
 	StatusNoRecords = "NO_RECORDS"
+	// StatusDegraded The last calculation of the tree failed, the shard
+	// keeps attending requests with the previous tree until it is
+	// calculated again, see Recover
+	StatusDegraded = "DEGRADED"
+	// StatusRecovering The load of the backup or the first calculation of
+	// the tree failed, the shard can't attend requests until the operation
+	// succeeds, see Recover
+	StatusRecovering = "RECOVERING"
+	// StatusFailed The shard couldn't recover after cMaxRecoveryAttempts,
+	// it has to be released so another instance can acquire it
+	StatusFailed = "FAILED"
 
 	// cMinRecordsToStart The minimal number of records to build a tree
 	cMinRecordsToStart = 100
@@ -37,6 +49,28 @@ const (
 	// the root trees are going to be the trees that starts for the most
 	// common items
 	cRecTreeNumOfTrees = 10
+	// cFullRebuildPeriod Max time between two full calculations of the
+	// tree, the tree is updated incrementally with the new records
+	// meanwhile, see rectree.Tree.Update
+	cFullRebuildPeriod = 10 * time.Minute
+	// cMaxAddedRatio Max ratio between the records added since the last
+	// full calculation of the tree and the records used by it to update
+	// the tree incrementally, the root items of the trees are not changed
+	// by the updates
+	cMaxAddedRatio = 0.5
+	// cMaxRemovedRatio Max ratio between the records removed, expired or
+	// replaced since the last full calculation of the tree and the records
+	// used by it to update the tree incrementally, the removed records are
+	// not considered by the updates
+	cMaxRemovedRatio = 0.1
+	// cAvgScoreEntrySize Estimation of the bytes used to store the average
+	// score of an item, key and value plus the overhead of the map
+	cAvgScoreEntrySize = 32
+
+	// cBackupExt Extension of the backups stored on S3
+	cBackupExt = ".json.gz"
+	// cMaxBackupsListed Max number of backups listed by each request to S3
+	cMaxBackupsListed = 1000
 
 	// S3BUCKET name of the S3 bucket where the backups are going to be stored
 	S3BUCKET = "pit-backups"
@@ -48,6 +82,9 @@ type Int interface {
 	// CalcScores Calculates the scores for the given records, and stores
 	// in memory the classification for further processing
 	CalcScores(recID uint64, scores map[uint64]uint8, maxToReturn int) (result []uint64)
+	// GetRecommendations Calculates the recommendations for the given
+	// scores without store them
+	GetRecommendations(scores map[uint64]uint8, maxToReturn int) (result []uint64)
 	// AddRecord Just adds a new record to the recommender system in order
 	// to increase the knoledge DB
 	AddRecord(recID uint64, scores map[uint64]uint8)
@@ -59,18 +96,44 @@ type Int interface {
 	// SaveBackup Stores all the records serialized in a inexpensive
 	// storage system
 	SaveBackup()
+	// SetFence Sets the ID and the ownership epoch of the shard and the
+	// function that returns an error if the ownership is not valid
+	// anymore, the backups are not stored by fenced off shards, and each
+	// owner stores its backups under its own key
+	SetFence(shardID int, epoch uint64, fence func() error)
 	// LoadBackup Restores all the information from backup
 	LoadBackup() (success bool)
 	// GetStatus Returns the current status of this recommender system,
-	// the posible statuses can be: LOADING, ACTIVE, STARTING, NO_RECORDS
+	// the posible statuses can be: LOADING, ACTIVE, STARTING, NO_RECORDS,
+	// DEGRADED, RECOVERING, FAILED
 	GetStatus() string
+	// GetStatusReason Returns the error of the last operation that failed
+	// while the shard is not healthy, empty if it is healthy
+	GetStatusReason() string
+	// Recover Retries the operation that failed once its backoff expires,
+	// returns the current status of the shard
+	Recover() string
+	// NextRecovery Returns the time when the operation that failed can be
+	// retried by Recover, the zero time if the shard is healthy
+	NextRecovery() time.Time
 	// GetStoredElements Returns the current total number of elements
 	// stored by this shard
 	GetStoredElements() uint64
+	// GetMemoryUsage Returns an estimation of the bytes used to store the
+	// records and the tree of this shard
+	GetMemoryUsage() uint64
 	// GetAvgScores Returns the average score for a slice of items, the
 	// returned value is a map where the key is the element ID and the
 	// value the average clasification for that element
 	GetAvgScores([]uint64) map[uint64]float64
+	// PopularItems Returns the most popular items of the shard excluding
+	// the given ones, used as fallback while the recommendations can't be
+	// calculated
+	PopularItems(exclude map[uint64]uint8, maxToReturn int) []uint64
+	// PopularAvgScores Returns the average score of the given items
+	// calculated from the stored records, used as fallback while the tree
+	// is not available
+	PopularAvgScores([]uint64) map[uint64]float64
 	// Stop Stops all the background tasks that are being performed by the
 	// recommender like the garbage collector
 	Stop()
@@ -83,18 +146,21 @@ type Int interface {
 	// IsDirty returns true in case of any record was added since the last
 	// time the tree was regenerated
 	IsDirty() bool
+	// GetPendingChanges Returns the number of records added or removed
+	// since the last time the tree was calculated
+	GetPendingChanges() uint64
+
+	// GetRecordIDs Returns the IDs of all the records stored on the shard
+	GetRecordIDs() []uint64
+	// GetRecord Returns the scores of a stored record
+	GetRecord(recID uint64) (scores map[uint64]uint8, ok bool)
+	// RemoveRecord Removes a record from the shard
+	RemoveRecord(recID uint64)
 
 	// DestroyS3Backup Removes all the data stored by this shard on S3
 	DestroyS3Backup() (success bool)
 }
 
-type score struct {
-	recID  uint64
-	scores map[uint64]uint8
-	next   *score
-	prev   *score
-}
-
 // Recommender This struct will manage and provide access to a recomender
 // system
 type Recommender struct {
@@ -105,25 +171,57 @@ type Recommender struct {
 	s3Path     string
 	s3Region   aws.Region
 
-	maxClassif   uint64
-	totalClassif uint64
+	maxClassif uint64
 
 	status string
 
-	records       map[uint64]*score
-	cloningBuffer map[uint64]map[uint64]uint8
-	older         *score
-	newer         *score
-	// Indicates if any new record was inserted since the last time the
-	// tree was recalculated
-	dirty   bool
-	running bool
-
-	recTree       rectree.BoostrapRecTree
+	store *recordStore
+	// Version of the store used to build the current tree, the tree has
+	// to be recalculated if any record was modified after it
+	builtVersion uint64
+	// builtSeq Insertion sequence of the last record considered by the
+	// current tree, see recordStore.getSeq
+	builtSeq uint64
+	// fullBuilt, fullBuiltRecords, fullBuiltSeq and fullBuiltRemoved
+	// Time of the last full calculation of the tree, the number of records
+	// used by it, and the insertion sequence and the number of removed
+	// records of the store at that time
+	fullBuilt        time.Time
+	fullBuiltRecords int
+	fullBuiltSeq     uint64
+	fullBuiltRemoved uint64
+	running          bool
+
+	recTree       *rectree.Tree
 	avgScoreElems map[uint64]float64
-
-	mutex   sync.Mutex
-	cloning bool
+	// treeMemory Estimation of the bytes used by the current tree and the
+	// average scores of the items
+	treeMemory uint64
+
+	// shardID and epoch Ownership of the shard, see SetFence
+	shardID int
+	epoch   uint64
+	fence   func() error
+	// legacyBackup The records were loaded from the backup shared by all
+	// the shards of the group, that is removed after store the first
+	// backup of the shard, see legacyBackupPath
+	legacyBackup bool
+
+	// fetchBackup Returns the content of the backup, nil if there is no
+	// backup stored
+	fetchBackup func() ([]byte, error)
+	// buildTree Calculates the tree for the given records
+	buildTree func(records []map[uint64]uint8, maxScore uint8) (*rectree.Tree, map[uint64]float64)
+	// updateTree Updates incrementally the tree with the added records,
+	// returns also the number of subtrees calculated again
+	updateTree func(recTree *rectree.Tree, added []map[uint64]uint8, getRecords func() []map[uint64]uint8) (*rectree.Tree, map[uint64]float64, int)
+	// health Operation that failed and has to be retried, see Recover
+	health health
+	// popularity Most popular items used as fallback while the tree is not
+	// available, see PopularItems
+	popularity popularity
+
+	mutex sync.Mutex
 }
 
 // NewShard Initialize a Recommender objects and returns it, this method also
@@ -133,19 +231,20 @@ func NewShard(s3Path string, identifier string, maxClassif uint64, maxScore uint
 	log.Info("Starting shard:", identifier, "With max number of elements:", maxClassif)
 
 	rc = &Recommender{
-		identifier:    identifier,
-		maxClassif:    maxClassif,
-		totalClassif:  0,
-		maxScore:      maxScore,
-		records:       make(map[uint64]*score),
-		status:        StatusStarting,
-		s3Path:        s3Path,
-		s3Region:      aws.Regions[s3Region],
-		dirty:         true,
-		running:       true,
-		cloning:       false,
-		cloningBuffer: make(map[uint64]map[uint64]uint8),
+		identifier: identifier,
+		maxClassif: maxClassif,
+		maxScore:   maxScore,
+		store:      newRecordStore(),
+		status:     StatusStarting,
+		s3Path:     s3Path,
+		s3Region:   aws.Regions[s3Region],
+		// The tree was never built
+		builtVersion: math.MaxUint64,
+		running:      true,
+		buildTree:    processNewTrees,
+		updateTree:   updateTree,
 	}
+	rc.fetchBackup = rc.fetchS3Backup
 
 	go rc.checkAndExpire()
 
@@ -155,36 +254,62 @@ func NewShard(s3Path string, identifier string, maxClassif uint64, maxScore uint
 // Stop Stops all the background tasks that are being performed by the
 // recommender like the garbage collector
 func (rc *Recommender) Stop() {
+	rc.mutex.Lock()
 	rc.running = false
+	rc.mutex.Unlock()
 }
 
 // SetMaxElements Sets the max number of elements that can be stored by the
 // recommender shard
 func (rc *Recommender) SetMaxElements(maxClassif uint64) {
+	rc.mutex.Lock()
 	rc.maxClassif = maxClassif
+	rc.mutex.Unlock()
 }
 
 // SetMaxScore Sets the max score to have in consideration, note that the score
-// starts at 0
+// starts at 0. The tree is fully calculated again after change it
 func (rc *Recommender) SetMaxScore(maxScore uint8) {
+	rc.mutex.Lock()
+	if rc.maxScore != maxScore {
+		rc.fullBuilt = time.Time{}
+	}
 	rc.maxScore = maxScore
+	rc.mutex.Unlock()
 }
 
 // GetTotalElements Returns the max number of elements that can ba allocated on
 // this recomender shard
 func (rc *Recommender) GetTotalElements() uint64 {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
 	return rc.maxClassif
 }
 
 // GetStoredElements Returns the current total number of elements stored by
 // this shard
 func (rc *Recommender) GetStoredElements() uint64 {
-	return rc.totalClassif
+	return rc.store.storedElements()
+}
+
+// GetMemoryUsage Returns an estimation of the bytes used to store the records
+// and the tree of this shard
+func (rc *Recommender) GetMemoryUsage() uint64 {
+	rc.mutex.Lock()
+	treeMemory := rc.treeMemory
+	rc.mutex.Unlock()
+
+	return rc.store.memoryUsage() + treeMemory
 }
 
 // GetStatus Returns the current status of this recommender system, the posible
-// statuses can be: LOADING, ACTIVE, STARTING, NO_RECORDS
+// statuses can be: LOADING, ACTIVE, STARTING, NO_RECORDS, DEGRADED, RECOVERING,
+// FAILED
 func (rc *Recommender) GetStatus() string {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
 	return rc.status
 }
 
@@ -192,6 +317,9 @@ func (rc *Recommender) GetStatus() string {
 // value is a map where the key is the element ID and the value the average
 // clasification for that element
 func (rc *Recommender) GetAvgScores(itemIDs []uint64) (scores map[uint64]float64) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
 	scores = make(map[uint64]float64)
 	for _, item := range itemIDs {
 		scores[item] = rc.avgScoreElems[item]
@@ -205,108 +333,146 @@ func (rc *Recommender) GetAvgScores(itemIDs []uint64) (scores map[uint64]float64
 func (rc *Recommender) CalcScores(recID uint64, scores map[uint64]uint8, maxToReturn int) (result []uint64) {
 	rc.AddRecord(recID, scores)
 
-	if rc.recTree == nil {
+	return rc.GetRecommendations(scores, maxToReturn)
+}
+
+// GetRecommendations Calculates the recommendations for the given scores
+// without store them
+func (rc *Recommender) GetRecommendations(scores map[uint64]uint8, maxToReturn int) (result []uint64) {
+	rc.mutex.Lock()
+	recTree := rc.recTree
+	rc.mutex.Unlock()
+	if recTree == nil {
 		return
 	}
-	result = rc.recTree.GetBestRecommendation(scores, maxToReturn)
 
-	return
+	return recTree.GetBestRecommendation(scores, maxToReturn)
 }
 
 // AddRecord Just adds a new record to the recommender system in order to
 // increase the knoledge DB
 func (rc *Recommender) AddRecord(recID uint64, scores map[uint64]uint8) {
-	var sc *score
-	var existingRecord bool
-
-	rc.dirty = true
-	// If the system is cloning the data to process the tree, just leave
-	// the data on the buffer
-	if rc.cloning {
-		rc.cloningBuffer[recID] = scores
-		return
-	}
-	rc.mutex.Lock()
-	if sc, existingRecord = rc.records[recID]; existingRecord {
-		if sc.prev != nil {
-			sc.prev.next = sc.next
-		} else {
-			// This is the older elem
-			rc.older = rc.older.next
-		}
-		if sc.next != nil {
-			sc.next.prev = sc.prev
-		} else {
-			// This is the last elem
-			rc.newer = rc.newer.prev
-		}
+	rc.store.add(recID, scores)
+}
 
-		rc.totalClassif += uint64(len(scores) - len(sc.scores))
-		sc.scores = scores
-	} else {
-		sc = &score{
-			recID:  recID,
-			scores: scores,
-		}
-		rc.records[recID] = sc
-		rc.totalClassif += uint64(len(scores))
-	}
+// GetRecordIDs Returns the IDs of all the records stored on the shard sorted
+// from the oldest to the newest
+func (rc *Recommender) GetRecordIDs() (ids []uint64) {
+	return rc.store.ids()
+}
 
-	if rc.newer != nil {
-		sc.prev = rc.newer
-		rc.newer.next = sc
-		rc.newer = sc
-	} else {
-		rc.newer = sc
-		rc.older = sc
-	}
-	rc.mutex.Unlock()
+// GetRecord Returns the scores of a stored record
+func (rc *Recommender) GetRecord(recID uint64) (scores map[uint64]uint8, ok bool) {
+	return rc.store.get(recID)
+}
 
-	log.Debug("Stored elements:", rc.totalClassif, "Max stored elements:", rc.maxClassif)
+// RemoveRecord Removes a record from the shard, the record will not be
+// considered until the next time the tree is recalculated
+func (rc *Recommender) RemoveRecord(recID uint64) {
+	rc.store.remove(recID)
 }
 
-// RecalculateTree Lanches the ETL process to create the tree
+// RecalculateTree Lanches the ETL process to create the tree, the tree is not
+// calculated while the backup is not loaded, or during the backoff after a
+// failed calculation. The tree is updated incrementally with the records added
+// since the last calculation, and fully calculated again each
+// cFullRebuildPeriod, or after too many records are added or removed
 func (rc *Recommender) RecalculateTree() {
 	// No new record was added, so is not necessary to calculate the tree
 	// again
-	if !rc.dirty {
+	if !rc.IsDirty() {
 		log.Info("Tree not dirty:", rc.identifier)
 		return
 	}
-	log.Info("Recalculating tree for:", rc.identifier)
-	if len(rc.records) < cMinRecordsToStart {
-		rc.dirty = false
+	if !rc.canRun(cOpRebuild) {
+		return
+	}
+	// The records modified while the tree is being built are considered
+	// on the next recalculation
+	version := rc.store.getVersion()
+	seq, removed := rc.store.getSeq(), rc.store.getRemoved()
+	records := rc.store.count()
+	if records < cMinRecordsToStart {
+		rc.mutex.Lock()
+		rc.builtVersion = version
 		rc.status = StatusNoRecords
+		rc.health.recovered(cOpRebuild)
+		rc.mutex.Unlock()
 		return
 	}
 
-	rc.cloning = true
 	rc.mutex.Lock()
-	records := make([]map[uint64]uint8, len(rc.records))
-	i := 0
-	for _, record := range rc.records {
-		records[i] = record.scores
-		i++
-	}
+	maxScore := rc.maxScore
+	recTree, builtSeq := rc.recTree, rc.builtSeq
+	incremental := recTree != nil &&
+		time.Since(rc.fullBuilt) < cFullRebuildPeriod &&
+		float64(seq-rc.fullBuiltSeq) <= float64(rc.fullBuiltRecords)*cMaxAddedRatio &&
+		float64(removed-rc.fullBuiltRemoved) <= float64(rc.fullBuiltRecords)*cMaxRemovedRatio
 	rc.mutex.Unlock()
-	rc.cloning = false
 
-	for recID, scores := range rc.cloningBuffer {
-		rc.AddRecord(recID, scores)
+	var avgScoreElems map[uint64]float64
+	var err error
+	if incremental {
+		log.Info("Updating tree for:", rc.identifier)
+		recTree, avgScoreElems, err = safeBuildTree(func() (*rectree.Tree, map[uint64]float64) {
+			updated, avgScores, rebuilt := rc.updateTree(recTree, rc.store.added(builtSeq, seq), func() []map[uint64]uint8 {
+				_, all := rc.store.snapshot()
+				return all
+			})
+			log.Info("Subtrees recalculated:", rebuilt, "on:", rc.identifier)
+			return updated, avgScores
+		})
+	} else {
+		log.Info("Recalculating tree for:", rc.identifier)
+		_, all := rc.store.snapshot()
+		records = len(all)
+		recTree, avgScoreElems, err = safeBuildTree(func() (*rectree.Tree, map[uint64]float64) {
+			return rc.buildTree(all, maxScore)
+		})
 	}
-	rc.cloningBuffer = make(map[uint64]map[uint64]uint8)
-
-	rc.recTree, rc.avgScoreElems = rectree.ProcessNewTrees(records, cRecTreeMaxDeep, rc.maxScore, cRecTreeNumOfTrees)
+	if err != nil {
+		rc.fail(cOpRebuild, err)
+		return
+	}
+	treeMemory := recTree.MemoryUsage() + uint64(len(avgScoreElems))*cAvgScoreEntrySize
 
+	rc.mutex.Lock()
+	rc.recTree, rc.avgScoreElems = recTree, avgScoreElems
+	rc.treeMemory = treeMemory
 	rc.status = StatusActive
+	rc.builtVersion = version
+	rc.builtSeq = seq
+	if !incremental {
+		rc.fullBuilt, rc.fullBuiltRecords = time.Now(), records
+		rc.fullBuiltSeq, rc.fullBuiltRemoved = seq, removed
+	}
+	rc.health.recovered(cOpRebuild)
+	rc.mutex.Unlock()
 	log.Info("Tree recalculation finished:", rc.identifier)
-	rc.dirty = false
 }
 
 // IsDirty returns true in case of any record was added since the last time the
 // tree was regenerated
 func (rc *Recommender) IsDirty() bool {
-	return rc.dirty
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	return rc.builtVersion != rc.store.getVersion()
+}
+
+// GetPendingChanges Returns the number of records added or removed since the
+// last time the tree was calculated, all the modifications if it was never
+// calculated
+func (rc *Recommender) GetPendingChanges() uint64 {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	version := rc.store.getVersion()
+	if rc.builtVersion == math.MaxUint64 {
+		return version
+	}
+
+	return version - rc.builtVersion
 }
 
 // DestroyS3Backup Removes all the data stored by this shard on S3
@@ -321,67 +487,200 @@ func (rc *Recommender) DestroyS3Backup() (success bool) {
 	s := s3.New(auth, rc.s3Region)
 	bucket := s.Bucket(S3BUCKET)
 
-	if err := bucket.Del(rc.getS3Path()); err != nil {
-		log.Info("Problem trying to remove backup from S3:", err)
+	backups, err := listBackups(bucket, rc.s3Path, rc.identifier)
+	if err != nil {
+		log.Info("Problem trying to list the backups on S3:", err)
 		return false
 	}
+	keys := []string{legacyBackupPath(rc.s3Path, rc.identifier)}
+	for _, backup := range backups {
+		keys = append(keys, backup.key)
+	}
+	for _, key := range keys {
+		if err := bucket.Del(key); err != nil {
+			log.Info("Problem trying to remove backup from S3:", err)
+			return false
+		}
+	}
 
 	return true
 }
 
-// LoadBackup Restores all the information from backup
-func (rc *Recommender) LoadBackup() (success bool) {
-	log.Info("Loading backup from S3:", rc.identifier)
+// DestroyBackup Removes the backup stored on S3 under the given path by the
+// shards with the given identifier
+func DestroyBackup(s3Path, identifier, s3Region string) bool {
+	rc := &Recommender{
+		identifier: identifier,
+		s3Path:     s3Path,
+		s3Region:   aws.Regions[s3Region],
+	}
+
+	return rc.DestroyS3Backup()
+}
+
+// ListBackups Returns the identifiers of the shards with a backup stored on S3
+// under the given path, and the time when the last backup of each one was
+// stored
+func ListBackups(s3Path, s3Region string) (backups map[string]time.Time, err error) {
 	auth, err := aws.EnvAuth()
 	if err != nil {
-		log.Error("Problem trying to connect with AWS:", err)
-		return false
+		return
 	}
 
-	s := s3.New(auth, rc.s3Region)
-	bucket := s.Bucket(S3BUCKET)
-
-	jsonData, err := bucket.Get(rc.getS3Path())
+	bucket := s3.New(auth, aws.Regions[s3Region]).Bucket(S3BUCKET)
+	backups = make(map[string]time.Time)
+	err = listKeys(bucket, s3Path+"/", func(key s3.Key) {
+		identifier, _, ok := parseBackupKey(s3Path, key)
+		if !ok {
+			return
+		}
+		stored, parseErr := time.Parse(time.RFC3339, key.LastModified)
+		if parseErr != nil {
+			err = parseErr
+			return
+		}
+		if stored.After(backups[identifier]) {
+			backups[identifier] = stored
+		}
+	})
 	if err != nil {
-		log.Info("Problem trying to get backup from S3:", err)
-		return false
+		return nil, err
 	}
 
+	return
+}
+
+// LoadBackup Restores all the information from backup, returns false if there
+// is no backup or if it can't be loaded, in the last case the load is retried by
+// Recover and the backups are not stored until it succeeds
+func (rc *Recommender) LoadBackup() (success bool) {
+	log.Info("Loading backup from S3:", rc.identifier)
+	rc.mutex.Lock()
+	rc.status = StatusLoading
+	rc.mutex.Unlock()
+
+	jsonData, err := rc.fetchBackup()
 	dataFromJSON := [][]uint64{}
-	json.Unmarshal(rc.uncompress(jsonData), &dataFromJSON)
+	if err == nil && jsonData != nil {
+		var uncompressed []byte
+		if uncompressed, err = rc.uncompress(jsonData); err == nil {
+			err = json.Unmarshal(uncompressed, &dataFromJSON)
+		}
+	}
+	if err != nil {
+		rc.fail(cOpLoad, err)
+		return false
+	}
 
 	log.Info("Data loaded from S3:", rc.identifier, "len:", len(dataFromJSON))
-	recs := 0
 	for _, record := range dataFromJSON {
+		if len(record) == 0 {
+			continue
+		}
 		scores := make(map[uint64]uint8)
-		for i := 1; i < len(record); i += 2 {
+		for i := 1; i+1 < len(record); i += 2 {
 			scores[record[i]] = uint8(record[i+1])
 		}
-		recs += len(scores)
 		rc.AddRecord(record[0], scores)
 	}
 
-	return true
+	rc.mutex.Lock()
+	rc.status = StatusStarting
+	rc.health.recovered(cOpLoad)
+	rc.mutex.Unlock()
+
+	return jsonData != nil
 }
 
-// SaveBackup Stores all the records serialized in a inexpensive storage system
+// fetchS3Backup Returns the content of the backup stored on S3, nil if there is
+// no backup stored. The backup of the newest epoch of the shard is loaded, or
+// the most recent backup of the group if the shard didn't store any backup, see
+// selectBackup. The backups are disabled without AWS credentials
+func (rc *Recommender) fetchS3Backup() ([]byte, error) {
+	auth, err := aws.EnvAuth()
+	if err != nil {
+		log.Error("Problem trying to connect with AWS:", err)
+		return nil, nil
+	}
+
+	rc.mutex.Lock()
+	shardID := rc.shardID
+	rc.mutex.Unlock()
+
+	bucket := s3.New(auth, rc.s3Region).Bucket(S3BUCKET)
+	backups, err := listBackups(bucket, rc.s3Path, rc.identifier)
+	if err != nil {
+		return nil, err
+	}
+	key, legacy := legacyBackupPath(rc.s3Path, rc.identifier), true
+	if backup := selectBackup(backups, shardID); backup != nil {
+		key, legacy = backup.key, false
+	}
+
+	data, err := bucket.Get(key)
+	if s3Err, ok := err.(*s3.Error); ok && s3Err.StatusCode == http.StatusNotFound {
+		log.Info("There is no backup stored on S3 for:", rc.identifier)
+		return nil, nil
+	}
+	if err == nil {
+		log.Info("Loading backup:", key, "of:", rc.identifier)
+		rc.mutex.Lock()
+		rc.legacyBackup = legacy
+		rc.mutex.Unlock()
+	}
+
+	return data, err
+}
+
+// SetFence Sets the ID and the ownership epoch of the shard and the function
+// that returns an error if the ownership is not valid anymore, the backups are
+// not stored by fenced off shards, and each owner stores its backups under its
+// own key, see backupPath
+func (rc *Recommender) SetFence(shardID int, epoch uint64, fence func() error) {
+	rc.mutex.Lock()
+	rc.shardID, rc.epoch, rc.fence = shardID, epoch, fence
+	rc.mutex.Unlock()
+}
+
+// SaveBackup Stores all the records serialized in a inexpensive storage system,
+// the backup is not stored while the previous one is being loaded, or if it
+// couldn't be loaded. Each owner of the shard stores its backup under its own
+// key, so the owners of older epochs can't overwrite it, and the backups of the
+// older epochs of the shard are removed after store it
 func (rc *Recommender) SaveBackup() {
-	log.Info("Storing backup on S3:", rc.identifier)
 	rc.mutex.Lock()
-	records := make([][]uint64, len(rc.records))
-	i := 0
-	for recID, record := range rc.records {
-		records[i] = make([]uint64, len(record.scores)*2+1)
+	shardID, epoch, fence, legacy := rc.shardID, rc.epoch, rc.fence, rc.legacyBackup
+	loadFailed := rc.health.op == cOpLoad
+	loading := rc.status == StatusLoading
+	rc.mutex.Unlock()
+	if loadFailed {
+		log.Error("The backup of:", rc.identifier, "can't be stored, the previous backup was not loaded")
+		return
+	}
+	if loading {
+		log.Error("The backup of:", rc.identifier, "can't be stored, the previous backup is being loaded")
+		return
+	}
+	if fence != nil {
+		if err := fence(); err != nil {
+			log.Error("The backup of:", rc.identifier, "can't be stored, the shard was fenced off, Error:", err)
+			return
+		}
+	}
+
+	log.Info("Storing backup on S3:", rc.identifier)
+	recIDs, scores := rc.store.snapshot()
+	records := make([][]uint64, len(recIDs))
+	for i, recID := range recIDs {
+		records[i] = make([]uint64, len(scores[i])*2+1)
 		records[i][0] = recID
 		elemPos := 1
-		for k, v := range record.scores {
+		for k, v := range scores[i] {
 			records[i][elemPos] = k
 			records[i][elemPos+1] = uint64(v)
 			elemPos += 2
 		}
-		i++
 	}
-	rc.mutex.Unlock()
 
 	jsonToUpload, err := json.Marshal(records)
 
@@ -394,27 +693,55 @@ func (rc *Recommender) SaveBackup() {
 	s := s3.New(auth, rc.s3Region)
 	bucket := s.Bucket(S3BUCKET)
 
-	err = bucket.Put(
-		rc.getS3Path(),
-		rc.compress(jsonToUpload),
-		"text/plain",
-		s3.BucketOwnerFull,
-		s3.Options{})
+	key := backupPath(rc.s3Path, rc.identifier, shardID, epoch)
+	err = bucket.Put(key, rc.compress(jsonToUpload), "text/plain", s3.BucketOwnerFull, s3.Options{})
 	if err != nil {
 		log.Error("Problem trying to upload backup to S3 from:", rc.identifier, "Error:", err)
+		return
 	}
+	log.Info("New backup stored on S3, bucket:", S3BUCKET, "Path:", key)
 
-	log.Info("New backup stored on S3, bucket:", S3BUCKET, "Path:", rc.getS3Path())
+	rc.removeStaleBackups(bucket, shardID, epoch, legacy)
 }
 
-func (rc *Recommender) getS3Path() string {
-	return fmt.Sprintf("%s/%s.json.gz", rc.s3Path, rc.identifier)
+// removeStaleBackups Removes the backups stored by the owners of the older
+// epochs of the shard, and the legacy backup of the group if the records of the
+// shard were loaded from it
+func (rc *Recommender) removeStaleBackups(bucket *s3.Bucket, shardID int, epoch uint64, legacy bool) {
+	backups, err := listBackups(bucket, rc.s3Path, rc.identifier)
+	if err != nil {
+		log.Error("Problem trying to list the backups of:", rc.identifier, "Error:", err)
+		return
+	}
+
+	stale := []string{}
+	if legacy {
+		stale = append(stale, legacyBackupPath(rc.s3Path, rc.identifier))
+	}
+	for _, backup := range backups {
+		if backup.shardID == shardID && backup.epoch < epoch {
+			stale = append(stale, backup.key)
+		}
+	}
+	for _, key := range stale {
+		if err := bucket.Del(key); err != nil {
+			log.Error("Problem trying to remove the stale backup:", key, "Error:", err)
+			return
+		}
+	}
+
+	if legacy {
+		rc.mutex.Lock()
+		rc.legacyBackup = false
+		rc.mutex.Unlock()
+	}
 }
 
-func (rc *Recommender) uncompress(data []byte) (result []byte) {
+func (rc *Recommender) uncompress(data []byte) (result []byte, err error) {
 	gz, err := gzip.NewReader(strings.NewReader(string(data)))
 	if err != nil {
 		log.Error("The data can't be uncompressed on shard:", rc.identifier, "Error:", err)
+		return
 	}
 	defer gz.Close()
 	if result, err = ioutil.ReadAll(gz); err != nil {
@@ -441,16 +768,17 @@ func (rc *Recommender) compress(data []byte) (result []byte) {
 }
 
 func (rc *Recommender) checkAndExpire() {
-	for rc.running {
-		for rc.totalClassif > rc.maxClassif {
-			rc.mutex.Lock()
-
-			rc.totalClassif -= uint64(len(rc.older.scores))
-			delete(rc.records, rc.older.recID)
-			rc.older = rc.older.next
-			rc.older.prev = nil
-
-			rc.mutex.Unlock()
+	for {
+		rc.mutex.Lock()
+		running, maxClassif := rc.running, rc.maxClassif
+		rc.mutex.Unlock()
+		if !running {
+			return
+		}
+		for rc.store.storedElements() > maxClassif {
+			if !rc.store.expireOldest() {
+				break
+			}
 		}
 
 		time.Sleep(time.Millisecond * 300)
@@ -3,8 +3,11 @@ package recommender
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
+	"github.com/alonsovidales/pit/adaptative_bootstrap_tree"
 	"github.com/alonsovidales/pit/log"
 	"os"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -19,11 +22,25 @@ const (
 func TestCompression(t *testing.T) {
 	aux := "This is a test..."
 	rc := &Recommender{}
-	if string(rc.uncompress(rc.compress([]byte(aux)))) != aux {
+	if result, err := rc.uncompress(rc.compress([]byte(aux))); err != nil || string(result) != aux {
 		t.Error("Problem trying to compress and uncompress data")
 	}
 }
 
+func TestFencedBackup(t *testing.T) {
+	fenced := false
+	sh := NewShard("/testing", "test_fenced_backup", 10, 5, "eu-west-1")
+	defer sh.Stop()
+	sh.SetFence(1, 2, func() error {
+		fenced = true
+		return errors.New("fenced")
+	})
+	sh.SaveBackup()
+	if !fenced {
+		t.Error("The ownership was not checked before store the backup")
+	}
+}
+
 func TestRecommenderLoadNoBackup(t *testing.T) {
 	sh := NewShard("/testing", "test_collab_insertion_no_baackup", 10, 5, "eu-west-1")
 	if sh.LoadBackup() {
@@ -31,6 +48,79 @@ func TestRecommenderLoadNoBackup(t *testing.T) {
 	}
 }
 
+func TestRemoveRecord(t *testing.T) {
+	sh := NewShard("/testing", "test_remove_record", 100, 5, "eu-west-1")
+	defer sh.Stop()
+	for i := uint64(0); i < 5; i++ {
+		sh.AddRecord(i, map[uint64]uint8{i: 1, i + 1: 2})
+	}
+	// Update a record in the middle of the list
+	sh.AddRecord(2, map[uint64]uint8{2: 3})
+
+	sh.RemoveRecord(3)
+	sh.RemoveRecord(0)
+	sh.RemoveRecord(10)
+	if sh.GetStoredElements() != 5 || len(sh.GetRecordIDs()) != 3 {
+		t.Error("Expected 3 records with 5 scores, obtained:", sh.GetRecordIDs(), "Scores:", sh.GetStoredElements())
+	}
+	if _, ok := sh.GetRecord(3); ok {
+		t.Error("The record 3 was not removed")
+	}
+	if scores, ok := sh.GetRecord(2); !ok || len(scores) != 1 || scores[2] != 3 {
+		t.Error("Unexpected scores for the record 2:", scores)
+	}
+
+	// The records has to remain sorted by insertion time
+	if ids := sh.GetRecordIDs(); !reflect.DeepEqual(ids, []uint64{1, 4, 2}) {
+		t.Error("Unexpected order of the records:", ids)
+	}
+}
+
+func TestIncrementalUpdate(t *testing.T) {
+	sh := NewShard("/testing", "test_incremental_update", 10000, 5, "eu-west-1")
+	defer sh.Stop()
+	updates := 0
+	var added []map[uint64]uint8
+	sh.updateTree = func(recTree *rectree.Tree, records []map[uint64]uint8, getRecords func() []map[uint64]uint8) (*rectree.Tree, map[uint64]float64, int) {
+		updates++
+		added = records
+		return updateTree(recTree, records, getRecords)
+	}
+
+	addRandomRecords(sh, 0)
+	addRandomRecords(sh, cMinRecordsToStart)
+	sh.RecalculateTree()
+	if updates != 0 || sh.GetStatus() != StatusActive {
+		t.Fatal("Expected a full calculation of the first tree, updates:", updates, "status:", sh.GetStatus())
+	}
+
+	// Only the records added since the last calculation update the tree
+	sh.AddRecord(1000, map[uint64]uint8{1: 5})
+	sh.AddRecord(1001, map[uint64]uint8{2: 3})
+	sh.RecalculateTree()
+	if updates != 1 || !reflect.DeepEqual(added, []map[uint64]uint8{{1: 5}, {2: 3}}) && !reflect.DeepEqual(added, []map[uint64]uint8{{2: 3}, {1: 5}}) {
+		t.Error("Unexpected update of the tree, updates:", updates, "records:", added)
+	}
+	if sh.IsDirty() || sh.GetStatus() != StatusActive || len(sh.GetAvgScores([]uint64{1})) != 1 {
+		t.Error("Unexpected shard after update the tree, status:", sh.GetStatus())
+	}
+
+	// The tree is fully calculated after remove too many records
+	for recID := uint64(0); recID < cMinRecordsToStart/2; recID++ {
+		sh.RemoveRecord(recID)
+	}
+	sh.RecalculateTree()
+	if updates != 1 {
+		t.Error("The tree was updated after remove:", cMinRecordsToStart/2, "records")
+	}
+
+	sh.AddRecord(1002, map[uint64]uint8{3: 1})
+	sh.RecalculateTree()
+	if updates != 2 || len(added) != 1 {
+		t.Error("The tree was not updated after the full calculation, updates:", updates, "records:", added)
+	}
+}
+
 func TestRecommenderSaveLoad(t *testing.T) {
 	maxClassifications := uint64(1000000)
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -57,21 +147,21 @@ func TestRecommenderSaveLoad(t *testing.T) {
 
 	time.Sleep(time.Second)
 
-	if sh.totalClassif > maxClassifications {
+	if sh.GetStoredElements() > maxClassifications {
 		t.Error(
 			"Problem with the garbage collection, the total number of stored stores are:",
-			sh.totalClassif, "and the max defined boundary is:", maxClassifications)
+			sh.GetStoredElements(), "and the max defined boundary is:", maxClassifications)
 	}
 
-	if sh.status != StatusStarting {
-		t.Error("The expectede status was:", StatusStarting, "but the actual one is:", sh.status)
+	if sh.GetStatus() != StatusStarting {
+		t.Error("The expectede status was:", StatusStarting, "but the actual one is:", sh.GetStatus())
 	}
 
 	log.Debug("Processing tree...")
 	sh.RecalculateTree()
 
-	if sh.status != StatusActive {
-		t.Error("The expectede status was:", StatusActive, "but the actual one is:", sh.status)
+	if sh.GetStatus() != StatusActive {
+		t.Error("The expectede status was:", StatusActive, "but the actual one is:", sh.GetStatus())
 	}
 
 	s, e = Readln(r)
@@ -81,24 +171,24 @@ func TestRecommenderSaveLoad(t *testing.T) {
 		t.Error("The expected recommendations was 10, but:", len(recomendationsBef), "obtained.")
 	}
 
-	prevScores := sh.totalClassif
+	prevScores := sh.GetStoredElements()
 	sh.SaveBackup()
 
 	sh = NewShard("/testing", "test_collab_insertion", maxClassifications, 5, "eu-west-1")
 	sh.RecalculateTree()
 
-	if sh.status != StatusNoRecords {
-		t.Error("The expectede status was:", StatusNoRecords, "but the actual one is:", sh.status)
+	if sh.GetStatus() != StatusNoRecords {
+		t.Error("The expectede status was:", StatusNoRecords, "but the actual one is:", sh.GetStatus())
 	}
 
 	sh.LoadBackup()
 
 	sh.RecalculateTree()
 
-	if prevScores != sh.totalClassif {
+	if prevScores != sh.GetStoredElements() {
 		t.Error(
 			"Before store a backup the number of records was:", prevScores,
-			"but after load the backup is:", sh.totalClassif)
+			"but after load the backup is:", sh.GetStoredElements())
 	}
 
 	recomendationsAfter := sh.CalcScores(recID, scores, 10)
@@ -106,7 +196,7 @@ func TestRecommenderSaveLoad(t *testing.T) {
 		t.Error("The expected recommendations was 10, but:", len(recomendationsAfter), "obtained.")
 	}
 
-	log.Debug("Classifications:", sh.maxClassif)
+	log.Debug("Classifications:", sh.GetTotalElements())
 }
 
 func Readln(r *bufio.Reader) (string, error) {
@@ -0,0 +1,410 @@
+package recommender
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// cStripesBits Number of bits of the record ID hash used to select the
+	// stripe of the store where the record is allocated
+	cStripesBits = 6
+	// cStripes Number of stripes of the store, each stripe is protected by
+	// its own mutex so the records on different stripes can be modified
+	// concurrently
+	cStripes = 1 << cStripesBits
+	// cHashMult Multiplier used to distribute the record IDs across the
+	// stripes (Fibonacci hashing)
+	cHashMult = 11400714819323198485
+
+	// cMinSlabSize Size in bytes of the first slab allocated by a stripe,
+	// the size of the slabs is doubled on each allocation up to
+	// cMaxSlabSize
+	cMinSlabSize = 1 << 10
+	// cMaxSlabSize Max size in bytes of a slab, only records bigger than
+	// this size are allocated on bigger slabs
+	cMaxSlabSize = 1 << 16
+	// cMapEntryOverhead Estimation of the bytes used by a map to store
+	// each entry in addition to the key and the value
+	cMapEntryOverhead = 16
+)
+
+// record Location of the encoded scores of a record on the slabs of the
+// stripe, see encodeScores
+type record struct {
+	// seq Insertion sequence, used to determine the oldest record across
+	// all the stripes
+	seq     uint64
+	slab    uint32
+	offset  uint32
+	size    uint32
+	classif uint32
+}
+
+// queued Entry of the list of records of a stripe sorted by insertion time,
+// the entry is stale if the record was updated or removed after be queued
+type queued struct {
+	recID uint64
+	seq   uint64
+}
+
+// stripe Portion of the records of the store. The encoded scores are appended
+// to slabs that are never modified after be written, so they can be read by
+// the snapshots without hold the lock, the space of the updated and removed
+// records is recovered compacting the slabs
+type stripe struct {
+	records map[uint64]record
+	slabs   [][]byte
+	// order Records sorted by insertion time in order to expire the
+	// oldest ones, the stale entries are skipped
+	order []queued
+	head  int
+
+	allocatedBytes uint64
+	usedBytes      uint64
+	// memory Estimation of the bytes used by the stripe
+	memory uint64
+
+	mutex sync.Mutex
+}
+
+// recordStore Records of a shard distributed across stripes by record ID
+type recordStore struct {
+	stripes      [cStripes]*stripe
+	totalClassif int64
+	seq          uint64
+	// version Incremented each time that a record is added or removed,
+	// used to determine if the trees have to be rebuilt
+	version uint64
+	// removed Number of records removed, expired or replaced by new scores,
+	// used to determine if the trees can be updated incrementally
+	removed uint64
+}
+
+// newRecordStore Returns an empty store
+func newRecordStore() *recordStore {
+	rs := &recordStore{}
+	for i := range rs.stripes {
+		rs.stripes[i] = &stripe{
+			records: make(map[uint64]record),
+		}
+	}
+
+	return rs
+}
+
+// stripe Returns the stripe where the record is allocated
+func (rs *recordStore) stripe(recID uint64) *stripe {
+	return rs.stripes[(recID*cHashMult)>>(64-cStripesBits)]
+}
+
+// add Stores the scores of the record, replacing the previous ones if the
+// record already exists, the record becomes the newest one
+func (rs *recordStore) add(recID uint64, scores map[uint64]uint8) {
+	data := encodeScores(nil, scores)
+	st := rs.stripe(recID)
+
+	st.mutex.Lock()
+	delta := int64(len(scores))
+	prev, existingRecord := st.records[recID]
+	if existingRecord {
+		st.usedBytes -= uint64(prev.size)
+		delta -= int64(prev.classif)
+	}
+	rec := st.alloc(data)
+	rec.classif = uint32(len(scores))
+	rec.seq = atomic.AddUint64(&rs.seq, 1)
+	st.records[recID] = rec
+	st.order = append(st.order, queued{recID: recID, seq: rec.seq})
+	st.compact()
+	st.mutex.Unlock()
+
+	atomic.AddInt64(&rs.totalClassif, delta)
+	atomic.AddUint64(&rs.version, 1)
+	if existingRecord {
+		atomic.AddUint64(&rs.removed, 1)
+	}
+}
+
+// remove Removes the record from the store, returns false if the record was
+// not stored
+func (rs *recordStore) remove(recID uint64) bool {
+	st := rs.stripe(recID)
+
+	st.mutex.Lock()
+	rec, ok := st.records[recID]
+	if ok {
+		st.delete(recID, rec)
+	}
+	st.mutex.Unlock()
+
+	if ok {
+		atomic.AddInt64(&rs.totalClassif, -int64(rec.classif))
+		atomic.AddUint64(&rs.version, 1)
+		atomic.AddUint64(&rs.removed, 1)
+	}
+
+	return ok
+}
+
+// get Returns the scores of the record
+func (rs *recordStore) get(recID uint64) (scores map[uint64]uint8, ok bool) {
+	st := rs.stripe(recID)
+
+	st.mutex.Lock()
+	rec, ok := st.records[recID]
+	var data []byte
+	if ok {
+		data = st.data(rec)
+	}
+	st.mutex.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	return decodeScores(data, int(rec.classif)), true
+}
+
+// expireOldest Removes the oldest record of the store, returns false if the
+// store is empty
+func (rs *recordStore) expireOldest() bool {
+	var oldest *stripe
+	oldestSeq := uint64(0)
+	for _, st := range rs.stripes {
+		st.mutex.Lock()
+		if q, ok := st.oldest(); ok && (oldest == nil || q.seq < oldestSeq) {
+			oldest = st
+			oldestSeq = q.seq
+		}
+		st.mutex.Unlock()
+	}
+	if oldest == nil {
+		return false
+	}
+
+	// The stripe could be modified since it was checked, but its first
+	// record is still the oldest one of the stripe
+	oldest.mutex.Lock()
+	q, ok := oldest.oldest()
+	rec := oldest.records[q.recID]
+	if ok {
+		oldest.delete(q.recID, rec)
+	}
+	oldest.mutex.Unlock()
+
+	if ok {
+		atomic.AddInt64(&rs.totalClassif, -int64(rec.classif))
+		atomic.AddUint64(&rs.removed, 1)
+	}
+
+	return true
+}
+
+// snapshot Returns the IDs and scores of all the records stored, the stripes
+// are locked one by one so the records can still be modified on the other
+// stripes while the snapshot is taken, and the scores are decoded after
+// release the lock
+func (rs *recordStore) snapshot() (recIDs []uint64, scores []map[uint64]uint8) {
+	data := [][]byte{}
+	classif := []uint32{}
+	for _, st := range rs.stripes {
+		st.mutex.Lock()
+		for recID, rec := range st.records {
+			recIDs = append(recIDs, recID)
+			data = append(data, st.data(rec))
+			classif = append(classif, rec.classif)
+		}
+		st.mutex.Unlock()
+	}
+
+	scores = make([]map[uint64]uint8, len(data))
+	for i, recData := range data {
+		scores[i] = decodeScores(recData, int(classif[i]))
+	}
+
+	return
+}
+
+// added Returns the scores of the records stored with an insertion sequence
+// after from and up to the given one, see getSeq. Only the binary search of the
+// first record on each stripe is performed under the lock
+func (rs *recordStore) added(from, to uint64) (scores []map[uint64]uint8) {
+	data := [][]byte{}
+	classif := []uint32{}
+	for _, st := range rs.stripes {
+		st.mutex.Lock()
+		order := st.order[st.head:]
+		for i := sort.Search(len(order), func(i int) bool { return order[i].seq > from }); i < len(order) && order[i].seq <= to; i++ {
+			// The records updated or removed after be queued are
+			// stale
+			if rec, ok := st.records[order[i].recID]; ok && rec.seq == order[i].seq {
+				data = append(data, st.data(rec))
+				classif = append(classif, rec.classif)
+			}
+		}
+		st.mutex.Unlock()
+	}
+
+	scores = make([]map[uint64]uint8, len(data))
+	for i, recData := range data {
+		scores[i] = decodeScores(recData, int(classif[i]))
+	}
+
+	return
+}
+
+// count Returns the number of records stored
+func (rs *recordStore) count() (records int) {
+	for _, st := range rs.stripes {
+		st.mutex.Lock()
+		records += len(st.records)
+		st.mutex.Unlock()
+	}
+
+	return
+}
+
+// ids Returns the IDs of all the records sorted from the oldest to the newest
+func (rs *recordStore) ids() []uint64 {
+	records := []queued{}
+	for _, st := range rs.stripes {
+		st.mutex.Lock()
+		for recID, rec := range st.records {
+			records = append(records, queued{recID: recID, seq: rec.seq})
+		}
+		st.mutex.Unlock()
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].seq < records[j].seq
+	})
+
+	ids := make([]uint64, len(records))
+	for i, q := range records {
+		ids[i] = q.recID
+	}
+
+	return ids
+}
+
+// storedElements Returns the number of scores stored
+func (rs *recordStore) storedElements() uint64 {
+	return uint64(atomic.LoadInt64(&rs.totalClassif))
+}
+
+// memoryUsage Returns an estimation of the bytes used to store the records,
+// including the space of the slabs not yet recovered by the compaction
+func (rs *recordStore) memoryUsage() (bytes uint64) {
+	for _, st := range rs.stripes {
+		bytes += atomic.LoadUint64(&st.memory)
+	}
+
+	return
+}
+
+// getVersion Returns the number of modifications performed on the store
+func (rs *recordStore) getVersion() uint64 {
+	return atomic.LoadUint64(&rs.version)
+}
+
+// getSeq Returns the insertion sequence of the last record added
+func (rs *recordStore) getSeq() uint64 {
+	return atomic.LoadUint64(&rs.seq)
+}
+
+// getRemoved Returns the number of records removed, expired or replaced
+func (rs *recordStore) getRemoved() uint64 {
+	return atomic.LoadUint64(&rs.removed)
+}
+
+// alloc Copies the encoded scores to the last slab of the stripe, or to a new
+// one if the data doesn't fit on it, and returns the location of the data
+func (st *stripe) alloc(data []byte) record {
+	last := len(st.slabs) - 1
+	if last < 0 || len(st.slabs[last])+len(data) > cap(st.slabs[last]) {
+		size := cMinSlabSize
+		if last >= 0 {
+			size = cap(st.slabs[last]) * 2
+		}
+		if size > cMaxSlabSize {
+			size = cMaxSlabSize
+		}
+		if size < len(data) {
+			size = len(data)
+		}
+		st.slabs = append(st.slabs, make([]byte, 0, size))
+		st.allocatedBytes += uint64(size)
+		last++
+	}
+
+	rec := record{
+		slab:   uint32(last),
+		offset: uint32(len(st.slabs[last])),
+		size:   uint32(len(data)),
+	}
+	st.slabs[last] = append(st.slabs[last], data...)
+	st.usedBytes += uint64(len(data))
+
+	return rec
+}
+
+// data Returns the encoded scores of the record, the returned slice is never
+// modified so it can be read after release the lock
+func (st *stripe) data(rec record) []byte {
+	return st.slabs[rec.slab][rec.offset : rec.offset+rec.size : rec.offset+rec.size]
+}
+
+// delete Removes the record from the stripe, the entry on the list sorted by
+// insertion time becomes stale
+func (st *stripe) delete(recID uint64, rec record) {
+	delete(st.records, recID)
+	st.usedBytes -= uint64(rec.size)
+	st.compact()
+}
+
+// oldest Returns the oldest record of the stripe discarding the stale entries
+// at the beginning of the list sorted by insertion time
+func (st *stripe) oldest() (queued, bool) {
+	for ; st.head < len(st.order); st.head++ {
+		q := st.order[st.head]
+		if rec, ok := st.records[q.recID]; ok && rec.seq == q.seq {
+			return q, true
+		}
+	}
+
+	return queued{}, false
+}
+
+// compact Recovers the space used by the stale entries of the list sorted by
+// insertion time and by the updated and removed records on the slabs when it
+// represents more than the half of the allocated space
+func (st *stripe) compact() {
+	if len(st.order) > cMinSlabSize && len(st.order) > 2*len(st.records) {
+		order := make([]queued, 0, len(st.records))
+		for _, q := range st.order[st.head:] {
+			if rec, ok := st.records[q.recID]; ok && rec.seq == q.seq {
+				order = append(order, q)
+			}
+		}
+		st.order, st.head = order, 0
+	}
+
+	if st.allocatedBytes > cMaxSlabSize && st.allocatedBytes > 2*st.usedBytes {
+		// The previous slabs can still be referenced by the snapshots
+		// being decoded, they are released by the garbage collector
+		// after that
+		slabs := st.slabs
+		st.slabs, st.allocatedBytes, st.usedBytes = nil, 0, 0
+		for recID, rec := range st.records {
+			newRec := st.alloc(slabs[rec.slab][rec.offset : rec.offset+rec.size])
+			newRec.seq, newRec.classif = rec.seq, rec.classif
+			st.records[recID] = newRec
+		}
+	}
+
+	atomic.StoreUint64(&st.memory, st.allocatedBytes+
+		uint64(len(st.records))*uint64(unsafe.Sizeof(uint64(0))+unsafe.Sizeof(record{})+cMapEntryOverhead)+
+		uint64(cap(st.order))*uint64(unsafe.Sizeof(queued{})))
+}
@@ -0,0 +1,268 @@
+package recommender
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStoreExpiration(t *testing.T) {
+	rs := newRecordStore()
+	for recID := uint64(0); recID < 100; recID++ {
+		rs.add(recID, map[uint64]uint8{recID: 1, recID + 1: 2})
+	}
+	// The updated records become the newest ones
+	rs.add(10, map[uint64]uint8{10: 3})
+	rs.add(0, map[uint64]uint8{0: 3})
+	if rs.storedElements() != 198 {
+		t.Error("Expected 198 stored elements, obtained:", rs.storedElements())
+	}
+
+	// The records are expired by insertion time independently of the
+	// stripe where they are allocated
+	for i := 0; i < 98; i++ {
+		if !rs.expireOldest() {
+			t.Fatal("The store is empty after expire:", i, "records")
+		}
+	}
+	if ids := rs.ids(); !reflect.DeepEqual(ids, []uint64{10, 0}) {
+		t.Error("Expected the updated records after expire the oldest ones, obtained:", ids)
+	}
+	if rs.storedElements() != 2 {
+		t.Error("Expected 2 stored elements, obtained:", rs.storedElements())
+	}
+
+	rs.expireOldest()
+	rs.expireOldest()
+	if rs.expireOldest() || rs.storedElements() != 0 {
+		t.Error("Expected an empty store, stored elements:", rs.storedElements())
+	}
+}
+
+func TestEncodeScores(t *testing.T) {
+	for _, scores := range []map[uint64]uint8{
+		{},
+		{0: 0},
+		{1: 5, 2: 3, 130: 1},
+		{math.MaxUint64: 255, 0: 1, 1 << 40: 7},
+	} {
+		data := encodeScores(nil, scores)
+		if decoded := decodeScores(data, len(scores)); !reflect.DeepEqual(decoded, scores) {
+			t.Error("Expected scores:", scores, "decoded:", decoded)
+		}
+	}
+
+	// Each item ID is encoded as the difference with the previous one
+	if data := encodeScores(nil, map[uint64]uint8{1: 5, 2: 3, 130: 1}); !reflect.DeepEqual(data, []byte{1, 5, 1, 3, 128, 1, 1}) {
+		t.Error("Unexpected encoded scores:", data)
+	}
+}
+
+func TestStoreCompaction(t *testing.T) {
+	rs := newRecordStore()
+	for i := uint64(0); i < 1000; i++ {
+		for recID := uint64(0); recID < 100; recID++ {
+			rs.add(recID, map[uint64]uint8{i: 1, 2000 + recID: 2, 1000: uint8(i)})
+		}
+	}
+	if rs.storedElements() != 300 || len(rs.ids()) != 100 {
+		t.Error("Expected 100 records with 300 scores, obtained:", len(rs.ids()), "Scores:", rs.storedElements())
+	}
+	for recID := uint64(0); recID < 100; recID++ {
+		if scores, _ := rs.get(recID); !reflect.DeepEqual(scores, map[uint64]uint8{999: 1, 2000 + recID: 2, 1000: 231}) {
+			t.Error("Unexpected scores for record:", recID, scores)
+		}
+	}
+
+	// The space of the updated records has to be recovered
+	maxMem := uint64(0)
+	for _, st := range rs.stripes {
+		maxMem += 2*cMaxSlabSize + uint64(cap(st.order)*16)
+	}
+	if mem := rs.memoryUsage(); mem > maxMem {
+		t.Error("The memory of the updated records was not recovered, used:", mem, "Max expected:", maxMem)
+	}
+
+	for rs.expireOldest() {
+	}
+	if rs.storedElements() != 0 || len(rs.ids()) != 0 {
+		t.Error("Expected an empty store, obtained:", rs.ids())
+	}
+}
+
+func TestStoreMemoryUsage(t *testing.T) {
+	rs := newRecordStore()
+	rnd := rand.New(rand.NewSource(1))
+	for recID := uint64(0); recID < 10000; recID++ {
+		scores := make(map[uint64]uint8)
+		for len(scores) < 20 {
+			scores[uint64(rnd.Intn(20000))] = uint8(rnd.Intn(6))
+		}
+		rs.add(recID, scores)
+	}
+
+	bytesByClassif := float64(rs.memoryUsage()) / float64(rs.storedElements())
+	t.Log("Bytes by classification:", bytesByClassif)
+	if bytesByClassif > 12 {
+		t.Error("Expected less than 12 bytes by classification, obtained:", bytesByClassif)
+	}
+}
+
+func TestMemoryUsageWithTree(t *testing.T) {
+	sh := NewShard("/testing", "test_memory_usage", 100000, 5, "eu-west-1")
+	defer sh.Stop()
+	rnd := rand.New(rand.NewSource(1))
+	for recID := uint64(0); recID < 1000; recID++ {
+		scores := make(map[uint64]uint8)
+		for len(scores) < 10 {
+			scores[uint64(rnd.Intn(100))] = uint8(rnd.Intn(6))
+		}
+		sh.AddRecord(recID, scores)
+	}
+
+	recordsMem := sh.GetMemoryUsage()
+	sh.RecalculateTree()
+	if sh.GetStatus() != StatusActive || sh.GetMemoryUsage() <= recordsMem {
+		t.Error("The memory of the tree is not considered, records:", recordsMem, "total:", sh.GetMemoryUsage())
+	}
+}
+
+func TestStoreConcurrentAccess(t *testing.T) {
+	const writers = 8
+	const recsByWriter = 2000
+
+	rs := newRecordStore()
+	var wg sync.WaitGroup
+	var snapshots int32
+	done := make(chan struct{})
+
+	// The snapshots are taken while the records are modified
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			recIDs, scores := rs.snapshot()
+			for i, recID := range recIDs {
+				if _, ok := scores[i][recID]; !ok {
+					t.Error("Inconsistent scores on the snapshot for record:", recID, scores[i])
+					return
+				}
+			}
+			atomic.AddInt32(&snapshots, 1)
+		}
+	}()
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < recsByWriter; i++ {
+				recID := uint64(w*recsByWriter + i)
+				rs.add(recID, map[uint64]uint8{recID: 1})
+				// Update and remove some of the records
+				// already stored by this writer
+				switch i % 10 {
+				case 3:
+					rs.add(recID-1, map[uint64]uint8{recID - 1: 2, recID: 3})
+				case 7:
+					rs.remove(recID - 2)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+
+	expectedRecs := writers * (recsByWriter - recsByWriter/10)
+	if recIDs, _ := rs.snapshot(); len(recIDs) != expectedRecs || len(rs.ids()) != expectedRecs {
+		t.Error("Expected", expectedRecs, "records, obtained:", len(recIDs))
+	}
+	if expected := uint64(expectedRecs + writers*recsByWriter/10); rs.storedElements() != expected {
+		t.Error("Expected", expected, "stored elements, obtained:", rs.storedElements())
+	}
+	if atomic.LoadInt32(&snapshots) == 0 {
+		t.Error("No snapshot was taken while the records were modified")
+	}
+}
+
+func TestIsDirty(t *testing.T) {
+	sh := NewShard("/testing", "test_is_dirty", 1000, 5, "eu-west-1")
+	defer sh.Stop()
+
+	if !sh.IsDirty() {
+		t.Error("A new shard has to be dirty until the first tree is built")
+	}
+	sh.RecalculateTree()
+	if sh.IsDirty() || sh.GetStatus() != StatusNoRecords {
+		t.Error("Unexpected shard after build an empty tree, status:", sh.GetStatus())
+	}
+
+	sh.AddRecord(1, map[uint64]uint8{1: 5})
+	if !sh.IsDirty() || sh.GetPendingChanges() != 1 {
+		t.Error("The shard has to be dirty after add a record, pending changes:", sh.GetPendingChanges())
+	}
+	sh.RecalculateTree()
+	sh.RemoveRecord(1)
+	if !sh.IsDirty() || sh.GetPendingChanges() != 1 {
+		t.Error("The shard has to be dirty after remove a record, pending changes:", sh.GetPendingChanges())
+	}
+}
+
+// cBenchRecords Number of different records used by the benchmarks, the store
+// keeps a constant size while the records are updated
+const cBenchRecords = 10000
+
+func BenchmarkAddRecordParallel(b *testing.B) {
+	sh := NewShard("/testing", "bench_add_record", 1<<40, 5, "eu-west-1")
+	defer sh.Stop()
+
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			recID := uint64(rnd.Int63n(cBenchRecords))
+			sh.AddRecord(recID, map[uint64]uint8{recID % 1000: 3})
+		}
+	})
+}
+
+func BenchmarkAddRecordWhileRebuilding(b *testing.B) {
+	sh := NewShard("/testing", "bench_add_record_rebuild", 1<<40, 5, "eu-west-1")
+	defer sh.Stop()
+	for recID := uint64(0); recID < cBenchRecords; recID++ {
+		sh.AddRecord(recID, map[uint64]uint8{recID % 1000: 3})
+	}
+
+	// The trees are rebuilt periodically while the records are added
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				sh.store.snapshot()
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			recID := uint64(rnd.Int63n(cBenchRecords))
+			sh.AddRecord(recID, map[uint64]uint8{recID % 1000: 3})
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package rest
+
+// Package with the common helpers used by all the handlers of the versioned
+// REST API in order to read JSON request bodies and to write JSON responses
+// and error objects in a consistent way
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	// CV2Prefix Prefix for all the endpoints of the version 2 of the API
+	CV2Prefix = "/v2/"
+
+	// CodeBadRequest The request body or parameters are not valid
+	CodeBadRequest = "bad_request"
+	// CodeUnauthorized The provided credentials are not valid
+	CodeUnauthorized = "unauthorized"
+	// CodeForbidden The credentials are valid but the action is not allowed
+	CodeForbidden = "forbidden"
+	// CodeNotFound The requested resource doesn't exists
+	CodeNotFound = "not_found"
+	// CodeMethodNotAllowed The HTTP method is not supported by the resource
+	CodeMethodNotAllowed = "method_not_allowed"
+	// CodeConflict The resource already exists
+	CodeConflict = "conflict"
+	// CodeUnprocessable The request is well formed but contains invalid
+	// values
+	CodeUnprocessable = "unprocessable_entity"
+	// CodeTooManyRequests The requests / sec limit was reached
+	CodeTooManyRequests = "too_many_requests"
+	// CodeInternal Internal server error
+	CodeInternal = "internal_error"
+	// CodeProvisioning There is no shard ready to attend the request
+	CodeProvisioning = "provisioning"
+
+	// cMaxBodySize Max size in bytes of a JSON request body
+	cMaxBodySize = 32 << 20
+)
+
+// ErrEmptyBody The request doesn't contain a body to be decoded
+var ErrEmptyBody = errors.New("Empty request body")
+
+// Error Error object returned by the API when a request can't be attended
+type Error struct {
+	// Code Machine readable error code, see the Code constants
+	Code string `json:"code"`
+	// Message Human readable description of the error
+	Message string `json:"message"`
+}
+
+// errorResponse Envelope used to return the error objects
+type errorResponse struct {
+	Error *Error `json:"error"`
+}
+
+// WriteJSON Writes the given value encoded as JSON as response body with the
+// specified status code
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		WriteError(w, 500, CodeInternal, "The response can't be encoded as JSON")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// WriteError Writes an error object as response body with the specified status
+// code
+func WriteError(w http.ResponseWriter, status int, code, message string) {
+	body, _ := json.Marshal(&errorResponse{
+		Error: &Error{
+			Code:    code,
+			Message: message,
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// ReadBody Returns the body of the request limited to the max allowed size
+func ReadBody(r *http.Request) (body []byte, err error) {
+	if r.Body == nil {
+		return nil, ErrEmptyBody
+	}
+
+	return ioutil.ReadAll(io.LimitReader(r.Body, cMaxBodySize))
+}
+
+// ReadJSON Decodes the JSON request body into v
+func ReadJSON(r *http.Request, v interface{}) (err error) {
+	body, err := ReadBody(r)
+	if err != nil {
+		return err
+	}
+
+	return DecodeJSON(body, v)
+}
+
+// DecodeJSON Decodes a JSON body previously read from a request into v
+func DecodeJSON(body []byte, v interface{}) (err error) {
+	if len(body) == 0 {
+		return ErrEmptyBody
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// AllowMethods Checks if the method of the request is one of the given
+// methods, if not, writes a 405 error with the corresponding Allow header and
+// returns false
+func AllowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	WriteError(w, 405, CodeMethodNotAllowed, "Method not allowed: "+r.Method)
+
+	return false
+}
+
+// PathParts Returns the non empty segments of the path after the given prefix
+func PathParts(path, prefix string) (parts []string) {
+	parts = []string{}
+	for _, part := range strings.Split(strings.TrimPrefix(path, prefix), "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	return
+}
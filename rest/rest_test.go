@@ -0,0 +1,65 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPathParts(t *testing.T) {
+	parts := PathParts("/v2/groups/my-group:1234/recs/batch/", "/v2/groups")
+	if len(parts) != 3 || parts[0] != "my-group:1234" || parts[1] != "recs" || parts[2] != "batch" {
+		t.Error("Unexpected path parts:", parts)
+	}
+
+	if len(PathParts("/v2/groups/", "/v2/groups")) != 0 {
+		t.Error("No parts expected for the root of the resource")
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteError(w, 429, CodeTooManyRequests, "Too Many Requests")
+
+	if w.Code != 429 {
+		t.Error("Expected status code 429, obtained:", w.Code)
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Error("The error has to be returned as JSON")
+	}
+
+	resp := &errorResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil || resp.Error == nil {
+		t.Fatal("The error object can't be decoded, Error:", err)
+	}
+	if resp.Error.Code != CodeTooManyRequests || resp.Error.Message != "Too Many Requests" {
+		t.Error("Unexpected error object:", resp.Error)
+	}
+}
+
+func TestAllowMethods(t *testing.T) {
+	w := httptest.NewRecorder()
+	if !AllowMethods(w, httptest.NewRequest("POST", "/v2/groups", nil), "GET", "POST") {
+		t.Error("The POST method has to be allowed")
+	}
+
+	w = httptest.NewRecorder()
+	if AllowMethods(w, httptest.NewRequest("DELETE", "/v2/groups", nil), "GET", "POST") {
+		t.Error("The DELETE method can't be allowed")
+	}
+	if w.Code != 405 || w.Header().Get("Allow") != "GET, POST" {
+		t.Error("Expected 405 with Allow header, obtained:", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	v := map[string]int{}
+	if err := ReadJSON(httptest.NewRequest("POST", "/", strings.NewReader(`{"a": 1}`)), &v); err != nil || v["a"] != 1 {
+		t.Error("The body can't be decoded, Error:", err)
+	}
+
+	if err := ReadJSON(httptest.NewRequest("POST", "/", strings.NewReader("")), &v); err != ErrEmptyBody {
+		t.Error("Expected empty body error, obtained:", err)
+	}
+}
@@ -0,0 +1,482 @@
+package shardsmanager
+
+import (
+	"github.com/alonsovidales/pit/log"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/models/users"
+	"github.com/alonsovidales/pit/rest"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// CV2GroupsPath Root of all the group resources on the version 2 of the
+	// API:
+	//   GET    /v2/groups                         Lists the groups of the user
+	//   POST   /v2/groups                         Creates a new group
+	//   DELETE /v2/groups/{gid}                   Removes a group
+	//   GET    /v2/groups/{gid}/info              Statistics of the shards
+	//   POST   /v2/groups/{gid}/key               Regenerates the group key
+	//   PUT    /v2/groups/{gid}/shards            Sets the number of shards
+	//   DELETE /v2/groups/{gid}/records           Removes all the records
+	//   PUT    /v2/groups/{gid}/records/{id}      Stores the scores of a record
+	//   POST   /v2/groups/{gid}/recs              Recommendations for a record
+	//   POST   /v2/groups/{gid}/recs/batch        Recommendations for a batch
+	//   POST   /v2/groups/{gid}/scores            Average scores of items
+	CV2GroupsPath = rest.CV2Prefix + "groups"
+
+	// CGroupKeyHeader Header used to send the key of the group on the
+	// management requests, where the basic auth contains the user
+	// credentials
+	CGroupKeyHeader = "X-Pit-Group-Key"
+)
+
+// CreateGroupReq Body of the request to create a new group
+type CreateGroupReq struct {
+	// Name Name of the group, used as prefix of the group ID
+	Name string `json:"name"`
+	// Type Type of group, determines the requests / sec and max elements
+	Type string `json:"type"`
+	// Shards Number of shards that composes the group
+	Shards int `json:"shards"`
+	// MaxScore Max score that can be assigned to an item
+	MaxScore uint8 `json:"max_score"`
+	// Routing Routing mode of the requests, "hash" to consistently hash
+	// the records onto the shards
+	Routing string `json:"routing,omitempty"`
+}
+
+// GroupKeyResponse Response that contains the key to access to a group
+type GroupKeyResponse struct {
+	// GroupID ID of the group
+	GroupID string `json:"group_id"`
+	// Key Secret key of the group
+	Key string `json:"key"`
+}
+
+// SetShardsReq Body of the request to modify the number of shards of a group
+type SetShardsReq struct {
+	// Shards Number of shards that composes the group
+	Shards int `json:"shards"`
+}
+
+// RecsReq Body of the request to obtain recommendations for a record
+type RecsReq struct {
+	// ID Record identifier
+	ID uint64 `json:"id"`
+	// Scores Scores by item ID of the record
+	Scores map[string]uint8 `json:"scores"`
+	// MaxRecs Max number of recommendations to be returned
+	MaxRecs int `json:"max_recs"`
+	// FanOut Merges the recommendations of all the shards of the group
+	// instead of use a single shard
+	FanOut bool `json:"fanout,omitempty"`
+}
+
+// RecBatchReqs Body of the request to obtain recommendations for a batch of
+// records
+type RecBatchReqs struct {
+	// Recs Recommendation requests, one by record
+	Recs []*RecBatchReq `json:"recs"`
+}
+
+// InsertReq Body of the request to store the scores of a record
+type InsertReq struct {
+	// Scores Scores by item ID of the record
+	Scores map[string]uint8 `json:"scores"`
+}
+
+// ScoresReq Body of the request to obtain the average scores of some items
+type ScoresReq struct {
+	// Items Items IDs
+	Items []uint64 `json:"items"`
+}
+
+// GroupsV2APIHandler Dispatches all the requests under CV2GroupsPath to the
+// corresponding handler depending on the path and the HTTP method
+func (mg *Manager) GroupsV2APIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	r = r.WithContext(requestContext(w, r))
+
+	parts := rest.PathParts(r.URL.Path, CV2GroupsPath)
+	switch {
+	case len(parts) == 0:
+		if rest.AllowMethods(w, r, "GET", "POST") {
+			if r.Method == "GET" {
+				mg.v2ListGroups(w, r)
+			} else {
+				mg.v2CreateGroup(w, r)
+			}
+		}
+	case len(parts) == 1:
+		if rest.AllowMethods(w, r, "DELETE") {
+			mg.v2DelGroup(w, r, parts[0])
+		}
+	case len(parts) == 2 && parts[1] == "info":
+		if rest.AllowMethods(w, r, "GET") {
+			mg.v2GroupInfo(w, r, parts[0])
+		}
+	case len(parts) == 2 && parts[1] == "key":
+		if rest.AllowMethods(w, r, "POST") {
+			mg.v2RegenerateKey(w, r, parts[0])
+		}
+	case len(parts) == 2 && parts[1] == "shards":
+		if rest.AllowMethods(w, r, "PUT") {
+			mg.v2SetShards(w, r, parts[0])
+		}
+	case len(parts) == 2 && parts[1] == "records":
+		if rest.AllowMethods(w, r, "DELETE") {
+			mg.v2RemoveRecords(w, r, parts[0])
+		}
+	case len(parts) == 3 && parts[1] == "records":
+		if rest.AllowMethods(w, r, "PUT") {
+			mg.v2Insert(w, r, parts[0], parts[2])
+		}
+	case len(parts) == 2 && parts[1] == "recs":
+		if rest.AllowMethods(w, r, "POST") {
+			mg.v2Recs(w, r, parts[0])
+		}
+	case len(parts) == 3 && parts[1] == "recs" && parts[2] == "batch":
+		if rest.AllowMethods(w, r, "POST") {
+			mg.v2RecBatch(w, r, parts[0])
+		}
+	case len(parts) == 2 && parts[1] == "scores":
+		if rest.AllowMethods(w, r, "POST") {
+			mg.v2Scores(w, r, parts[0])
+		}
+	default:
+		rest.WriteError(w, 404, rest.CodeNotFound, "Resource not found")
+	}
+}
+
+// writeV2Error Writes the error object that corresponds to the given error
+func writeV2Error(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrTooManyRequests:
+		rest.WriteError(w, 429, rest.CodeTooManyRequests, err.Error())
+	case ErrShardNotAvailable:
+		rest.WriteError(w, 503, rest.CodeProvisioning, cProvisioningMsg)
+	case ErrUnauthorized, shardinfo.ErrAuth, shardinfo.ErrGroupNotFound, shardinfo.ErrGroupUserNotFound:
+		rest.WriteError(w, 401, rest.CodeUnauthorized, "Unauthorized")
+	case ErrGroupTypeRequired, shardinfo.ErrUnknownRouting:
+		rest.WriteError(w, 422, rest.CodeUnprocessable, err.Error())
+	case ErrBatchTooBig, rest.ErrEmptyBody:
+		rest.WriteError(w, 400, rest.CodeBadRequest, err.Error())
+	default:
+		log.Error("Problem processing API v2 request, Error:", err)
+		rest.WriteError(w, 500, rest.CodeInternal, "Internal Server Error")
+	}
+}
+
+// v2User Returns the user that corresponds to the basic auth credentials of
+// the request
+func (mg *Manager) v2User(r *http.Request) (uid string, user *users.User, err error) {
+	uid, key, ok := r.BasicAuth()
+	if !ok {
+		return "", nil, ErrUnauthorized
+	}
+	if user = mg.usersModel.GetUserInfo(uid, key); user == nil {
+		return "", nil, ErrUnauthorized
+	}
+
+	return
+}
+
+// v2UserGroup Returns the user that corresponds to the basic auth credentials
+// and the group identified by the group ID and the key on the CGroupKeyHeader
+// header
+func (mg *Manager) v2UserGroup(r *http.Request, groupID string) (uid string, user *users.User, group *shardinfo.GroupInfo, err error) {
+	uid, uKey, ok := r.BasicAuth()
+	if !ok {
+		return "", nil, nil, ErrUnauthorized
+	}
+
+	user, group, err = mg.getUserGroup(uid, uKey, groupID, r.Header.Get(CGroupKeyHeader))
+
+	return
+}
+
+// v2Group Returns the group after validate the basic auth credentials of the
+// request, where the password is the key of the group
+func (mg *Manager) v2Group(r *http.Request, groupID string) (group *shardinfo.GroupInfo, err error) {
+	uid, key, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+
+	return mg.shardsModel.GetGroupByUserKeyID(uid, key, groupID)
+}
+
+// v2ListGroups Returns all the groups of the user
+func (mg *Manager) v2ListGroups(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := mg.v2User(r)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	rest.WriteJSON(w, 200, mg.shardsModel.GetAllGroupsByUserID(uid))
+}
+
+// v2CreateGroup Creates a new group and returns the ID and key for it
+func (mg *Manager) v2CreateGroup(w http.ResponseWriter, r *http.Request) {
+	uid, user, err := mg.v2User(r)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	req := &CreateGroupReq{}
+	if err = rest.ReadJSON(r, req); err != nil {
+		rest.WriteError(w, 400, rest.CodeBadRequest, err.Error())
+		return
+	}
+	if req.Name == "" || req.Shards < 1 || req.MaxScore < 1 {
+		rest.WriteError(w, 422, rest.CodeUnprocessable, "The name, shards and max_score fields are required")
+		return
+	}
+
+	groupID, key, err := mg.addGroup(user, uid, req.Name, req.Type, req.Routing, req.Shards, req.MaxScore, r.RemoteAddr)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	rest.WriteJSON(w, 201, &GroupKeyResponse{
+		GroupID: groupID,
+		Key:     key,
+	})
+}
+
+// v2DelGroup Removes the group and all the content on the shards
+func (mg *Manager) v2DelGroup(w http.ResponseWriter, r *http.Request, groupID string) {
+	uid, user, group, err := mg.v2UserGroup(r, groupID)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	if err = mg.delGroup(user, uid, group, r.RemoteAddr); err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// v2GroupInfo Returns the statistics of all the shards of the group
+func (mg *Manager) v2GroupInfo(w http.ResponseWriter, r *http.Request, groupID string) {
+	group, err := mg.v2Group(r, groupID)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	rest.WriteJSON(w, 200, mg.getGroupStats(r.Context(), group, true))
+}
+
+// v2RegenerateKey Creates a new key for the group and returns it
+func (mg *Manager) v2RegenerateKey(w http.ResponseWriter, r *http.Request, groupID string) {
+	_, user, group, err := mg.v2UserGroup(r, groupID)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	key, err := mg.regenerateGroupKey(user, group, r.RemoteAddr)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	rest.WriteJSON(w, 200, &GroupKeyResponse{
+		GroupID: group.GroupID,
+		Key:     key,
+	})
+}
+
+// v2SetShards Modifies the number of shards of the group
+func (mg *Manager) v2SetShards(w http.ResponseWriter, r *http.Request, groupID string) {
+	uid, user, group, err := mg.v2UserGroup(r, groupID)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	req := &SetShardsReq{}
+	if err = rest.ReadJSON(r, req); err != nil {
+		rest.WriteError(w, 400, rest.CodeBadRequest, err.Error())
+		return
+	}
+	if req.Shards < 1 {
+		rest.WriteError(w, 422, rest.CodeUnprocessable, "The number of shards has to be a positive integer")
+		return
+	}
+
+	if err = mg.setShards(user, uid, group, req.Shards, r.RemoteAddr); err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// v2RemoveRecords Wipes all the records stored on the shards of the group
+func (mg *Manager) v2RemoveRecords(w http.ResponseWriter, r *http.Request, groupID string) {
+	_, user, group, err := mg.v2UserGroup(r, groupID)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	if !mg.removeShardsContent(user, group, r.RemoteAddr) {
+		rest.WriteError(w, 500, rest.CodeInternal, "The content of the shards can't be removed")
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// v2Recs Returns the recommendations for a record
+func (mg *Manager) v2Recs(w http.ResponseWriter, r *http.Request, groupID string) {
+	group, err := mg.v2Group(r, groupID)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	recsReq := &RecsReq{}
+	if !mg.readV2Body(w, r, recsReq) {
+		return
+	}
+	scores, err := parseScores(recsReq.Scores)
+	if err != nil {
+		rest.WriteError(w, 400, rest.CodeBadRequest, err.Error())
+		return
+	}
+
+	if err = mg.takeQuota(w.Header(), group, 1, false); err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	var response *RecsResponse
+	if recsReq.FanOut {
+		response, err = mg.recommendFanOut(r.Context(), group, recsReq.ID, scores, recsReq.MaxRecs)
+	} else {
+		response, err = mg.recommendOrForward(r.Context(), group, recsReq.ID, scores, recsReq.MaxRecs)
+	}
+	writeV2DataResponse(w, response, err)
+}
+
+// v2RecBatch Returns the recommendations for a batch of records
+func (mg *Manager) v2RecBatch(w http.ResponseWriter, r *http.Request, groupID string) {
+	group, err := mg.v2Group(r, groupID)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	batchReq := &RecBatchReqs{}
+	if !mg.readV2Body(w, r, batchReq) {
+		return
+	}
+
+	if len(batchReq.Recs) > cMaxRecBatchSize {
+		writeV2Error(w, ErrBatchTooBig)
+		return
+	}
+	if _, err = parseBatch(batchReq.Recs); err != nil {
+		rest.WriteError(w, 400, rest.CodeBadRequest, err.Error())
+		return
+	}
+	if err = mg.takeQuota(w.Header(), group, len(batchReq.Recs), false); err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	response, err := mg.recommendBatchOrForward(r.Context(), group, batchReq.Recs)
+	switch err {
+	case nil, ErrShardNotAvailable, ErrTooManyRequests, ErrBatchTooBig:
+		writeV2DataResponse(w, response, err)
+	default:
+		// Any other error is caused by an invalid record on the batch
+		rest.WriteError(w, 400, rest.CodeBadRequest, err.Error())
+	}
+}
+
+// v2Insert Stores the scores of a record
+func (mg *Manager) v2Insert(w http.ResponseWriter, r *http.Request, groupID, recID string) {
+	group, err := mg.v2Group(r, groupID)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	id, err := strconv.ParseUint(recID, 10, 64)
+	if err != nil {
+		rest.WriteError(w, 400, rest.CodeBadRequest, "The record ID has to be an integer")
+		return
+	}
+	insertReq := &InsertReq{}
+	if !mg.readV2Body(w, r, insertReq) {
+		return
+	}
+	scores, err := parseScores(insertReq.Scores)
+	if err != nil {
+		rest.WriteError(w, 400, rest.CodeBadRequest, err.Error())
+		return
+	}
+
+	if err = mg.takeQuota(w.Header(), group, 1, true); err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	response, err := mg.insertOrForward(r.Context(), group, id, scores)
+	writeV2DataResponse(w, response, err)
+}
+
+// v2Scores Returns the average scores for the requested items
+func (mg *Manager) v2Scores(w http.ResponseWriter, r *http.Request, groupID string) {
+	group, err := mg.v2Group(r, groupID)
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	scoresReq := &ScoresReq{}
+	if !mg.readV2Body(w, r, scoresReq) {
+		return
+	}
+
+	if err = mg.takeQuota(w.Header(), group, 1, false); err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	response, err := mg.itemScoresOrForward(r.Context(), group, scoresReq.Items)
+	writeV2DataResponse(w, response, err)
+}
+
+// readV2Body Reads and decodes the JSON body of the request into v, in case of
+// error writes a bad request error and returns false
+func (mg *Manager) readV2Body(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := rest.ReadJSON(r, v); err != nil {
+		rest.WriteError(w, 400, rest.CodeBadRequest, err.Error())
+		return false
+	}
+
+	return true
+}
+
+// writeV2DataResponse Writes the response of a recommendations, insert or
+// scores request, or the error object if the request couldn't be attended
+func writeV2DataResponse(w http.ResponseWriter, response interface{}, err error) {
+	if err != nil {
+		writeV2Error(w, err)
+		return
+	}
+
+	rest.WriteJSON(w, 200, response)
+}
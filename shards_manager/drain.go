@@ -0,0 +1,116 @@
+package shardsmanager
+
+import (
+	"context"
+	"github.com/alonsovidales/pit/log"
+	"time"
+)
+
+const (
+	// cDrainCheckPeriod Period to check if the manage loop finished and if
+	// the shards handed off were released while the instance is drained
+	cDrainCheckPeriod = 100 * time.Millisecond
+)
+
+// IsDraining Returns true after the manager was stopped, while the instance is
+// draining it doesn't acquire new shards and has to stop receiving requests
+func (mg *Manager) IsDraining() bool {
+	return !mg.isActive()
+}
+
+// freezeWrites Stops storing new records on the shard of the group, the
+// requests that would store them are answered with ErrShardNotAvailable. The
+// method waits until the records in progress are stored, so the backup stored
+// after that contains all the records accepted by the shard. The shard accepts
+// records again once it is released
+func (mg *Manager) freezeWrites(groupID string) {
+	mg.writesMutex.Lock()
+	defer mg.writesMutex.Unlock()
+
+	mg.mutex.Lock()
+	if mg.frozen == nil {
+		mg.frozen = make(map[string]bool)
+	}
+	mg.frozen[groupID] = true
+	mg.mutex.Unlock()
+}
+
+// storeRecords Calls fn, that stores records on the local shard of the group,
+// in case of the shard was not frozen by freezeWrites, returns
+// ErrShardNotAvailable if it was
+func (mg *Manager) storeRecords(groupID string, fn func()) error {
+	mg.writesMutex.RLock()
+	defer mg.writesMutex.RUnlock()
+
+	mg.mutex.RLock()
+	frozen := mg.frozen[groupID]
+	mg.mutex.RUnlock()
+	if frozen {
+		return ErrShardNotAvailable
+	}
+	fn()
+
+	return nil
+}
+
+// Drain Stops the acquisition of new shards, stores a final backup of each
+// acquired shard and hands them off releasing them, so the other instances can
+// acquire the shards and restore the backups without wait for the expiration
+// of the ownership. The shards don't store new records since their final
+// backup is stored, see freezeWrites. The method waits until all the shards
+// are released, the records of the groups routed by hash are migrated before
+// that, or until the context expires. It should be called after stop receiving
+// requests from the clients
+func (mg *Manager) Drain(ctx context.Context) (err error) {
+	mg.Stop()
+	ticker := time.NewTicker(cDrainCheckPeriod)
+	defer ticker.Stop()
+
+	// The manage loop could be acquiring a shard
+	for !mg.IsFinished() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	mg.mutex.RLock()
+	groupIDs := make([]string, 0, len(mg.acquiredShards))
+	for groupID := range mg.acquiredShards {
+		groupIDs = append(groupIDs, groupID)
+	}
+	mg.mutex.RUnlock()
+
+	for _, groupID := range groupIDs {
+		rec, ok := mg.getAcquiredShard(groupID)
+		group := mg.shardsModel.GetGroupByID(groupID)
+		if !ok || group == nil {
+			continue
+		}
+
+		log.Info("Draining, handing off shard of group:", groupID)
+		mg.freezeWrites(groupID)
+		rec.SaveBackup()
+		group.ReleaseShard()
+	}
+
+	// The shards are released by keepUpdateGroup after detect that the
+	// instance is not the owner anymore
+	for len(mg.getAcquiredShards()) > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			log.Error("The shards can't be released before the drain timeout, pending shards:", len(mg.getAcquiredShards()))
+			// Release the ownership of the remaining shards
+			mg.shardsModel.ReleaseAllAcquiredShards()
+
+			return
+		case <-ticker.C:
+		}
+	}
+	mg.shardsModel.ReleaseAllAcquiredShards()
+	log.Info("All the shards were handed off")
+
+	return
+}
@@ -0,0 +1,137 @@
+package shardsmanager
+
+import (
+	"context"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/models/storage"
+	"github.com/alonsovidales/pit/recommender"
+	"testing"
+	"time"
+)
+
+func newDrainManager(t *testing.T, groupIDs ...string) (mg *Manager, shards map[string]*memShard) {
+	shardsModel := shardinfo.NewModel(storage.NewMemTable(), storage.NewMemTable(), "admin@test.com")
+	shards = make(map[string]*memShard)
+	acquiredShards := make(map[string]recommender.Int)
+	for _, groupID := range groupIDs {
+		group, _, err := shardsModel.AddUpdateGroup("s", "user@test.com", groupID, 2, 1000, 100, 100, 5)
+		if err != nil {
+			t.Fatal("Problem creating the group, Error:", err)
+		}
+		if acquired, err := group.AcquireShard(); !acquired {
+			t.Fatal("Problem acquiring the shard of the group:", groupID, "Error:", err)
+		}
+		shards[groupID] = &memShard{}
+		acquiredShards[groupID] = shards[groupID]
+	}
+
+	mg = &Manager{
+		shardsModel:    shardsModel,
+		acquiredShards: acquiredShards,
+		reqSecStats:    make(map[string]*statsReqSec),
+		active:         true,
+		finished:       true,
+	}
+
+	return
+}
+
+func TestDrain(t *testing.T) {
+	mg, shards := newDrainManager(t, "g1", "g2")
+
+	// Emulates keepUpdateGroup releasing the shards that are not owned
+	// anymore by the instance
+	go func() {
+		for len(mg.getAcquiredShards()) > 0 {
+			for _, groupID := range []string{"g1", "g2"} {
+				if gr := mg.shardsModel.GetGroupByID(groupID); !gr.IsThisInstanceOwner() {
+					mg.releaseAcquiredShard(groupID)
+				}
+			}
+			time.Sleep(cDrainCheckPeriod)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := mg.Drain(ctx); err != nil {
+		t.Fatal("Problem draining the instance, Error:", err)
+	}
+	if !mg.IsDraining() {
+		t.Error("The manager has to be draining after the drain")
+	}
+	for groupID, shard := range shards {
+		if shard.backups != 1 {
+			t.Error("Expected a single backup of the shard of the group:", groupID, "obtained:", shard.backups)
+		}
+		if mg.shardsModel.GetGroupByID(groupID).IsThisInstanceOwner() {
+			t.Error("The shard of the group:", groupID, "was not handed off")
+		}
+	}
+	if len(mg.getAcquiredShards()) != 0 {
+		t.Error("Expected all the shards released, pending:", len(mg.getAcquiredShards()))
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	mg, shards := newDrainManager(t, "g1")
+
+	// The shard is never released by keepUpdateGroup
+	ctx, cancel := context.WithTimeout(context.Background(), 3*cDrainCheckPeriod)
+	defer cancel()
+	if err := mg.Drain(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected a deadline exceeded error, obtained:", err)
+	}
+	if shards["g1"].backups != 1 || mg.shardsModel.GetGroupByID("g1").IsThisInstanceOwner() {
+		t.Error("The shard has to be backed up and released even if the drain expires")
+	}
+
+	// The manage loop never finishes
+	mg, shards = newDrainManager(t, "g1")
+	mg.finished = false
+	ctx, cancel = context.WithTimeout(context.Background(), 3*cDrainCheckPeriod)
+	defer cancel()
+	if err := mg.Drain(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected a deadline exceeded error, obtained:", err)
+	}
+	if shards["g1"].backups != 0 {
+		t.Error("The shards can't be handed off while the manage loop is running")
+	}
+}
+
+func TestFreezeWrites(t *testing.T) {
+	mg, _ := newDrainManager(t, "g1", "g2")
+
+	// The records in progress are stored before the shard is frozen
+	storing, stored := make(chan bool), make(chan bool)
+	go mg.storeRecords("g1", func() {
+		storing <- true
+		<-stored
+	})
+	<-storing
+	frozen := make(chan bool)
+	go func() {
+		mg.freezeWrites("g1")
+		close(frozen)
+	}()
+	select {
+	case <-frozen:
+		t.Fatal("The shard was frozen while a record was being stored")
+	case <-time.After(cDrainCheckPeriod):
+	}
+	close(stored)
+	<-frozen
+
+	if err := mg.storeRecords("g1", func() {}); err != ErrShardNotAvailable {
+		t.Error("The frozen shard stored records, Error:", err)
+	}
+	if err := mg.storeRecords("g2", func() {}); err != nil {
+		t.Error("The shard not frozen can't store records, Error:", err)
+	}
+
+	// The shard acquired again after the release accepts records
+	mg.releaseAcquiredShard("g1")
+	if err := mg.storeRecords("g1", func() {}); err != nil {
+		t.Error("The released shard is still frozen, Error:", err)
+	}
+}
@@ -0,0 +1,154 @@
+package shardsmanager
+
+import (
+	"context"
+	"github.com/alonsovidales/pit/cluster"
+	"github.com/alonsovidales/pit/log"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cFanOutTimeout Max time to wait for the rankings of the shards of the group
+// on a fan-out request, the shards that don't answer on time are ignored
+const cFanOutTimeout = 300 * time.Millisecond
+
+// internalRankReq Call to obtain the recommendations of a shard for some
+// scores without store them
+type internalRankReq struct {
+	internalReq
+	Scores  map[uint64]uint8 `json:"scores"`
+	MaxRecs int              `json:"max_recs"`
+}
+
+// rankResponse Recommendations calculated by a single shard
+type rankResponse struct {
+	StoredElements uint64   `json:"stored_elements"`
+	ReqsSec        uint64   `json:"reqs_sec"`
+	Recs           []uint64 `json:"recs"`
+}
+
+// rank Returns the recommendations of the local shard of the group for the
+// given scores without store them
+func (mg *Manager) rank(group *shardinfo.GroupInfo, scores map[uint64]uint8, maxRecs int) (*rankResponse, error) {
+	rec, stats, err := mg.getLocalShard(group.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	reqs := countRequests(stats, 1, false)
+
+	return &rankResponse{
+		StoredElements: rec.GetStoredElements(),
+		ReqsSec:        reqs,
+		Recs:           rec.GetRecommendations(scores, maxRecs),
+	}, nil
+}
+
+// recommendFanOut Stores the scores of the record and returns the
+// recommendations obtained merging the rankings of all the shards of the
+// group, the shards are queried in parallel and the ones that fail or don't
+// answer before cFanOutTimeout are not considered
+func (mg *Manager) recommendFanOut(ctx context.Context, group *shardinfo.GroupInfo, recID uint64, scores map[uint64]uint8, maxRecs int) (*RecsResponse, error) {
+	inserted, err := mg.insertOrForward(ctx, group, recID, scores)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cFanOutTimeout)
+	defer cancel()
+	ctx = cluster.WithHostsVisited(ctx, mg.localHost())
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	rankings := [][]uint64{}
+	var storedElements uint64
+	owners := group.GetOwners()
+	for _, addr := range owners {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+
+			var resp *rankResponse
+			var err error
+			if addr == mg.localHost() {
+				resp, err = mg.rank(group, scores, maxRecs)
+			} else {
+				resp = &rankResponse{}
+				err = remoteError(mg.rpc.Call(ctx, addr, cMethodRank, &internalRankReq{
+					internalReq: internalReq{GroupID: group.GroupID},
+					Scores:      scores,
+					MaxRecs:     maxRecs,
+				}, resp))
+			}
+			if err != nil {
+				log.Debug("Shard on instance:", addr, "ignored on fan-out request:", cluster.RequestID(ctx), "Error:", err)
+				return
+			}
+
+			mutex.Lock()
+			rankings = append(rankings, resp.Recs)
+			storedElements += resp.StoredElements
+			mutex.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+
+	response := &RecsResponse{
+		Success:        true,
+		StoredElements: storedElements,
+		ReqsSec:        inserted.ReqsSec,
+		Recs:           mergeRankings(rankings, maxRecs),
+		ShardsQueried:  len(owners),
+		ShardsAnswered: len(rankings),
+	}
+	if len(response.Recs) == 0 {
+		// The most popular items of the local shard are returned while
+		// no shard can calculate the recommendations
+		rec, _, err := mg.getFallbackShard(group.GroupID)
+		if err == nil {
+			response.Recs = rec.PopularItems(scores, maxRecs)
+			response.Fallback = len(response.Recs) > 0
+		} else if len(rankings) == 0 {
+			return nil, ErrShardNotAvailable
+		}
+		response.Success = response.Fallback
+		response.Status = "Adquiring data"
+	}
+
+	return response, nil
+}
+
+// mergeRankings Merges the rankings of the shards using the Borda count, each
+// item receives as many points as items are below it on each ranking, the
+// items with the same points are sorted by the number of rankings where they
+// appear, and then by item ID
+func mergeRankings(rankings [][]uint64, maxRecs int) []uint64 {
+	points := make(map[uint64]int)
+	votes := make(map[uint64]int)
+	for _, ranking := range rankings {
+		for pos, item := range ranking {
+			points[item] += len(ranking) - pos
+			votes[item]++
+		}
+	}
+
+	items := make([]uint64, 0, len(points))
+	for item := range points {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if points[items[i]] != points[items[j]] {
+			return points[items[i]] > points[items[j]]
+		}
+		if votes[items[i]] != votes[items[j]] {
+			return votes[items[i]] > votes[items[j]]
+		}
+		return items[i] < items[j]
+	})
+	if len(items) > maxRecs {
+		items = items[:maxRecs]
+	}
+
+	return items
+}
@@ -0,0 +1,131 @@
+package shardsmanager
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alonsovidales/pit/cluster"
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/models/storage"
+	"github.com/alonsovidales/pit/recommender"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMergeRankings(t *testing.T) {
+	merged := mergeRankings([][]uint64{
+		{1, 2, 3},
+		{2, 1, 4},
+		{2, 5},
+	}, 4)
+
+	// 2: 2+3+2 points, 1: 3+2, 3: 1 with 1 vote, 4: 1 with 1 vote, 5: 1
+	if expected := []uint64{2, 1, 3, 4}; !reflect.DeepEqual(merged, expected) {
+		t.Error("Expected merged ranking:", expected, "obtained:", merged)
+	}
+
+	if merged = mergeRankings([][]uint64{}, 10); len(merged) != 0 {
+		t.Error("Expected empty ranking, obtained:", merged)
+	}
+}
+
+func TestRecommendFanOut(t *testing.T) {
+	var inserts, ranks int32
+	remote := cluster.NewServer("secret")
+	remote.Handle(cMethodInsert, func(ctx context.Context, body []byte) (interface{}, error) {
+		atomic.AddInt32(&inserts, 1)
+		return &InsertResponse{Success: true, ReqsSec: 1}, nil
+	})
+	remote.Handle(cMethodRank, func(ctx context.Context, body []byte) (interface{}, error) {
+		req := &internalRankReq{}
+		if err := json.Unmarshal(body, req); err != nil {
+			return nil, err
+		}
+
+		return &rankResponse{StoredElements: 10, Recs: []uint64{3, 2, 1}[:req.MaxRecs]}, nil
+	})
+	// The instance accessed as "localhost" is too slow to be considered
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, cMethodRank) {
+			atomic.AddInt32(&ranks, 1)
+			if strings.HasPrefix(r.Host, "localhost") {
+				time.Sleep(3 * cFanOutTimeout)
+			}
+		}
+		remote.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	group := &shardinfo.GroupInfo{
+		GroupID:      "group",
+		NumShards:    2,
+		MaxReqSec:    100,
+		ShardsByAddr: map[string]*shardinfo.Shard{},
+	}
+	for i, addr := range []string{"127.0.0.1", "localhost"} {
+		group.ShardsByAddr[addr] = &shardinfo.Shard{Addr: addr, GroupID: group.GroupID, ShardID: i}
+	}
+
+	mg := &Manager{
+		rpc:            cluster.NewClient(port, "secret", cluster.CDefaultTimeout),
+		acquiredShards: map[string]recommender.Int{},
+	}
+
+	started := time.Now()
+	resp, err := mg.recommendFanOut(context.Background(), group, 1, map[uint64]uint8{1: 5}, 2)
+	if err != nil {
+		t.Fatal("Problem performing the fan-out request, Error:", err)
+	}
+	if time.Since(started) > 2*cFanOutTimeout {
+		t.Error("The fan-out request didn't respect the timeout:", time.Since(started))
+	}
+	if !resp.Success || !reflect.DeepEqual(resp.Recs, []uint64{3, 2}) || resp.ShardsQueried != 2 || resp.ShardsAnswered != 1 || resp.StoredElements != 10 {
+		t.Error("Unexpected fan-out response:", resp)
+	}
+	if atomic.LoadInt32(&inserts) != 1 || atomic.LoadInt32(&ranks) != 2 {
+		t.Error("Expected a single insert and two rank calls, obtained:", inserts, ranks)
+	}
+}
+
+func TestFanOutOwners(t *testing.T) {
+	shardsModel := shardinfo.NewModel(storage.NewMemTable(), storage.NewMemTable(), "admin@test.com")
+	group, _, err := shardsModel.AddUpdateGroup("s", "user@test.com", "group", 2, 1000, 100, 100, 5)
+	if err != nil {
+		t.Fatal("Problem creating the group, Error:", err)
+	}
+
+	// The shards are released and acquired while the owners are obtained
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			group.AcquireShard()
+			group.ReleaseShard()
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if owners := group.GetOwners(); len(owners) > 1 {
+			t.Fatal("Unexpected owners of the group:", owners)
+		}
+	}
+
+	group.AcquireShard()
+	defer group.ReleaseShard()
+	if owners := group.GetOwners(); len(owners) != 1 || owners[0] != instances.GetHostName() {
+		t.Error("Expected the local instance as owner, obtained:", owners)
+	}
+}
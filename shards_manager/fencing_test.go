@@ -0,0 +1,67 @@
+package shardsmanager
+
+import (
+	"encoding/json"
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/models/storage"
+	"github.com/goamz/goamz/dynamodb"
+	"testing"
+	"time"
+)
+
+func TestFence(t *testing.T) {
+	localHost := instances.GetHostName()
+	defer instances.SetHostname(localHost)
+	instances.SetHostname("a")
+
+	shardsTable := storage.NewMemTable()
+	shardsModel := shardinfo.NewModel(storage.NewMemTable(), shardsTable, "admin@test.com")
+	group, _, err := shardsModel.AddUpdateGroup("s", "user@test.com", "g", 1, 1000, 100, 100, 5)
+	if err != nil {
+		t.Fatal("Problem creating the group, Error:", err)
+	}
+	mg := &Manager{shardsModel: shardsModel}
+
+	if acquired, err := group.AcquireShard(); !acquired {
+		t.Fatal("Problem acquiring the shard, Error:", err)
+	}
+	_, firstEpoch, ok := group.LocalOwnership()
+	if !ok || firstEpoch != 1 {
+		t.Fatal("Expected the first ownership epoch, obtained:", firstEpoch, ok)
+	}
+	if err := mg.fence("g", firstEpoch)(); err != nil {
+		t.Error("The owner of the shard was fenced off, Error:", err)
+	}
+
+	// Each acquisition increases the epoch
+	group.ReleaseShard()
+	if acquired, err := group.AcquireShard(); !acquired {
+		t.Fatal("Problem acquiring the shard, Error:", err)
+	}
+	if _, epoch, _ := group.LocalOwnership(); epoch != firstEpoch+1 {
+		t.Error("Expected the epoch:", firstEpoch+1, "obtained:", epoch)
+	}
+	if err := mg.fence("g", firstEpoch)(); err != shardinfo.ErrShardFenced {
+		t.Error("The owner of a previous epoch was not fenced off, Error:", err)
+	}
+
+	// Another instance acquires the shard while this instance is paused
+	newer := storage.Ownership{Owner: "b", Epoch: firstEpoch + 2, LastTs: time.Now().Unix()}
+	shardsTable.PutItem("g:0", "shardId", newer.Item(func(own storage.Ownership) []dynamodb.Attribute {
+		info, _ := json.Marshal(&shardinfo.Shard{Addr: own.Owner, GroupID: "g", LastTs: own.LastTs, Epoch: own.Epoch})
+		return []dynamodb.Attribute{
+			*dynamodb.NewStringAttribute("shardId", "g:0"),
+			*dynamodb.NewStringAttribute("info", string(info)),
+		}
+	}))
+	if err := mg.fence("g", firstEpoch+1)(); err != shardinfo.ErrShardFenced {
+		t.Error("The stale owner was not fenced off, Error:", err)
+	}
+
+	// The stale owner can't release the shard of the newer owner
+	group.ReleaseShard()
+	if stored, _, _ := storage.ReadOwnership(shardsTable, "g:0"); stored != newer {
+		t.Error("The shard of the newer owner was modified by the stale owner:", stored)
+	}
+}
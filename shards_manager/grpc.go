@@ -0,0 +1,226 @@
+package shardsmanager
+
+import (
+	"context"
+	"fmt"
+	"github.com/alonsovidales/pit/cluster"
+	"github.com/alonsovidales/pit/grpc_api"
+	"github.com/alonsovidales/pit/log"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// GRPCServer Implementation of the gRPC service backed by the Manager, the
+// requests for shards not available on this instance are forwarded to another
+// instance that owns a shard of the group using the internal calls of the
+// cluster
+type GRPCServer struct {
+	mg *Manager
+}
+
+// GRPCServer Returns the implementation of the gRPC service for this manager
+func (mg *Manager) GRPCServer() *GRPCServer {
+	return &GRPCServer{
+		mg: mg,
+	}
+}
+
+// Recommend Returns the recommendations for a record
+func (gs *GRPCServer) Recommend(ctx context.Context, req *grpcapi.RecommendRequest) (*grpcapi.RecommendResponse, error) {
+	group, err := gs.mg.shardsModel.GetGroupByUserKeyID(req.UID, req.Key, req.Group)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	if err = gs.takeQuota(ctx, group, 1, false); err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp, err := gs.mg.recommendOrForward(requestCtx(ctx), group, req.ID, req.Scores, req.MaxRecs)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &grpcapi.RecommendResponse{
+		Success:        resp.Success,
+		Status:         resp.Status,
+		StoredElements: resp.StoredElements,
+		ReqsSec:        resp.ReqsSec,
+		Recs:           resp.Recs,
+		Fallback:       resp.Fallback,
+	}, nil
+}
+
+// Insert Stores the scores of a record
+func (gs *GRPCServer) Insert(ctx context.Context, req *grpcapi.InsertRequest) (*grpcapi.InsertResponse, error) {
+	group, err := gs.mg.shardsModel.GetGroupByUserKeyID(req.UID, req.Key, req.Group)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	if err = gs.takeQuota(ctx, group, 1, true); err != nil {
+		return nil, grpcError(err)
+	}
+
+	return gs.insert(requestCtx(ctx), group, req)
+}
+
+// Scores Returns the average scores of the requested items
+func (gs *GRPCServer) Scores(ctx context.Context, req *grpcapi.ScoresRequest) (*grpcapi.ScoresResponse, error) {
+	group, err := gs.mg.shardsModel.GetGroupByUserKeyID(req.UID, req.Key, req.Group)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	if err = gs.takeQuota(ctx, group, 1, false); err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp, err := gs.mg.itemScoresOrForward(requestCtx(ctx), group, req.Items)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	scores := make(map[uint64]float64, len(resp.Scores))
+	for _, item := range req.Items {
+		if score, ok := resp.Scores[fmt.Sprintf("%d", item)]; ok {
+			scores[item] = score
+		}
+	}
+
+	return &grpcapi.ScoresResponse{
+		Success:        resp.Success,
+		StoredElements: resp.StoredElements,
+		ReqsSec:        resp.ReqsSec,
+		Scores:         scores,
+		Fallback:       resp.Fallback,
+	}, nil
+}
+
+// GroupInfo Returns the statistics of all the shards of the group
+func (gs *GRPCServer) GroupInfo(ctx context.Context, req *grpcapi.GroupInfoRequest) (*grpcapi.GroupInfoResponse, error) {
+	group, err := gs.mg.shardsModel.GetGroupByUserKeyID(req.UID, req.Key, req.Group)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp := &grpcapi.GroupInfoResponse{
+		Shards: make(map[string]*grpcapi.ShardStats),
+	}
+	for host, stats := range gs.mg.getGroupStats(requestCtx(ctx), group, true) {
+		resp.Shards[host] = &grpcapi.ShardStats{
+			StoredElements: stats.StoredElements,
+			RecTreeStatus:  stats.RecTreeStatus,
+			QueriesBySec:   stats.BySecStats,
+			QueriesByMin:   stats.ByMinStats,
+			RecTreeError:   stats.RecTreeError,
+		}
+	}
+
+	return resp, nil
+}
+
+// BulkInsert Stores all the records received on the stream, the records that
+// can't be stored, including the ones rejected by the rate limit of the group,
+// are counted as failed without interrupt the stream
+func (gs *GRPCServer) BulkInsert(stream grpcapi.BulkInsertServer) error {
+	ctx := requestCtx(stream.Context())
+	result := &grpcapi.BulkInsertResponse{}
+	groups := make(map[string]*shardinfo.GroupInfo)
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(result)
+		}
+		if err != nil {
+			return err
+		}
+
+		groupKey := req.UID + ":" + req.Key + ":" + req.Group
+		group, ok := groups[groupKey]
+		if !ok {
+			if group, err = gs.mg.shardsModel.GetGroupByUserKeyID(req.UID, req.Key, req.Group); err != nil {
+				return grpcError(err)
+			}
+			groups[groupKey] = group
+		}
+
+		if err = gs.mg.takeQuota(http.Header{}, group, 1, true); err == nil {
+			_, err = gs.insert(ctx, group, req)
+		}
+		if err != nil {
+			log.Debug("Problem storing record from bulk insert, Error:", err)
+			result.Failed++
+		} else {
+			result.Inserted++
+		}
+	}
+}
+
+// insert Stores the scores of the record on the local shard or forwards the
+// request to the instance that owns a shard of the group
+func (gs *GRPCServer) insert(ctx context.Context, group *shardinfo.GroupInfo, req *grpcapi.InsertRequest) (*grpcapi.InsertResponse, error) {
+	resp, err := gs.mg.insertOrForward(ctx, group, req.ID, req.Scores)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &grpcapi.InsertResponse{
+		Success:        resp.Success,
+		StoredElements: resp.StoredElements,
+		ReqsSec:        resp.ReqsSec,
+	}, nil
+}
+
+// takeQuota Consumes n requests from the quota of the group, the rate limit
+// headers are sent as metadata of the call
+func (gs *GRPCServer) takeQuota(ctx context.Context, group *shardinfo.GroupInfo, n int, insert bool) error {
+	header := http.Header{}
+	err := gs.mg.takeQuota(header, group, n, insert)
+
+	md := metadata.MD{}
+	for name, values := range header {
+		md.Set(strings.ToLower(name), values...)
+	}
+	grpc.SetHeader(ctx, md)
+
+	return err
+}
+
+// requestCtx Returns the context to be used to attend a gRPC call, with the
+// request ID received on the metadata of the call, or a new one
+func requestCtx(ctx context.Context) context.Context {
+	requestID := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(strings.ToLower(cluster.CRequestIDHeader)); len(ids) > 0 {
+			requestID = ids[0]
+		}
+	}
+	if requestID == "" {
+		requestID = cluster.NewRequestID()
+	}
+
+	return cluster.WithRequestID(ctx, requestID)
+}
+
+// grpcError Converts the errors of the manager to gRPC status errors
+func grpcError(err error) error {
+	switch err {
+	case ErrTooManyRequests:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case ErrShardNotAvailable:
+		return status.Error(codes.Unavailable, cProvisioningMsg)
+	case ErrUnauthorized, shardinfo.ErrAuth, shardinfo.ErrGroupNotFound, shardinfo.ErrGroupUserNotFound:
+		return status.Error(codes.Unauthenticated, err.Error())
+	case ErrBatchTooBig, ErrGroupTypeRequired, shardinfo.ErrUnknownRouting:
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
@@ -0,0 +1,411 @@
+package shardsmanager
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alonsovidales/pit/cluster"
+	"github.com/alonsovidales/pit/log"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/rest"
+	"net/http"
+)
+
+const (
+	cMethodRecommend = "recommend"
+	cMethodInsert    = "insert"
+	cMethodScores    = "scores"
+	cMethodRecBatch  = "rec_batch"
+	cMethodStats     = "stats"
+	cMethodRank      = "rank"
+	cMethodHandOff   = "hand_off"
+	cMethodAcquire   = "acquire"
+	cMethodMigrate   = "migrate"
+)
+
+// internalReq Common fields of all the calls between instances, the group is
+// identified only by its ID since the calls are authenticated by the cluster
+type internalReq struct {
+	GroupID string `json:"group_id"`
+}
+
+// internalRecsReq Call to obtain the recommendations for a record
+type internalRecsReq struct {
+	internalReq
+	ID      uint64           `json:"id"`
+	Scores  map[uint64]uint8 `json:"scores"`
+	MaxRecs int              `json:"max_recs"`
+}
+
+// internalInsertReq Call to store the scores of a record
+type internalInsertReq struct {
+	internalReq
+	ID     uint64           `json:"id"`
+	Scores map[uint64]uint8 `json:"scores"`
+}
+
+// internalRecord Scores of a record handed off to another shard
+type internalRecord struct {
+	ID     uint64           `json:"id"`
+	Scores map[uint64]uint8 `json:"scores"`
+}
+
+// internalMigrateReq Call to store the records handed off by another shard of
+// the group, see migrateRecords
+type internalMigrateReq struct {
+	internalReq
+	Recs []*internalRecord `json:"recs"`
+}
+
+// internalMigrateResp Response to the records handed off with the IDs of the
+// records stored
+type internalMigrateResp struct {
+	Stored []uint64 `json:"stored"`
+}
+
+// internalScoresReq Call to obtain the average scores of some items
+type internalScoresReq struct {
+	internalReq
+	Items []uint64 `json:"items"`
+}
+
+// internalRecBatchReq Call to obtain the recommendations for a batch of
+// records
+type internalRecBatchReq struct {
+	internalReq
+	Recs []*RecBatchReq `json:"recs"`
+}
+
+// internalHandOffReq Call of the leader to hand off a shard of the instance in
+// order to rebalance the cluster
+type internalHandOffReq struct{}
+
+// internalHandOffResp Response to the hand off of a shard
+type internalHandOffResp struct {
+	HandedOff bool `json:"handed_off"`
+}
+
+// internalAcquireReq Call to acquire the shard of the group handed off by
+// another instance, the shard is identified by its ID in order to restore its
+// backup
+type internalAcquireReq struct {
+	internalReq
+	ShardID int `json:"shard_id"`
+}
+
+// internalAcquireResp Response to the acquisition of a shard handed off by
+// another instance
+type internalAcquireResp struct {
+	Acquired bool `json:"acquired"`
+}
+
+// ClusterServer Returns the server that attends the calls performed by the
+// other instances in order to forward the requests that can't be attended by
+// them
+func (mg *Manager) ClusterServer() *cluster.Server {
+	sv := cluster.NewServer(cluster.Secret())
+	sv.Handle(cMethodRecommend, func(ctx context.Context, body []byte) (interface{}, error) {
+		req := &internalRecsReq{}
+		group, err := mg.internalGroup(body, req, &req.internalReq)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := mg.recommendOrForward(ctx, group, req.ID, req.Scores, req.MaxRecs)
+		return resp, internalError(err)
+	})
+	sv.Handle(cMethodInsert, func(ctx context.Context, body []byte) (interface{}, error) {
+		req := &internalInsertReq{}
+		group, err := mg.internalGroup(body, req, &req.internalReq)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := mg.insertOrForward(ctx, group, req.ID, req.Scores)
+		return resp, internalError(err)
+	})
+	sv.Handle(cMethodMigrate, func(ctx context.Context, body []byte) (interface{}, error) {
+		req := &internalMigrateReq{}
+		group, err := mg.internalGroup(body, req, &req.internalReq)
+		if err != nil {
+			return nil, err
+		}
+
+		return mg.storeMigratedRecords(group, req.Recs), nil
+	})
+	sv.Handle(cMethodScores, func(ctx context.Context, body []byte) (interface{}, error) {
+		req := &internalScoresReq{}
+		group, err := mg.internalGroup(body, req, &req.internalReq)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := mg.itemScoresOrForward(ctx, group, req.Items)
+		return resp, internalError(err)
+	})
+	sv.Handle(cMethodRecBatch, func(ctx context.Context, body []byte) (interface{}, error) {
+		req := &internalRecBatchReq{}
+		group, err := mg.internalGroup(body, req, &req.internalReq)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := mg.recommendBatchOrForward(ctx, group, req.Recs)
+		return resp, internalError(err)
+	})
+	sv.Handle(cMethodStats, func(ctx context.Context, body []byte) (interface{}, error) {
+		req := &internalReq{}
+		group, err := mg.internalGroup(body, req, req)
+		if err != nil {
+			return nil, err
+		}
+
+		return mg.getGroupStats(ctx, group, false), nil
+	})
+	sv.Handle(cMethodRank, func(ctx context.Context, body []byte) (interface{}, error) {
+		req := &internalRankReq{}
+		group, err := mg.internalGroup(body, req, &req.internalReq)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := mg.rank(group, req.Scores, req.MaxRecs)
+		return resp, internalError(err)
+	})
+	sv.Handle(cMethodHandOff, func(ctx context.Context, body []byte) (interface{}, error) {
+		// The draining instances hand off all their shards
+		if !mg.isActive() {
+			return &internalHandOffResp{}, nil
+		}
+
+		return &internalHandOffResp{HandedOff: mg.handOffShard()}, nil
+	})
+	sv.Handle(cMethodAcquire, func(ctx context.Context, body []byte) (interface{}, error) {
+		req := &internalAcquireReq{}
+		if _, err := mg.internalGroup(body, req, &req.internalReq); err != nil {
+			return nil, err
+		}
+
+		return &internalAcquireResp{Acquired: mg.acquireHandedOff(req.GroupID, req.ShardID)}, nil
+	})
+
+	return sv
+}
+
+// internalGroup Decodes the body of a call into req and returns the group
+// identified by the call
+func (mg *Manager) internalGroup(body []byte, req interface{}, common *internalReq) (*shardinfo.GroupInfo, error) {
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, &cluster.Error{StatusCode: 400, Code: rest.CodeBadRequest, Message: err.Error()}
+	}
+
+	group := mg.shardsModel.GetGroupByID(common.GroupID)
+	if group == nil {
+		return nil, internalError(shardinfo.ErrGroupNotFound)
+	}
+
+	return group, nil
+}
+
+// internalErrors Error codes used to propagate the errors of the manager
+// between instances
+var internalErrors = map[error]*cluster.Error{
+	ErrTooManyRequests:         &cluster.Error{StatusCode: 429, Code: rest.CodeTooManyRequests},
+	ErrShardNotAvailable:       &cluster.Error{StatusCode: 503, Code: rest.CodeProvisioning},
+	ErrBatchTooBig:             &cluster.Error{StatusCode: 400, Code: rest.CodeBadRequest},
+	shardinfo.ErrGroupNotFound: &cluster.Error{StatusCode: 404, Code: rest.CodeNotFound},
+}
+
+// internalError Converts an error of the manager to the error to be returned
+// to the instance that performed the call
+func internalError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if callErr, ok := internalErrors[err]; ok {
+		return &cluster.Error{
+			StatusCode: callErr.StatusCode,
+			Code:       callErr.Code,
+			Message:    err.Error(),
+		}
+	}
+
+	return err
+}
+
+// remoteError Converts the error returned by a call to another instance to the
+// corresponding error of the manager
+func remoteError(err error) error {
+	callErr, ok := err.(*cluster.Error)
+	if !ok {
+		return err
+	}
+	for mgErr, internalErr := range internalErrors {
+		if internalErr.Code == callErr.Code && internalErr.StatusCode == callErr.StatusCode {
+			return mgErr
+		}
+	}
+
+	return err
+}
+
+// requestContext Returns the context to be used to attend a request received
+// by the API, the ID of the request is obtained from the CRequestIDHeader, or
+// a new one is generated, and returned as header of the response
+func requestContext(w http.ResponseWriter, r *http.Request) context.Context {
+	requestID := r.Header.Get(cluster.CRequestIDHeader)
+	if requestID == "" {
+		requestID = cluster.NewRequestID()
+	}
+	w.Header().Set(cluster.CRequestIDHeader, requestID)
+
+	return cluster.WithRequestID(r.Context(), requestID)
+}
+
+// forward Calls the method on another instance that owns a shard of the group
+// and was not visited yet by the request, or on the owner of the record if
+// specified on groups with hash routing
+func (mg *Manager) forward(ctx context.Context, group *shardinfo.GroupInfo, method string, req, resp interface{}, recID ...uint64) error {
+	addr, hostsVisited, found := mg.getForwardHost(group, cluster.HostsVisited(ctx))
+	if len(recID) > 0 {
+		addr, hostsVisited, found = mg.getRecordHost(group, recID[0], cluster.HostsVisited(ctx))
+	}
+	if !found {
+		return ErrShardNotAvailable
+	}
+
+	log.Debug("Forwarding request:", cluster.RequestID(ctx), "Method:", method, "Group:", group.GroupID, "To:", addr)
+	err := mg.rpc.Call(cluster.WithHostsVisited(ctx, hostsVisited), addr, method, req, resp)
+	if _, ok := err.(*cluster.Error); err != nil && !ok {
+		log.Error("Problem forwarding request:", cluster.RequestID(ctx), "to instance:", addr, "Error:", err)
+	}
+
+	return remoteError(err)
+}
+
+// canFallback Returns if a request that couldn't be forwarded can be answered
+// with the most popular items of the local shard, this is the case when no
+// instance can attend the request, or the instance that owns the shard is
+// unreachable
+func canFallback(err error) bool {
+	if _, callErr := err.(*cluster.Error); callErr {
+		return false
+	}
+	for mgErr := range internalErrors {
+		if err == mgErr {
+			return err == ErrShardNotAvailable
+		}
+	}
+
+	return true
+}
+
+// recommendOrForward Returns the recommendations for the record from the local
+// shard, or from another instance if the local shard can't attend the request.
+// The most popular items of the local shard are returned if no instance can
+// attend it
+func (mg *Manager) recommendOrForward(ctx context.Context, group *shardinfo.GroupInfo, recID uint64, scores map[uint64]uint8, maxRecs int) (*RecsResponse, error) {
+	resp, err := mg.recommend(group, recID, scores, maxRecs)
+	if err != ErrShardNotAvailable {
+		return resp, err
+	}
+
+	resp = &RecsResponse{}
+	err = mg.forward(ctx, group, cMethodRecommend, &internalRecsReq{
+		internalReq: internalReq{GroupID: group.GroupID},
+		ID:          recID,
+		Scores:      scores,
+		MaxRecs:     maxRecs,
+	}, resp, recID)
+	if err != nil {
+		if rec, stats, localErr := mg.getFallbackShard(group.GroupID); localErr == nil && canFallback(err) {
+			log.Debug("Answering request:", cluster.RequestID(ctx), "with the popular items of group:", group.GroupID, "Error:", err)
+			return popularRecs(rec, scores, maxRecs, countRequests(stats, 1, false)), nil
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// insertOrForward Stores the scores of the record on the local shard, or on
+// another instance if the local shard can't attend the request
+func (mg *Manager) insertOrForward(ctx context.Context, group *shardinfo.GroupInfo, recID uint64, scores map[uint64]uint8) (*InsertResponse, error) {
+	resp, err := mg.insert(group, recID, scores)
+	if err != ErrShardNotAvailable {
+		return resp, err
+	}
+
+	resp = &InsertResponse{}
+	err = mg.forward(ctx, group, cMethodInsert, &internalInsertReq{
+		internalReq: internalReq{GroupID: group.GroupID},
+		ID:          recID,
+		Scores:      scores,
+	}, resp, recID)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// itemScoresOrForward Returns the average scores of the items from the local
+// shard, or from another instance if the local shard can't attend the request.
+// The scores are calculated from the records stored on the local shard if no
+// instance can attend it
+func (mg *Manager) itemScoresOrForward(ctx context.Context, group *shardinfo.GroupInfo, items []uint64) (*ScoresResponse, error) {
+	resp, err := mg.itemScores(group, items)
+	if err != ErrShardNotAvailable {
+		return resp, err
+	}
+
+	resp = &ScoresResponse{}
+	err = mg.forward(ctx, group, cMethodScores, &internalScoresReq{
+		internalReq: internalReq{GroupID: group.GroupID},
+		Items:       items,
+	}, resp)
+	if err != nil {
+		if rec, stats, localErr := mg.getFallbackShard(group.GroupID); localErr == nil && canFallback(err) {
+			log.Debug("Answering request:", cluster.RequestID(ctx), "with the scores of the records of group:", group.GroupID, "Error:", err)
+			return popularScores(rec, stats, items), nil
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// recommendBatchOrForward Returns the recommendations for the batch from the
+// local shard, or from another instance if the local shard can't attend the
+// request. The most popular items of the local shard are returned if no
+// instance can attend it
+func (mg *Manager) recommendBatchOrForward(ctx context.Context, group *shardinfo.GroupInfo, batch []*RecBatchReq) (*RecBatchResponse, error) {
+	resp, err := mg.recommendBatch(ctx, group, batch)
+	if err != ErrShardNotAvailable {
+		return resp, err
+	}
+
+	resp = &RecBatchResponse{}
+	err = mg.forward(ctx, group, cMethodRecBatch, &internalRecBatchReq{
+		internalReq: internalReq{GroupID: group.GroupID},
+		Recs:        batch,
+	}, resp)
+	if err != nil {
+		if rec, stats, localErr := mg.getFallbackShard(group.GroupID); localErr == nil && canFallback(err) {
+			log.Debug("Answering request:", cluster.RequestID(ctx), "with the popular items of group:", group.GroupID, "Error:", err)
+			return popularBatch(rec, stats, batch)
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// remoteGroupStats Returns the statistics of the shard of the group owned by
+// the given instance
+func (mg *Manager) remoteGroupStats(ctx context.Context, group *shardinfo.GroupInfo, addr string) (stats map[string]*statsReqSec, err error) {
+	stats = make(map[string]*statsReqSec)
+	ctx = cluster.WithHostsVisited(ctx, mg.localHost())
+	err = mg.rpc.Call(ctx, addr, cMethodStats, &internalReq{GroupID: group.GroupID}, &stats)
+
+	return
+}
@@ -0,0 +1,80 @@
+package shardsmanager
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alonsovidales/pit/cluster"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/recommender"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestForward(t *testing.T) {
+	group := &shardinfo.GroupInfo{
+		GroupID:      "group",
+		NumShards:    1,
+		Shards:       map[int]*shardinfo.Shard{},
+		ShardsByAddr: map[string]*shardinfo.Shard{},
+	}
+
+	var received *internalRecsReq
+	var requestID, hostsVisited string
+	remote := cluster.NewServer("secret")
+	remote.Handle(cMethodRecommend, func(ctx context.Context, body []byte) (interface{}, error) {
+		received = &internalRecsReq{}
+		requestID = cluster.RequestID(ctx)
+		hostsVisited = cluster.HostsVisited(ctx)
+		if err := json.Unmarshal(body, received); err != nil {
+			return nil, err
+		}
+
+		return &RecsResponse{Success: true, Recs: []uint64{1, 2}}, nil
+	})
+	remote.Handle(cMethodScores, func(ctx context.Context, body []byte) (interface{}, error) {
+		return nil, internalError(ErrTooManyRequests)
+	})
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+
+	mg := &Manager{
+		rpc:            cluster.NewClient(port, "secret", cluster.CDefaultTimeout),
+		acquiredShards: map[string]recommender.Int{},
+	}
+
+	// Without other instances owning a shard the request can't be attended
+	ctx := cluster.WithRequestID(context.Background(), "req-id")
+	if _, err := mg.recommendOrForward(ctx, group, 10, map[uint64]uint8{1: 5}, 5); err != ErrShardNotAvailable {
+		t.Error("Expected shard not available error, obtained:", err)
+	}
+
+	shard := &shardinfo.Shard{Addr: serverURL.Hostname(), GroupID: group.GroupID}
+	group.Shards[0] = shard
+	group.ShardsByAddr[shard.Addr] = shard
+	resp, err := mg.recommendOrForward(ctx, group, 10, map[uint64]uint8{1: 5}, 5)
+	if err != nil || !resp.Success || len(resp.Recs) != 2 {
+		t.Error("Unexpected forwarded response:", resp, "Error:", err)
+	}
+	if received == nil || received.GroupID != group.GroupID || received.ID != 10 || received.Scores[1] != 5 || received.MaxRecs != 5 {
+		t.Error("Unexpected forwarded request:", received)
+	}
+	if requestID != "req-id" || hostsVisited == "" {
+		t.Error("The request ID and visited hosts were not propagated:", requestID, hostsVisited)
+	}
+
+	// The errors of the remote instance are converted to the errors of the
+	// manager
+	if _, err = mg.itemScoresOrForward(ctx, group, []uint64{1}); err != ErrTooManyRequests {
+		t.Error("Expected too many requests error, obtained:", err)
+	}
+
+	// Already visited instances are not visited again
+	ctx = cluster.WithHostsVisited(ctx, shard.Addr)
+	if _, err = mg.recommendOrForward(ctx, group, 10, map[uint64]uint8{1: 5}, 5); err != ErrShardNotAvailable {
+		t.Error("Expected shard not available error, obtained:", err)
+	}
+}
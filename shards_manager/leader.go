@@ -0,0 +1,76 @@
+package shardsmanager
+
+import (
+	"github.com/alonsovidales/pit/log"
+	"time"
+)
+
+const (
+	// cOrphanedBackupsPeriod Time between two removals of the orphaned
+	// backups by the leader
+	cOrphanedBackupsPeriod = time.Hour
+	// cOrphanedBackupsGrace Min time since a backup was stored to consider
+	// it orphaned, the groups created recently could be still unknown
+	cOrphanedBackupsGrace = 24 * time.Hour
+	// cPruneChangesPeriod Time between two removals of the old changes of
+	// the groups by the leader
+	cPruneChangesPeriod = 10 * time.Minute
+)
+
+// runLeaderTasks Runs the tasks that affect the whole cluster, only the leader
+// of the cluster runs them, see instances.ModelInt.IsLeader. The users are the
+// owners of the groups of the cluster
+func (mg *Manager) runLeaderTasks(users map[string]bool) {
+	for usID := range users {
+		mg.recalculateBillingForUser(usID)
+	}
+	mg.rebalance()
+	mg.removeOrphanedBackups()
+	mg.pruneChanges()
+}
+
+// pruneChanges Removes the old changes of the groups from the changes feed
+// each cPruneChangesPeriod, the storage doesn't expire them
+func (mg *Manager) pruneChanges() {
+	if time.Since(mg.lastChangesPrune) < cPruneChangesPeriod {
+		return
+	}
+	mg.lastChangesPrune = time.Now()
+
+	if removed, err := mg.shardsModel.PruneChanges(); err != nil {
+		log.Error("Problem trying to remove the old changes of the groups, Error:", err)
+	} else if removed > 0 {
+		log.Debug("Removed old changes of the groups:", removed)
+	}
+}
+
+// removeOrphanedBackups Removes the backups stored on S3 of the groups that
+// don't exist anymore, the backups are removed with the groups but an
+// instance could die before remove them. The backups are checked each
+// cOrphanedBackupsPeriod
+func (mg *Manager) removeOrphanedBackups() {
+	if time.Since(mg.lastBackupsCleanup) < cOrphanedBackupsPeriod {
+		return
+	}
+	mg.lastBackupsCleanup = time.Now()
+
+	// The groups could be not loaded yet
+	if len(mg.shardsModel.GetAllGroups()) == 0 {
+		return
+	}
+
+	backups, err := mg.listBackups(mg.s3BackupsPath, mg.awsRegion)
+	if err != nil {
+		log.Error("Problem trying to list the backups, Error:", err)
+		return
+	}
+
+	for groupID, stored := range backups {
+		if time.Since(stored) < cOrphanedBackupsGrace || mg.shardsModel.GetGroupByID(groupID) != nil {
+			continue
+		}
+
+		log.Info("Removing orphaned backup of group:", groupID, "stored at:", stored)
+		mg.destroyBackup(mg.s3BackupsPath, groupID, mg.awsRegion)
+	}
+}
@@ -0,0 +1,91 @@
+package shardsmanager
+
+import (
+	"context"
+	"github.com/alonsovidales/pit/cluster"
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/models/storage"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRemoveOrphanedBackups(t *testing.T) {
+	shardsModel := shardinfo.NewModel(storage.NewMemTable(), storage.NewMemTable(), "admin@test.com")
+	if _, _, err := shardsModel.AddUpdateGroup("s", "user@test.com", "alive", 1, 1000, 100, 100, 5); err != nil {
+		t.Fatal("Problem creating the group, Error:", err)
+	}
+
+	old := time.Now().Add(-2 * cOrphanedBackupsGrace)
+	destroyed := []string{}
+	mg := &Manager{
+		shardsModel:    shardsModel,
+		instancesModel: &fakeInstances{total: 1, leader: true},
+		listBackups: func(s3Path, s3Region string) (map[string]time.Time, error) {
+			return map[string]time.Time{
+				"alive":  old,
+				"orphan": old,
+				"recent": time.Now(),
+			}, nil
+		},
+		destroyBackup: func(s3Path, identifier, s3Region string) bool {
+			destroyed = append(destroyed, identifier)
+			return true
+		},
+	}
+
+	mg.removeOrphanedBackups()
+	if len(destroyed) != 1 || destroyed[0] != "orphan" {
+		t.Error("Expected only the removal of the orphaned backup, removed:", destroyed)
+	}
+
+	// The backups are checked only once each period
+	mg.removeOrphanedBackups()
+	if len(destroyed) != 1 {
+		t.Error("The backups were checked again before cOrphanedBackupsPeriod, removed:", destroyed)
+	}
+}
+
+func TestRebalanceRequestsHandOff(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	remoteServer := cluster.NewServer("secret")
+	remoteServer.Handle(cMethodHandOff, func(ctx context.Context, body []byte) (interface{}, error) {
+		requests <- struct{}{}
+		return &internalHandOffResp{HandedOff: true}, nil
+	})
+	remote := httptest.NewServer(remoteServer)
+	defer remote.Close()
+	remoteURL, _ := url.Parse(remote.URL)
+	port, _ := strconv.Atoi(remoteURL.Port())
+	remoteHost := remoteURL.Hostname()
+
+	shardsModel := shardinfo.NewModel(storage.NewMemTable(), storage.NewMemTable(), "admin@test.com")
+	for _, groupID := range []string{"g1", "g2"} {
+		group, _, err := shardsModel.AddUpdateGroup("s", "user@test.com", groupID, 1, 1000, 100, 100, 5)
+		if err != nil {
+			t.Fatal("Problem creating the group, Error:", err)
+		}
+		group.ShardsByAddr[remoteHost] = &shardinfo.Shard{Addr: remoteHost}
+	}
+
+	mg := &Manager{
+		rpc:            cluster.NewClient(port, "secret", cluster.CDefaultTimeout),
+		shardsModel:    shardsModel,
+		instancesModel: &fakeInstances{total: 2, leader: true, bids: map[string]instances.Bid{instances.GetHostName(): {}, remoteHost: {}}},
+		handedOff:      make(map[string]time.Time),
+	}
+
+	// The leader asks the instance with more shards to hand off one of them
+	mg.rebalance()
+	if len(requests) != 1 {
+		t.Fatal("Expected a hand off request to the instance:", remoteHost, "requests:", len(requests))
+	}
+
+	mg.rebalance()
+	if len(requests) != 1 {
+		t.Error("A hand off was requested before cRebalanceInterval, requests:", len(requests))
+	}
+}
@@ -0,0 +1,205 @@
+package shardsmanager
+
+import (
+	"bufio"
+	"github.com/alonsovidales/pit/cfg"
+	"github.com/alonsovidales/pit/log"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/recommender"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// cMemInfoPath File that contains the memory statistics of the system
+	cMemInfoPath = "/proc/meminfo"
+	// cPressureReleaseWait Time to wait after release a shard because of
+	// memory pressure before release another one, the memory of the
+	// released shard is returned to the system progressively
+	cPressureReleaseWait = time.Minute
+	// cMinElemsToMeasureMem Min number of classifications stored on the
+	// instance to use the measured memory by classification instead of the
+	// records-by-gb estimation of the configuration
+	cMinElemsToMeasureMem = 100000
+	// cMinSysAvailablePct Min percentage of the memory of the system that
+	// has to remain available, the shards are released below it
+	cMinSysAvailablePct = 5
+)
+
+// memStatus Memory usage of the instance in bytes
+type memStatus struct {
+	// limit Max memory that can be used by this process as defined on the
+	// configuration
+	limit uint64
+	// used Memory in use by this process
+	used uint64
+	// sysTotal Total memory of the system, zero if unknown
+	sysTotal uint64
+	// sysAvailable Memory of the system that can still be used by any
+	// process
+	sysAvailable uint64
+	// headroomPct Percentage of the limit, and of the memory of the
+	// system, that is kept free
+	headroomPct uint64
+}
+
+// readMemStatus Returns the memory usage of the instance based on the runtime
+// statistics and on the memory statistics of the system when available
+func readMemStatus() (status memStatus) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	status.limit = uint64(cfg.GetInt("mem", "instance-mem-gb")) << 30
+	status.used = ms.Sys - ms.HeapReleased
+	status.headroomPct = uint64(cfg.GetInt("mem", "headroom-pct"))
+	if status.headroomPct > 100 {
+		status.headroomPct = 100
+	}
+
+	f, err := os.Open(cMemInfoPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if total, available, ok := parseMemInfo(f); ok {
+		status.sysTotal, status.sysAvailable = total, available
+	}
+
+	return
+}
+
+// free Returns the memory that can still be allocated by this process keeping
+// the headroom on its limit and on the memory of the system, the memory used by
+// other processes reduces the memory that can be allocated
+func (status memStatus) free() uint64 {
+	free := uint64(0)
+	if budget := status.limit - status.limit*status.headroomPct/100; budget > status.used {
+		free = budget - status.used
+	}
+	if status.sysTotal > 0 {
+		sysReserved := status.sysTotal * status.headroomPct / 100
+		if status.sysAvailable < sysReserved {
+			return 0
+		}
+		if sysFree := status.sysAvailable - sysReserved; sysFree < free {
+			free = sysFree
+		}
+	}
+
+	return free
+}
+
+// underPressure Returns true if this process exceeds its memory limit or if
+// the system is running out of memory
+func (status memStatus) underPressure() bool {
+	return status.used > status.limit ||
+		(status.sysTotal > 0 && status.sysAvailable < status.sysTotal*cMinSysAvailablePct/100)
+}
+
+// parseMemInfo Returns the total and available memory in bytes from the
+// contents of /proc/meminfo
+func parseMemInfo(r io.Reader) (total, available uint64, ok bool) {
+	var totalOk, availableOk bool
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			v <<= 10
+		}
+
+		switch fields[0] {
+		case "MemTotal:":
+			total, totalOk = v, true
+		case "MemAvailable:":
+			available, availableOk = v, true
+		}
+	}
+
+	return total, available, totalOk && availableOk && available <= total
+}
+
+// bytesByClassif Returns the average number of bytes used to store each
+// classification on the given shards, if there are not enough classifications
+// stored to measure it, the estimation from the records-by-gb configuration
+// is returned
+func bytesByClassif(shards []recommender.Int) float64 {
+	storedElems, memUsage := uint64(0), uint64(0)
+	for _, rec := range shards {
+		storedElems += rec.GetStoredElements()
+		memUsage += rec.GetMemoryUsage()
+	}
+	if storedElems < cMinElemsToMeasureMem {
+		return float64(1<<30) / float64(cfg.GetInt("mem", "records-by-gb"))
+	}
+
+	return float64(memUsage) / float64(storedElems)
+}
+
+// requiredMem Returns the memory that would be required to allocate a new
+// shard of the group, considering that the acquired shards will keep growing
+// until store the max number of elements allowed
+func requiredMem(shards []recommender.Int, maxElements uint64) uint64 {
+	pendingElems := maxElements
+	for _, rec := range shards {
+		if total, stored := rec.GetTotalElements(), rec.GetStoredElements(); total > stored {
+			pendingElems += total - stored
+		}
+	}
+
+	return uint64(float64(pendingElems) * bytesByClassif(shards))
+}
+
+// releaseUnderPressure Releases the shard that uses more memory in case of
+// memory pressure on the given memory usage, see memStatus.underPressure, the
+// shard can be acquired by another instance after that. As on handOff, the
+// shard doesn't store new records since its backup is stored before the
+// release, see freezeWrites
+func (mg *Manager) releaseUnderPressure(status memStatus) {
+	if time.Since(mg.lastPressureRelease) < cPressureReleaseWait {
+		return
+	}
+	if !status.underPressure() {
+		return
+	}
+
+	memByGroup := make(map[string]uint64)
+	mg.mutex.RLock()
+	for groupID, rec := range mg.acquiredShards {
+		memByGroup[groupID] = rec.GetMemoryUsage()
+	}
+	mg.mutex.RUnlock()
+
+	var group *shardinfo.GroupInfo
+	maxMem := uint64(0)
+	for groupID, mem := range memByGroup {
+		// The shards already released are still allocated until
+		// keepUpdateGroup detects it
+		if gr := mg.shardsModel.GetGroupByID(groupID); gr != nil && gr.IsThisInstanceOwner() && (group == nil || mem > maxMem) {
+			group, maxMem = gr, mem
+		}
+	}
+	if group == nil {
+		return
+	}
+
+	log.Info("Memory pressure, used:", status.used, "limit:", status.limit, "available on the system:", status.sysAvailable, "releasing shard of group:", group.GroupID, "using:", maxMem, "bytes")
+	if rec, ok := mg.getAcquiredShard(group.GroupID); ok {
+		mg.freezeWrites(group.GroupID)
+		rec.SaveBackup()
+	}
+	group.ReleaseShard()
+	mg.lastPressureRelease = time.Now()
+}
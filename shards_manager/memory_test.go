@@ -0,0 +1,179 @@
+package shardsmanager
+
+import (
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/models/storage"
+	"github.com/alonsovidales/pit/recommender"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMemInfo(t *testing.T) {
+	total, available, ok := parseMemInfo(strings.NewReader(`MemTotal:       16384 kB
+MemFree:         1024 kB
+MemAvailable:    4096 kB
+Buffers:          512 kB
+`))
+	if !ok || total != 16384<<10 || available != 4096<<10 {
+		t.Error("Unexpected memory info, total:", total, "available:", available, "ok:", ok)
+	}
+
+	if _, _, ok := parseMemInfo(strings.NewReader("MemTotal: 16384 kB\n")); ok {
+		t.Error("The memory info without available memory has to be discarded")
+	}
+}
+
+func TestMemStatusFree(t *testing.T) {
+	status := memStatus{
+		limit:       10 << 30,
+		used:        2 << 30,
+		headroomPct: 20,
+	}
+	if free := status.free(); free != 6<<30 {
+		t.Error("Expected 6GB of free memory, obtained:", free)
+	}
+
+	// The memory used by other processes reduces the free memory
+	status.sysTotal, status.sysAvailable = 100<<30, 23<<30
+	if free := status.free(); free != 3<<30 {
+		t.Error("Expected 3GB of free memory, obtained:", free)
+	}
+	status.sysAvailable = 10 << 30
+	if free := status.free(); free != 0 || status.underPressure() {
+		t.Error("Expected no free memory without pressure, obtained:", free)
+	}
+
+	status.sysAvailable = 4 << 30
+	if !status.underPressure() {
+		t.Error("The system is running out of memory, pressure expected")
+	}
+	status.sysAvailable, status.used = 50<<30, 11<<30
+	if !status.underPressure() || status.free() != 0 {
+		t.Error("The process exceeds its limit, pressure expected")
+	}
+}
+
+func TestCanAllocate(t *testing.T) {
+	shardsModel := shardinfo.NewModel(storage.NewMemTable(), storage.NewMemTable(), "admin@test.com")
+	group, _, err := shardsModel.AddUpdateGroup("s", "user@test.com", "group", 1, 1000000, 100, 100, 5)
+	if err != nil {
+		t.Fatal("Problem creating the group, Error:", err)
+	}
+	status := memStatus{
+		limit:       1 << 30,
+		used:        100 << 20,
+		headroomPct: 10,
+	}
+	instancesModel := &fakeInstances{total: 1, bids: map[string]instances.Bid{}}
+	mg := &Manager{
+		shardsModel:    shardsModel,
+		instancesModel: instancesModel,
+		acquiredShards: map[string]recommender.Int{
+			// 100 bytes by classification, 400MB required to
+			// fill the shard
+			"other": &memShard{total: 5000000, stored: 1000000, memory: 100000000},
+		},
+		reqSecStats: map[string]*statsReqSec{},
+		load: func() float64 {
+			return 0
+		},
+		demand: newDemandMeter(),
+	}
+
+	// 400MB for the acquired shard plus 100MB for the new one
+	mg.publishBid(status)
+	if !canAllocate(instancesModel.bids[instances.GetHostName()], group) {
+		t.Error("There is memory enough to acquire the shard")
+	}
+	status.used = 500 << 20
+	mg.publishBid(status)
+	if canAllocate(instancesModel.bids[instances.GetHostName()], group) {
+		t.Error("There is not memory enough to acquire the shard")
+	}
+}
+
+// backupShard Recommender that keeps the records in memory and stores a copy of
+// them as its backup
+type backupShard struct {
+	*fakeShard
+
+	memory uint64
+	backup map[uint64]map[uint64]uint8
+}
+
+func (bs *backupShard) GetMemoryUsage() uint64 {
+	return bs.memory
+}
+
+func (bs *backupShard) SaveBackup() {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	bs.backup = make(map[uint64]map[uint64]uint8)
+	for recID, scores := range bs.records {
+		bs.backup[recID] = scores
+	}
+}
+
+func TestReleaseUnderPressure(t *testing.T) {
+	shardsModel := shardinfo.NewModel(storage.NewMemTable(), storage.NewMemTable(), "admin@test.com")
+	for _, groupID := range []string{"small", "big"} {
+		group, _, err := shardsModel.AddUpdateGroup("s", "user@test.com", groupID, 1, 1000, 100, 100, 5)
+		if err != nil {
+			t.Fatal("Problem creating the group, Error:", err)
+		}
+		if acquired, err := group.AcquireShard(); !acquired {
+			t.Fatal("Problem acquiring the shard of the group:", groupID, "Error:", err)
+		}
+	}
+
+	status := memStatus{limit: 1 << 30, used: 100 << 20}
+	big := &backupShard{fakeShard: newFakeShard(), memory: 50 << 20}
+	mg := &Manager{
+		shardsModel: shardsModel,
+		acquiredShards: map[string]recommender.Int{
+			"small": &backupShard{fakeShard: newFakeShard(), memory: 10 << 20},
+			"big":   big,
+		},
+	}
+	for recID := uint64(1); recID <= 3; recID++ {
+		if err := mg.storeRecords("big", func() { big.AddRecord(recID, map[uint64]uint8{recID: 5}) }); err != nil {
+			t.Fatal("Problem storing the record:", recID, "Error:", err)
+		}
+	}
+
+	mg.releaseUnderPressure(status)
+	if !shardsModel.GetGroupByID("big").IsThisInstanceOwner() {
+		t.Error("The shard was released without memory pressure")
+	}
+
+	status.used = 2 << 30
+	mg.releaseUnderPressure(status)
+	if shardsModel.GetGroupByID("big").IsThisInstanceOwner() || !shardsModel.GetGroupByID("small").IsThisInstanceOwner() {
+		t.Error("Expected the release of the shard that uses more memory")
+	}
+
+	// The records survive the release on the backup restored by the next
+	// owner, and the shard doesn't accept records after store it
+	if !reflect.DeepEqual(big.backup, big.records) || len(big.backup) != 3 {
+		t.Error("The backup doesn't contain the records of the released shard:", big.backup)
+	}
+	if err := mg.storeRecords("big", func() { big.AddRecord(4, map[uint64]uint8{4: 5}) }); err != ErrShardNotAvailable {
+		t.Error("The released shard stored records after its backup, Error:", err)
+	}
+
+	// The memory of the released shard is not returned instantly, the
+	// next shard is not released until cPressureReleaseWait
+	mg.releaseUnderPressure(status)
+	if !shardsModel.GetGroupByID("small").IsThisInstanceOwner() {
+		t.Error("The shard was released before wait for the previous release")
+	}
+	mg.lastPressureRelease = time.Now().Add(-cPressureReleaseWait)
+	mg.releaseUnderPressure(status)
+	if shardsModel.GetGroupByID("small").IsThisInstanceOwner() {
+		t.Error("The shard was not released after wait for the previous release")
+	}
+}
@@ -0,0 +1,160 @@
+package shardsmanager
+
+import (
+	"github.com/alonsovidales/pit/log"
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"io/ioutil"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// cLoadAvgPath File that contains the load average of the system
+	cLoadAvgPath = "/proc/loadavg"
+	// cQPSScale Number of queries / sec attended by an instance that halves
+	// the score of its bids
+	cQPSScale = 1000
+	// cZonePenalty Factor applied to the score of the bids for each shard
+	// of the group on the availability zone of the instance when all the
+	// instances that can allocate the shard are on zones with shards of the
+	// group, so the zones with less shards of the group are preferred
+	cZonePenalty = 0.25
+)
+
+// publishBid Publishes the resources of the local instance with the given
+// memory usage on the instances table, the free memory published discounts the
+// memory that the acquired shards will use until be full
+func (mg *Manager) publishBid(status memStatus) {
+	shards := mg.getAcquiredShards()
+	free := status.free()
+	if growth := requiredMem(shards, 0); growth < free {
+		free -= growth
+	} else {
+		free = 0
+	}
+
+	mg.instancesModel.SetLocalBid(instances.Bid{
+		Zone:        mg.zone,
+		FreeMem:     free,
+		BytesByElem: bytesByClassif(shards),
+		Load:        mg.load(),
+		QPS:         mg.currentQPS(),
+		Demand:      mg.demand.measure(time.Now()),
+	})
+}
+
+// wonBid Returns true if the local instance is the one that has to acquire the
+// next free shard of the group according to the published bids. The local
+// instance is admitted by the same rule applied to the bids of the other
+// instances, see canAllocate, so the winner never refuses the shard
+func (mg *Manager) wonBid(group *shardinfo.GroupInfo) bool {
+	winner, ok := selectWinner(mg.instancesModel.GetBids(), group)
+	if !ok {
+		log.Debug("No instance can acquire a shard of group:", group.GroupID)
+		return false
+	}
+
+	return winner == mg.localHost()
+}
+
+// canAllocate Returns true if the instance of the bid has enough free memory
+// to allocate a shard of the group, the memory required is estimated with the
+// bytes by element of the instance, or the configured ones if unknown
+func canAllocate(bid instances.Bid, group *shardinfo.GroupInfo) bool {
+	bytesByElem := bid.BytesByElem
+	if bytesByElem == 0 {
+		bytesByElem = bytesByClassif(nil)
+	}
+
+	return float64(bid.FreeMem) >= float64(group.MaxElements)*bytesByElem
+}
+
+// selectWinner Returns the host name of the instance that has to acquire the
+// next free shard of the group. Only the instances that don't own a shard of
+// the group and with enough free memory to allocate it can win, see
+// canAllocate. While any of them is on an availability zone without shards of
+// the group only the instances on those zones can win, so the shards of a
+// group are spread across the zones while possible, if not the score is
+// penalized by cZonePenalty for each shard of the group on the zone. The
+// winner is the instance with the best score, see bidScore, and the ties are
+// resolved by host name, so all the instances select the same winner for the
+// same bids
+func selectWinner(bids map[string]instances.Bid, group *shardinfo.GroupInfo) (winner string, ok bool) {
+	owners := make(map[string]bool)
+	shardsByZone := make(map[string]int)
+	for _, addr := range group.GetOwners() {
+		owners[addr] = true
+		if bid, isBid := bids[addr]; isBid && bid.Zone != "" {
+			shardsByZone[bid.Zone]++
+		}
+	}
+
+	eligible := make(map[string]instances.Bid)
+	spread := false
+	for host, bid := range bids {
+		if !owners[host] && canAllocate(bid, group) {
+			eligible[host] = bid
+			spread = spread || shardsByZone[bid.Zone] == 0
+		}
+	}
+
+	bestScore := 0.0
+	for host, bid := range eligible {
+		if spread && shardsByZone[bid.Zone] > 0 {
+			continue
+		}
+
+		score := bidScore(bid) * math.Pow(cZonePenalty, float64(shardsByZone[bid.Zone]))
+		if !ok || score > bestScore || (score == bestScore && host < winner) {
+			winner, bestScore, ok = host, score, true
+		}
+	}
+
+	return
+}
+
+// bidScore Returns the score of a bid, the score is proportional to the free
+// memory and decreases with the CPU load and the queries / sec of the instance
+func bidScore(bid instances.Bid) float64 {
+	return float64(bid.FreeMem) / (1 + bid.Load) / (1 + float64(bid.QPS)/cQPSScale)
+}
+
+// currentQPS Returns the number of queries attended on the last second by all
+// the shards of the instance
+func (mg *Manager) currentQPS() (qps uint64) {
+	mg.mutex.RLock()
+	defer mg.mutex.RUnlock()
+
+	for _, stats := range mg.reqSecStats {
+		stats.mutex.Lock()
+		if len(stats.BySecStats) > 0 {
+			qps += stats.BySecStats[len(stats.BySecStats)-1]
+		}
+		stats.mutex.Unlock()
+	}
+
+	return
+}
+
+// readLoad Returns the load average of the last minute divided by the number
+// of CPUs, zero if it is not available
+func readLoad() float64 {
+	content, err := ioutil.ReadFile(cLoadAvgPath)
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+
+	return load / float64(runtime.NumCPU())
+}
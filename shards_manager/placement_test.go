@@ -0,0 +1,130 @@
+package shardsmanager
+
+import (
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/recommender"
+	"testing"
+)
+
+func TestSelectWinner(t *testing.T) {
+	// 2GB are required to allocate a shard of the group on each instance
+	bids := map[string]instances.Bid{
+		"a": {HostName: "a", Zone: "zone-1", FreeMem: 8 << 30, BytesByElem: 1 << 10},
+		"b": {HostName: "b", Zone: "zone-1", FreeMem: 6 << 30, BytesByElem: 1 << 10},
+		"c": {HostName: "c", Zone: "zone-2", FreeMem: 8 << 30, BytesByElem: 1 << 10, Load: 1},
+		"d": {HostName: "d", Zone: "zone-3", FreeMem: 1 << 30, BytesByElem: 1 << 10},
+		"e": {HostName: "e", Zone: "zone-3", FreeMem: 8 << 30, BytesByElem: 1 << 10, QPS: 3 * cQPSScale},
+	}
+	group := &shardinfo.GroupInfo{
+		GroupID:      "group",
+		NumShards:    4,
+		MaxElements:  2 << 20,
+		ShardsByAddr: map[string]*shardinfo.Shard{},
+	}
+
+	if winner, ok := selectWinner(bids, group); !ok || winner != "a" {
+		t.Error("Expected the instance with more free memory as winner, obtained:", winner)
+	}
+
+	// The instances on zones with shards of the group are penalized
+	group.ShardsByAddr["a"] = &shardinfo.Shard{Addr: "a"}
+	if winner, ok := selectWinner(bids, group); !ok || winner != "c" {
+		t.Error("Expected an instance on a zone without shards of the group as winner, obtained:", winner)
+	}
+
+	// The instances without memory enough can't acquire the shard
+	group.ShardsByAddr["c"] = &shardinfo.Shard{Addr: "c"}
+	if winner, ok := selectWinner(bids, group); !ok || winner != "e" {
+		t.Error("Expected the instance with memory enough as winner, obtained:", winner)
+	}
+
+	// The zones with shards of the group are used when there is no other
+	// instance that can allocate the shard
+	group.ShardsByAddr["e"] = &shardinfo.Shard{Addr: "e"}
+	if winner, ok := selectWinner(bids, group); !ok || winner != "b" {
+		t.Error("Expected an instance on a zone with shards of the group as winner, obtained:", winner)
+	}
+	group.ShardsByAddr["b"] = &shardinfo.Shard{Addr: "b"}
+	if winner, ok := selectWinner(bids, group); ok {
+		t.Error("No instance can allocate the shard, unexpected winner:", winner)
+	}
+
+	// An instance on a zone without shards of the group wins even with a
+	// much lower score
+	bids["f"] = instances.Bid{HostName: "f", Zone: "zone-1", FreeMem: 64 << 30, BytesByElem: 1 << 10}
+	bids["g"] = instances.Bid{HostName: "g", Zone: "zone-4", FreeMem: 3 << 30, BytesByElem: 1 << 10}
+	if winner, ok := selectWinner(bids, group); !ok || winner != "g" {
+		t.Error("Expected the instance on a zone without shards of the group as winner, obtained:", winner)
+	}
+
+	// Without instances on other zones the penalty can be compensated by
+	// the free memory
+	bids["g"] = instances.Bid{HostName: "g", Zone: "zone-4", FreeMem: 1 << 30, BytesByElem: 1 << 10}
+	bids["h"] = instances.Bid{HostName: "h", Zone: "zone-2", FreeMem: 8 << 30, BytesByElem: 1 << 10}
+	if winner, ok := selectWinner(bids, group); !ok || winner != "f" {
+		t.Error("Expected the instance with much more free memory as winner, obtained:", winner)
+	}
+
+	// The instances without zone are not affected by the anti-affinity
+	// and the ties are resolved by host name
+	bids = map[string]instances.Bid{
+		"y": {HostName: "y", FreeMem: 4 << 30, BytesByElem: 1 << 10},
+		"x": {HostName: "x", FreeMem: 4 << 30, BytesByElem: 1 << 10},
+		"z": {HostName: "z", FreeMem: 4 << 30, BytesByElem: 1 << 10},
+	}
+	group.ShardsByAddr = map[string]*shardinfo.Shard{"z": {Addr: "z"}}
+	for i := 0; i < 10; i++ {
+		if winner, ok := selectWinner(bids, group); !ok || winner != "x" {
+			t.Fatal("Expected the instance with the lowest host name as winner, obtained:", winner)
+		}
+	}
+}
+
+func TestWonBid(t *testing.T) {
+	localHost := instances.GetHostName()
+	defer instances.SetHostname(localHost)
+	instances.SetHostname("b")
+
+	status := memStatus{limit: 4 << 30}
+	instancesModel := &fakeInstances{
+		total: 2,
+		bids: map[string]instances.Bid{
+			"a": {HostName: "a", FreeMem: 2 << 30, BytesByElem: 10},
+		},
+	}
+	mg := &Manager{
+		instancesModel: instancesModel,
+		acquiredShards: map[string]recommender.Int{
+			"other": &memShard{total: cMinElemsToMeasureMem, stored: cMinElemsToMeasureMem, memory: 10 * cMinElemsToMeasureMem},
+		},
+		reqSecStats: map[string]*statsReqSec{},
+		load: func() float64 {
+			return 0.5
+		},
+		zone:   "zone-1",
+		demand: newDemandMeter(),
+	}
+	group := &shardinfo.GroupInfo{
+		GroupID:      "group",
+		MaxElements:  1000,
+		NumShards:    2,
+		ShardsByAddr: map[string]*shardinfo.Shard{},
+	}
+
+	mg.publishBid(status)
+	if bid := instancesModel.bids["b"]; bid.FreeMem != 4<<30 || bid.Zone != "zone-1" || bid.Load != 0.5 {
+		t.Error("Unexpected published bid:", bid)
+	}
+	if !mg.wonBid(group) {
+		t.Error("The local instance has the best score, it has to win the bid")
+	}
+
+	// 3GB of free memory with a load of 0.5 scores as the 2GB of the
+	// instance a without load
+	status.used = 1 << 30
+	mg.publishBid(status)
+	if mg.wonBid(group) {
+		t.Error("The local instance ties with an instance with lower host name, it can not win the bid")
+	}
+}
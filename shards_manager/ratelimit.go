@@ -0,0 +1,165 @@
+package shardsmanager
+
+import (
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// CRateLimitHeader Header that contains the number of requests / sec
+	// allowed for the group
+	CRateLimitHeader = "X-RateLimit-Limit"
+	// CRateLimitRemainingHeader Header that contains the number of requests
+	// that can still be performed on the group without wait through the
+	// instance that attended the request, see takeQuota
+	CRateLimitRemainingHeader = "X-RateLimit-Remaining"
+	// CRetryAfterHeader Header that contains the number of seconds to wait
+	// before retry a request rejected by the rate limit
+	CRetryAfterHeader = "Retry-After"
+
+	// cBurstSecs Number of seconds of unused quota that a group can
+	// accumulate to attend bursts of requests
+	cBurstSecs = 2
+	// cMinQuotaShare Share of the even split of the limit of a group
+	// between the instances that is kept by the instances that don't
+	// receive requests of the group, so they can attend the first ones
+	// before their demand is published
+	cMinQuotaShare = 0.1
+	// cDemandWindow Min time between two measures of the requests / sec
+	// received by the instance
+	cDemandWindow = time.Second
+	// cDemandSmoothing Weight of the last measure of the requests / sec
+	// received by the instance over the previous ones
+	cDemandSmoothing = 0.5
+	// cMinDemand Requests / sec received for a group below which the
+	// demand is not published anymore
+	cMinDemand = 0.01
+)
+
+// demandMeter Requests / sec received by the local instance from the clients
+// by rate limit key, including the rejected requests, smoothed over the time
+type demandMeter struct {
+	counts map[string]float64
+	rates  map[string]float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+// newDemandMeter Returns a meter without requests
+func newDemandMeter() *demandMeter {
+	return &demandMeter{
+		counts: make(map[string]float64),
+		rates:  make(map[string]float64),
+	}
+}
+
+// add Counts n requests received for the rate limit key
+func (dm *demandMeter) add(key string, n int) {
+	dm.mutex.Lock()
+	dm.counts[key] += float64(n)
+	dm.mutex.Unlock()
+}
+
+// measure Adds the requests counted since the last measure to the requests /
+// sec by rate limit key if at least cDemandWindow passed since then, and
+// returns a copy of them
+func (dm *demandMeter) measure(now time.Time) (rates map[string]float64) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	if elapsed := now.Sub(dm.last); dm.last.IsZero() || elapsed >= cDemandWindow {
+		for key := range dm.rates {
+			if _, counted := dm.counts[key]; !counted {
+				dm.counts[key] = 0
+			}
+		}
+		for key, count := range dm.counts {
+			rate := dm.rates[key]
+			if !dm.last.IsZero() {
+				rate = rate*(1-cDemandSmoothing) + count/elapsed.Seconds()*cDemandSmoothing
+			}
+			if rate < cMinDemand {
+				delete(dm.rates, key)
+			} else {
+				dm.rates[key] = rate
+			}
+		}
+		dm.counts = make(map[string]float64)
+		dm.last = now
+	}
+
+	rates = make(map[string]float64, len(dm.rates))
+	for key, rate := range dm.rates {
+		rates[key] = rate
+	}
+
+	return
+}
+
+// quotaShare Returns the share of the limit of the rate limit key that has to
+// be enforced by the given instance according to the requests / sec received
+// by each instance published on the bids. The limit is split proportionally to
+// the demand of the instances, and each instance keeps at least cMinQuotaShare
+// of the even split, so the shares of all the instances add up to the whole
+// limit. The limit is split evenly if the demand is unknown
+func quotaShare(bids map[string]instances.Bid, hostName, key string, totalInstances int) float64 {
+	if totalInstances < len(bids) {
+		totalInstances = len(bids)
+	}
+	if totalInstances < 1 {
+		totalInstances = 1
+	}
+	minShare := cMinQuotaShare / float64(totalInstances)
+
+	total, local := 0.0, 0.0
+	for host, bid := range bids {
+		demand := bid.Demand[key]
+		total += demand
+		if host == hostName {
+			local = demand
+		}
+	}
+	if total == 0 {
+		return 1 / float64(totalInstances)
+	}
+
+	// Each instance receives at least minShare, the rest of the limit is
+	// split by demand
+	return minShare + (1-minShare*float64(totalInstances))*local/total
+}
+
+// takeQuota Consumes n requests from the queries, or inserts, quota of the
+// group and writes the rate limit headers. The limit of the group is the limit
+// by shard multiplied by the number of shards, and is consumed only by the
+// instance that receives the request from the client. Each instance enforces a
+// share of the limit proportional to the requests of the group that it
+// receives, see quotaShare, so the limit applies to the whole group
+// independently of which instances receive the requests. The remaining
+// requests are the ones of the share of the local instance. Returns
+// ErrTooManyRequests if the quota was exceeded
+func (mg *Manager) takeQuota(header http.Header, group *shardinfo.GroupInfo, n int, insert bool) error {
+	limit, key := group.MaxReqSec, group.GroupID+":queries"
+	if insert {
+		limit, key = group.MaxInsertReqSec, group.GroupID+":inserts"
+	}
+	limit *= uint64(group.NumShards)
+
+	mg.demand.add(key, n)
+	share := quotaShare(mg.instancesModel.GetBids(), mg.localHost(), key, mg.instancesModel.GetTotalInstances())
+	rate := float64(limit) * share
+	quota := mg.limiter.Take(key, rate, rate*cBurstSecs, n)
+
+	header.Set(CRateLimitHeader, strconv.FormatUint(limit, 10))
+	header.Set(CRateLimitRemainingHeader, strconv.FormatUint(uint64(quota.Remaining), 10))
+	if !quota.Allowed {
+		header.Set(CRetryAfterHeader, strconv.Itoa(int(math.Max(1, math.Ceil(quota.RetryAfter.Seconds())))))
+		return ErrTooManyRequests
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package shardsmanager
+
+import (
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/models/storage"
+	"github.com/alonsovidales/pit/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeInstances Instances model with a fixed number of active instances
+type fakeInstances struct {
+	total  int
+	bids   map[string]instances.Bid
+	leader bool
+}
+
+func (fi *fakeInstances) GetTotalInstances() int {
+	return fi.total
+}
+
+func (fi *fakeInstances) GetInstances() []string {
+	hosts := []string{}
+	for host := range fi.bids {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	return hosts
+}
+
+func (fi *fakeInstances) SetLocalBid(bid instances.Bid) {
+	bid.HostName = instances.GetHostName()
+	fi.bids[bid.HostName] = bid
+}
+
+func (fi *fakeInstances) GetBids() map[string]instances.Bid {
+	return fi.bids
+}
+
+func (fi *fakeInstances) HostName() string {
+	return instances.GetHostName()
+}
+
+func (fi *fakeInstances) IsLeader() bool {
+	return fi.leader
+}
+
+func TestTakeQuota(t *testing.T) {
+	group := &shardinfo.GroupInfo{
+		GroupID:         "group",
+		NumShards:       2,
+		MaxReqSec:       10,
+		MaxInsertReqSec: 5,
+	}
+	mg := &Manager{
+		instancesModel: &fakeInstances{total: 4},
+		limiter:        ratelimit.New(),
+		demand:         newDemandMeter(),
+	}
+
+	// The group allows 20 queries / sec, without published demand 5 on
+	// each instance, plus a burst of cBurstSecs
+	for i := 0; i < 5*cBurstSecs; i++ {
+		header := http.Header{}
+		if err := mg.takeQuota(header, group, 1, false); err != nil {
+			t.Fatal("Query:", i, "was rejected, Error:", err)
+		}
+		if header.Get(CRateLimitHeader) != "20" || header.Get(CRetryAfterHeader) != "" {
+			t.Error("Unexpected rate limit headers:", header)
+		}
+	}
+
+	header := http.Header{}
+	if err := mg.takeQuota(header, group, 1, false); err != ErrTooManyRequests {
+		t.Error("Expected too many requests error, obtained:", err)
+	}
+	if header.Get(CRetryAfterHeader) != "1" || header.Get(CRateLimitRemainingHeader) != "0" {
+		t.Error("Unexpected rate limit headers for a rejected query:", header)
+	}
+
+	// The inserts have their own quota
+	header = http.Header{}
+	if err := mg.takeQuota(header, group, 1, true); err != nil {
+		t.Error("The insert was rejected, Error:", err)
+	}
+	if header.Get(CRateLimitHeader) != "10" || header.Get(CRateLimitRemainingHeader) != "4" {
+		t.Error("Unexpected rate limit headers for an insert:", header)
+	}
+}
+
+func TestQuotaShare(t *testing.T) {
+	bids := map[string]instances.Bid{
+		"a": {HostName: "a", Demand: map[string]float64{"group:queries": 90}},
+		"b": {HostName: "b", Demand: map[string]float64{"group:queries": 10}},
+		"c": {HostName: "c"},
+	}
+
+	// The instances that receive the requests obtain the limit
+	// proportionally to their demand, the ones without demand keep a min
+	// share, and all the shares add up to the whole limit
+	total := 0.0
+	for _, host := range []string{"a", "b", "c"} {
+		total += quotaShare(bids, host, "group:queries", 3)
+	}
+	if total < 0.999 || total > 1.001 {
+		t.Error("The shares don't add up to the limit:", total)
+	}
+	if share := quotaShare(bids, "a", "group:queries", 3); share < 0.8 {
+		t.Error("The instance with most of the demand obtained a small share:", share)
+	}
+	if share := quotaShare(bids, "c", "group:queries", 3); share != cMinQuotaShare/3 {
+		t.Error("The instance without demand didn't obtain the min share:", share)
+	}
+
+	// Without demand the limit is split evenly
+	if share := quotaShare(bids, "a", "group:inserts", 4); share != 0.25 {
+		t.Error("The limit was not split evenly without demand:", share)
+	}
+	if share := quotaShare(nil, "a", "group:queries", 0); share != 1 {
+		t.Error("The only instance didn't obtain the whole limit:", share)
+	}
+}
+
+func TestDemandMeter(t *testing.T) {
+	dm := newDemandMeter()
+	now := time.Now()
+	dm.measure(now)
+
+	dm.add("group:queries", 100)
+	if rates := dm.measure(now.Add(cDemandWindow / 2)); len(rates) != 0 {
+		t.Error("The demand was measured before cDemandWindow:", rates)
+	}
+	if rates := dm.measure(now.Add(cDemandWindow)); rates["group:queries"] != 100*cDemandSmoothing {
+		t.Error("Unexpected demand:", rates)
+	}
+
+	// The demand decays without requests until is not published
+	for i := 2; i < 20; i++ {
+		dm.measure(now.Add(time.Duration(i) * cDemandWindow))
+	}
+	if rates := dm.measure(now.Add(20 * cDemandWindow)); len(rates) != 0 {
+		t.Error("The demand didn't decay without requests:", rates)
+	}
+}
+
+func TestRateLimitedHandler(t *testing.T) {
+	shardsModel := shardinfo.NewModel(storage.NewMemTable(), storage.NewMemTable(), "admin@test.com")
+	group, key, err := shardsModel.AddUpdateGroup("s", "user@test.com", "group", 1, 100, 1, 1, 5)
+	if err != nil {
+		t.Fatal("Problem creating the group, Error:", err)
+	}
+	mg := &Manager{
+		shardsModel:    shardsModel,
+		instancesModel: &fakeInstances{total: 1},
+		limiter:        ratelimit.New(),
+		demand:         newDemandMeter(),
+	}
+	// Consume the whole quota of the group
+	mg.takeQuota(http.Header{}, group, cBurstSecs, false)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", CRecPath, strings.NewReader(url.Values{
+		"uid":      {"user@test.com"},
+		"key":      {key},
+		"group":    {"group"},
+		"id":       {"1"},
+		"scores":   {`{"1": 5}`},
+		"max_recs": {"10"},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	mg.ScoresAPIHandler(w, r)
+
+	if w.Code != 429 || w.Header().Get(CRetryAfterHeader) != "1" || w.Header().Get(CRateLimitRemainingHeader) != "0" {
+		t.Error("Expected too many requests response with Retry-After, obtained:", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,231 @@
+package shardsmanager
+
+import (
+	"context"
+	"github.com/alonsovidales/pit/cluster"
+	"github.com/alonsovidales/pit/log"
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"sort"
+	"time"
+)
+
+const (
+	// cRebalanceInterval Min time between two shards handed off by request
+	// of the leader in order to rebalance the cluster
+	cRebalanceInterval = 5 * time.Minute
+	// cHandOffCooldown Time during which the instance doesn't bid for a
+	// shard of a group that it handed off, so the shard can be acquired by
+	// another instance
+	cHandOffCooldown = 2 * time.Minute
+)
+
+// rebalance Asks the instance with more shards to hand off one of them in case
+// of have at least two shards more than another active instance, see
+// handOffShard. Only the leader of the cluster rebalances the shards, and the
+// shards are moved one by one to avoid the thrashing of the shards between the
+// instances
+func (mg *Manager) rebalance() {
+	if time.Since(mg.lastRebalance) < cRebalanceInterval {
+		return
+	}
+
+	shardsByInstance := mg.shardsByInstance()
+	source := ""
+	minShards := -1
+	for host, shards := range shardsByInstance {
+		if source == "" || shards > shardsByInstance[source] || (shards == shardsByInstance[source] && host < source) {
+			source = host
+		}
+		if minShards == -1 || shards < minShards {
+			minShards = shards
+		}
+	}
+	if source == "" || minShards+1 >= shardsByInstance[source] {
+		return
+	}
+
+	handedOff := false
+	if source == mg.localHost() {
+		handedOff = mg.handOffShard()
+	} else {
+		handedOff = mg.requestHandOff(source)
+	}
+	if handedOff {
+		mg.lastRebalance = time.Now()
+	}
+}
+
+// requestHandOff Asks the instance to hand off one of its shards, returns if a
+// shard was handed off
+func (mg *Manager) requestHandOff(addr string) bool {
+	ctx := cluster.WithRequestID(context.Background(), cluster.NewRequestID())
+	resp := &internalHandOffResp{}
+	if err := mg.rpc.Call(ctx, addr, cMethodHandOff, &internalHandOffReq{}, resp); err != nil {
+		log.Error("Problem requesting the hand off of a shard to instance:", addr, "Request:", cluster.RequestID(ctx), "Error:", err)
+		return false
+	}
+
+	return resp.HandedOff
+}
+
+// handOffShard Hands off a shard of the local instance in case of have at least
+// two shards more than another active instance that can allocate it, returns
+// if a shard was handed off. The shard is backed up and released, then it is
+// acquired by the selected instance, see handOff, and restored from the backup
+func (mg *Manager) handOffShard() bool {
+	mg.handOffMutex.Lock()
+	defer mg.handOffMutex.Unlock()
+
+	for groupID, handedOff := range mg.handedOff {
+		if time.Since(handedOff) >= cHandOffCooldown {
+			delete(mg.handedOff, groupID)
+		}
+	}
+
+	localHost := mg.localHost()
+	shardsByInstance := mg.shardsByInstance()
+	bids := mg.instancesModel.GetBids()
+	underloaded := make(map[string]instances.Bid)
+	for host, shards := range shardsByInstance {
+		if bid, ok := bids[host]; ok && host != localHost && shards+1 < shardsByInstance[localHost] {
+			underloaded[host] = bid
+		}
+	}
+	if len(underloaded) == 0 {
+		return false
+	}
+
+	// The shards that use less memory are the cheapest to move
+	memByGroup := make(map[string]uint64)
+	groupIDs := []string{}
+	mg.mutex.RLock()
+	for groupID, rec := range mg.acquiredShards {
+		memByGroup[groupID] = rec.GetMemoryUsage()
+		groupIDs = append(groupIDs, groupID)
+	}
+	mg.mutex.RUnlock()
+	sort.Slice(groupIDs, func(i, j int) bool {
+		if memByGroup[groupIDs[i]] != memByGroup[groupIDs[j]] {
+			return memByGroup[groupIDs[i]] < memByGroup[groupIDs[j]]
+		}
+		return groupIDs[i] < groupIDs[j]
+	})
+
+	for _, groupID := range groupIDs {
+		group := mg.shardsModel.GetGroupByID(groupID)
+		if group == nil || !group.IsThisInstanceOwner() {
+			continue
+		}
+
+		// The shard can be moved only to an underloaded instance that
+		// could win the bid once the local instance releases it, only
+		// the addresses of the owners are used to select the winner
+		owners := &shardinfo.GroupInfo{
+			GroupID:      group.GroupID,
+			MaxElements:  group.MaxElements,
+			ShardsByAddr: make(map[string]*shardinfo.Shard),
+		}
+		for _, addr := range group.GetOwners() {
+			if addr != localHost {
+				owners.ShardsByAddr[addr] = nil
+			}
+		}
+		target, ok := selectWinner(underloaded, owners)
+		if !ok {
+			continue
+		}
+
+		log.Info("Rebalancing, handing off shard of group:", groupID, "shards on this instance:", shardsByInstance[localHost], "shards on:", target, shardsByInstance[target])
+		mg.handOff(group, target)
+
+		return true
+	}
+
+	return false
+}
+
+// handOff Stores the backup of the shard of the group and releases it, the
+// shard doesn't store new records since the backup is stored, see
+// freezeWrites. After the release the target instance is asked to acquire the
+// shard with the same ID, so it restores the backup, if it can't the shard is acquired by the instance that wins the bid,
+// see wonBid. The instance doesn't bid for a shard of the group until
+// cHandOffCooldown. The caller has to hold handOffMutex
+func (mg *Manager) handOff(group *shardinfo.GroupInfo, target string) {
+	rec, ok := mg.getAcquiredShard(group.GroupID)
+	if !ok {
+		return
+	}
+	shardID, _, ok := group.LocalOwnership()
+	if !ok {
+		return
+	}
+
+	mg.freezeWrites(group.GroupID)
+	rec.SaveBackup()
+	mg.handedOff[group.GroupID] = time.Now()
+	group.ReleaseShard()
+
+	ctx := cluster.WithRequestID(context.Background(), cluster.NewRequestID())
+	resp := &internalAcquireResp{}
+	if err := mg.rpc.Call(ctx, target, cMethodAcquire, &internalAcquireReq{
+		internalReq: internalReq{GroupID: group.GroupID},
+		ShardID:     shardID,
+	}, resp); err != nil || !resp.Acquired {
+		log.Error("The instance:", target, "didn't acquire the shard handed off of group:", group.GroupID, "it will be acquired by the winner of the bid, Request:", cluster.RequestID(ctx), "Error:", err)
+	}
+}
+
+// acquireHandedOff Acquires the shard of the group with the given ID handed off
+// to the local instance by another instance, see handOff, in case of the local
+// instance can allocate it. The group is loaded again since the release of the
+// shard could not be received yet. Returns if the shard was acquired
+func (mg *Manager) acquireHandedOff(groupID string, shardID int) bool {
+	mg.acquireMutex.Lock()
+	defer mg.acquireMutex.Unlock()
+
+	if _, local := mg.getAcquiredShard(groupID); local || !mg.isActive() {
+		return false
+	}
+	group := mg.shardsModel.ReloadGroup(groupID)
+	if group == nil || group.IsThisInstanceOwner() || !canAllocate(mg.instancesModel.GetBids()[mg.localHost()], group) {
+		return false
+	}
+	if acquired, err := group.AcquireShardByID(shardID); !acquired || err != nil {
+		log.Info("The shard:", shardID, "handed off of the group:", groupID, "can't be acquired, Error:", err)
+		return false
+	}
+	log.Info("Acquired the shard:", shardID, "handed off of the group:", groupID)
+	mg.acquiredShard(group)
+
+	return true
+}
+
+// recentlyHandedOff Returns true if the local instance handed off a shard of
+// the group during the last cHandOffCooldown
+func (mg *Manager) recentlyHandedOff(groupID string) bool {
+	mg.handOffMutex.Lock()
+	handedOff, ok := mg.handedOff[groupID]
+	mg.handOffMutex.Unlock()
+
+	return ok && time.Since(handedOff) < cHandOffCooldown
+}
+
+// shardsByInstance Returns the number of shards owned by each active instance
+func (mg *Manager) shardsByInstance() map[string]int {
+	shards := make(map[string]int)
+	for _, host := range mg.instancesModel.GetInstances() {
+		shards[host] = 0
+	}
+	for _, groups := range mg.shardsModel.GetAllGroups() {
+		for _, group := range groups {
+			for _, addr := range group.GetOwners() {
+				if _, alive := shards[addr]; alive {
+					shards[addr]++
+				}
+			}
+		}
+	}
+
+	return shards
+}
@@ -0,0 +1,173 @@
+package shardsmanager
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alonsovidales/pit/cluster"
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/models/storage"
+	"github.com/alonsovidales/pit/models/users"
+	"github.com/alonsovidales/pit/recommender"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRebalance(t *testing.T) {
+	localHost := instances.GetHostName()
+	defer instances.SetHostname(localHost)
+	instances.SetHostname("a")
+
+	// The target of the hand offs acquires the shards
+	acquired := make(chan *internalAcquireReq, 10)
+	remoteServer := cluster.NewServer("secret")
+	remoteServer.Handle(cMethodAcquire, func(ctx context.Context, body []byte) (interface{}, error) {
+		req := &internalAcquireReq{}
+		json.Unmarshal(body, req)
+		acquired <- req
+		return &internalAcquireResp{Acquired: true}, nil
+	})
+	remote := httptest.NewServer(remoteServer)
+	defer remote.Close()
+	remoteURL, _ := url.Parse(remote.URL)
+	port, _ := strconv.Atoi(remoteURL.Port())
+	remoteHost := remoteURL.Hostname()
+
+	shardsModel := shardinfo.NewModel(storage.NewMemTable(), storage.NewMemTable(), "admin@test.com")
+	shards := make(map[string]*memShard)
+	acquiredShards := make(map[string]recommender.Int)
+	for i, groupID := range []string{"g1", "g2", "g3"} {
+		group, _, err := shardsModel.AddUpdateGroup("s", "user@test.com", groupID, 2, 1000, 100, 100, 5)
+		if err != nil {
+			t.Fatal("Problem creating the group, Error:", err)
+		}
+		if acquired, err := group.AcquireShard(); !acquired {
+			t.Fatal("Problem acquiring the shard of the group:", groupID, "Error:", err)
+		}
+		shards[groupID] = &memShard{stored: cMinElemsToMeasureMem, memory: uint64(3-i) << 20}
+		acquiredShards[groupID] = shards[groupID]
+	}
+
+	instancesModel := &fakeInstances{
+		total: 2,
+		bids: map[string]instances.Bid{
+			"a":        {HostName: "a"},
+			remoteHost: {HostName: remoteHost, BytesByElem: 1 << 10},
+		},
+	}
+	mg := &Manager{
+		rpc:            cluster.NewClient(port, "secret", cluster.CDefaultTimeout),
+		shardsModel:    shardsModel,
+		instancesModel: instancesModel,
+		acquiredShards: acquiredShards,
+		handedOff:      make(map[string]time.Time),
+	}
+
+	// The instance b doesn't have memory enough to allocate the shards
+	mg.rebalance()
+	if len(mg.handedOff) != 0 {
+		t.Fatal("A shard was handed off to an instance without memory:", mg.handedOff)
+	}
+
+	instancesModel.bids[remoteHost] = instances.Bid{HostName: remoteHost, FreeMem: 1 << 30, BytesByElem: 1 << 10}
+	shardID, _, _ := shardsModel.GetGroupByID("g3").LocalOwnership()
+	mg.rebalance()
+	if shardsModel.GetGroupByID("g3").IsThisInstanceOwner() || shards["g3"].backups != 1 || !mg.recentlyHandedOff("g3") {
+		t.Error("Expected the hand off of the shard that uses less memory")
+	}
+	if len(acquired) != 1 {
+		t.Fatal("The target instance was not asked to acquire the shard handed off")
+	}
+	if req := <-acquired; req.GroupID != "g3" || req.ShardID != shardID {
+		t.Error("The target instance was asked to acquire another shard:", req.GroupID, req.ShardID, "expected:", shardID)
+	}
+	if err := mg.storeRecords("g3", func() {}); err != ErrShardNotAvailable {
+		t.Error("The shard handed off can store records, Error:", err)
+	}
+	if !shardsModel.GetGroupByID("g1").IsThisInstanceOwner() || !shardsModel.GetGroupByID("g2").IsThisInstanceOwner() {
+		t.Error("Only a shard can be handed off on each rebalance")
+	}
+
+	// The shards are moved one by one
+	delete(mg.acquiredShards, "g3")
+	mg.rebalance()
+	if !shardsModel.GetGroupByID("g2").IsThisInstanceOwner() {
+		t.Error("A shard was handed off before cRebalanceInterval")
+	}
+	mg.lastRebalance = time.Now().Add(-cRebalanceInterval)
+	mg.rebalance()
+	if shardsModel.GetGroupByID("g2").IsThisInstanceOwner() || shards["g2"].backups != 1 {
+		t.Error("Expected the hand off of the shard of the group g2")
+	}
+
+	// The difference of a single shard is not rebalanced
+	delete(mg.acquiredShards, "g2")
+	mg.lastRebalance = time.Now().Add(-cRebalanceInterval)
+	shardsModel.GetGroupByID("g3").ShardsByAddr[remoteHost] = &shardinfo.Shard{Addr: remoteHost}
+	mg.rebalance()
+	if !shardsModel.GetGroupByID("g1").IsThisInstanceOwner() || shards["g1"].backups != 0 {
+		t.Error("The shard was handed off with a difference of a single shard")
+	}
+	if len(mg.handedOff) != 2 {
+		t.Error("Expected two shards handed off, obtained:", mg.handedOff)
+	}
+}
+
+func TestAcquireHandedOff(t *testing.T) {
+	groupsTable, shardsTable, changesTable := storage.NewMemTable(), storage.NewMemTable(), storage.NewMemTable()
+	sourceModel := shardinfo.NewModelForHost(groupsTable, shardsTable, changesTable, "admin@test.com", "source")
+	group, _, err := sourceModel.AddUpdateGroup("s", "user@test.com", "group", 8, 1000, 100, 100, 5)
+	if err != nil {
+		t.Fatal("Problem creating the group, Error:", err)
+	}
+	if acquired, err := group.AcquireShard(); !acquired {
+		t.Fatal("Problem acquiring the shard of the group, Error:", err)
+	}
+	shardID, _, _ := group.LocalOwnership()
+
+	shardsModel := shardinfo.NewModelForHost(groupsTable, shardsTable, changesTable, "admin@test.com", "target")
+	shard := &loadingShard{
+		fakeShard: newFakeShard(),
+		load:      make(chan struct{}),
+		status:    recommender.StatusStarting,
+	}
+	close(shard.load)
+	mg := &Manager{
+		hostName:       "target",
+		active:         true,
+		shardsModel:    shardsModel,
+		instancesModel: &fakeInstances{total: 2, bids: map[string]instances.Bid{"target": {HostName: "target", FreeMem: 1 << 30, BytesByElem: 1 << 10}}},
+		usersModel:     users.NewModel(storage.NewMemTable()),
+		acquiredShards: make(map[string]recommender.Int),
+		reqSecStats:    make(map[string]*statsReqSec),
+		handedOff:      make(map[string]time.Time),
+		scheduler:      newRebuildScheduler(1),
+		newShard: func(s3Path, identifier string, maxClassif uint64, maxScore uint8, s3Region string) recommender.Int {
+			return shard
+		},
+	}
+
+	if mg.acquireHandedOff("group", shardID) {
+		t.Fatal("The shard was acquired before the hand off")
+	}
+
+	// The release of the shard is not received before the acquisition, and
+	// the shard handed off is acquired instead of the other free shards
+	group.ReleaseShard()
+	if !mg.acquireHandedOff("group", shardID) {
+		t.Fatal("The shard handed off was not acquired")
+	}
+	defer shardsModel.GetGroupByID("group").ReleaseShard()
+	if _, local := mg.getAcquiredShard("group"); !local || !shardsModel.GetGroupByID("group").IsThisInstanceOwner() {
+		t.Error("The shard handed off was not registered")
+	}
+	if acquiredID, _, _ := shardsModel.GetGroupByID("group").LocalOwnership(); acquiredID != shardID {
+		t.Error("Acquired the shard:", acquiredID, "instead of the shard handed off:", shardID)
+	}
+	if mg.acquireHandedOff("group", shardID) {
+		t.Error("The shard was acquired twice")
+	}
+}
@@ -0,0 +1,154 @@
+package shardsmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/ratelimit"
+	"github.com/alonsovidales/pit/recommender"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// batchGroups Shards model that only knows a single group
+type batchGroups struct {
+	shardinfo.ModelInt
+	group *shardinfo.GroupInfo
+}
+
+func (bg *batchGroups) GetGroupByUserKeyID(userID, key, groupID string) (*shardinfo.GroupInfo, error) {
+	if userID != bg.group.UserID || key != bg.group.Secret || groupID != bg.group.GroupID {
+		return nil, errors.New("Invalid key")
+	}
+
+	return bg.group, nil
+}
+
+// batchShard Active shard that stores the records and always recommends the
+// item 1
+type batchShard struct {
+	recommender.Int
+	records map[uint64]map[uint64]uint8
+}
+
+func (bs *batchShard) GetStatus() string {
+	return recommender.StatusActive
+}
+
+func (bs *batchShard) CalcScores(recID uint64, scores map[uint64]uint8, maxToReturn int) []uint64 {
+	bs.records[recID] = scores
+
+	return []uint64{1}
+}
+
+func (bs *batchShard) GetStoredElements() uint64 {
+	return uint64(len(bs.records))
+}
+
+// recBatchRequest Returns a request for the /rec_batch endpoint with the given
+// records as JSON
+func recBatchRequest(key, recs string) *http.Request {
+	r := httptest.NewRequest("POST", CRecBatchPath, strings.NewReader(url.Values{
+		"uid":   {"user@test.com"},
+		"key":   {key},
+		"group": {"batch"},
+		"recs":  {recs},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return r
+}
+
+func TestRecBatchAPIHandler(t *testing.T) {
+	group := &shardinfo.GroupInfo{
+		UserID:    "user@test.com",
+		Secret:    "key",
+		GroupID:   "batch",
+		NumShards: 1,
+		MaxReqSec: 5,
+	}
+	rec := &batchShard{records: make(map[uint64]map[uint64]uint8)}
+	mg := &Manager{
+		active:         true,
+		shardsModel:    &batchGroups{group: group},
+		instancesModel: &fakeInstances{total: 1},
+		limiter:        ratelimit.New(),
+		demand:         newDemandMeter(),
+		acquiredShards: map[string]recommender.Int{group.GroupID: rec},
+		reqSecStats:    map[string]*statsReqSec{group.GroupID: {}},
+	}
+
+	w := httptest.NewRecorder()
+	mg.RecBatchAPIHandler(w, recBatchRequest("bad_key", `[]`))
+	if w.Code != 401 {
+		t.Error("Expected unauthorized response for an invalid key, obtained:", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mg.RecBatchAPIHandler(w, recBatchRequest("key", `[{"id": 1,`))
+	if w.Code != 400 {
+		t.Error("Expected bad request for a malformed batch, obtained:", w.Code)
+	}
+
+	tooBig := make([]*RecBatchReq, cMaxRecBatchSize+1)
+	for i := range tooBig {
+		tooBig[i] = &RecBatchReq{ID: uint64(i), Scores: map[string]uint8{"1": 1}}
+	}
+	tooBigJSON, _ := json.Marshal(tooBig)
+	w = httptest.NewRecorder()
+	mg.RecBatchAPIHandler(w, recBatchRequest("key", string(tooBigJSON)))
+	if w.Code != 400 || w.Body.String() != ErrBatchTooBig.Error() {
+		t.Error("Expected batch too big error, obtained:", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	mg.RecBatchAPIHandler(w, recBatchRequest("key", `[
+		{"id": 1, "scores": {"10": 5}, "max_recs": 2},
+		{"id": 2, "scores": {"20": 3}, "max_recs": 2},
+		{"id": 3, "scores": {"30": 1}, "max_recs": 2}
+	]`))
+	response := &RecBatchResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), response); w.Code != 200 || err != nil || !response.Success || len(response.Recs) != 3 {
+		t.Fatal("Unexpected batch response:", w.Code, w.Body.String(), "Error:", err)
+	}
+	for i, result := range response.Recs {
+		if result.ID != uint64(i+1) || !result.Success || !reflect.DeepEqual(result.Recs, []uint64{1}) {
+			t.Error("Unexpected result for record:", i+1, result)
+		}
+	}
+	// Each record of the batch counts as a query, the burst of the group
+	// is of cBurstSecs * 5 queries
+	if rec.GetStoredElements() != 3 || response.ReqsSec != 3 || w.Header().Get(CRateLimitRemainingHeader) != "7" {
+		t.Error("Unexpected stored records, queries or remaining quota:", rec.GetStoredElements(), response.ReqsSec, w.Header().Get(CRateLimitRemainingHeader))
+	}
+
+	// A record with invalid scores rejects the whole batch without store
+	// any of the records
+	w = httptest.NewRecorder()
+	mg.RecBatchAPIHandler(w, recBatchRequest("key", `[
+		{"id": 4, "scores": {"10": 5}},
+		{"id": 5, "scores": {"item": 3}}
+	]`))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "Error on record 5") {
+		t.Error("Expected error on the record with invalid scores, obtained:", w.Code, w.Body.String())
+	}
+	if rec.GetStoredElements() != 3 {
+		t.Error("The records of a rejected batch were stored:", rec.GetStoredElements())
+	}
+
+	// The rejected batch doesn't consume quota, so seven queries remain
+	w = httptest.NewRecorder()
+	mg.RecBatchAPIHandler(w, recBatchRequest("key", `[{"id": 4}, {"id": 5}, {"id": 6}, {"id": 7}, {"id": 8}, {"id": 9}, {"id": 10}]`))
+	if w.Code != 200 || w.Header().Get(CRateLimitRemainingHeader) != "0" {
+		t.Error("Unexpected response consuming the remaining quota:", w.Code, w.Header())
+	}
+	w = httptest.NewRecorder()
+	mg.RecBatchAPIHandler(w, recBatchRequest("key", `[{"id": 11}, {"id": 12}, {"id": 13}, {"id": 14}, {"id": 15}]`))
+	if w.Code != 429 || w.Header().Get(CRetryAfterHeader) != "1" {
+		t.Error("Expected too many requests response, obtained:", w.Code, w.Header())
+	}
+}
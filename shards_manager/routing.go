@@ -0,0 +1,236 @@
+package shardsmanager
+
+import (
+	"context"
+	"github.com/alonsovidales/pit/cluster"
+	"github.com/alonsovidales/pit/log"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/recommender"
+	"strings"
+	"time"
+)
+
+const (
+	// cMigrationRetryPeriod Time to wait before try again to hand off the
+	// records that couldn't be moved to the shard that owns them
+	cMigrationRetryPeriod = 10 * time.Second
+	// cMigrationBatchSize Max number of records handed off to an instance
+	// on a single call
+	cMigrationBatchSize = 500
+)
+
+// getRecordShard Returns the local shard of the group in case of be ready to
+// attend requests for the record, on groups with hash routing the local shard
+// has to be the owner of the record
+func (mg *Manager) getRecordShard(group *shardinfo.GroupInfo, recID uint64) (rec recommender.Int, stats *statsReqSec, err error) {
+	if group.HashRouting() && !group.IsRecordOwner(recID) {
+		return nil, nil, ErrShardNotAvailable
+	}
+
+	return mg.getLocalShard(group.GroupID)
+}
+
+// getRecordHost Returns the address of the instance where the request for the
+// record has to be forwarded, on groups with hash routing this is the owner of
+// the shard of the record, in other case any instance not visited yet
+func (mg *Manager) getRecordHost(group *shardinfo.GroupInfo, recID uint64, visited string) (addr string, hostsVisited string, found bool) {
+	if !group.HashRouting() {
+		return mg.getForwardHost(group, visited)
+	}
+
+	visitedHosts := append(strings.Split(visited, ","), mg.localHost())
+	hostsVisited = strings.Join(visitedHosts, ",")
+	addr, found = group.RecordOwner(recID)
+	for _, host := range visitedHosts {
+		if host == addr {
+			return "", "", false
+		}
+	}
+
+	return
+}
+
+// recommendRoutedBatch Returns the recommendations for a batch of records on
+// a group with hash routing, the records owned by the local shard are
+// calculated locally and the rest are requested to the owners of their shards
+func (mg *Manager) recommendRoutedBatch(ctx context.Context, group *shardinfo.GroupInfo, batch []*RecBatchReq) (*RecBatchResponse, error) {
+	localBatch := []*RecBatchReq{}
+	localPos := []int{}
+	remoteBatches := make(map[string][]*RecBatchReq)
+	remotePos := make(map[string][]int)
+	results := make([]*RecBatchResult, len(batch))
+	visited := cluster.HostsVisited(ctx)
+	for i, recReq := range batch {
+		if group.IsRecordOwner(recReq.ID) {
+			localBatch = append(localBatch, recReq)
+			localPos = append(localPos, i)
+			continue
+		}
+
+		if addr, _, found := mg.getRecordHost(group, recReq.ID, visited); found {
+			remoteBatches[addr] = append(remoteBatches[addr], recReq)
+			remotePos[addr] = append(remotePos[addr], i)
+		} else {
+			results[i] = &RecBatchResult{ID: recReq.ID, Recs: []uint64{}}
+		}
+	}
+
+	response := &RecBatchResponse{
+		Success: true,
+		Recs:    results,
+	}
+	if len(localBatch) > 0 {
+		localResp, err := mg.recommendLocalBatch(group, localBatch)
+		if err != nil {
+			return nil, err
+		}
+		for i, pos := range localPos {
+			results[pos] = localResp.Recs[i]
+		}
+		response.StoredElements = localResp.StoredElements
+		response.ReqsSec = localResp.ReqsSec
+	}
+
+	for addr, remoteBatch := range remoteBatches {
+		remoteResults := mg.remoteRecBatch(ctx, addr, group, remoteBatch)
+		for i, pos := range remotePos[addr] {
+			if i < len(remoteResults) && remoteResults[i] != nil {
+				results[pos] = remoteResults[i]
+			} else {
+				results[pos] = &RecBatchResult{ID: batch[pos].ID, Recs: []uint64{}}
+			}
+		}
+	}
+
+	return response, nil
+}
+
+// remoteRecBatch Requests the recommendations for a batch of records to
+// another instance, the records are returned as failed in case of error
+func (mg *Manager) remoteRecBatch(ctx context.Context, addr string, group *shardinfo.GroupInfo, batch []*RecBatchReq) (results []*RecBatchResult) {
+	hostsVisited := strings.Join(append(strings.Split(cluster.HostsVisited(ctx), ","), mg.localHost()), ",")
+	remoteResp := &RecBatchResponse{}
+	err := mg.rpc.Call(cluster.WithHostsVisited(ctx, hostsVisited), addr, cMethodRecBatch, &internalRecBatchReq{
+		internalReq: internalReq{GroupID: group.GroupID},
+		Recs:        batch,
+	}, remoteResp)
+	if err != nil {
+		log.Error("Problem requesting batch recommendations to instance:", addr, "Request:", cluster.RequestID(ctx), "Error:", err)
+		return
+	}
+
+	return remoteResp.Recs
+}
+
+// migrateRecords Hands off the records of the local shard that are not owned
+// by it to the instances that owns their shards in batches of up to
+// cMigrationBatchSize records by instance, the records are removed from the
+// local shard after be accepted by the owner. Returns the number of records
+// that couldn't be moved
+func (mg *Manager) migrateRecords(group *shardinfo.GroupInfo, rec recommender.Int) (pending int) {
+	moved := 0
+	batches := make(map[string][]*internalRecord)
+	handOff := func(addr string) {
+		batch := batches[addr]
+		delete(batches, addr)
+		stored := mg.handOffRecords(addr, group, batch)
+		for _, recID := range stored {
+			rec.RemoveRecord(recID)
+		}
+		moved += len(stored)
+		pending += len(batch) - len(stored)
+	}
+
+	for _, recID := range rec.GetRecordIDs() {
+		if group.IsRecordOwner(recID) {
+			continue
+		}
+
+		addr, found := group.RecordOwner(recID)
+		scores, ok := rec.GetRecord(recID)
+		if !ok {
+			continue
+		}
+		if !found || addr == mg.localHost() {
+			pending++
+			continue
+		}
+
+		batches[addr] = append(batches[addr], &internalRecord{ID: recID, Scores: scores})
+		if len(batches[addr]) >= cMigrationBatchSize {
+			handOff(addr)
+		}
+	}
+	for addr := range batches {
+		handOff(addr)
+	}
+
+	if moved > 0 || pending > 0 {
+		log.Info("Records migrated on group:", group.GroupID, "Moved:", moved, "Pending:", pending)
+	}
+
+	return
+}
+
+// handOffRecords Stores the scores of the records on the given instance,
+// returns the IDs of the records accepted by the instance
+func (mg *Manager) handOffRecords(addr string, group *shardinfo.GroupInfo, records []*internalRecord) []uint64 {
+	ctx := cluster.WithHostsVisited(cluster.WithRequestID(context.Background(), cluster.NewRequestID()), mg.localHost())
+	resp := &internalMigrateResp{}
+	err := mg.rpc.Call(ctx, addr, cMethodMigrate, &internalMigrateReq{
+		internalReq: internalReq{GroupID: group.GroupID},
+		Recs:        records,
+	}, resp)
+	if err != nil {
+		log.Error("Can't hand off:", len(records), "records to instance:", addr, "Request:", cluster.RequestID(ctx), "Error:", err)
+		return nil
+	}
+
+	return resp.Stored
+}
+
+// storeMigratedRecords Stores on the local shard of the group the records
+// handed off by another shard, see migrateRecords, and returns the IDs of the
+// records stored. The records that can't be stored locally are not forwarded
+func (mg *Manager) storeMigratedRecords(group *shardinfo.GroupInfo, records []*internalRecord) *internalMigrateResp {
+	resp := &internalMigrateResp{Stored: []uint64{}}
+	for _, record := range records {
+		if _, err := mg.insert(group, record.ID, record.Scores); err == nil {
+			resp.Stored = append(resp.Stored, record.ID)
+		}
+	}
+
+	return resp
+}
+
+// keepRoutedRecords Moves the records that are not owned by the local shard to
+// their owners each time the number of shards of the group changes, the
+// migration is retried each cMigrationRetryPeriod until all the records are
+// moved. The records are moved until stop is closed, done is closed after that
+func (mg *Manager) keepRoutedRecords(groupID string, rec recommender.Int, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	migratedShards := 0
+	lastMigration := time.Time{}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		group := mg.shardsModel.GetGroupByID(groupID)
+		if group == nil || !group.HashRouting() || migratedShards == group.NumShards || time.Since(lastMigration) < cMigrationRetryPeriod {
+			continue
+		}
+
+		lastMigration = time.Now()
+		if mg.migrateRecords(group, rec) > 0 {
+			migratedShards = -1
+		} else {
+			migratedShards = group.NumShards
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package shardsmanager
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alonsovidales/pit/cluster"
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/models/storage"
+	"github.com/alonsovidales/pit/recommender"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestRecordShard(t *testing.T) {
+	const records = 10000
+	before := &shardinfo.GroupInfo{NumShards: 4}
+	after := &shardinfo.GroupInfo{NumShards: 5}
+
+	byShard := make(map[int]int)
+	moved := 0
+	for recID := uint64(0); recID < records; recID++ {
+		shard := before.RecordShard(recID)
+		if shard != before.RecordShard(recID) {
+			t.Fatal("The shard of the record:", recID, "is not stable")
+		}
+		byShard[shard]++
+
+		if newShard := after.RecordShard(recID); newShard != shard {
+			if newShard != 4 {
+				t.Fatal("The record:", recID, "was moved between existing shards:", shard, "->", newShard)
+			}
+			moved++
+		}
+	}
+
+	// Only the records assigned to the new shard are moved, around 1/5
+	if moved < records/5-records/50 || moved > records/5+records/50 {
+		t.Error("Unexpected number of moved records:", moved)
+	}
+	for shard, recs := range byShard {
+		if recs < records/4-records/40 || recs > records/4+records/40 {
+			t.Error("Unbalanced shard:", shard, "Records:", recs)
+		}
+	}
+}
+
+func TestRecordOwnerConcurrency(t *testing.T) {
+	shardsModel := shardinfo.NewModel(storage.NewMemTable(), storage.NewMemTable(), "admin@test.com")
+	group, _, err := shardsModel.AddUpdateGroup("s", "user@test.com", "routed", 2, 1000, 100, 100, 5)
+	if err != nil {
+		t.Fatal("Problem creating the group, Error:", err)
+	}
+	if err = group.SetRouting(shardinfo.CRoutingHash); err != nil {
+		t.Fatal("Problem setting the routing of the group, Error:", err)
+	}
+
+	// The owners of the records are obtained while the shard is acquired
+	// and released, the race detector reports the unsafe accesses
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			group.AcquireShard()
+			group.ReleaseShard()
+		}
+	}()
+	for recID := uint64(0); ; recID++ {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		addr, owned := group.RecordOwner(recID)
+		if group.IsRecordOwner(recID) && addr != instances.GetHostName() && owned {
+			t.Fatal("Unexpected owner of the record:", recID, addr)
+		}
+	}
+}
+
+func TestMigrateRecords(t *testing.T) {
+	var mutex sync.Mutex
+	accept := false
+	calls := 0
+	handedOff := make(map[uint64]*internalRecord)
+	ownerServer := cluster.NewServer("secret")
+	ownerServer.Handle(cMethodMigrate, func(ctx context.Context, body []byte) (interface{}, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls++
+		if !accept {
+			return nil, internalError(ErrTooManyRequests)
+		}
+		req := &internalMigrateReq{}
+		if err := json.Unmarshal(body, req); err != nil || req.GroupID != "routed" {
+			return nil, err
+		}
+		resp := &internalMigrateResp{}
+		for _, record := range req.Recs {
+			handedOff[record.ID] = record
+			resp.Stored = append(resp.Stored, record.ID)
+		}
+
+		return resp, nil
+	})
+	owner := httptest.NewServer(ownerServer)
+	defer owner.Close()
+	ownerURL, _ := url.Parse(owner.URL)
+	port, _ := strconv.Atoi(ownerURL.Port())
+
+	localShard := &shardinfo.Shard{Addr: instances.GetHostName(), ShardID: 0}
+	remoteShard := &shardinfo.Shard{Addr: ownerURL.Hostname(), ShardID: 1}
+	group := &shardinfo.GroupInfo{
+		UserID:    "user@test.com",
+		Secret:    "group_key",
+		GroupID:   "routed",
+		NumShards: 2,
+		Routing:   shardinfo.CRoutingHash,
+		Shards:    map[int]*shardinfo.Shard{0: localShard, 1: remoteShard},
+		ShardsByAddr: map[string]*shardinfo.Shard{
+			localShard.Addr:  localShard,
+			remoteShard.Addr: remoteShard,
+		},
+	}
+
+	rec := recommender.NewShard("/testing", "test_migrate_records", 1000, 5, "eu-west-1")
+	defer rec.Stop()
+	mg := &Manager{
+		rpc:            cluster.NewClient(port, "secret", cluster.CDefaultTimeout),
+		acquiredShards: map[string]recommender.Int{group.GroupID: rec},
+	}
+
+	remote := 0
+	for recID := uint64(0); recID < 100; recID++ {
+		rec.AddRecord(recID, map[uint64]uint8{recID: 3})
+		if !group.IsRecordOwner(recID) {
+			remote++
+		}
+	}
+	if remote == 0 || remote == 100 {
+		t.Fatal("The records have to be distributed across the shards, remote records:", remote)
+	}
+
+	// The records are kept while the owner rejects them
+	if pending := mg.migrateRecords(group, rec); pending != remote || len(rec.GetRecordIDs()) != 100 {
+		t.Error("Expected", remote, "pending records, obtained:", pending, "Stored records:", len(rec.GetRecordIDs()))
+	}
+
+	mutex.Lock()
+	accept = true
+	mutex.Unlock()
+	if pending := mg.migrateRecords(group, rec); pending != 0 {
+		t.Error("Expected no pending records, obtained:", pending)
+	}
+	if len(handedOff) != remote || len(rec.GetRecordIDs()) != 100-remote {
+		t.Error("Expected", remote, "handed off records, obtained:", len(handedOff), "Stored records:", len(rec.GetRecordIDs()))
+	}
+	// The records are handed off on a single batch by instance
+	if calls != 2 {
+		t.Error("Expected a call by migration to the owner, obtained:", calls)
+	}
+	for recID, record := range handedOff {
+		if group.IsRecordOwner(recID) {
+			t.Error("The record:", recID, "is owned by the local shard and was handed off")
+		}
+		if len(record.Scores) != 1 || record.Scores[recID] != 3 {
+			t.Error("Unexpected hand off of record:", recID, "Record:", record)
+		}
+		if _, _, err := mg.getRecordShard(group, recID); err != ErrShardNotAvailable {
+			t.Error("The record:", recID, "is owned by another shard and can be accessed locally")
+		}
+	}
+
+	// The records that are not owned by the local shard are forwarded
+	for recID := uint64(0); recID < 100; recID++ {
+		addr, _, found := mg.getRecordHost(group, recID, "")
+		if group.IsRecordOwner(recID) {
+			if found {
+				t.Error("The record:", recID, "is owned by the local shard and was forwarded to:", addr)
+			}
+		} else if !found || addr != remoteShard.Addr {
+			t.Error("The record:", recID, "has to be forwarded to the owner, obtained:", addr)
+		}
+	}
+}
+
+func TestStoreMigratedRecords(t *testing.T) {
+	localShard := &shardinfo.Shard{Addr: instances.GetHostName(), ShardID: 0}
+	remoteShard := &shardinfo.Shard{Addr: "remote", ShardID: 1}
+	group := &shardinfo.GroupInfo{
+		GroupID:   "routed",
+		NumShards: 2,
+		Routing:   shardinfo.CRoutingHash,
+		Shards:    map[int]*shardinfo.Shard{0: localShard, 1: remoteShard},
+		ShardsByAddr: map[string]*shardinfo.Shard{
+			localShard.Addr:  localShard,
+			remoteShard.Addr: remoteShard,
+		},
+	}
+	shard := newFakeShard()
+	mg := &Manager{
+		acquiredShards: map[string]recommender.Int{group.GroupID: shard},
+		reqSecStats:    map[string]*statsReqSec{group.GroupID: {}},
+	}
+
+	records := []*internalRecord{}
+	owned := 0
+	for recID := uint64(0); recID < 20; recID++ {
+		records = append(records, &internalRecord{ID: recID, Scores: map[uint64]uint8{recID: 3}})
+		if group.IsRecordOwner(recID) {
+			owned++
+		}
+	}
+
+	// Only the records owned by the local shard are stored
+	resp := mg.storeMigratedRecords(group, records)
+	if len(resp.Stored) != owned || shard.GetStoredElements() != uint64(owned) {
+		t.Error("Expected", owned, "stored records, obtained:", resp.Stored, "Stored on the shard:", shard.GetStoredElements())
+	}
+	for _, recID := range resp.Stored {
+		if !group.IsRecordOwner(recID) {
+			t.Error("The record:", recID, "is not owned by the local shard and was stored")
+		}
+	}
+}
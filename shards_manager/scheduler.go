@@ -0,0 +1,209 @@
+package shardsmanager
+
+import (
+	"github.com/alonsovidales/pit/recommender"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// cRebuildInterval Min time between two calculations of the tree of a
+	// shard, the backup of the shard is stored after each calculation
+	cRebuildInterval = 30 * time.Second
+	// cRebuildCheckInterval Time that an idle worker waits before check
+	// again the shards that have to be calculated
+	cRebuildCheckInterval = time.Second
+	// cDefaultCPUBudgetPct Percentage of the CPUs of the instance that can
+	// be used to calculate the trees if cpu-budget-pct is not configured
+	cDefaultCPUBudgetPct = 50
+	// cSaturatedLoad Load by CPU from which the instance is considered
+	// saturated, only one tree is calculated at a time meanwhile so the
+	// requests can still be attended
+	cSaturatedLoad = 1.0
+)
+
+// rebuildCandidate Shard whose tree has to be calculated, and its priority
+type rebuildCandidate struct {
+	rec      recommender.Int
+	priority float64
+	// starting The first tree of the shard was not calculated yet, the
+	// shard can't attend requests until then
+	starting bool
+	// recovering An operation of the shard failed and its backoff expired,
+	// the backoff takes the place of cRebuildInterval, see Recover
+	recovering bool
+}
+
+// rebuildScheduler Assigns the shards whose trees have to be calculated to a
+// pool of workers, the shards that didn't calculate their first tree yet go
+// first, and then the shards with more records modified since the last
+// calculation and more traffic. Each shard is calculated by a single worker at
+// a time, and at most once each cRebuildInterval after its first tree. The
+// shards that failed are recovered by the workers once their backoff expires
+type rebuildScheduler struct {
+	// workers Number of workers, that is the max number of trees
+	// calculated concurrently
+	workers int
+	// running Shards being calculated by a worker
+	running map[recommender.Int]bool
+	// lastRun Time when the shards were calculated during the last
+	// cRebuildInterval
+	lastRun map[recommender.Int]time.Time
+	mutex   sync.Mutex
+}
+
+// newRebuildScheduler Returns a scheduler for the given number of workers, see
+// rebuildWorkers
+func newRebuildScheduler(workers int) *rebuildScheduler {
+	return &rebuildScheduler{
+		workers: workers,
+		running: make(map[recommender.Int]bool),
+		lastRun: make(map[recommender.Int]time.Time),
+	}
+}
+
+// rebuildWorkers Returns the number of trees that can be calculated
+// concurrently using the given percentage of the CPUs, each tree is calculated
+// by a single goroutine. At least one tree is calculated at a time
+func rebuildWorkers(budgetPct int64, cpus int) int {
+	if budgetPct <= 0 {
+		budgetPct = cDefaultCPUBudgetPct
+	}
+	workers := int(int64(cpus) * budgetPct / 100)
+	switch {
+	case workers < 1:
+		return 1
+	case workers > cpus:
+		return cpus
+	}
+
+	return workers
+}
+
+// rebuildPriority Returns the priority of a shard with the given number of
+// records modified since its last calculation and queries received during the
+// last minute, the traffic increases the priority logarithmically so the
+// changes prevail
+func rebuildPriority(pendingChanges, queries uint64) float64 {
+	return float64(pendingChanges) * (1 + math.Log2(1+float64(queries)))
+}
+
+// next Returns the candidate with the highest priority that is not being
+// calculated and was not calculated during the last cRebuildInterval, unless
+// it is starting or recovering, nil if there is no one or if the worker has to wait because
+// the instance is saturated. The shard has to be returned by done after
+// calculate it
+func (sc *rebuildScheduler) next(worker int, candidates []*rebuildCandidate, load float64) recommender.Int {
+	if worker > 0 && load >= cSaturatedLoad {
+		return nil
+	}
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	for rec, lastRun := range sc.lastRun {
+		if time.Since(lastRun) >= cRebuildInterval {
+			delete(sc.lastRun, rec)
+		}
+	}
+
+	var best *rebuildCandidate
+	for _, candidate := range candidates {
+		if _, recent := sc.lastRun[candidate.rec]; (recent && !candidate.starting && !candidate.recovering) || sc.running[candidate.rec] {
+			continue
+		}
+		if best == nil || (candidate.starting && !best.starting) ||
+			(candidate.starting == best.starting && candidate.priority > best.priority) {
+			best = candidate
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	sc.running[best.rec] = true
+
+	return best.rec
+}
+
+// done Registers the end of the calculation of the shard
+func (sc *rebuildScheduler) done(rec recommender.Int) {
+	sc.mutex.Lock()
+	delete(sc.running, rec)
+	sc.lastRun[rec] = time.Now()
+	sc.mutex.Unlock()
+}
+
+// loading Prevents the workers from calculating the tree of the shard while
+// its backup is being loaded, until loaded is called
+func (sc *rebuildScheduler) loading(rec recommender.Int) {
+	sc.mutex.Lock()
+	sc.running[rec] = true
+	sc.mutex.Unlock()
+}
+
+// loaded Allows the workers to calculate the tree of the shard after load its
+// backup
+func (sc *rebuildScheduler) loaded(rec recommender.Int) {
+	sc.mutex.Lock()
+	delete(sc.running, rec)
+	sc.mutex.Unlock()
+}
+
+// rebuildCandidates Returns the acquired shards whose trees have to be
+// calculated or that have to be recovered with their priorities, the shards are
+// not calculated while their backups are being loaded, during the backoff of
+// the operation that failed, or after fail. The shards that can't attend
+// requests until recover go first with the starting ones
+func (mg *Manager) rebuildCandidates() (candidates []*rebuildCandidate) {
+	mg.mutex.RLock()
+	shards := make(map[recommender.Int]*statsReqSec, len(mg.acquiredShards))
+	for groupID, rec := range mg.acquiredShards {
+		shards[rec] = mg.reqSecStats[groupID]
+	}
+	mg.mutex.RUnlock()
+
+	now := time.Now()
+	for rec, stats := range shards {
+		status := rec.GetStatus()
+		nextRecovery := rec.NextRecovery()
+		recovering := !nextRecovery.IsZero()
+		switch {
+		case status == recommender.StatusLoading || status == recommender.StatusFailed:
+			continue
+		case recovering && now.Before(nextRecovery):
+			continue
+		case !recovering && !rec.IsDirty():
+			continue
+		}
+		candidates = append(candidates, &rebuildCandidate{
+			rec:        rec,
+			priority:   rebuildPriority(rec.GetPendingChanges(), stats.lastMinuteQueries()),
+			starting:   status == recommender.StatusStarting || status == recommender.StatusRecovering,
+			recovering: recovering,
+		})
+	}
+
+	return
+}
+
+// rebuildWorker Calculates the trees of the shards assigned by the scheduler,
+// or recovers them if an operation failed, and stores their backups after
+// finish
+func (mg *Manager) rebuildWorker(worker int) {
+	for {
+		rec := mg.scheduler.next(worker, mg.rebuildCandidates(), mg.load())
+		if rec == nil {
+			time.Sleep(cRebuildCheckInterval)
+			continue
+		}
+
+		if rec.NextRecovery().IsZero() {
+			rec.RecalculateTree()
+		} else {
+			rec.Recover()
+		}
+		rec.SaveBackup()
+		mg.scheduler.done(rec)
+	}
+}
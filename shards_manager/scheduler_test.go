@@ -0,0 +1,159 @@
+package shardsmanager
+
+import (
+	"github.com/alonsovidales/pit/recommender"
+	"testing"
+	"time"
+)
+
+// dirtyShard Recommender that only reports its status, the records modified
+// since the last calculation of its tree and when it can be recovered
+type dirtyShard struct {
+	recommender.Int
+
+	pending      uint64
+	status       string
+	nextRecovery time.Time
+}
+
+func (ds *dirtyShard) GetStatus() string {
+	return ds.status
+}
+
+func (ds *dirtyShard) IsDirty() bool {
+	return ds.pending > 0
+}
+
+func (ds *dirtyShard) GetPendingChanges() uint64 {
+	return ds.pending
+}
+
+func (ds *dirtyShard) NextRecovery() time.Time {
+	return ds.nextRecovery
+}
+
+func TestRebuildWorkers(t *testing.T) {
+	cases := []struct {
+		budgetPct int64
+		cpus      int
+		workers   int
+	}{
+		{50, 8, 4},
+		{0, 8, 4},
+		{10, 2, 1},
+		{200, 4, 4},
+		{100, 1, 1},
+	}
+
+	for _, c := range cases {
+		if workers := rebuildWorkers(c.budgetPct, c.cpus); workers != c.workers {
+			t.Error("Unexpected number of workers for budget:", c.budgetPct, "CPUs:", c.cpus, "workers:", workers, "expected:", c.workers)
+		}
+	}
+}
+
+func TestRebuildCandidates(t *testing.T) {
+	busy := &statsReqSec{BySecStats: []uint64{100, 100}}
+	idle := &statsReqSec{BySecStats: []uint64{}}
+	mg := &Manager{
+		acquiredShards: map[string]recommender.Int{
+			"busy":     &dirtyShard{pending: 10, status: recommender.StatusActive},
+			"idle":     &dirtyShard{pending: 10, status: recommender.StatusActive},
+			"clean":    &dirtyShard{status: recommender.StatusActive},
+			"loading":  &dirtyShard{pending: 10, status: recommender.StatusLoading},
+			"starting": &dirtyShard{pending: 10, status: recommender.StatusStarting},
+			// The shards that failed are recovered after their backoff
+			"recovering": &dirtyShard{status: recommender.StatusRecovering, nextRecovery: time.Now().Add(-time.Second)},
+			"degraded":   &dirtyShard{pending: 10, status: recommender.StatusDegraded, nextRecovery: time.Now().Add(time.Minute)},
+			"failed":     &dirtyShard{pending: 10, status: recommender.StatusFailed, nextRecovery: time.Now().Add(-time.Second)},
+		},
+		reqSecStats: map[string]*statsReqSec{
+			"busy":       busy,
+			"idle":       idle,
+			"clean":      idle,
+			"loading":    idle,
+			"starting":   idle,
+			"recovering": idle,
+			"degraded":   idle,
+			"failed":     idle,
+		},
+	}
+
+	priorities := make(map[recommender.Int]float64)
+	for _, candidate := range mg.rebuildCandidates() {
+		priorities[candidate.rec] = candidate.priority
+		recovering := candidate.rec == mg.acquiredShards["recovering"]
+		if candidate.starting != (candidate.rec == mg.acquiredShards["starting"] || recovering) {
+			t.Error("Only the shards that can't attend requests are starting, candidate:", candidate.rec)
+		}
+		if candidate.recovering != recovering {
+			t.Error("Only the shard whose backoff expired is recovering, candidate:", candidate.rec)
+		}
+	}
+	if len(priorities) != 4 {
+		t.Fatal("Only the dirty shards that are not loading and the shards to be recovered have to be calculated, candidates:", priorities)
+	}
+	if priorities[mg.acquiredShards["busy"]] <= priorities[mg.acquiredShards["idle"]] {
+		t.Error("The traffic didn't increase the priority of the shard:", priorities)
+	}
+	if rebuildPriority(100, 0) <= rebuildPriority(10, 60) {
+		t.Error("The traffic prevails over the modified records")
+	}
+}
+
+func TestRebuildScheduler(t *testing.T) {
+	low := &dirtyShard{pending: 1}
+	high := &dirtyShard{pending: 100}
+	candidates := []*rebuildCandidate{
+		{rec: low, priority: rebuildPriority(low.pending, 0)},
+		{rec: high, priority: rebuildPriority(high.pending, 0)},
+	}
+	sc := newRebuildScheduler(2)
+
+	// The shard with the highest priority goes first, and the shards being
+	// calculated are not assigned to other workers
+	if rec := sc.next(0, candidates, 0); rec != high {
+		t.Error("The shard with the highest priority was not returned first:", rec)
+	}
+	if rec := sc.next(1, candidates, 0); rec != low {
+		t.Error("The shard with the lowest priority was not returned:", rec)
+	}
+	if rec := sc.next(0, candidates, 0); rec != nil {
+		t.Error("A shard being calculated was returned again:", rec)
+	}
+
+	// The shards are not calculated again before cRebuildInterval
+	sc.done(high)
+	if rec := sc.next(0, candidates, 0); rec != nil {
+		t.Error("A shard was calculated again before cRebuildInterval:", rec)
+	}
+	sc.mutex.Lock()
+	sc.lastRun[high] = time.Now().Add(-cRebuildInterval)
+	sc.mutex.Unlock()
+
+	// Only the first worker calculates trees while the instance is saturated
+	if rec := sc.next(1, candidates, cSaturatedLoad); rec != nil {
+		t.Error("A shard was returned to a secondary worker under load:", rec)
+	}
+	if rec := sc.next(0, candidates, cSaturatedLoad); rec != high {
+		t.Error("The first worker didn't obtain the shard under load:", rec)
+	}
+
+	// The shards without tree go first, even after a recent calculation
+	starting := &dirtyShard{pending: 1}
+	sc.done(high)
+	sc.done(starting)
+	candidates = append(candidates, &rebuildCandidate{rec: starting, priority: rebuildPriority(starting.pending, 0), starting: true})
+	if rec := sc.next(0, candidates, 0); rec != starting {
+		t.Error("The shard without tree was not returned first:", rec)
+	}
+
+	// The backoff of the shards that failed replaces cRebuildInterval
+	recovering := &dirtyShard{}
+	sc.done(starting)
+	sc.done(recovering)
+	candidates = []*rebuildCandidate{{rec: recovering, recovering: true}}
+	if rec := sc.next(0, candidates, 0); rec != recovering {
+		t.Error("The shard to be recovered was not returned:", rec)
+	}
+}
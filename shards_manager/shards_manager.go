@@ -1,19 +1,22 @@
 package shardsmanager
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/alonsovidales/pit/cfg"
+	"github.com/alonsovidales/pit/cluster"
 	"github.com/alonsovidales/pit/log"
 	"github.com/alonsovidales/pit/models/instances"
 	"github.com/alonsovidales/pit/models/shard_info"
 	"github.com/alonsovidales/pit/models/users"
+	"github.com/alonsovidales/pit/ratelimit"
 	"github.com/alonsovidales/pit/recommender"
 	"github.com/nu7hatch/gouuid"
-	"io/ioutil"
 	"net/http"
-	"net/url"
 	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,6 +30,9 @@ const (
 	// CRecPath Path that will provide the recommendations based on a list
 	// of items
 	CRecPath = "/rec"
+	// CRecBatchPath Path that will provide the recommendations for a list
+	// of records on a single request
+	CRecBatchPath = "/rec_batch"
 	// CGroupInfoPath Endpoint that returns information from all the shards
 	// that composes the group, status, elements stored, etc
 	CGroupInfoPath = "/info"
@@ -52,30 +58,114 @@ const (
 
 	// cMaxMinsToStore Max time in minutes to keep the metrics in memory
 	cMaxMinsToStore = 1440 // A day
+	// cMaxRecBatchSize Max number of records that can be sent on a single
+	// batch request
+	cMaxRecBatchSize = 1000
+
+	// cProvisioningMsg Message returned when there is no shard ready to
+	// attend a request
+	cProvisioningMsg = "The server is provisioning the recomender system, the shard will be available soon, please be patient"
 )
 
+// ErrTooManyRequests The number of requests / sec on the group is bigger than
+// its limit
+var ErrTooManyRequests = errors.New("Too Many Requests")
+
+// ErrShardNotAvailable There is no shard of the group ready to attend the
+// request on the local instance
+var ErrShardNotAvailable = errors.New("The shard is not available on this instance")
+
+// ErrUnauthorized The user credentials are not valid
+var ErrUnauthorized = errors.New("Unauthorized")
+
+// ErrGroupTypeRequired The specified group type is not valid
+var ErrGroupTypeRequired = errors.New("Group type required")
+
+// ErrBatchTooBig The number of records on a batch is bigger than the allowed
+var ErrBatchTooBig = fmt.Errorf("The max number of records by batch is: %d", cMaxRecBatchSize)
+
 // Manager Structure that provides HTTP access to manage all the different
 // groups and shards on each grorup
 type Manager struct {
-	awsRegion      string
-	s3BackupsPath  string
-	port           int
+	// hostName Host name of the instance, the one of the machine if it is
+	// empty
+	hostName      string
+	awsRegion     string
+	s3BackupsPath string
+	rpc           *cluster.Client
+	limiter       *ratelimit.Limiter
+	// demand Requests / sec received by the instance for each rate limit
+	// key, published on the bid to share the limits of the groups
+	demand         *demandMeter
 	active         bool
 	finished       bool
 	acquiredShards map[string]recommender.Int
+	reqSecStats    map[string]*statsReqSec
+	// mutex Protects the acquired shards, their statistics and the status
+	// of the manager, that are accessed by the requests and the background
+	// tasks
+	mutex sync.RWMutex
+	// frozen Groups whose shard doesn't store new records since it is
+	// being handed off, see freezeWrites, protected by mutex
+	frozen map[string]bool
+	// writesMutex Held for reading while the records are stored on the
+	// shards, see storeRecords
+	writesMutex sync.RWMutex
 
 	shardsModel    shardinfo.ModelInt
 	instancesModel instances.ModelInt
-	reqSecStats    map[string]*statsReqSec
 	usersModel     users.ModelInt
+
+	// memStatus Returns the memory usage of the instance
+	memStatus func() memStatus
+	// load Returns the CPU load of the instance
+	load func() float64
+	// zone Availability zone of the instance, used to place the shards of
+	// each group on different zones
+	zone string
+	// lastPressureRelease Last time that a shard was released because of
+	// memory pressure, only accessed by the manage loop
+	lastPressureRelease time.Time
+	// lastRebalance Last time that a shard was handed off to rebalance the
+	// cluster by request of this instance as leader, only accessed by the
+	// manage loop
+	lastRebalance time.Time
+	// handedOff Time when the shards were handed off by group ID, the
+	// shards are handed off by request of the leader
+	handedOff    map[string]time.Time
+	handOffMutex sync.Mutex
+	// acquireMutex Serializes the acquisitions of shards by the manage
+	// loop and the acquisitions of the shards handed off to the instance
+	acquireMutex sync.Mutex
+	// listBackups Returns the groups with a backup stored and the time when
+	// each backup was stored
+	listBackups func(s3Path, s3Region string) (map[string]time.Time, error)
+	// destroyBackup Removes the backup of a group
+	destroyBackup func(s3Path, identifier, s3Region string) bool
+	// lastBackupsCleanup Last time that the orphaned backups were removed
+	// by this instance as leader, only accessed by the manage loop
+	lastBackupsCleanup time.Time
+	// lastChangesPrune Last time that the old changes of the groups were
+	// removed by this instance as leader, only accessed by the manage loop
+	lastChangesPrune time.Time
+	// scheduler Assigns the shards whose trees have to be calculated to
+	// the workers, see recalculateRecs
+	scheduler *rebuildScheduler
+	// newShard Returns a new shard of a group, see recommender.NewShard
+	newShard func(s3Path, identifier string, maxClassif uint64, maxScore uint8, s3Region string) recommender.Int
 }
 
-// statsReqSec Statistics for a shard
+// statsReqSec Statistics for a shard, the statistics are updated under the
+// mutex, use snapshot in order to obtain a copy that can be accessed without
+// it
 type statsReqSec struct {
 	// StoredElements Number of stored elements on this shard
 	StoredElements uint64 `json:"stored_elements"`
 	// RecTreeStatus Current status of the recommender tree
 	RecTreeStatus string `json:"rec_tree_status"`
+	// RecTreeError Error that caused the current status of the shard, empty
+	// if the shard is healthy
+	RecTreeError string `json:"rec_tree_error,omitempty"`
 	// BySecStats Number of queries per second
 	BySecStats []uint64 `json:"queries_by_sec"`
 	// ByMinStats Number of queries per minute
@@ -83,24 +173,85 @@ type statsReqSec struct {
 	queries    uint64
 	inserts    uint64
 	mutex      sync.Mutex
-	stop       bool
+	done       chan struct{}
+}
+
+// RecBatchReq Recommendation request for a single record inside a batch
+type RecBatchReq struct {
+	// ID Record identifier
+	ID uint64 `json:"id"`
+	// Scores Scores by item ID of the record
+	Scores map[string]uint8 `json:"scores"`
+	// MaxRecs Max number of recommendations to be returned for this record
+	MaxRecs int `json:"max_recs"`
+}
+
+// RecBatchResult Recommendations returned for a single record of a batch
+type RecBatchResult struct {
+	// ID Record identifier
+	ID uint64 `json:"id"`
+	// Success Indicates if recommendations could be calculated for this
+	// record
+	Success bool `json:"success"`
+	// Recs Recommended items IDs
+	Recs []uint64 `json:"recs"`
+	// Fallback Indicates that the recommended items are the most popular
+	// ones, since the shard couldn't calculate the recommendations yet
+	Fallback bool `json:"fallback,omitempty"`
 }
 
 // Init Initializes and returns the Manager for a group, this method also
-// launches the monitorization process in background
+// launches the monitorization process in background. The port is the one where
+// all the instances attend the internal calls of the cluster
 func Init(prefix, awsRegion, s3BackupsPath string, port int, usersModel users.ModelInt, adminEmail string) (mg *Manager) {
+	return New(
+		shardinfo.GetModel(prefix, awsRegion, adminEmail),
+		instances.InitAndKeepAlive(prefix, awsRegion, true),
+		usersModel,
+		awsRegion,
+		s3BackupsPath,
+		port)
+}
+
+// New Returns a Manager that uses the given models and launches the
+// monitorization process in background, the requests that can't be attended
+// locally are forwarded to the other instances using the internal calls of the
+// cluster on the given port
+func New(shardsModel shardinfo.ModelInt, instancesModel instances.ModelInt, usersModel users.ModelInt, awsRegion, s3BackupsPath string, port int) (mg *Manager) {
+	if cluster.Secret() == "" {
+		log.Error("The requests can't be forwarded to other instances, Error:", cluster.ErrNoSecret)
+	}
+
+	return NewWithClient(shardsModel, instancesModel, usersModel, awsRegion, s3BackupsPath, cluster.NewClient(port, cluster.Secret(), cluster.CDefaultTimeout))
+}
+
+// NewWithClient Returns a Manager as New that forwards the requests to the
+// other instances using the given client, the instance is identified by the
+// host name of the instances model
+func NewWithClient(shardsModel shardinfo.ModelInt, instancesModel instances.ModelInt, usersModel users.ModelInt, awsRegion, s3BackupsPath string, rpc *cluster.Client) (mg *Manager) {
 	mg = &Manager{
+		hostName:      instancesModel.HostName(),
 		s3BackupsPath: s3BackupsPath,
-		port:          port,
+		rpc:           rpc,
+		limiter:       ratelimit.New(),
+		demand:        newDemandMeter(),
 		active:        true,
 		finished:      false,
 		reqSecStats:   make(map[string]*statsReqSec),
 
-		shardsModel:    shardinfo.GetModel(prefix, awsRegion, adminEmail),
-		instancesModel: instances.InitAndKeepAlive(prefix, awsRegion, true),
+		shardsModel:    shardsModel,
+		instancesModel: instancesModel,
 		awsRegion:      awsRegion,
 		acquiredShards: make(map[string]recommender.Int),
 		usersModel:     usersModel,
+		memStatus:      readMemStatus,
+		load:           readLoad,
+		handedOff:      make(map[string]time.Time),
+		listBackups:    recommender.ListBackups,
+		destroyBackup:  recommender.DestroyBackup,
+		zone:           cfg.GetStr("aws", "zone"),
+		scheduler:      newRebuildScheduler(rebuildWorkers(cfg.GetInt("rebuild", "cpu-budget-pct"), runtime.NumCPU())),
+		newShard:       newRecommender,
 	}
 
 	go mg.manage()
@@ -108,34 +259,139 @@ func Init(prefix, awsRegion, s3BackupsPath string, port int, usersModel users.Mo
 	return
 }
 
-// Stop deactivates a group, and stops all the management tasks
+// localHost Returns the host name of the instance
+func (mg *Manager) localHost() string {
+	if mg.hostName == "" {
+		return instances.GetHostName()
+	}
+
+	return mg.hostName
+}
+
+// Stop deactivates a group, and stops all the management tasks, the acquired
+// shards are kept until they are handed off by Drain
 func (mg *Manager) Stop() {
+	mg.mutex.Lock()
 	mg.active = false
+	mg.mutex.Unlock()
 }
 
 // IsFinished Returs if the manager has finish the adquisition of shards for
 // this group or not
 func (mg *Manager) IsFinished() bool {
+	mg.mutex.RLock()
+	defer mg.mutex.RUnlock()
+
 	return mg.finished
 }
 
+// isActive Returns if the manager has to keep acquiring shards
+func (mg *Manager) isActive() bool {
+	mg.mutex.RLock()
+	defer mg.mutex.RUnlock()
+
+	return mg.active
+}
+
+// newRecommender Returns a new shard of a group, see recommender.NewShard
+func newRecommender(s3Path, identifier string, maxClassif uint64, maxScore uint8, s3Region string) recommender.Int {
+	return recommender.NewShard(s3Path, identifier, maxClassif, maxScore, s3Region)
+}
+
 // acquiredShard After determine that is possible to acquire a shard on this
 // local machine, this method is requested to set up the shard and all the
-// monitorizaion processes
+// monitorizaion processes. The shard is registered before load its backup, so
+// it can answer with the most popular items of the records loaded so far, the
+// backup is loaded in background and the loaded records are processed by the
+// rebuild workers, the shard can't attend requests until the first tree is
+// calculated
 func (mg *Manager) acquiredShard(group *shardinfo.GroupInfo) {
-	rec := recommender.NewShard(mg.s3BackupsPath, group.GroupID, group.MaxElements, group.MaxScore, mg.awsRegion)
-	rec.LoadBackup()
-	mg.reqSecStats[group.GroupID] = &statsReqSec{
+	rec := mg.newShard(mg.s3BackupsPath, group.GroupID, group.MaxElements, group.MaxScore, mg.awsRegion)
+	if shardID, epoch, ok := group.LocalOwnership(); ok {
+		rec.SetFence(shardID, epoch, mg.fence(group.GroupID, epoch))
+	}
+	mg.scheduler.loading(rec)
+	mg.addAcquiredShard(group.GroupID, rec)
+
+	go mg.keepUpdateGroup(group.GetUserID(), group.GroupID)
+	go func() {
+		rec.LoadBackup()
+		mg.scheduler.loaded(rec)
+		log.Info("Finished acquisition of shard on group:", group.GroupID)
+	}()
+}
+
+// fence Returns a function that checks if the shard of the group acquired with
+// the given ownership epoch is still owned by this instance, the backups of the
+// shard are not stored after lose the ownership
+func (mg *Manager) fence(groupID string, epoch uint64) func() error {
+	return func() error {
+		gr := mg.shardsModel.GetGroupByID(groupID)
+		if gr == nil {
+			return shardinfo.ErrGroupNotFound
+		}
+
+		return gr.CheckEpoch(epoch)
+	}
+}
+
+// addAcquiredShard Registers the shard of the group allocated on this
+// instance, after this call the shard can attend requests
+func (mg *Manager) addAcquiredShard(groupID string, rec recommender.Int) {
+	stats := &statsReqSec{
 		BySecStats: []uint64{},
 		ByMinStats: []uint64{},
-		queries:    0,
-		inserts:    0,
+		done:       make(chan struct{}),
 	}
-	go mg.reqSecStats[group.GroupID].monitorStats()
-	mg.acquiredShards[group.GroupID] = rec
+	go stats.monitorStats()
 
-	go mg.keepUpdateGroup(group.GetUserID(), group.GroupID)
-	log.Info("Finished acquisition of shard on group:", group.GroupID)
+	mg.mutex.Lock()
+	mg.acquiredShards[groupID] = rec
+	mg.reqSecStats[groupID] = stats
+	mg.mutex.Unlock()
+}
+
+// releaseAcquiredShard Unregisters the shard of the group allocated on this
+// instance and stops the monitorization of its statistics, the shard is
+// returned in order to be stopped by the caller
+func (mg *Manager) releaseAcquiredShard(groupID string) (rec recommender.Int) {
+	mg.mutex.Lock()
+	rec = mg.acquiredShards[groupID]
+	stats := mg.reqSecStats[groupID]
+	delete(mg.acquiredShards, groupID)
+	delete(mg.reqSecStats, groupID)
+	delete(mg.frozen, groupID)
+	mg.mutex.Unlock()
+
+	if stats != nil {
+		close(stats.done)
+	}
+
+	return
+}
+
+// getAcquiredShard Returns the shard of the group allocated on this instance
+// independently of its status
+func (mg *Manager) getAcquiredShard(groupID string) (rec recommender.Int, ok bool) {
+	mg.mutex.RLock()
+	defer mg.mutex.RUnlock()
+
+	rec, ok = mg.acquiredShards[groupID]
+
+	return
+}
+
+// getAcquiredShards Returns all the shards allocated on this instance
+func (mg *Manager) getAcquiredShards() (shards []recommender.Int) {
+	mg.mutex.RLock()
+	defer mg.mutex.RUnlock()
+
+	shards = make([]recommender.Int, 0, len(mg.acquiredShards))
+	for _, rec := range mg.acquiredShards {
+		shards = append(shards, rec)
+	}
+
+	return
 }
 
 // recalculateBillingForUser Recalculates a bill for the given user based in
@@ -161,104 +417,640 @@ func (mg *Manager) recalculateBillingForUser(userID string) {
 // keepUpdateGroup updates each second the status of the shard on S3 and keeps
 // it adquired for the local machine
 func (mg *Manager) keepUpdateGroup(uid, groupID string) {
+	rec, ok := mg.getAcquiredShard(groupID)
+	if !ok {
+		return
+	}
+
+	// The records of the groups routed by hash are moved in background,
+	// since the migration can take longer than the ownership of the shard
+	stopMigration, migrationDone := make(chan struct{}), make(chan struct{})
+	go mg.keepRoutedRecords(groupID, rec, stopMigration, migrationDone)
 	for {
 		gr := mg.shardsModel.GetGroupByID(groupID)
 		if gr == nil || !gr.IsThisInstanceOwner() {
-			mg.acquiredShards[groupID].Stop()
-			delete(mg.acquiredShards, groupID)
-			mg.reqSecStats[groupID].stop = true
-			delete(mg.reqSecStats, groupID)
+			close(stopMigration)
+			<-migrationDone
+			if gr != nil && gr.HashRouting() {
+				// Hand off the records to the shards that
+				// remains on the group before release the shard
+				mg.migrateRecords(gr, rec)
+			}
+			mg.releaseAcquiredShard(groupID)
+			rec.Stop()
 			log.Info("Shard released on group:", groupID)
 			mg.recalculateBillingForUser(uid)
 
 			return
 		}
 
-		mg.acquiredShards[groupID].SetMaxElements(gr.MaxElements)
-		mg.acquiredShards[groupID].SetMaxScore(gr.MaxScore)
+		// The shards that failed are recovered by the rebuild workers,
+		// see rebuildCandidates
+		if rec.GetStatus() == recommender.StatusFailed {
+			// The shard is stopped on the next iterations, once the
+			// group doesn't list this instance as owner, the release
+			// is retried after wait in case of it couldn't be stored
+			mg.releaseFailedShard(gr, rec)
+		} else {
+			rec.SetMaxElements(gr.MaxElements)
+			rec.SetMaxScore(gr.MaxScore)
+		}
 
 		time.Sleep(time.Second)
 	}
 }
 
-// recalculateRecs Determines is the shard have receive any new data each 30
-// seconds, and in case of have new data launched the reprocesed of the tree
-// and stores the backup after finish
+// releaseFailedShard Releases the shard of the group that couldn't recover, so
+// another instance can acquire it, the local instance doesn't bid for a shard
+// of the group until cHandOffCooldown
+func (mg *Manager) releaseFailedShard(group *shardinfo.GroupInfo, rec recommender.Int) {
+	log.Error("The shard of the group:", group.GroupID, "couldn't recover, releasing it, Error:", rec.GetStatusReason())
+
+	mg.handOffMutex.Lock()
+	mg.handedOff[group.GroupID] = time.Now()
+	mg.handOffMutex.Unlock()
+	group.ReleaseShard()
+}
+
+// recalculateRecs Launches the workers that calculate the trees of the shards
+// that received new data, and store their backups after finish, the number of
+// workers is limited by the cpu-budget-pct configuration. See rebuildScheduler
 func (mg *Manager) recalculateRecs() {
+	for worker := 0; worker < mg.scheduler.workers; worker++ {
+		go mg.rebuildWorker(worker)
+	}
+}
+
+// monitorStats Adds each second the number of queries to the statistics of
+// the shard until the done channel is closed
+func (st *statsReqSec) monitorStats() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	i := 0
 	for {
-		for _, rec := range mg.acquiredShards {
-			if rec.IsDirty() {
-				rec.RecalculateTree()
-				rec.SaveBackup()
+		select {
+		case <-st.done:
+			return
+		case <-ticker.C:
+			i++
+			st.addSecond(i == 60)
+			if i == 60 {
+				i = 0
 			}
 		}
+	}
+}
+
+// addSecond Stores the queries of the last second and resets the counters,
+// the queries of the last minute are stored if closeMinute is true
+func (st *statsReqSec) addSecond(closeMinute bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.BySecStats = append(st.BySecStats, st.queries)
+	if closeMinute {
+		v := uint64(0)
+		for _, q := range st.BySecStats {
+			v += q
+		}
+		st.ByMinStats = append(st.ByMinStats, v)
+		if len(st.ByMinStats) == cMaxMinsToStore {
+			st.ByMinStats = st.ByMinStats[1:]
+		}
+	}
 
-		time.Sleep(time.Second * 30)
+	if len(st.BySecStats) == 61 {
+		st.BySecStats = st.BySecStats[1:]
 	}
+	st.queries = 0
+	st.inserts = 0
 }
 
-func (st *statsReqSec) monitorStats() {
-	c := time.Tick(time.Second)
-	i := 0
-	for _ = range c {
-		st.BySecStats = append(st.BySecStats, st.queries)
-		i++
-		if i == 60 {
-			i = 0
-			v := uint64(0)
-			for _, q := range st.BySecStats {
-				v += q
+// lastMinuteQueries Returns the number of queries received during the last
+// minute
+func (st *statsReqSec) lastMinuteQueries() (queries uint64) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	for _, secQueries := range st.BySecStats {
+		queries += secQueries
+	}
+
+	return
+}
+
+// snapshot Returns a copy of the statistics with the current status of the
+// shard
+func (st *statsReqSec) snapshot(rec recommender.Int) *statsReqSec {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return &statsReqSec{
+		StoredElements: rec.GetStoredElements(),
+		RecTreeStatus:  rec.GetStatus(),
+		RecTreeError:   rec.GetStatusReason(),
+		BySecStats:     append([]uint64{}, st.BySecStats...),
+		ByMinStats:     append([]uint64{}, st.ByMinStats...),
+	}
+}
+
+// RecsResponse Response returned to a recommendations request
+type RecsResponse struct {
+	// Success Indicates if recommendations could be calculated
+	Success bool `json:"success"`
+	// Status Reason why the recommendations couldn't be calculated
+	Status string `json:"status,omitempty"`
+	// StoredElements Current number of elements stored on the shard
+	StoredElements uint64 `json:"stored_elements"`
+	// ReqsSec Current number of queries / sec on the shard
+	ReqsSec uint64 `json:"reqs_sec"`
+	// Recs Recommended items IDs
+	Recs []uint64 `json:"recs"`
+	// Fallback Indicates that the recommended items are the most popular
+	// ones, since the shard couldn't calculate the recommendations yet
+	Fallback bool `json:"fallback,omitempty"`
+	// ShardsQueried Number of shards queried on a fan-out request
+	ShardsQueried int `json:"shards_queried,omitempty"`
+	// ShardsAnswered Number of shards whose rankings were merged on a
+	// fan-out request
+	ShardsAnswered int `json:"shards_answered,omitempty"`
+}
+
+// InsertResponse Response returned after insert the scores of a record
+type InsertResponse struct {
+	// Success Indicates if the record was stored
+	Success bool `json:"success"`
+	// StoredElements Current number of elements stored on the shard
+	StoredElements uint64 `json:"stored_elements"`
+	// ReqsSec Current number of inserts / sec on the shard
+	ReqsSec uint64 `json:"reqs_sec"`
+}
+
+// ScoresResponse Response returned to a request of average scores
+type ScoresResponse struct {
+	// Success Indicates if the scores could be calculated
+	Success bool `json:"success"`
+	// StoredElements Current number of elements stored on the shard
+	StoredElements uint64 `json:"stored_elements"`
+	// ReqsSec Current number of queries / sec on the shard
+	ReqsSec uint64 `json:"reqs_sec"`
+	// Scores Average score by item ID
+	Scores map[string]float64 `json:"scores"`
+	// Fallback Indicates that the scores were calculated from the stored
+	// records, since the shard didn't calculate the tree yet
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// RecBatchResponse Response returned to a batch of recommendations requests
+type RecBatchResponse struct {
+	// Success Indicates if the batch could be processed
+	Success bool `json:"success"`
+	// StoredElements Current number of elements stored on the shard
+	StoredElements uint64 `json:"stored_elements"`
+	// ReqsSec Current number of queries / sec on the shard
+	ReqsSec uint64 `json:"reqs_sec"`
+	// Recs Recommendations by record, in the same order than the requests
+	Recs []*RecBatchResult `json:"recs"`
+}
+
+// getLocalShard Returns the shard of the group allocated on this instance in
+// case of be ready to attend requests, or ErrShardNotAvailable if not
+func (mg *Manager) getLocalShard(groupID string) (rec recommender.Int, stats *statsReqSec, err error) {
+	mg.mutex.RLock()
+	defer mg.mutex.RUnlock()
+
+	rec, local := mg.acquiredShards[groupID]
+	if !local || !canAttendRequests(rec.GetStatus()) {
+		return nil, nil, ErrShardNotAvailable
+	}
+
+	return rec, mg.reqSecStats[groupID], nil
+}
+
+// canAttendRequests Returns if a shard with the given status can attend
+// requests, the degraded shards attend them with the previous tree
+func canAttendRequests(status string) bool {
+	return status == recommender.StatusActive || status == recommender.StatusNoRecords || status == recommender.StatusDegraded
+}
+
+// getFallbackShard Returns the shard of the group allocated on this instance
+// in case of be able to answer with the most popular items while it can't
+// attend requests, any shard that didn't fail can do it with the records
+// loaded so far. Returns ErrShardNotAvailable if not
+func (mg *Manager) getFallbackShard(groupID string) (rec recommender.Int, stats *statsReqSec, err error) {
+	mg.mutex.RLock()
+	defer mg.mutex.RUnlock()
+
+	rec, local := mg.acquiredShards[groupID]
+	if !local || rec.GetStatus() == recommender.StatusFailed {
+		return nil, nil, ErrShardNotAvailable
+	}
+
+	return rec, mg.reqSecStats[groupID], nil
+}
+
+// countRequests Adds n queries or inserts to the statistics of the shard and
+// returns the current number of requests / sec on it, the limits of the group
+// are enforced by takeQuota when the request is received
+func countRequests(stats *statsReqSec, n uint64, insert bool) (reqs uint64) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	if insert {
+		stats.inserts += n
+		return stats.inserts
+	}
+
+	stats.queries += n
+	return stats.queries
+}
+
+// recommend Stores the scores of the record and returns the recommendations
+// for it using the local shard of the group
+func (mg *Manager) recommend(group *shardinfo.GroupInfo, recID uint64, scores map[uint64]uint8, maxRecs int) (*RecsResponse, error) {
+	rec, stats, err := mg.getRecordShard(group, recID)
+	if err != nil {
+		return nil, err
+	}
+
+	var reqs uint64
+	var recommendations []uint64
+	if err = mg.storeRecords(group.GroupID, func() {
+		reqs = countRequests(stats, 1, false)
+		recommendations = rec.CalcScores(recID, scores, maxRecs)
+	}); err != nil {
+		return nil, err
+	}
+	if len(recommendations) == 0 {
+		return popularRecs(rec, scores, maxRecs, reqs), nil
+	}
+
+	return &RecsResponse{
+		Success:        true,
+		StoredElements: rec.GetStoredElements(),
+		ReqsSec:        reqs,
+		Recs:           recommendations,
+	}, nil
+}
+
+// popularRecs Returns the most popular items of the shard not scored by the
+// record, used as fallback while the shard can't calculate the recommendations
+func popularRecs(rec recommender.Int, scores map[uint64]uint8, maxRecs int, reqs uint64) *RecsResponse {
+	recs := rec.PopularItems(scores, maxRecs)
+
+	return &RecsResponse{
+		Success:        len(recs) > 0,
+		Status:         "Adquiring data",
+		StoredElements: rec.GetStoredElements(),
+		ReqsSec:        reqs,
+		Recs:           recs,
+		Fallback:       len(recs) > 0,
+	}
+}
+
+// insert Stores the scores of the record on the local shard of the group
+func (mg *Manager) insert(group *shardinfo.GroupInfo, recID uint64, scores map[uint64]uint8) (*InsertResponse, error) {
+	rec, stats, err := mg.getRecordShard(group, recID)
+	if err != nil {
+		return nil, err
+	}
+
+	var reqs uint64
+	if err = mg.storeRecords(group.GroupID, func() {
+		reqs = countRequests(stats, 1, true)
+		rec.AddRecord(recID, scores)
+	}); err != nil {
+		return nil, err
+	}
+
+	return &InsertResponse{
+		Success:        true,
+		StoredElements: rec.GetStoredElements(),
+		ReqsSec:        reqs,
+	}, nil
+}
+
+// itemScores Returns the average scores for the given items from the local
+// shard of the group, the scores are calculated from the stored records while
+// the shard has no tree
+func (mg *Manager) itemScores(group *shardinfo.GroupInfo, items []uint64) (*ScoresResponse, error) {
+	rec, stats, err := mg.getLocalShard(group.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	if rec.GetStatus() == recommender.StatusNoRecords {
+		return popularScores(rec, stats, items), nil
+	}
+	reqs := countRequests(stats, 1, false)
+
+	scoresToJSON := make(map[string]float64)
+	for k, v := range rec.GetAvgScores(items) {
+		scoresToJSON[fmt.Sprintf("%d", k)] = v
+	}
+
+	return &ScoresResponse{
+		Success:        true,
+		StoredElements: rec.GetStoredElements(),
+		ReqsSec:        reqs,
+		Scores:         scoresToJSON,
+	}, nil
+}
+
+// popularScores Returns the average scores for the given items calculated
+// from the records stored on the shard, used as fallback while the shard has
+// no tree
+func popularScores(rec recommender.Int, stats *statsReqSec, items []uint64) *ScoresResponse {
+	reqs := countRequests(stats, 1, false)
+
+	scoresToJSON := make(map[string]float64)
+	for k, v := range rec.PopularAvgScores(items) {
+		scoresToJSON[fmt.Sprintf("%d", k)] = v
+	}
+
+	return &ScoresResponse{
+		Success:        true,
+		StoredElements: rec.GetStoredElements(),
+		ReqsSec:        reqs,
+		Scores:         scoresToJSON,
+		Fallback:       true,
+	}
+}
+
+// recommendBatch Returns the recommendations for all the records on the batch,
+// each record counts as a query. On groups with hash routing the records not
+// owned by the local shard are requested to the owners of their shards
+func (mg *Manager) recommendBatch(ctx context.Context, group *shardinfo.GroupInfo, batch []*RecBatchReq) (*RecBatchResponse, error) {
+	if len(batch) > cMaxRecBatchSize {
+		return nil, ErrBatchTooBig
+	}
+
+	if group.HashRouting() {
+		return mg.recommendRoutedBatch(ctx, group, batch)
+	}
+
+	return mg.recommendLocalBatch(group, batch)
+}
+
+// recommendLocalBatch Returns the recommendations for all the records on the
+// batch using the local shard of the group
+func (mg *Manager) recommendLocalBatch(group *shardinfo.GroupInfo, batch []*RecBatchReq) (*RecBatchResponse, error) {
+	rec, stats, err := mg.getLocalShard(group.GroupID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse all the records before start counting them as queries in
+	// order to don't count invalid requests
+	scoresByRecord, err := parseBatch(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	var reqs uint64
+	results := make([]*RecBatchResult, len(batch))
+	if err = mg.storeRecords(group.GroupID, func() {
+		reqs = countRequests(stats, uint64(len(batch)), false)
+		for i, recReq := range batch {
+			results[i] = &RecBatchResult{
+				ID:   recReq.ID,
+				Recs: rec.CalcScores(recReq.ID, scoresByRecord[i], recReq.MaxRecs),
 			}
-			st.ByMinStats = append(st.ByMinStats, v)
-			if len(st.ByMinStats) == cMaxMinsToStore {
-				st.ByMinStats = st.ByMinStats[1:]
+			if len(results[i].Recs) == 0 {
+				results[i].Recs = rec.PopularItems(scoresByRecord[i], recReq.MaxRecs)
+				results[i].Fallback = len(results[i].Recs) > 0
 			}
+			results[i].Success = len(results[i].Recs) > 0
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	return &RecBatchResponse{
+		Success:        true,
+		StoredElements: rec.GetStoredElements(),
+		ReqsSec:        reqs,
+		Recs:           results,
+	}, nil
+}
+
+// popularBatch Returns the most popular items of the shard not scored by each
+// record of the batch, used as fallback while the shard can't calculate the
+// recommendations. The records are not stored
+func popularBatch(rec recommender.Int, stats *statsReqSec, batch []*RecBatchReq) (*RecBatchResponse, error) {
+	scoresByRecord, err := parseBatch(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	reqs := countRequests(stats, uint64(len(batch)), false)
+
+	results := make([]*RecBatchResult, len(batch))
+	for i, recReq := range batch {
+		recs := rec.PopularItems(scoresByRecord[i], recReq.MaxRecs)
+		results[i] = &RecBatchResult{
+			ID:       recReq.ID,
+			Success:  len(recs) > 0,
+			Recs:     recs,
+			Fallback: len(recs) > 0,
 		}
+	}
+
+	return &RecBatchResponse{
+		Success:        true,
+		StoredElements: rec.GetStoredElements(),
+		ReqsSec:        reqs,
+		Recs:           results,
+	}, nil
+}
+
+// getGroupStats Returns the statistics of all the shards of the group by host
+// name, in case of remote is true, the statistics are requested to all the
+// other instances that owns a shard of this group
+func (mg *Manager) getGroupStats(ctx context.Context, group *shardinfo.GroupInfo, remote bool) (stats map[string]*statsReqSec) {
+	stats = make(map[string]*statsReqSec)
+	mg.mutex.RLock()
+	rec, local := mg.acquiredShards[group.GroupID]
+	localStats := mg.reqSecStats[group.GroupID]
+	mg.mutex.RUnlock()
+	if local {
+		stats[mg.localHost()] = localStats.snapshot(rec)
+	}
+
+	if !remote {
+		return
+	}
 
-		if len(st.BySecStats) == 61 {
-			st.BySecStats = st.BySecStats[1:]
+	for _, addr := range group.GetOwners() {
+		if addr == mg.localHost() {
+			continue
 		}
-		st.queries = 0
-		st.inserts = 0
 
-		if st.stop {
-			return
+		info, err := mg.remoteGroupStats(ctx, group, addr)
+		if err != nil {
+			log.Error("Can't retreive group information from instance:", addr, "Request:", cluster.RequestID(ctx), "Error:", err)
+			continue
+		}
+		for k, v := range info {
+			stats[k] = v
 		}
 	}
+
+	return
 }
 
-// RemoveShardsContent Used to wipe the content of a shard included the content on the persistance layer
-func (mg *Manager) RemoveShardsContent(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+// getUserGroup Returns the group after check the credentials of the user
+// account and the key of the group
+func (mg *Manager) getUserGroup(uid, uKey, gid, key string) (user *users.User, group *shardinfo.GroupInfo, err error) {
+	if user = mg.usersModel.GetUserInfo(uid, uKey); user == nil {
+		return nil, nil, ErrUnauthorized
+	}
+
+	if group, err = mg.shardsModel.GetGroupByUserKeyID(uid, key, gid); err != nil {
+		return nil, nil, err
+	}
 
-	userID := r.FormValue("u")
-	key := r.FormValue("uk")
-	shardKey := r.FormValue("k")
-	groupID := r.FormValue("g")
+	return
+}
 
-	user := mg.usersModel.GetUserInfo(userID, key)
-	if user == nil {
-		w.WriteHeader(401)
-		w.Write([]byte("Unauthorized"))
-		return
+// addGroup Creates a new group of shards for the user and returns the group ID
+// and the key to access to it
+func (mg *Manager) addGroup(user *users.User, uid, name, groupType, routing string, shards int, maxScore uint8, ip string) (guid, key string, err error) {
+	reqs, records, _ := users.GetGroupInfo(groupType)
+	if reqs == 0 {
+		return "", "", ErrGroupTypeRequired
+	}
+	if routing != "" && routing != shardinfo.CRoutingHash {
+		return "", "", shardinfo.ErrUnknownRouting
 	}
 
-	group, err := mg.shardsModel.GetGroupByUserKeyID(userID, shardKey, groupID)
+	// Sanitize the group ID
+	guid = strings.Replace(name, " ", "-", -1)
+	guid = strings.Replace(guid, "<", "", -1)
+	guid = strings.Replace(guid, ">", "", -1)
+	guid = strings.Replace(guid, "\"", "", -1)
+	guid = strings.Replace(guid, "'", "", -1)
+	guid = strings.Replace(guid, "/", "", -1)
+
+	uuid, _ := uuid.NewV4()
+	guid = guid + ":" + uuid.String()
+	group, key, err := mg.shardsModel.AddUpdateGroup(groupType, uid, guid, shards, records, reqs, reqs*4, maxScore)
 	if err != nil {
-		// User not authorised to access to this shard
-		w.WriteHeader(401)
-		w.Write([]byte(fmt.Sprintf("%s", err)))
+		return "", "", err
+	}
+	if routing != "" {
+		if err = group.SetRouting(routing); err != nil {
+			return "", "", err
+		}
+	}
+
+	user.AddActivityLog(
+		users.CActivityShardsType,
+		fmt.Sprintf("Added new group of type: %s with Shards: %d GUID: %s", groupType, shards, guid),
+		ip)
+	mg.recalculateBillingForUser(uid)
 
+	return
+}
+
+// regenerateGroupKey Creates a new random key for the group
+func (mg *Manager) regenerateGroupKey(user *users.User, group *shardinfo.GroupInfo, ip string) (key string, err error) {
+	if key, err = group.RegenerateKey(); err != nil {
+		return "", err
+	}
+	user.AddActivityLog(users.CActivityShardsType, "Regenerated group key", ip)
+
+	return
+}
+
+// delGroup Removes the group and all the content on the shards
+func (mg *Manager) delGroup(user *users.User, uid string, group *shardinfo.GroupInfo, ip string) (err error) {
+	if err = mg.shardsModel.RemoveGroup(group.GroupID); err != nil {
+		return
+	}
+	user.AddActivityLog(users.CActivityShardsType, fmt.Sprintf("Removed group: %s", group.GroupID), ip)
+	go func() {
+		time.Sleep(10)
+		mg.recalculateBillingForUser(uid)
+	}()
+
+	return
+}
+
+// setShards Updates the number of shards that composes the group
+func (mg *Manager) setShards(user *users.User, uid string, group *shardinfo.GroupInfo, shards int, ip string) (err error) {
+	if err = group.SetNumShards(shards); err != nil {
+		log.Error("Problem trying to store a new number of shards, Error:", err)
 		return
 	}
+
+	user.AddActivityLog(
+		users.CActivityShardsType,
+		fmt.Sprintf("Modified number of shards on group: %s, to: %d", group.GroupID, shards),
+		ip)
+	mg.recalculateBillingForUser(uid)
+
+	return
+}
+
+// removeShardsContent Wipes the content of all the shards of the group
+// included the content on the persistance layer
+func (mg *Manager) removeShardsContent(user *users.User, group *shardinfo.GroupInfo, ip string) bool {
 	result := group.RemoveAllContent(
 		recommender.NewShard(mg.s3BackupsPath, group.GroupID, group.MaxElements, group.MaxScore, mg.awsRegion),
 	)
-	if !result {
+	if result {
+		user.AddActivityLog(users.CActivityShardsType, fmt.Sprintf("Removed all the shards content for group: %s", group.GroupID), ip)
+	}
+
+	return result
+}
+
+// writeV1Error Writes the error as plain text with the corresponding status
+// code, as expected by the clients of the first version of the API
+func writeV1Error(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrTooManyRequests:
+		w.WriteHeader(429)
+	case ErrShardNotAvailable:
+		w.WriteHeader(503)
+		w.Write([]byte(cProvisioningMsg))
+		return
+	case ErrUnauthorized, shardinfo.ErrAuth, shardinfo.ErrGroupNotFound, shardinfo.ErrGroupUserNotFound:
+		w.WriteHeader(401)
+	case ErrGroupTypeRequired, shardinfo.ErrUnknownRouting:
+		w.WriteHeader(422)
+	case ErrBatchTooBig:
+		w.WriteHeader(400)
+	default:
+		w.WriteHeader(500)
+	}
+	w.Write([]byte(fmt.Sprintf("%s", err)))
+}
+
+// writeV1JSON Writes the given response as JSON with a 200 status code
+func writeV1JSON(w http.ResponseWriter, response interface{}) {
+	result, _ := json.Marshal(response)
+	w.WriteHeader(200)
+	w.Write(result)
+}
+
+// RemoveShardsContent Used to wipe the content of a shard included the content on the persistance layer
+func (mg *Manager) RemoveShardsContent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	user, group, err := mg.getUserGroup(r.FormValue("u"), r.FormValue("uk"), r.FormValue("g"), r.FormValue("k"))
+	if err != nil {
+		// User not authorised to access to this shard
+		writeV1Error(w, err)
+		return
+	}
+
+	if !mg.removeShardsContent(user, group, r.RemoteAddr) {
 		w.WriteHeader(500)
 		w.Write([]byte("KO"))
+		return
 	}
-	user.AddActivityLog(users.CActivityShardsType, fmt.Sprintf("Removed all the shards content for group: %s", groupID), r.RemoteAddr)
 	w.WriteHeader(200)
 	w.Write([]byte("OK"))
 }
@@ -280,50 +1072,9 @@ func (mg *Manager) GroupInfoAPIHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := make(map[string]*statsReqSec)
-	if _, ok := mg.reqSecStats[groupID]; ok {
-		mg.reqSecStats[groupID].RecTreeStatus = mg.acquiredShards[groupID].GetStatus()
-		mg.reqSecStats[groupID].StoredElements = mg.acquiredShards[groupID].GetStoredElements()
-		response[instances.GetHostName()] = mg.reqSecStats[groupID]
-	}
-
-	// If this is a direct call, visit all the remaining shards in order to
-	// get the necessary info from them
-	if r.FormValue("fw") == "" {
-		for _, shard := range group.ShardsByAddr {
-			if shard.Addr != instances.GetHostName() {
-				vals := url.Values{
-					"uid":   {userID},
-					"key":   {key},
-					"group": {groupID},
-					"fw":    {"1"},
-				}
-				resp, err := http.PostForm(
-					fmt.Sprintf("http://%s:%d%s", shard.Addr, mg.port, CGroupInfoPath),
-					vals)
-
-				if err != nil {
-					log.Error("Can't retreive group information from instance:", shard.Addr, "Error:", err)
-				} else {
-					defer resp.Body.Close()
-					remoteResp, err := ioutil.ReadAll(resp.Body)
-					info := make(map[string]*statsReqSec)
-					if err = json.Unmarshal([]byte(remoteResp), &info); err == nil {
-						for k, v := range info {
-							response[k] = v
-						}
-					} else {
-						log.Error("Problem trying to get group information from host:", shard.Addr)
-					}
-				}
-			}
-		}
-	}
-
-	respJSON, _ := json.Marshal(response)
-	// User not authorised to access to this shard
-	w.WriteHeader(200)
-	w.Write(respJSON)
+	// Visit all the remaining shards in order to get the necessary info
+	// from them
+	writeV1JSON(w, mg.getGroupStats(requestContext(w, r), group, true))
 }
 
 // AddUpdateGroup Creates a new group of shards, or in case of exists updates
@@ -332,61 +1083,34 @@ func (mg *Manager) AddUpdateGroup(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	uid := r.FormValue("u")
-	uKey := r.FormValue("uk")
-	guid := r.FormValue("guid")
-
-	// Sanitize the group ID
-	guid = strings.Replace(guid, " ", "-", -1)
-	guid = strings.Replace(guid, "<", "", -1)
-	guid = strings.Replace(guid, ">", "", -1)
-	guid = strings.Replace(guid, "\"", "", -1)
-	guid = strings.Replace(guid, "'", "", -1)
-
-	user := mg.usersModel.GetUserInfo(uid, uKey)
+	user := mg.usersModel.GetUserInfo(uid, r.FormValue("uk"))
 	if user == nil {
-		w.WriteHeader(401)
-		w.Write([]byte("Unauthorized"))
-		return
-	}
-
-	groupType := r.FormValue("gt")
-	reqs, records, _ := users.GetGroupInfo(groupType)
-	if reqs == 0 {
-		w.WriteHeader(422)
-		w.Write([]byte("Group type required"))
+		writeV1Error(w, ErrUnauthorized)
 		return
 	}
 
-	shardsStr := r.FormValue("shards")
-	shards, err := strconv.ParseInt(shardsStr, 10, 64)
+	shards, err := strconv.ParseInt(r.FormValue("shards"), 10, 64)
 	if err != nil {
 		w.WriteHeader(422)
 		w.Write([]byte("The param shards is not an integer"))
 		return
 	}
-	maxScoreStr := r.FormValue("maxscore")
-	maxScore, err := strconv.ParseInt(maxScoreStr, 10, 64)
+	maxScore, err := strconv.ParseInt(r.FormValue("maxscore"), 10, 64)
 	if err != nil {
 		w.WriteHeader(422)
 		w.Write([]byte("The param max-score is not an integer"))
 		return
 	}
 
-	uuid, _ := uuid.NewV4()
-	guid = guid + ":" + uuid.String()
-	_, key, err := mg.shardsModel.AddUpdateGroup(groupType, uid, guid, int(shards), records, reqs, reqs*4, uint8(maxScore))
+	_, key, err := mg.addGroup(user, uid, r.FormValue("guid"), r.FormValue("gt"), r.FormValue("routing"), int(shards), uint8(maxScore), r.RemoteAddr)
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(fmt.Sprintf("Error trying to add a new group:", err)))
+		if err != ErrGroupTypeRequired && err != shardinfo.ErrUnknownRouting {
+			err = fmt.Errorf("Error trying to add a new group: %s", err)
+		}
+		writeV1Error(w, err)
 		return
 	}
 
-	user.AddActivityLog(
-		users.CActivityShardsType,
-		fmt.Sprintf("Added new group of type: %s with Shards: %d GUID: %s", groupType, shards, guid),
-		r.RemoteAddr)
-	mg.recalculateBillingForUser(uid)
-
 	w.WriteHeader(200)
 	w.Write([]byte(fmt.Sprintf(`{"success": true, "key": "%s"}`, key)))
 }
@@ -395,31 +1119,20 @@ func (mg *Manager) AddUpdateGroup(w http.ResponseWriter, r *http.Request) {
 func (mg *Manager) RegenerateGroupKey(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	uid := r.FormValue("u")
-	uKey := r.FormValue("uk")
-	gid := r.FormValue("g")
-	key := r.FormValue("k")
-
-	user := mg.usersModel.GetUserInfo(uid, uKey)
-	if user == nil {
-		w.WriteHeader(401)
-		w.Write([]byte("Unauthorized"))
+	user, group, err := mg.getUserGroup(r.FormValue("u"), r.FormValue("uk"), r.FormValue("g"), r.FormValue("k"))
+	if err != nil {
+		writeV1Error(w, ErrUnauthorized)
 		return
 	}
 
-	if group, err := mg.shardsModel.GetGroupByUserKeyID(uid, key, gid); err == nil {
-		if key, err := group.RegenerateKey(); err == nil {
-			user.AddActivityLog(users.CActivityShardsType, "Regenerated group key", r.RemoteAddr)
-			w.WriteHeader(200)
-			w.Write([]byte(key))
-		} else {
-			w.WriteHeader(500)
-			w.Write([]byte("Problem re-generating key"))
-		}
-	} else {
-		w.WriteHeader(401)
-		w.Write([]byte("Unauthorized"))
+	key, err := mg.regenerateGroupKey(user, group, r.RemoteAddr)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("Problem re-generating key"))
+		return
 	}
+	w.WriteHeader(200)
+	w.Write([]byte(key))
 }
 
 // GetGroupsByUser Returns the group registered for a user
@@ -430,15 +1143,11 @@ func (mg *Manager) GetGroupsByUser(w http.ResponseWriter, r *http.Request) {
 	uKey := r.FormValue("uk")
 	user := mg.usersModel.GetUserInfo(uid, uKey)
 	if user == nil {
-		w.WriteHeader(401)
-		w.Write([]byte("Unauthorized"))
+		writeV1Error(w, ErrUnauthorized)
 		return
 	}
 
-	groups := mg.shardsModel.GetAllGroupsByUserID(uid)
-	groupsJSON, _ := json.Marshal(groups)
-	w.WriteHeader(200)
-	w.Write(groupsJSON)
+	writeV1JSON(w, mg.shardsModel.GetAllGroupsByUserID(uid))
 }
 
 // DelGroup removes a group of shards and all the content on the shards
@@ -446,35 +1155,20 @@ func (mg *Manager) DelGroup(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	uid := r.FormValue("u")
-	uKey := r.FormValue("uk")
-	gid := r.FormValue("g")
-	key := r.FormValue("k")
-
-	user := mg.usersModel.GetUserInfo(uid, uKey)
-	if user == nil {
-		w.WriteHeader(401)
-		w.Write([]byte("Unauthorized"))
+	user, group, err := mg.getUserGroup(uid, r.FormValue("uk"), r.FormValue("g"), r.FormValue("k"))
+	if err != nil {
+		writeV1Error(w, ErrUnauthorized)
 		return
 	}
 
-	if _, err := mg.shardsModel.GetGroupByUserKeyID(uid, key, gid); err == nil {
-		if err := mg.shardsModel.RemoveGroup(gid); err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte("Internal Server Error"))
-			return
-		}
-		user.AddActivityLog(users.CActivityShardsType, fmt.Sprintf("Removed group: %s", gid), r.RemoteAddr)
-		go func() {
-			time.Sleep(10)
-			mg.recalculateBillingForUser(uid)
-		}()
-
-		w.WriteHeader(200)
-		w.Write([]byte("OK"))
-	} else {
-		w.WriteHeader(401)
-		w.Write([]byte("Unauthorized"))
+	if err := mg.delGroup(user, uid, group, r.RemoteAddr); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
+		return
 	}
+
+	w.WriteHeader(200)
+	w.Write([]byte("OK"))
 }
 
 // SetShards Updates the number of shards that composes a group
@@ -482,45 +1176,27 @@ func (mg *Manager) SetShards(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	uid := r.FormValue("u")
-	uKey := r.FormValue("uk")
-	gid := r.FormValue("g")
-	key := r.FormValue("k")
-
-	user := mg.usersModel.GetUserInfo(uid, uKey)
-	if user == nil {
-		w.WriteHeader(401)
-		w.Write([]byte("Unauthorized"))
+	user, group, err := mg.getUserGroup(uid, r.FormValue("uk"), r.FormValue("g"), r.FormValue("k"))
+	if err != nil {
+		writeV1Error(w, ErrUnauthorized)
 		return
 	}
 
-	if group, err := mg.shardsModel.GetGroupByUserKeyID(uid, key, gid); err == nil {
-		shards, err := strconv.ParseInt(r.FormValue("s"), 10, 64)
-		if err != nil {
-			w.WriteHeader(422)
-			w.Write([]byte("The number of shards has to be an integer"))
-			return
-		}
-
-		if err := group.SetNumShards(int(shards)); err != nil {
-			log.Error("Problem trying to store a new number of shards, Error:", err)
-			w.WriteHeader(500)
-			w.Write([]byte("Internal Server Error"))
-			return
-		}
-
-		user.AddActivityLog(
-			users.CActivityShardsType,
-			fmt.Sprintf("Modified number of shards on group: %s, to: %d", gid, shards),
-			r.RemoteAddr)
-		mg.recalculateBillingForUser(uid)
+	shards, err := strconv.ParseInt(r.FormValue("s"), 10, 64)
+	if err != nil {
+		w.WriteHeader(422)
+		w.Write([]byte("The number of shards has to be an integer"))
+		return
+	}
 
-		w.WriteHeader(200)
-		w.Write([]byte("OK"))
-	} else {
-		w.WriteHeader(401)
-		w.Write([]byte("Unauthorized"))
+	if err := mg.setShards(user, uid, group, int(shards), r.RemoteAddr); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error"))
 		return
 	}
+
+	w.WriteHeader(200)
+	w.Write([]byte("OK"))
 }
 
 // ScoresAPIHandler Returns the scores for a group of items on a shard, in case
@@ -548,69 +1224,38 @@ func (mg *Manager) ScoresAPIHandler(w http.ResponseWriter, r *http.Request) {
 	maxRecs := r.FormValue("max_recs")
 	justAdd := r.FormValue("insert") != ""
 
-	rec, local := mg.acquiredShards[group.GroupID]
-	if local && (rec.GetStatus() == recommender.StatusActive || rec.GetStatus() == recommender.StatusNoRecords) {
-		mg.reqSecStats[group.GroupID].mutex.Lock()
-		if justAdd {
-			mg.reqSecStats[group.GroupID].inserts++
-		} else {
-			mg.reqSecStats[group.GroupID].queries++
-		}
-		mg.reqSecStats[group.GroupID].mutex.Unlock()
-		if (!justAdd && mg.reqSecStats[group.GroupID].queries > group.MaxReqSec) ||
-			(justAdd && mg.reqSecStats[group.GroupID].inserts > group.MaxInsertReqSec) {
-			w.WriteHeader(429)
-			w.Write([]byte("Too Many Requests"))
+	ctx := requestContext(w, r)
+	var response interface{}
+	if r.URL.Path == CScoresPath {
+		// This is a query for average scores for the elements
+		itemsSlice := []uint64{}
+		if err = json.Unmarshal([]byte(items), &itemsSlice); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("Error: %s", err)))
 
 			return
 		}
 
-		if r.URL.Path == CScoresPath {
-			// This is a query for average scores for the elements
-			itemsSlice := []uint64{}
-			if err = json.Unmarshal([]byte(items), &itemsSlice); err != nil {
-				w.WriteHeader(400)
-				w.Write([]byte(fmt.Sprintf("Error: %s", err)))
-			}
-
-			scores := rec.GetAvgScores(itemsSlice)
-			scoresToJSON := make(map[string]float64)
-			for k, v := range scores {
-				scoresToJSON[fmt.Sprintf("%d", k)] = v
-			}
-
-			result, _ := json.Marshal(scoresToJSON)
-			// User not authorised to access to this shard
-			w.WriteHeader(200)
-			w.Write([]byte(fmt.Sprintf(`{
-				"success": true,
-				"reqs_sec": %d,
-				"stored_elements": %d,
-				"scores": %s
-			}`, mg.reqSecStats[group.GroupID].inserts, rec.GetStoredElements(), string(result))))
-
+		if err = mg.takeQuota(w.Header(), group, 1, false); err != nil {
+			writeV1Error(w, err)
 			return
 		}
-
+		response, err = mg.itemScoresOrForward(ctx, group, itemsSlice)
+	} else {
 		// This is a query for recommendations
 		jsonScores := make(map[string]uint8)
-		scores := make(map[uint64]uint8)
-
 		if err = json.Unmarshal([]byte(elemScores), &jsonScores); err != nil {
 			w.WriteHeader(400)
 			w.Write([]byte(fmt.Sprintf("Error: %s", err)))
 
 			return
 		}
-		for k, v := range jsonScores {
-			if elemID, err := strconv.ParseInt(k, 10, 64); err == nil {
-				scores[uint64(elemID)] = v
-			} else {
-				w.WriteHeader(400)
-				w.Write([]byte(fmt.Sprintf("Error: %s", err)))
+		scores, err := parseScores(jsonScores)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("Error: %s", err)))
 
-				return
-			}
+			return
 		}
 
 		idInt, err := strconv.ParseInt(id, 10, 64)
@@ -622,160 +1267,188 @@ func (mg *Manager) ScoresAPIHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if justAdd {
-			rec.AddRecord(uint64(idInt), scores)
-
-			// User not authorised to access to this shard
-			w.WriteHeader(200)
-			w.Write([]byte(fmt.Sprintf(`{
-				"success": true,
-				"reqs_sec": %d,
-				"stored_elements": %d
-			}`, mg.reqSecStats[group.GroupID].inserts, rec.GetStoredElements())))
-
-			return
-		}
-
-		maxRecsInt, err := strconv.ParseInt(maxRecs, 10, 64)
-		if err != nil {
-			w.WriteHeader(400)
-			w.Write([]byte("The specified value for the record \"max_recs\" has to be an integer"))
-
-			return
-		}
-		recommendations := rec.CalcScores(uint64(idInt), scores, int(maxRecsInt))
-		if len(recommendations) > 0 {
-			result, _ := json.Marshal(recommendations)
-			// User not authorised to access to this shard
-			w.WriteHeader(200)
-			w.Write([]byte(fmt.Sprintf(`{
-				"success": true,
-				"stored_elements": %d,
-				"reqs_sec": %d,
-				"recs": %s
-			}`, rec.GetStoredElements(), mg.reqSecStats[group.GroupID].queries, string(result))))
+			if err = mg.takeQuota(w.Header(), group, 1, true); err != nil {
+				writeV1Error(w, err)
+				return
+			}
+			response, err = mg.insertOrForward(ctx, group, uint64(idInt), scores)
 		} else {
-			w.WriteHeader(200)
-			w.Write([]byte(fmt.Sprintf(`{
-				"success": false,
-				"status": "Adquiring data",
-				"reqs_sec": %d,
-				"stored_elements": %d,
-				"recs": []
-			}`, mg.reqSecStats[group.GroupID].queries, rec.GetStoredElements())))
+			maxRecsInt, err := strconv.ParseInt(maxRecs, 10, 64)
+			if err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte("The specified value for the record \"max_recs\" has to be an integer"))
+
+				return
+			}
+			if err = mg.takeQuota(w.Header(), group, 1, false); err != nil {
+				writeV1Error(w, err)
+				return
+			}
+			if r.FormValue("fanout") != "" {
+				response, err = mg.recommendFanOut(ctx, group, uint64(idInt), scores, int(maxRecsInt))
+			} else {
+				response, err = mg.recommendOrForward(ctx, group, uint64(idInt), scores, int(maxRecsInt))
+			}
 		}
+	}
 
+	if err != nil {
+		writeV1Error(w, err)
 		return
 	}
 
-	log.Debug("Remote API request", group, "Shards:", group.Shards)
-	// TODO Get the results from another instance
-	var shard *shardinfo.Shard
-	var addr string
+	writeV1JSON(w, response)
+}
 
-	hostsVisited := strings.Split(r.FormValue("hosts_visited"), ",")
-	hostsVisited = append(hostsVisited, instances.GetHostName())
+// RecBatchAPIHandler Returns the recommendations for a list of records on a
+// single request, each one of the records counts as a query for the
+// requests/sec limit. In case of the shard is not available on the local
+// machine, the whole batch is propagated to another instance
+func (mg *Manager) RecBatchAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	visitedHostsMap := make(map[string]bool)
-	for _, host := range hostsVisited {
-		visitedHostsMap[host] = true
-	}
+	userID := r.FormValue("uid")
+	key := r.FormValue("key")
+	groupID := r.FormValue("group")
 
-	// Get a random instance with this shard
-	for addr, shard = range group.ShardsByAddr {
-		if _, visited := visitedHostsMap[addr]; !visited {
-			break
-		}
+	group, err := mg.shardsModel.GetGroupByUserKeyID(userID, key, groupID)
+	if err != nil {
+		// User not authorised to access to this shard
+		w.WriteHeader(401)
+		w.Write([]byte(fmt.Sprintf("%s", err)))
+
+		return
 	}
 
-	if shard == nil || addr == instances.GetHostName() {
-		w.WriteHeader(503)
-		w.Write([]byte("The server is provisioning the recomender system, the shard will be available soon, please be patient"))
+	recsJSON := r.FormValue("recs")
+	batch := []*RecBatchReq{}
+	if err = json.Unmarshal([]byte(recsJSON), &batch); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Error: %s", err)))
 
 		return
 	}
 
-	vals := url.Values{
-		"uid":           {userID},
-		"key":           {key},
-		"group":         {groupID},
-		"id":            {id},
-		"scores":        {elemScores},
-		"items":         {items},
-		"hosts_visited": {strings.Join(hostsVisited, ",")},
+	ctx := requestContext(w, r)
+	if len(batch) > cMaxRecBatchSize {
+		writeV1Error(w, ErrBatchTooBig)
+		return
 	}
-	if len(maxRecs) > 0 {
-		vals.Add("max_recs", maxRecs)
+	// The records are validated before take the quota, so an invalid
+	// batch doesn't consume it
+	if _, err = parseBatch(batch); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("%s", err)))
+
+		return
 	}
-	if justAdd {
-		vals.Add("insert", "true")
+	if err = mg.takeQuota(w.Header(), group, len(batch), false); err != nil {
+		writeV1Error(w, err)
+		return
 	}
 
-	resp, err := http.PostForm(
-		fmt.Sprintf("http://%s:%d%s", shard.Addr, mg.port, r.URL.Path),
-		vals)
+	response, err := mg.recommendBatchOrForward(ctx, group, batch)
+	switch err {
+	case nil:
+		writeV1JSON(w, response)
+	case ErrShardNotAvailable, ErrTooManyRequests:
+		writeV1Error(w, err)
+	default:
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("%s", err)))
+	}
+}
 
-	if err != nil {
-		w.WriteHeader(500)
+// getForwardHost Returns the address of an instance that owns a shard of the
+// group and was not visited yet by the request, and the list of visited hosts
+// including the local one
+func (mg *Manager) getForwardHost(group *shardinfo.GroupInfo, visited string) (addr string, hostsVisited string, found bool) {
+	visitedHosts := strings.Split(visited, ",")
+	visitedHosts = append(visitedHosts, mg.localHost())
 
-		return
+	visitedHostsMap := make(map[string]bool)
+	for _, host := range visitedHosts {
+		visitedHostsMap[host] = true
 	}
-	defer resp.Body.Close()
-	responseBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte("Internal server error"))
 
-		return
+	// Get a random instance with this shard
+	for _, addr = range group.GetOwners() {
+		if !visitedHostsMap[addr] {
+			return addr, strings.Join(visitedHosts, ","), true
+		}
 	}
-	w.WriteHeader(resp.StatusCode)
-	w.Write(responseBody)
 
-	log.Debug("API result:", string(responseBody))
+	return "", "", false
 }
 
-// canAcquireNewShard Checks if this machine have enough resources to allocate
-// a shard of the given group
-func (mg *Manager) canAcquireNewShard(group *shardinfo.GroupInfo) bool {
-	maxShardsToAcquire := mg.instancesModel.GetMaxShardsToAcquire(mg.shardsModel.GetTotalNumberOfShards())
-	if maxShardsToAcquire <= len(mg.acquiredShards) {
-		return false
+// parseScores Converts the scores by item ID received as JSON, where the keys
+// are strings, to scores by numeric item ID
+func parseScores(jsonScores map[string]uint8) (scores map[uint64]uint8, err error) {
+	scores = make(map[uint64]uint8)
+	for k, v := range jsonScores {
+		elemID, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		scores[uint64(elemID)] = v
 	}
 
-	totalElems := uint64(0)
-	for _, group := range mg.acquiredShards {
-		totalElems += group.GetTotalElements()
-	}
-	allocableElems := cfg.GetInt("mem", "instance-mem-gb") * cfg.GetInt("mem", "records-by-gb")
+	return
+}
 
-	log.Debug("Max elems to alloc:", allocableElems, "Current elements:", totalElems, "Group Elements:", group.MaxElements)
+// parseBatch Returns the scores of each record of the batch converted by
+// parseScores, or an error that identifies the first invalid record
+func parseBatch(batch []*RecBatchReq) (scoresByRecord []map[uint64]uint8, err error) {
+	scoresByRecord = make([]map[uint64]uint8, len(batch))
+	for i, recReq := range batch {
+		if scoresByRecord[i], err = parseScores(recReq.Scores); err != nil {
+			return nil, fmt.Errorf("Error on record %d: %s", recReq.ID, err)
+		}
+	}
 
-	return uint64(allocableElems) >= totalElems+group.MaxElements
+	return
 }
 
 // manage mintorize the status of the shards, updates bills, etc
 func (mg *Manager) manage() {
 	go mg.recalculateRecs()
 
-	for mg.active {
+	for mg.isActive() {
+		// The memory usage is read once by pass since it stops the
+		// world, the memory of the shards acquired during the pass is
+		// considered by requiredMem
+		status := mg.memStatus()
+		mg.releaseUnderPressure(status)
+		mg.publishBid(status)
+
 		users := make(map[string]bool)
 		for _, groups := range mg.shardsModel.GetAllGroups() {
 			for _, group := range groups {
 				users[group.UserID] = true
-				if mg.canAcquireNewShard(group) {
+				mg.acquireMutex.Lock()
+				// The shard could be handed off to the
+				// instance since the groups were obtained
+				if _, local := mg.getAcquiredShard(group.GroupID); !local && !mg.recentlyHandedOff(group.GroupID) && mg.wonBid(group) {
 					if acquired, err := group.AcquireShard(); acquired && err == nil {
 						mg.acquiredShard(group)
+						// The next bids have to consider the
+						// resources used by the new shard
+						mg.publishBid(status)
 					}
 				}
+				mg.acquireMutex.Unlock()
 			}
 		}
 
-		for usID := range users {
-			mg.recalculateBillingForUser(usID)
+		if mg.instancesModel.IsLeader() {
+			mg.runLeaderTasks(users)
 		}
 
 		time.Sleep(time.Second)
 	}
 
-	mg.shardsModel.ReleaseAllAcquiredShards()
+	// The shards are handed off by Drain
+	mg.mutex.Lock()
 	mg.finished = true
+	mg.mutex.Unlock()
 }
@@ -0,0 +1,447 @@
+package shardsmanager
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/models/storage"
+	"github.com/alonsovidales/pit/models/users"
+	"github.com/alonsovidales/pit/recommender"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeShard Recommender that keeps the records in memory without calculate
+// any tree, safe for concurrent use
+type fakeShard struct {
+	recommender.Int
+
+	records map[uint64]map[uint64]uint8
+	stopped bool
+	mutex   sync.Mutex
+}
+
+func newFakeShard() *fakeShard {
+	return &fakeShard{
+		records: make(map[uint64]map[uint64]uint8),
+	}
+}
+
+func (fs *fakeShard) GetStatus() string {
+	return recommender.StatusActive
+}
+
+func (fs *fakeShard) GetStatusReason() string {
+	return ""
+}
+
+func (fs *fakeShard) Recover() string {
+	return recommender.StatusActive
+}
+
+func (fs *fakeShard) NextRecovery() time.Time {
+	return time.Time{}
+}
+
+func (fs *fakeShard) AddRecord(recID uint64, scores map[uint64]uint8) {
+	fs.mutex.Lock()
+	fs.records[recID] = scores
+	fs.mutex.Unlock()
+}
+
+func (fs *fakeShard) CalcScores(recID uint64, scores map[uint64]uint8, maxToReturn int) []uint64 {
+	fs.AddRecord(recID, scores)
+
+	return fs.GetRecommendations(scores, maxToReturn)
+}
+
+func (fs *fakeShard) GetRecommendations(scores map[uint64]uint8, maxToReturn int) []uint64 {
+	return []uint64{1}
+}
+
+func (fs *fakeShard) GetAvgScores(items []uint64) map[uint64]float64 {
+	return map[uint64]float64{}
+}
+
+func (fs *fakeShard) GetStoredElements() uint64 {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return uint64(len(fs.records))
+}
+
+func (fs *fakeShard) GetTotalElements() uint64 {
+	return 1000
+}
+
+func (fs *fakeShard) Stop() {
+	fs.mutex.Lock()
+	fs.stopped = true
+	fs.mutex.Unlock()
+}
+
+// memShard Recommender that only reports the memory used by its records
+type memShard struct {
+	recommender.Int
+
+	total   uint64
+	stored  uint64
+	memory  uint64
+	backups int
+}
+
+func (ms *memShard) SaveBackup() {
+	ms.backups++
+}
+
+func (ms *memShard) GetTotalElements() uint64 {
+	return ms.total
+}
+
+func (ms *memShard) GetStoredElements() uint64 {
+	return ms.stored
+}
+
+func (ms *memShard) GetMemoryUsage() uint64 {
+	return ms.memory
+}
+
+func TestBytesByClassif(t *testing.T) {
+	shards := []recommender.Int{
+		&memShard{stored: cMinElemsToMeasureMem, memory: 6 * cMinElemsToMeasureMem},
+		&memShard{stored: cMinElemsToMeasureMem, memory: 10 * cMinElemsToMeasureMem},
+	}
+	if bytes := bytesByClassif(shards); bytes != 8 {
+		t.Error("Expected 8 bytes by classification, obtained:", bytes)
+	}
+}
+
+func TestReleaseFailedShard(t *testing.T) {
+	shardsModel := shardinfo.NewModel(storage.NewMemTable(), storage.NewMemTable(), "admin@test.com")
+	group, _, err := shardsModel.AddUpdateGroup("s", "user@test.com", "failed", 1, 1000, 100, 100, 5)
+	if err != nil {
+		t.Fatal("Problem creating the group, Error:", err)
+	}
+	if acquired, err := group.AcquireShard(); !acquired {
+		t.Fatal("Problem acquiring the shard of the group, Error:", err)
+	}
+
+	mg := &Manager{
+		shardsModel: shardsModel,
+		handedOff:   make(map[string]time.Time),
+	}
+	mg.releaseFailedShard(group, newFakeShard())
+	if shardsModel.GetGroupByID("failed").IsThisInstanceOwner() || !mg.recentlyHandedOff("failed") {
+		t.Error("The failed shard was not released, or it could be acquired again by the instance")
+	}
+}
+
+func TestPopularFallback(t *testing.T) {
+	group := &shardinfo.GroupInfo{
+		GroupID:      "popular",
+		NumShards:    1,
+		ShardsByAddr: map[string]*shardinfo.Shard{},
+	}
+	mg := &Manager{
+		active:         true,
+		acquiredShards: make(map[string]recommender.Int),
+		reqSecStats:    make(map[string]*statsReqSec),
+	}
+	rec := recommender.NewShard("/testing", group.GroupID, 1000, 5, "eu-west-1")
+	defer rec.Stop()
+	rec.AddRecord(1, map[uint64]uint8{10: 5, 20: 3})
+	rec.AddRecord(2, map[uint64]uint8{10: 4, 30: 1})
+	mg.addAcquiredShard(group.GroupID, rec)
+	defer mg.releaseAcquiredShard(group.GroupID)
+
+	// The shard is starting and no other instance can attend the requests
+	ctx := context.Background()
+	recs, err := mg.recommendOrForward(ctx, group, 3, map[uint64]uint8{10: 5}, 10)
+	if err != nil || !recs.Success || !recs.Fallback || !reflect.DeepEqual(recs.Recs, []uint64{20, 30}) {
+		t.Error("Unexpected fallback recommendations:", recs, "Error:", err)
+	}
+	if _, ok := rec.GetRecord(3); ok {
+		t.Error("The record was stored by a shard that can't attend requests")
+	}
+	scores, err := mg.itemScoresOrForward(ctx, group, []uint64{10, 30})
+	if err != nil || !scores.Fallback || !reflect.DeepEqual(scores.Scores, map[string]float64{"10": 4.5, "30": 1}) {
+		t.Error("Unexpected fallback scores:", scores, "Error:", err)
+	}
+	batch, err := mg.recommendBatchOrForward(ctx, group, []*RecBatchReq{{ID: 3, Scores: map[string]uint8{"20": 1}, MaxRecs: 1}})
+	if err != nil || len(batch.Recs) != 1 || !batch.Recs[0].Fallback || !reflect.DeepEqual(batch.Recs[0].Recs, []uint64{10}) {
+		t.Error("Unexpected fallback batch:", batch, "Error:", err)
+	}
+
+	// Without enough records to calculate the tree the shard attends the
+	// requests with the popular items
+	rec.RecalculateTree()
+	recs, err = mg.recommend(group, 3, map[uint64]uint8{30: 2}, 1)
+	if err != nil || !recs.Fallback || !reflect.DeepEqual(recs.Recs, []uint64{10}) {
+		t.Error("Unexpected fallback recommendations without records:", recs, "Error:", err)
+	}
+	if _, ok := rec.GetRecord(3); !ok {
+		t.Error("The record was not stored by the shard")
+	}
+	if scores, err = mg.itemScores(group, []uint64{20}); err != nil || !scores.Fallback || scores.Scores["20"] != 3 {
+		t.Error("Unexpected fallback scores without records:", scores, "Error:", err)
+	}
+}
+
+// loadingShard Recommender whose backup is loaded in two parts, the second one
+// after close the load channel, the popular items are the items scored by the
+// loaded records
+type loadingShard struct {
+	*fakeShard
+
+	load   chan struct{}
+	status string
+}
+
+func (ls *loadingShard) SetFence(shardID int, epoch uint64, fence func() error) {}
+
+func (ls *loadingShard) SetMaxElements(maxClassif uint64) {}
+
+func (ls *loadingShard) SetMaxScore(maxScore uint8) {}
+
+func (ls *loadingShard) GetStatus() string {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	return ls.status
+}
+
+func (ls *loadingShard) setStatus(status string) {
+	ls.mutex.Lock()
+	ls.status = status
+	ls.mutex.Unlock()
+}
+
+func (ls *loadingShard) LoadBackup() bool {
+	ls.setStatus(recommender.StatusLoading)
+	ls.AddRecord(1, map[uint64]uint8{10: 5})
+	<-ls.load
+	ls.AddRecord(2, map[uint64]uint8{20: 5})
+	ls.setStatus(recommender.StatusStarting)
+
+	return true
+}
+
+func (ls *loadingShard) PopularItems(exclude map[uint64]uint8, maxToReturn int) (items []uint64) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	items = []uint64{}
+	for _, scores := range ls.records {
+		for item := range scores {
+			if _, excluded := exclude[item]; !excluded {
+				items = append(items, item)
+			}
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i] < items[j] })
+
+	return
+}
+
+func TestAcquiredShardFallback(t *testing.T) {
+	shardsModel := shardinfo.NewModel(storage.NewMemTable(), storage.NewMemTable(), "admin@test.com")
+	group, _, err := shardsModel.AddUpdateGroup("s", "user@test.com", "cold", 1, 1000, 100, 100, 5)
+	if err != nil {
+		t.Fatal("Problem creating the group, Error:", err)
+	}
+	if acquired, err := group.AcquireShard(); !acquired {
+		t.Fatal("Problem acquiring the shard of the group, Error:", err)
+	}
+
+	shard := &loadingShard{
+		fakeShard: newFakeShard(),
+		load:      make(chan struct{}),
+		status:    recommender.StatusStarting,
+	}
+	mg := &Manager{
+		shardsModel:    shardsModel,
+		usersModel:     users.NewModel(storage.NewMemTable()),
+		acquiredShards: make(map[string]recommender.Int),
+		reqSecStats:    make(map[string]*statsReqSec),
+		handedOff:      make(map[string]time.Time),
+		scheduler:      newRebuildScheduler(1),
+		newShard: func(s3Path, identifier string, maxClassif uint64, maxScore uint8, s3Region string) recommender.Int {
+			return shard
+		},
+	}
+	mg.acquiredShard(group)
+	defer group.ReleaseShard()
+
+	waitStatus := func(status string) bool {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if shard.GetStatus() == status {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The shard answers with the records loaded so far while its backup
+	// is being loaded
+	if !waitStatus(recommender.StatusLoading) {
+		t.Fatal("The backup of the shard is not being loaded, status:", shard.GetStatus())
+	}
+	if _, ok := mg.getAcquiredShard("cold"); !ok {
+		t.Fatal("The shard was not registered before load its backup")
+	}
+	if rec := mg.scheduler.next(0, []*rebuildCandidate{{rec: shard, starting: true}}, 0); rec != nil {
+		t.Error("The tree of the shard can be calculated while its backup is being loaded")
+	}
+	ctx := context.Background()
+	recs, err := mg.recommendOrForward(ctx, group, 3, map[uint64]uint8{30: 1}, 10)
+	if err != nil || !recs.Fallback || !reflect.DeepEqual(recs.Recs, []uint64{10}) {
+		t.Error("Unexpected fallback recommendations while loading:", recs, "Error:", err)
+	}
+
+	close(shard.load)
+	if !waitStatus(recommender.StatusStarting) {
+		t.Fatal("The backup of the shard was not loaded, status:", shard.GetStatus())
+	}
+	for deadline := time.Now().Add(5 * time.Second); mg.scheduler.next(0, []*rebuildCandidate{{rec: shard, starting: true}}, 0) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("The tree of the shard can't be calculated after load its backup")
+		}
+	}
+	mg.scheduler.done(shard)
+	recs, err = mg.recommendOrForward(ctx, group, 3, map[uint64]uint8{30: 1}, 10)
+	if err != nil || !recs.Fallback || !reflect.DeepEqual(recs.Recs, []uint64{10, 20}) {
+		t.Error("Unexpected fallback recommendations after load:", recs, "Error:", err)
+	}
+}
+
+func TestStatsReqSec(t *testing.T) {
+	stats := &statsReqSec{BySecStats: []uint64{}, ByMinStats: []uint64{}}
+	rec := newFakeShard()
+	rec.AddRecord(1, map[uint64]uint8{1: 5})
+
+	for i := 1; i <= 61; i++ {
+		if reqs := countRequests(stats, 2, false); reqs != 2 {
+			t.Fatal("Expected 2 queries / sec, obtained:", reqs)
+		}
+		countRequests(stats, 1, true)
+		stats.addSecond(i == 60)
+	}
+
+	snapshot := stats.snapshot(rec)
+	if len(snapshot.BySecStats) != 60 || !reflect.DeepEqual(snapshot.ByMinStats, []uint64{120}) {
+		t.Error("Unexpected statistics:", snapshot.BySecStats, snapshot.ByMinStats)
+	}
+	if snapshot.StoredElements != 1 || snapshot.RecTreeStatus != recommender.StatusActive {
+		t.Error("Unexpected status of the shard on the statistics:", snapshot)
+	}
+
+	// The snapshot is not modified by the new requests
+	countRequests(stats, 5, false)
+	stats.addSecond(false)
+	if snapshot.BySecStats[59] != 2 {
+		t.Error("The snapshot was modified after take it:", snapshot.BySecStats)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	group := &shardinfo.GroupInfo{
+		GroupID:      "group",
+		NumShards:    1,
+		ShardsByAddr: map[string]*shardinfo.Shard{},
+	}
+	mg := &Manager{
+		active:         true,
+		acquiredShards: make(map[string]recommender.Int),
+		reqSecStats:    make(map[string]*statsReqSec),
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// Acquisition and release of the shard while the requests are attended
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			rec := newFakeShard()
+			mg.addAcquiredShard(group.GroupID, rec)
+			runtime.Gosched()
+			if released := mg.releaseAcquiredShard(group.GroupID); released != rec {
+				t.Error("Unexpected released shard:", released)
+			}
+			rec.Stop()
+		}
+		mg.Stop()
+	}()
+
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for recID := uint64(w); ; recID += 4 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				scores := map[uint64]uint8{recID: 3}
+				if _, err := mg.insert(group, recID, scores); err != nil && err != ErrShardNotAvailable {
+					t.Error("Unexpected error inserting record:", recID, "Error:", err)
+				}
+				if _, err := mg.recommend(group, recID, scores, 10); err != nil && err != ErrShardNotAvailable {
+					t.Error("Unexpected error requesting recommendations:", recID, "Error:", err)
+				}
+				if _, err := mg.itemScores(group, []uint64{recID}); err != nil && err != ErrShardNotAvailable {
+					t.Error("Unexpected error requesting scores:", recID, "Error:", err)
+				}
+				for _, stats := range mg.getGroupStats(context.Background(), group, false) {
+					if _, err := json.Marshal(stats); err != nil {
+						t.Error("The statistics can't be encoded, Error:", err)
+					}
+				}
+				for _, rec := range mg.getAcquiredShards() {
+					rec.GetTotalElements()
+				}
+				mg.isActive()
+				runtime.Gosched()
+			}
+		}(w)
+	}
+
+	// The statistics are rotated faster than by monitorStats
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 1; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if _, stats, err := mg.getLocalShard(group.GroupID); err == nil {
+				stats.addSecond(i%60 == 0)
+			}
+			runtime.Gosched()
+		}
+	}()
+
+	wg.Wait()
+
+	if len(mg.getAcquiredShards()) != 0 || mg.isActive() {
+		t.Error("Expected an inactive manager without shards")
+	}
+	if stats := mg.getGroupStats(context.Background(), group, false); stats[instances.GetHostName()] != nil {
+		t.Error("Unexpected statistics for a released shard:", stats)
+	}
+}
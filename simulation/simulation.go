@@ -0,0 +1,307 @@
+package simulation
+
+// Package that runs a cluster of instances on a single process in order to
+// test the behaviour of the cluster without deploy it. Each instance has its
+// own host name and all of them share the tables kept in memory, the internal
+// calls between the instances are sent over loopback HTTP through a simulated
+// network that allows to inject faults: kill instances, partition the cluster
+// and delay the calls received by an instance
+
+import (
+	"errors"
+	"github.com/alonsovidales/pit/api"
+	"github.com/alonsovidales/pit/cluster"
+	"github.com/alonsovidales/pit/models/instances"
+	"github.com/alonsovidales/pit/models/shard_info"
+	"github.com/alonsovidales/pit/models/storage"
+	"github.com/alonsovidales/pit/models/users"
+	"github.com/alonsovidales/pit/shards_manager"
+	"github.com/goamz/goamz/dynamodb"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// CCallTimeout Deadline of the internal calls between the instances
+	CCallTimeout = time.Second
+
+	// cClusterPort Port used to address the instances, the simulated
+	// network routes the calls to the loopback server of each instance
+	cClusterPort = 4000
+	cAdminEmail  = "admin@test.com"
+	cAwsRegion   = "eu-west-1"
+	cBackupsPath = "/backups_simulation"
+)
+
+// ErrUnreachable The instance was killed or is on another side of a partition
+var ErrUnreachable = errors.New("The instance is not reachable")
+
+// ErrDuplicatedHost There is already an instance with the same host name
+var ErrDuplicatedHost = errors.New("There is already an instance with this host name")
+
+// Node Simulated instance of the cluster
+type Node struct {
+	// HostName Host name of the instance
+	HostName string
+	// Manager Manager of the shards of the instance
+	Manager *shardsmanager.Manager
+	// Instances Model of the active instances seen by the instance
+	Instances *instances.Model
+	// API Server that attends the public API of the instance
+	API *httptest.Server
+
+	clusterServer *httptest.Server
+}
+
+// Cluster Instances running on the same process that share the tables
+type Cluster struct {
+	// Users Model used to manage the user accounts of the cluster, each
+	// instance uses its own model over the same table
+	Users *users.Model
+
+	usersTable            *storage.MemTable
+	groupsTable           *storage.MemTable
+	shardsTable           *storage.MemTable
+	shardsChangesTable    *storage.MemTable
+	instancesTable        *storage.MemTable
+	instancesChangesTable *storage.MemTable
+	leaderTable           *storage.MemTable
+	nodes                 map[string]*Node
+	// killed Instances that were killed by host name
+	killed map[string]bool
+	// sides Side of the partition of each instance by host name, the
+	// instances on different sides can't reach each other
+	sides map[string]int
+	// delays Delay of the calls received by each instance by host name
+	delays map[string]time.Duration
+	mutex  sync.RWMutex
+}
+
+// New Returns a cluster without instances, use AddNode to start them
+func New() *Cluster {
+	usersTable := storage.NewMemTable()
+
+	return &Cluster{
+		Users:                 users.NewModel(usersTable),
+		usersTable:            usersTable,
+		groupsTable:           storage.NewMemTable(),
+		shardsTable:           storage.NewMemTable(),
+		shardsChangesTable:    storage.NewMemTable(),
+		instancesTable:        storage.NewMemTable(),
+		instancesChangesTable: storage.NewMemTable(),
+		leaderTable:           storage.NewMemTable(),
+		nodes:                 make(map[string]*Node),
+		killed:                make(map[string]bool),
+		sides:                 make(map[string]int),
+		delays:                make(map[string]time.Duration),
+	}
+}
+
+// AddNode Starts an instance with the given host name, the instance is
+// registered on the instances table and starts to bid for the free shards
+func (cl *Cluster) AddNode(hostName string) (node *Node, err error) {
+	if cluster.Secret() == "" {
+		return nil, cluster.ErrNoSecret
+	}
+
+	cl.mutex.Lock()
+	if _, ok := cl.nodes[hostName]; ok {
+		cl.mutex.Unlock()
+		return nil, ErrDuplicatedHost
+	}
+	node = &Node{HostName: hostName}
+	cl.nodes[hostName] = node
+	cl.mutex.Unlock()
+
+	rpc := cluster.NewClientWithTransport(cClusterPort, cluster.Secret(), CCallTimeout, &link{
+		cl:        cl,
+		from:      hostName,
+		transport: http.DefaultTransport.(*http.Transport).Clone(),
+	})
+	node.Instances = instances.NewModelForHost(cl.table(hostName, cl.instancesTable), cl.table(hostName, cl.instancesChangesTable), cl.table(hostName, cl.leaderTable), hostName, true)
+	node.Manager = shardsmanager.NewWithClient(
+		shardinfo.NewModelForHost(cl.table(hostName, cl.groupsTable), cl.table(hostName, cl.shardsTable), cl.table(hostName, cl.shardsChangesTable), cAdminEmail, hostName),
+		node.Instances,
+		users.NewModel(cl.table(hostName, cl.usersTable)),
+		cAwsRegion,
+		cBackupsPath,
+		rpc)
+
+	cl.mutex.Lock()
+	node.API = httptest.NewServer(api.New(node.Manager, nil, "", false))
+	node.clusterServer = httptest.NewServer(node.Manager.ClusterServer())
+	cl.mutex.Unlock()
+
+	return
+}
+
+// Node Returns the instance with the given host name, nil if it doesn't exist
+func (cl *Cluster) Node(hostName string) *Node {
+	cl.mutex.RLock()
+	defer cl.mutex.RUnlock()
+
+	return cl.nodes[hostName]
+}
+
+// Hosts Returns the host names of the instances that were not killed sorted by
+// name
+func (cl *Cluster) Hosts() (hosts []string) {
+	cl.mutex.RLock()
+	defer cl.mutex.RUnlock()
+
+	for hostName := range cl.nodes {
+		if !cl.killed[hostName] {
+			hosts = append(hosts, hostName)
+		}
+	}
+	sort.Strings(hosts)
+
+	return
+}
+
+// Kill Stops the instance as if its process was killed: the instance stops
+// attending requests, can't be reached by the other instances, and all its
+// writes on the tables are lost, so its shards and its registration on the
+// instances table expire
+func (cl *Cluster) Kill(hostName string) {
+	cl.mutex.Lock()
+	node, ok := cl.nodes[hostName]
+	if !ok || cl.killed[hostName] {
+		cl.mutex.Unlock()
+		return
+	}
+	cl.killed[hostName] = true
+	cl.mutex.Unlock()
+
+	node.Manager.Stop()
+	node.API.Close()
+	node.clusterServer.Close()
+}
+
+// Partition Splits the cluster on the given sides, the instances on different
+// sides can't call each other. The instances not included on any side are
+// placed on the first one
+func (cl *Cluster) Partition(sides ...[]string) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	cl.sides = make(map[string]int)
+	for side, hosts := range sides {
+		for _, hostName := range hosts {
+			cl.sides[hostName] = side
+		}
+	}
+}
+
+// Heal Removes the partition of the cluster
+func (cl *Cluster) Heal() {
+	cl.Partition()
+}
+
+// Delay Delays the calls received by the instance, a zero delay removes it
+func (cl *Cluster) Delay(hostName string, delay time.Duration) {
+	cl.mutex.Lock()
+	cl.delays[hostName] = delay
+	cl.mutex.Unlock()
+}
+
+// Close Stops all the instances of the cluster
+func (cl *Cluster) Close() {
+	for _, hostName := range cl.Hosts() {
+		cl.Kill(hostName)
+	}
+}
+
+// route Returns the address of the loopback server of the instance that
+// receives a call and the delay of the call, ErrUnreachable is returned if the
+// instance can't be reached from the caller
+func (cl *Cluster) route(from, to string) (addr string, delay time.Duration, err error) {
+	cl.mutex.RLock()
+	defer cl.mutex.RUnlock()
+
+	node, ok := cl.nodes[to]
+	if !ok || node.clusterServer == nil || cl.killed[from] || cl.killed[to] || cl.sides[from] != cl.sides[to] {
+		return "", 0, ErrUnreachable
+	}
+
+	return node.clusterServer.Listener.Addr().String(), cl.delays[to], nil
+}
+
+// isKilled Returns if the instance was killed
+func (cl *Cluster) isKilled(hostName string) bool {
+	cl.mutex.RLock()
+	defer cl.mutex.RUnlock()
+
+	return cl.killed[hostName]
+}
+
+// table Returns the table used by the instance to access the shared table
+func (cl *Cluster) table(hostName string, table *storage.MemTable) storage.Table {
+	return &nodeTable{MemTable: table, cl: cl, hostName: hostName}
+}
+
+// link Transport used by an instance to call the others through the
+// simulated network
+type link struct {
+	cl        *Cluster
+	from      string
+	transport http.RoundTripper
+}
+
+// RoundTrip Sends the call to the loopback server of the instance addressed by
+// the host name of the request after the delay of the instance
+func (ln *link) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr, delay, err := ln.cl.route(ln.from, req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	out := req.Clone(req.Context())
+	out.URL.Host = addr
+	out.Host = addr
+
+	return ln.transport.RoundTrip(out)
+}
+
+// nodeTable Access of an instance to a shared table, the writes of the killed
+// instances are lost
+type nodeTable struct {
+	*storage.MemTable
+
+	cl       *Cluster
+	hostName string
+}
+
+func (nt *nodeTable) PutItem(hashKey, rangeKey string, attributes []dynamodb.Attribute) (bool, error) {
+	if nt.cl.isKilled(nt.hostName) {
+		return true, nil
+	}
+
+	return nt.MemTable.PutItem(hashKey, rangeKey, attributes)
+}
+
+func (nt *nodeTable) ConditionalPutItem(hashKey, rangeKey string, attributes, expected []dynamodb.Attribute) (bool, error) {
+	if nt.cl.isKilled(nt.hostName) {
+		return true, nil
+	}
+
+	return nt.MemTable.ConditionalPutItem(hashKey, rangeKey, attributes, expected)
+}
+
+func (nt *nodeTable) DeleteItem(key *dynamodb.Key) (bool, error) {
+	if nt.cl.isKilled(nt.hostName) {
+		return true, nil
+	}
+
+	return nt.MemTable.DeleteItem(key)
+}
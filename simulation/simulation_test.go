@@ -0,0 +1,289 @@
+package simulation
+
+import (
+	"context"
+	"github.com/alonsovidales/pit/cfg"
+	"github.com/alonsovidales/pit/client"
+	"github.com/alonsovidales/pit/recommender"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+const (
+	cTestUID = "user@test.com"
+	cTestKey = "user_key"
+	// cWaitPeriod Period between the checks of the state of the cluster
+	cWaitPeriod = 100 * time.Millisecond
+	// cAcquireTimeout Max time to wait for the acquisition of the shards
+	cAcquireTimeout = 20 * time.Second
+	// cExpireTimeout Max time to wait until the instances table and the
+	// shards of a killed instance expire and the shards are acquired again
+	cExpireTimeout = 60 * time.Second
+)
+
+func TestMain(m *testing.M) {
+	if err := cfg.Init("pit", "test"); err != nil {
+		panic(err)
+	}
+	os.Setenv("PIT_CLUSTER_SECRET", "simulation")
+
+	os.Exit(m.Run())
+}
+
+// startCluster Starts a cluster with the given instances and a registered user
+func startCluster(t *testing.T, hosts ...string) *Cluster {
+	cl := New()
+	if _, err := cl.Users.RegisterUser(cTestUID, cTestKey, "127.0.0.1"); err != nil {
+		t.Fatal("Problem registering the test user, Error:", err)
+	}
+	for _, hostName := range hosts {
+		if _, err := cl.AddNode(hostName); err != nil {
+			t.Fatal("Problem starting the instance:", hostName, "Error:", err)
+		}
+	}
+
+	return cl
+}
+
+// newClient Returns a client of the API of the instance that doesn't retry the
+// failed requests
+func newClient(cl *Cluster, hostName string) *client.Client {
+	return client.New(cl.Node(hostName).API.URL, client.WithRetries(0, 0))
+}
+
+// createGroup Creates a group with the given number of shards using the API of
+// the instance and waits until all the shards are acquired, returns the owners
+// of the shards sorted by host name
+func createGroup(t *testing.T, cl *Cluster, hostName string, shards int) (group *client.Group, owners []string) {
+	ctx := context.Background()
+	group, err := newClient(cl, hostName).Account(cTestUID, cTestKey).CreateGroup(ctx, "simulation", "s", shards, 5)
+	if err != nil {
+		t.Fatal("Problem creating the group, Error:", err)
+	}
+
+	// All the instances have to know the group and its owners
+	ok := waitFor(cAcquireTimeout, func() bool {
+		for _, host := range cl.Hosts() {
+			if owners = groupOwners(cl, host, group); len(owners) != shards {
+				return false
+			}
+		}
+		return true
+	})
+	if !ok {
+		t.Fatal("The shards of the group were not acquired, owners:", owners)
+	}
+
+	// The trees of the shards are calculated by the rebuild workers after
+	// the acquisition, the shards don't attend requests until then
+	gr := newClient(cl, hostName).Group(cTestUID, group.ID(), group.Key())
+	ok = waitFor(cAcquireTimeout, func() bool {
+		info, err := gr.Info(ctx)
+		if err != nil {
+			return false
+		}
+		for _, stats := range info {
+			if stats.RecTreeStatus != recommender.StatusActive && stats.RecTreeStatus != recommender.StatusNoRecords {
+				return false
+			}
+		}
+		return true
+	})
+	if !ok {
+		t.Fatal("The shards of the group are not ready, owners:", owners)
+	}
+
+	return
+}
+
+// groupOwners Returns the host names of the instances that own a shard of the
+// group sorted by name, as seen by the given instance
+func groupOwners(cl *Cluster, hostName string, group *client.Group) (owners []string) {
+	cli := newClient(cl, hostName)
+	info, err := cli.Group(cTestUID, group.ID(), group.Key()).Info(context.Background())
+	if err != nil {
+		return nil
+	}
+	for owner := range info {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	return
+}
+
+// otherHost Returns an instance of the cluster that is not the given one
+func otherHost(cl *Cluster, hostName string) string {
+	for _, host := range cl.Hosts() {
+		if host != hostName {
+			return host
+		}
+	}
+
+	return ""
+}
+
+// waitFor Checks the condition until it is true or the timeout expires
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(cWaitPeriod) {
+		if cond() {
+			return true
+		}
+	}
+
+	return cond()
+}
+
+func TestAcquisition(t *testing.T) {
+	t.Parallel()
+	cl := startCluster(t, "acq-a", "acq-b", "acq-c")
+	defer cl.Close()
+
+	// Each instance acquires a different shard of the group
+	_, owners := createGroup(t, cl, "acq-a", 3)
+	if len(owners) != 3 || owners[0] != "acq-a" || owners[1] != "acq-b" || owners[2] != "acq-c" {
+		t.Error("Expected a shard of the group on each instance, owners:", owners)
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	t.Parallel()
+	cl := startCluster(t, "fwd-a", "fwd-b")
+	defer cl.Close()
+
+	group, owners := createGroup(t, cl, "fwd-a", 1)
+	other := otherHost(cl, owners[0])
+
+	// The instance without shards forwards the requests to the owner
+	gr := newClient(cl, other).Group(cTestUID, group.ID(), group.Key())
+	inserted, err := gr.Insert(context.Background(), 1, map[uint64]uint8{1: 5, 2: 3})
+	if err != nil || !inserted.Success {
+		t.Fatal("The insert was not forwarded to the owner of the shard:", owners[0], "Response:", inserted, "Error:", err)
+	}
+
+	info, err := gr.Info(context.Background())
+	if stats, ok := info[owners[0]]; err != nil || !ok || stats.StoredElements != 2 {
+		t.Error("Unexpected group info:", info, "Error:", err)
+	}
+	if _, ok := info[other]; ok {
+		t.Error("The instance:", other, "doesn't own a shard of the group, info:", info)
+	}
+}
+
+func TestKillNode(t *testing.T) {
+	t.Parallel()
+	cl := startCluster(t, "kill-a", "kill-b")
+	defer cl.Close()
+
+	group, owners := createGroup(t, cl, "kill-a", 1)
+	killed := owners[0]
+	survivor := otherHost(cl, killed)
+	cl.Kill(killed)
+
+	// The killed instance is removed from the instances table after its
+	// registration expires, and its shard is acquired by the survivor
+	// after the ownership expires
+	ok := waitFor(cExpireTimeout, func() bool {
+		instances := cl.Node(survivor).Instances.GetInstances()
+		owners = groupOwners(cl, survivor, group)
+
+		return len(instances) == 1 && len(owners) == 1 && owners[0] == survivor
+	})
+	if !ok {
+		t.Error("The shard of the killed instance was not acquired by:", survivor, "owners:", owners, "instances:", cl.Node(survivor).Instances.GetInstances())
+	}
+}
+
+// leaders Returns the instances that were not killed that consider themselves
+// the leader of the cluster
+func leaders(cl *Cluster) (hosts []string) {
+	for _, host := range cl.Hosts() {
+		if cl.Node(host).Instances.IsLeader() {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return
+}
+
+func TestLeader(t *testing.T) {
+	t.Parallel()
+	cl := startCluster(t, "lead-a", "lead-b", "lead-c")
+	defer cl.Close()
+
+	var current []string
+	if !waitFor(cAcquireTimeout, func() bool { current = leaders(cl); return len(current) == 1 }) {
+		t.Fatal("Expected a single leader, leaders:", current)
+	}
+
+	// All the rows of the instances table are registrations, the previous
+	// versions consider any row an instance
+	rows, err := cl.instancesTable.Scan(nil)
+	if err != nil || len(rows) != 3 {
+		t.Error("Expected the registration of 3 instances, rows:", rows, "Error:", err)
+	}
+	for _, row := range rows {
+		if _, ok := row["ts"]; !ok {
+			t.Error("Row without registration time stamp on the instances table:", row)
+		}
+	}
+
+	// Another instance takes over after the lease of the killed leader
+	// expires
+	killed := current[0]
+	cl.Kill(killed)
+	if !waitFor(cExpireTimeout, func() bool { current = leaders(cl); return len(current) == 1 }) {
+		t.Fatal("Expected a new leader after kill the leader:", killed, "leaders:", current)
+	}
+	if current[0] == killed {
+		t.Error("The killed instance is still the leader")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	t.Parallel()
+	cl := startCluster(t, "part-a", "part-b")
+	defer cl.Close()
+
+	group, owners := createGroup(t, cl, "part-a", 1)
+	other := otherHost(cl, owners[0])
+	gr := newClient(cl, other).Group(cTestUID, group.ID(), group.Key())
+
+	cl.Partition([]string{owners[0]}, []string{other})
+	if inserted, err := gr.Insert(context.Background(), 1, map[uint64]uint8{1: 5}); err == nil && inserted.Success {
+		t.Error("The insert was forwarded across the partition, Response:", inserted)
+	}
+
+	cl.Heal()
+	if inserted, err := gr.Insert(context.Background(), 1, map[uint64]uint8{1: 5}); err != nil || !inserted.Success {
+		t.Error("The insert was not forwarded after heal the partition, Response:", inserted, "Error:", err)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	t.Parallel()
+	cl := startCluster(t, "delay-a", "delay-b")
+	defer cl.Close()
+
+	group, owners := createGroup(t, cl, "delay-a", 1)
+	other := otherHost(cl, owners[0])
+	gr := newClient(cl, other).Group(cTestUID, group.ID(), group.Key())
+
+	// The calls slower than the deadline are cancelled
+	cl.Delay(owners[0], 2*CCallTimeout)
+	if inserted, err := gr.Insert(context.Background(), 1, map[uint64]uint8{1: 5}); err == nil && inserted.Success {
+		t.Error("The insert was forwarded after the deadline, Response:", inserted)
+	}
+
+	delay := CCallTimeout / 4
+	cl.Delay(owners[0], delay)
+	started := time.Now()
+	if inserted, err := gr.Insert(context.Background(), 1, map[uint64]uint8{1: 5}); err != nil || !inserted.Success {
+		t.Error("The delayed insert was not forwarded, Response:", inserted, "Error:", err)
+	}
+	if elapsed := time.Since(started); elapsed < delay {
+		t.Error("The insert was not delayed, elapsed:", elapsed)
+	}
+}